@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/datatogether/core"
+	"github.com/multiformats/go-multihash"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// blobs is the store response bodies are written to, nil if content
+// storage is disabled
+var blobs BlobStore
+
+// BlobStore is content-addressed storage for response bodies. Blobs are
+// keyed by the hex-encoded sha2-256 multihash of their contents, as
+// calculated by core.CalcHash, the same hash recorded on urls & snapshots
+type BlobStore interface {
+	// Put stores data, returning it's hash. Putting data that's already
+	// stored is a no-op
+	Put(data []byte) (hash string, err error)
+	// PutReader stores the contents of r without reading it all into
+	// memory. hash must already be known, & is checked against the
+	// contents as they're stored
+	PutReader(hash string, r io.ReadSeeker) error
+	// Get reads the blob for a hash, returning core.ErrNotFound if
+	// it isn't stored
+	Get(hash string) ([]byte, error)
+	// Has reports weather a blob is stored
+	Has(hash string) (bool, error)
+	// Delete removes a blob
+	Delete(hash string) error
+}
+
+// NewBlobStore creates the blob store configured by cfg.BlobStore,
+// returning nil if none is set
+func NewBlobStore(cfg *config) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case "":
+		return nil, nil
+	case "local":
+		if cfg.BlobStoreDir == "" {
+			return nil, fmt.Errorf("BLOB_STORE_DIR must be set to use a local blob store")
+		}
+		s, err := NewLocalBlobStore(cfg.BlobStoreDir)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "ipfs":
+		if cfg.BlobStoreDir == "" {
+			return nil, fmt.Errorf("BLOB_STORE_DIR must be set to use an ipfs blob store")
+		}
+		ds, err := NewFlatfsDatastore(cfg.BlobStoreDir)
+		if err != nil {
+			return nil, err
+		}
+		return NewIpfsBlobStore(ds), nil
+	case "s3":
+		return &S3BlobStore{
+			Region:          cfg.AwsRegion,
+			BucketName:      cfg.AwsS3BucketName,
+			BucketPath:      cfg.AwsS3BucketPath,
+			AccessKeyId:     cfg.AwsAccessKeyId,
+			SecretAccessKey: cfg.AwsSecretAccessKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store: '%s'", cfg.BlobStore)
+	}
+}
+
+// blobFilename drops the multihash prefix from a hash so stored
+// blobs are named with plain sha256 hashes, matching core.File
+func blobFilename(hash string) (string, error) {
+	if len(hash) <= 4 {
+		return "", fmt.Errorf("invalid blob hash: '%s'", hash)
+	}
+	return hash[4:], nil
+}
+
+// LocalBlobStore keeps blobs on disk in Dir. blobs are sharded into nested
+// directories by the first two pairs of hash characters, so no single
+// directory grows too large, eg: ab/cd/abcdef...
+type LocalBlobStore struct {
+	Dir string
+}
+
+// NewLocalBlobStore creates a local store, creating dir if it doesn't exist
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+// path gives the location on disk for a hash
+func (s *LocalBlobStore) path(hash string) (string, error) {
+	name, err := blobFilename(hash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, name[0:2], name[2:4], name), nil
+}
+
+// Put writes data to disk
+func (s *LocalBlobStore) Put(data []byte) (string, error) {
+	hash, err := core.CalcHash(data)
+	if err != nil {
+		return "", err
+	}
+	return hash, s.PutReader(hash, bytes.NewReader(data))
+}
+
+// PutReader copies r to disk. blobs are written to a temp file & moved into
+// place once their hash checks out, so a partially written blob is never visible
+func (s *LocalBlobStore) PutReader(hash string, r io.ReadSeeker) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	hr := newHashCheckReader(r)
+	if _, err := io.Copy(tmp, hr); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := hr.Check(hash); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads a blob from disk
+func (s *LocalBlobStore) Get(hash string) ([]byte, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, core.ErrNotFound
+	}
+	return data, err
+}
+
+// Has checks for a blob on disk
+func (s *LocalBlobStore) Has(hash string) (bool, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes a blob from disk. deleting a blob that isn't stored
+// isn't an error
+func (s *LocalBlobStore) Delete(hash string) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore keeps blobs in an S3 bucket, using the same key layout as
+// core.File so content stored by either is interchangeable
+type S3BlobStore struct {
+	// region the bucket is in, eg "us-east-1"
+	Region string
+	// name of the bucket, no protocol prefixes or paths
+	BucketName string
+	// path within the bucket to store blobs under
+	BucketPath string
+	// aws credentials
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+// client creates an s3 client from the store's settings
+func (s *S3BlobStore) client() *s3.S3 {
+	return s3.New(session.New(&aws.Config{
+		Region:      aws.String(s.Region),
+		Credentials: credentials.NewStaticCredentials(s.AccessKeyId, s.SecretAccessKey, ""),
+	}))
+}
+
+// key gives the object key for a hash
+func (s *S3BlobStore) key(hash string) (string, error) {
+	name, err := blobFilename(hash)
+	if err != nil {
+		return "", err
+	}
+	return s.BucketPath + "/" + name, nil
+}
+
+// Put uploads data to the bucket if it isn't already there
+func (s *S3BlobStore) Put(data []byte) (string, error) {
+	hash, err := core.CalcHash(data)
+	if err != nil {
+		return "", err
+	}
+	return hash, s.PutReader(hash, bytes.NewReader(data))
+}
+
+// PutReader uploads the contents of r if they aren't already in the bucket.
+// r is read once to check it's hash, then rewound for the upload
+func (s *S3BlobStore) PutReader(hash string, r io.ReadSeeker) error {
+	if has, err := s.Has(hash); err != nil {
+		return err
+	} else if has {
+		return nil
+	}
+
+	hr := newHashCheckReader(r)
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		return err
+	}
+	if err := hr.Check(hash); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	key, err := s.key(hash)
+	if err != nil {
+		return err
+	}
+	_, err = s.client().PutObject(&s3.PutObjectInput{
+		ACL:    aws.String(s3.BucketCannedACLPublicRead),
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	return err
+}
+
+// Get downloads a blob from the bucket
+func (s *S3BlobStore) Get(hash string) ([]byte, error) {
+	key, err := s.key(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if s3NotFound(err) {
+		return nil, core.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// Has checks the bucket for a blob
+func (s *S3BlobStore) Has(hash string) (bool, error) {
+	key, err := s.key(hash)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.client().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if s3NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes a blob from the bucket
+func (s *S3BlobStore) Delete(hash string) error {
+	key, err := s.key(hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// s3NotFound reports weather err is a missing key or object error
+func s3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	return false
+}
+
+// hashCheckReader hashes everything read through it, so a streamed blob
+// can be checked against the hash it's being stored under
+type hashCheckReader struct {
+	r   io.Reader
+	sha hash.Hash
+}
+
+func newHashCheckReader(r io.Reader) *hashCheckReader {
+	return &hashCheckReader{r: r, sha: sha256.New()}
+}
+
+func (h *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.sha.Write(p[:n])
+	return n, err
+}
+
+// Check compares the hash of everything read so far with hash
+func (h *hashCheckReader) Check(hash string) error {
+	mh, err := multihash.Encode(h.sha.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(mh); got != hash {
+		return fmt.Errorf("blob hash mismatch. expected: %s, got: %s", hash, got)
+	}
+	return nil
+}
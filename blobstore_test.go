@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"github.com/datatogether/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []string{
+		"hello",
+		"<html><body>a page</body></html>",
+		"",
+	}
+
+	for i, c := range cases {
+		hash, err := s.Put([]byte(c))
+		if err != nil {
+			t.Errorf("case %d put error: %s", i, err.Error())
+			continue
+		}
+		if expect, _ := core.CalcHash([]byte(c)); hash != expect {
+			t.Errorf("case %d hash mismatch. expected: %s, got: %s", i, expect, hash)
+		}
+
+		// sharded by the first two pairs of the sha256 hash
+		name := hash[4:]
+		if _, err := os.Stat(filepath.Join(dir, name[0:2], name[2:4], name)); err != nil {
+			t.Errorf("case %d: expected blob on disk: %s", i, err.Error())
+		}
+
+		// putting the same data again is fine
+		if again, err := s.Put([]byte(c)); err != nil || again != hash {
+			t.Errorf("case %d: re-put mismatch: %s, %v", i, again, err)
+		}
+
+		if has, err := s.Has(hash); err != nil || !has {
+			t.Errorf("case %d: expected store to have blob. err: %v", i, err)
+		}
+
+		data, err := s.Get(hash)
+		if err != nil {
+			t.Errorf("case %d get error: %s", i, err.Error())
+			continue
+		}
+		if string(data) != c {
+			t.Errorf("case %d data mismatch. expected: %q, got: %q", i, c, string(data))
+		}
+
+		if err := s.Delete(hash); err != nil {
+			t.Errorf("case %d delete error: %s", i, err.Error())
+		}
+		if _, err := s.Get(hash); err != core.ErrNotFound {
+			t.Errorf("case %d: expected ErrNotFound after delete, got: %v", i, err)
+		}
+		if has, _ := s.Has(hash); has {
+			t.Errorf("case %d: expected store not to have deleted blob", i)
+		}
+	}
+
+	if _, err := s.Get("12"); err == nil {
+		t.Errorf("expected invalid hash to error")
+	}
+}
+
+func TestNewBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		store, dir string
+		err        bool
+		nilStore   bool
+	}{
+		{"", "", false, true},
+		{"local", dir, false, false},
+		{"local", "", true, true},
+		{"s3", "", false, false},
+		{"floppy", "", true, true},
+	}
+
+	for i, c := range cases {
+		s, err := NewBlobStore(&config{BlobStore: c.store, BlobStoreDir: c.dir})
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+		}
+		if (s == nil) != c.nilStore {
+			t.Errorf("case %d store mismatch. expected nil: %t, got: %#v", i, c.nilStore, s)
+		}
+	}
+}
+
+func TestBlobStorePutReaderMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := NewLocalBlobStore(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ds, err := NewFlatfsDatastore(filepath.Join(dir, "ipfs"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hash, _ := core.CalcHash([]byte("expected"))
+	cases := []BlobStore{local, NewIpfsBlobStore(ds)}
+	for i, s := range cases {
+		if err := s.PutReader(hash, bytes.NewReader([]byte("something else"))); err == nil {
+			t.Errorf("case %d: expected hash mismatch error", i)
+		}
+		if has, _ := s.Has(hash); has {
+			t.Errorf("case %d: mismatched blob shouldn't be stored", i)
+		}
+		if err := s.PutReader(hash, bytes.NewReader([]byte("expected"))); err != nil {
+			t.Errorf("case %d put error: %s", i, err.Error())
+		}
+		if has, _ := s.Has(hash); !has {
+			t.Errorf("case %d: expected store to have blob", i)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"net/http"
+	"time"
+)
+
+// lastGetSnapshot reads the most recent complete snapshot of rawurl that
+// recorded a hash, returning core.ErrNotFound if there isn't one
+func lastGetSnapshot(db sqlutil.Queryable, rawurl string) (*Snapshot, error) {
+	if _, ok := store.(*EmbeddedStore); ok {
+		snaps, err := snapshotsForUrl(store, rawurl)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snaps {
+			if s.Hash != "" && !s.Truncated {
+				return s, nil
+			}
+		}
+		return nil, core.ErrNotFound
+	}
+
+	s := &Snapshot{}
+	if err := s.UnmarshalSQL(db.QueryRow(qSnapshotLastGet, rawurl)); err == sql.ErrNoRows {
+		return nil, core.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// conditionalHeader builds If-None-Match & If-Modified-Since headers from the
+// validators a snapshot was served with
+func conditionalHeader(s *core.Snapshot) http.Header {
+	h := http.Header{}
+	for i := 0; i+1 < len(s.Headers); i += 2 {
+		switch http.CanonicalHeaderKey(s.Headers[i]) {
+		case "Etag":
+			h.Set("If-None-Match", s.Headers[i+1])
+		case "Last-Modified":
+			h.Set("If-Modified-Since", s.Headers[i+1])
+		}
+	}
+	return h
+}
+
+// handleNotModified records a 304 response to a conditional GET. Nothing is
+// downloaded, the new snapshot inherits the hash & CID of the snapshot it was
+// conditional on, along with it's headers updated by any sent with the 304
+func handleNotModified(db *sql.DB, u *core.Url, res *http.Response) error {
+	res.Body.Close()
+
+	prev, err := lastGetSnapshot(db, u.Url)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	u.LastGet = &now
+	u.Hash = prev.Hash
+	u.Headers = mergeHeaders(prev.Headers, rawHeadersSlice(res))
+	if err := u.Save(store); err != nil {
+		return err
+	}
+
+	// the url keeps it's last full status, only the snapshot records the 304
+	snap := newSnapshot(u)
+	snap.Status = res.StatusCode
+	snap.Cid = prev.Cid
+	if err := writeSnapshot(store, snap); err != nil {
+		return err
+	}
+
+	writeWarc(res, nil, now)
+	return nil
+}
+
+// mergeHeaders combines two [key,value,key,value...] header slices,
+// values in update replacing those in base
+func mergeHeaders(base, update []string) []string {
+	merged := http.Header{}
+	for _, h := range [][]string{base, update} {
+		for i := 0; i+1 < len(h); i += 2 {
+			merged.Set(h[i], h[i+1])
+		}
+	}
+
+	headers := make([]string, 0, len(merged)*2)
+	for key, val := range merged {
+		headers = append(headers, key, val[0])
+	}
+	return headers
+}
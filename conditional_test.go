@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalHeader(t *testing.T) {
+	cases := []struct {
+		headers       []string
+		noneMatch     string
+		modifiedSince string
+	}{
+		{nil, "", ""},
+		{[]string{"Content-Type", "text/html"}, "", ""},
+		{[]string{"Etag", `"abc"`}, `"abc"`, ""},
+		{[]string{"ETag", `"abc"`, "Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"}, `"abc"`, "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{[]string{"last-modified", "Mon, 02 Jan 2006 15:04:05 GMT"}, "", "Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+
+	for i, c := range cases {
+		h := conditionalHeader(&core.Snapshot{Headers: c.headers})
+		if got := h.Get("If-None-Match"); got != c.noneMatch {
+			t.Errorf("case %d If-None-Match mismatch. expected: %s, got: %s", i, c.noneMatch, got)
+		}
+		if got := h.Get("If-Modified-Since"); got != c.modifiedSince {
+			t.Errorf("case %d If-Modified-Since mismatch. expected: %s, got: %s", i, c.modifiedSince, got)
+		}
+	}
+}
+
+func TestMergeHeaders(t *testing.T) {
+	cases := []struct {
+		base, update, expect []string
+	}{
+		{nil, nil, []string{}},
+		{[]string{"Etag", "a"}, nil, []string{"Etag:a"}},
+		{[]string{"Etag", "a", "Content-Type", "text/csv"}, []string{"ETag", "b"}, []string{"Content-Type:text/csv", "Etag:b"}},
+	}
+
+	for i, c := range cases {
+		merged := mergeHeaders(c.base, c.update)
+		got := []string{}
+		for j := 0; j+1 < len(merged); j += 2 {
+			got = append(got, merged[j]+":"+merged[j+1])
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestHandleNotModified(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("a,b,c"))
+	}))
+	defer s.Close()
+
+	prev := time.Now().Add(-time.Hour)
+	u := &core.Url{Url: s.URL + "/data.csv", Status: 200, LastGet: &prev, Hash: "1220abc", Headers: []string{"Etag", `"v1"`}}
+	if err := u.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := newSnapshot(u)
+	first.Cid = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	if err := writeSnapshot(store, first); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cmd, err := newCrawlCmd(appDB, &FrontierEntry{Url: u.Url, Method: "GET"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, err := http.NewRequest("GET", u.Url, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header = cmd.(*crawlCmd).Header()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected conditional GET to be not modified, got: %d", res.StatusCode)
+	}
+
+	if err := handleNotModified(appDB, u, res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if u.Hash != "1220abc" || u.Status != 200 {
+		t.Errorf("expected url to keep hash & status, got: %s, %d", u.Hash, u.Status)
+	}
+
+	snapshots, err := snapshotsForUrl(store, u.Url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got: %d", len(snapshots))
+	}
+	for _, snap := range snapshots {
+		if snap.Created.Equal(prev.In(time.UTC).Round(time.Second)) {
+			continue
+		}
+		if snap.Status != http.StatusNotModified {
+			t.Errorf("expected new snapshot status 304, got: %d", snap.Status)
+		}
+		if snap.Hash != "1220abc" {
+			t.Errorf("expected new snapshot to inherit hash, got: %s", snap.Hash)
+		}
+		if snap.Cid != first.Cid {
+			t.Errorf("expected new snapshot to inherit cid, got: %s", snap.Cid)
+		}
+	}
+}
+
+func TestHandleNotModifiedEmbedded(t *testing.T) {
+	_, done := useEmbeddedStore(t)
+	defer done()
+
+	prev := time.Now().Add(-time.Hour)
+	u := &core.Url{Url: "http://cid.test/data.csv", Status: 200, LastGet: &prev, Hash: "1220abc", Headers: []string{"Etag", `"v1"`}}
+	if err := u.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := newSnapshot(u)
+	first.Cid = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	if err := writeSnapshot(store, first); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", u.Url, nil)
+	res := &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+	if err := handleNotModified(appDB, u, res); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshots, err := snapshotsForUrl(store, u.Url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got: %d", len(snapshots))
+	}
+	if latest := snapshots[0]; latest.Status != http.StatusNotModified || latest.Hash != first.Hash || latest.Cid != first.Cid {
+		t.Errorf("expected 304 snapshot to inherit hash & cid, got: %#v", latest)
+	}
+}
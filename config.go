@@ -34,7 +34,7 @@ type config struct {
 	// root url for service
 	UrlRoot string
 
-	// url of postgres app db
+	// url of postgres app db, required unless Store is "embedded"
 	PostgresDbUrl string
 
 	// Public Key to use for signing metablocks. required.
@@ -44,18 +44,24 @@ type config struct {
 	// should be true in production
 	TLS bool
 
-	// How long before a url is considered stale, in hours.
+	// How long before a url is considered stale, in hours. Sources with their
+	// own stale duration override this value for urls they contain.
+	// defaults to 72 hours
 	StaleDurationHours int
 
 	// crawl urls?
 	Crawl bool
 	// Weather or not the crawler respects robots.txt
 	Polite bool
-	// how long to wait between requests. one day this'll be dynamically
-	// modifiable
+	// how long to wait between requests to the same host. hosts that ask
+	// for a longer robots.txt Crawl-delay or start to struggle get more
 	CrawlDelaySeconds int
-	// Content Types to Store
+	// Content Types to Store, eg: "application/pdf,image/*". GET response
+	// bodies of these types are written to the blob store
 	StoreContentTypes []string
+	// name this process holds crawl frontier leases under, defaults
+	// to the machine hostname. must be stable across restarts
+	InstanceName string
 
 	// read from env variable: AWS_REGION
 	// the region your bucket is in, eg "us-east-1"
@@ -70,12 +76,22 @@ type config struct {
 	// path to store & retrieve data from
 	AwsS3BucketPath string
 
-	// seed        = flag.String("seed", "", "seed URL")
-	// cancelAfter = flag.Duration("cancelafter", 0, "automatically cancel the fetchbot after a given time")
-	// cancelAtURL = flag.String("cancelat", "", "automatically cancel the fetchbot at a given URL")
-	// stopAfter   = flag.Duration("stopafter", 0, "automatically stop the fetchbot after a given time")
-	// stopAtURL   = flag.String("stopat", "", "automatically stop the fetchbot at a given URL")
-	// memStats    = flag.Duration("memstats", 0, "display memory statistics at a given interval")
+	// where to keep urls, links, snapshots, sources, primers, metadata &
+	// crawl state like the frontier & source settings, "postgres" (default)
+	// or "embedded". an embedded store needs no database server, but only
+	// one process can crawl from it
+	Store string
+	// directory for the "embedded" store
+	StoreDir string
+
+	// where to store response bodies, one of "local", "ipfs" or "s3".
+	// leaving this blank disables content storage
+	BlobStore string
+	// directory for the "local" & "ipfs" blob stores
+	BlobStoreDir string
+
+	// seed urls, stop & cancel points & memory stats for one-off crawls are
+	// flags of the crawl command, see crawl_command.go
 
 	// setting HTTP_AUTH_USERNAME & HTTP_AUTH_PASSWORD
 	// will enable basic http auth for the server. This is a single
@@ -91,12 +107,163 @@ type config struct {
 	ProxyForceHttps bool
 	// CertbotResponse is only for doing manual SSL certificate generation via LetsEncrypt.
 	CertbotResponse string
+
+	// directory to write WARC files of every capture to. leaving this
+	// blank disables WARC output
+	WarcDir string
+	// write HEAD requests to WARC files as well as GETs
+	WarcHeads bool
+	// size in megabytes at which a new WARC file is started, defaults to 1000
+	WarcMaxSizeMb int
+	// largest response body to download in megabytes, anything past this
+	// is cut off. sources can set their own limit. 0 is unlimited
+	MaxContentSizeMb int
+	// largest GET body the main & seed crawlers read into memory to parse
+	// for links in megabytes, defaults to 10. pages past this are cut off
+	MaxPageSizeMb int
+	// number of times to try resuming an interrupted download before
+	// giving up, defaults to 5
+	DownloadRetries int
+	// number of failed attempts before a url is marked dead & no longer
+	// crawled, defaults to 5
+	MaxFailedAttempts int
+	// max concurrent requests to a single host across all crawlers,
+	// defaults to 1
+	MaxHostConnections int
+
+	// product name crawlers identify themselves with in the User-Agent
+	// header, defaults to "datatogether-sentry"
+	UserAgent string
+	// url site operators can visit to find out about the crawler & who to
+	// contact, added to the User-Agent. defaults to UrlRoot
+	ContactUrl string
+	// seconds to wait for a connection to a host, defaults to 30
+	ConnectTimeoutSeconds int
+	// seconds to wait for any response data before giving up on a request,
+	// defaults to 60
+	ReadTimeoutSeconds int
+	// number of redirects to follow before giving up, defaults to 10
+	MaxRedirects int
+	// how often to poll source feeds, in minutes. defaults to 15
+	FeedIntervalMinutes int
+
+	// minutes a running crawler can hold urls without a successful fetch
+	// before /readyz reports it as wedged, defaults to 15
+	ReadyMaxFetchAgeMinutes int
+	// number of pending frontier urls past which /readyz fails, 0 is no max
+	ReadyMaxPending int
 }
 
 // StaleDuration turns cfg.StaleDurationHours into a time.Duration
 func (cfg *config) StaleDuration() time.Duration {
-	return 72 * time.Hour
-	// return cfg.StaleDurationHours * time.Hour
+	if cfg.StaleDurationHours <= 0 {
+		return 72 * time.Hour
+	}
+	return time.Duration(cfg.StaleDurationHours) * time.Hour
+}
+
+// WarcMaxSize gives the WARC rollover size in bytes
+func (cfg *config) WarcMaxSize() int64 {
+	if cfg.WarcMaxSizeMb <= 0 {
+		return 1000 * 1024 * 1024
+	}
+	return int64(cfg.WarcMaxSizeMb) * 1024 * 1024
+}
+
+// MaxPageSize gives the largest page body read into memory in bytes
+func (cfg *config) MaxPageSize() int64 {
+	if cfg.MaxPageSizeMb <= 0 {
+		return 10 * 1024 * 1024
+	}
+	return int64(cfg.MaxPageSizeMb) * 1024 * 1024
+}
+
+// MaxDownloadRetries gives the number of attempts to resume an
+// interrupted download
+func (cfg *config) MaxDownloadRetries() int {
+	if cfg.DownloadRetries <= 0 {
+		return 5
+	}
+	return cfg.DownloadRetries
+}
+
+// MaxAttempts gives the number of failed attempts before a url is dead
+func (cfg *config) MaxAttempts() int {
+	if cfg.MaxFailedAttempts <= 0 {
+		return 5
+	}
+	return cfg.MaxFailedAttempts
+}
+
+// HostConnections gives the max concurrent requests per host
+func (cfg *config) HostConnections() int {
+	if cfg.MaxHostConnections <= 0 {
+		return 1
+	}
+	return cfg.MaxHostConnections
+}
+
+// MaxFetchAge turns cfg.ReadyMaxFetchAgeMinutes into a time.Duration
+func (cfg *config) MaxFetchAge() time.Duration {
+	if cfg.ReadyMaxFetchAgeMinutes <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(cfg.ReadyMaxFetchAgeMinutes) * time.Minute
+}
+
+// UserAgentString gives the User-Agent header crawlers send, eg:
+// "datatogether-sentry (+https://example.com/about)"
+func (cfg *config) UserAgentString() string {
+	name := cfg.UserAgent
+	if name == "" {
+		name = "datatogether-sentry"
+	}
+	contact := cfg.ContactUrl
+	if contact == "" {
+		contact = cfg.UrlRoot
+	}
+	if contact == "" {
+		return name
+	}
+	return fmt.Sprintf("%s (+%s)", name, contact)
+}
+
+// ConnectTimeout turns cfg.ConnectTimeoutSeconds into a time.Duration
+func (cfg *config) ConnectTimeout() time.Duration {
+	if cfg.ConnectTimeoutSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(cfg.ConnectTimeoutSeconds) * time.Second
+}
+
+// ReadTimeout turns cfg.ReadTimeoutSeconds into a time.Duration
+func (cfg *config) ReadTimeout() time.Duration {
+	if cfg.ReadTimeoutSeconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(cfg.ReadTimeoutSeconds) * time.Second
+}
+
+// Redirects gives the max number of redirects to follow
+func (cfg *config) Redirects() int {
+	if cfg.MaxRedirects <= 0 {
+		return 10
+	}
+	return cfg.MaxRedirects
+}
+
+// Embedded reports weather everything is kept in an embedded store, in which
+// case there's no postgres database
+func (cfg *config) Embedded() bool {
+	return cfg.Store == "embedded"
+}
+
+// FeedInterval turns cfg.FeedIntervalMinutes into a time.Duration
+func (cfg *config) FeedInterval() time.Duration {
+	if cfg.FeedIntervalMinutes <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(cfg.FeedIntervalMinutes) * time.Minute
 }
 
 // initConfig pulls configuration from config.json
@@ -119,11 +286,14 @@ func initConfig(mode string) (cfg *config, err error) {
 		cfg.Port = "8080"
 	}
 
-	err = requireConfigStrings(map[string]string{
-		"PORT":            cfg.Port,
-		"POSTGRES_DB_URL": cfg.PostgresDbUrl,
-		"PUBLIC_KEY":      cfg.PublicKey,
-	})
+	required := map[string]string{
+		"PORT":       cfg.Port,
+		"PUBLIC_KEY": cfg.PublicKey,
+	}
+	if !cfg.Embedded() {
+		required["POSTGRES_DB_URL"] = cfg.PostgresDbUrl
+	}
+	err = requireConfigStrings(required)
 
 	// transfer settings to core library
 	core.AwsRegion = cfg.AwsRegion
@@ -131,6 +301,7 @@ func initConfig(mode string) (cfg *config, err error) {
 	core.AwsS3BucketName = cfg.AwsS3BucketName
 	core.AwsS3BucketPath = cfg.AwsS3BucketPath
 	core.AwsSecretAccessKey = cfg.AwsSecretAccessKey
+	core.StaleDuration = cfg.StaleDuration()
 
 	return
 }
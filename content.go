@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+	"github.com/datatogether/ffi"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleGetResponse is a stand-in for core.Url.HandleGetResponse. It reads
+// the body of a GET response up to the page size limit for u, updates u with it's
+// hash, passes it to storeBlob & saves u with a snapshot. core writes it's
+// snapshot in the background, before the body is hashed, which left
+// snapshots without hashes & callers racing to fill them in
+func handleGetResponse(db *sql.DB, u *core.Url, res *http.Response) (body []byte, truncated bool, err error) {
+	lb := limitBody(res, maxPageSize(u.Url))
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	u.Status = res.StatusCode
+	u.ContentLength = int64(len(body))
+	u.ContentType = res.Header.Get("Content-Type")
+	u.ContentSniff = http.DetectContentType(body)
+	u.Headers = rawHeadersSlice(res)
+	u.LastGet = &now
+	if u.Hash, err = core.CalcHash(body); err != nil {
+		return nil, false, err
+	}
+
+	// sometimes xhtml documents come back as text/plain
+	if u.ContentSniff == "text/html; charset=utf-8" || u.ContentSniff == "text/plain; charset=utf-8" {
+		if doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body)); err == nil {
+			u.Title = doc.Find("title").Text()
+		}
+	} else if u.SuspectedContentUrl() {
+		if filename, err := ffi.FilenameFromUrlString(u.Url); err == nil {
+			u.FileName = filename
+		}
+	}
+
+	s := newSnapshot(u)
+	s.Truncated = lb.Truncated
+	if s.Cid, err = storeBlob(u, bytes.NewReader(body)); err != nil {
+		log.Infof("content storage error: %s - %s", u.Url, err)
+	}
+	if err := saveGet(db, u, s); err != nil {
+		return nil, false, err
+	}
+	return body, lb.Truncated, nil
+}
+
+// maxPageSize gives the largest GET body to read into memory for rawurl in
+// bytes, the smaller of it's content size limit & cfg.MaxPageSize. pages
+// are always capped, even for sources without a content size limit
+func maxPageSize(rawurl string) int64 {
+	max := cfg.MaxPageSize()
+	if limit := maxContentSize(rawurl); limit > 0 && limit < max {
+		return limit
+	}
+	return max
+}
+
+// storeBlob writes body to the configured blob store under u.Hash if u's
+// content type is one of cfg.StoreContentTypes, returning it's CID if the
+// blob store gives content ids
+func storeBlob(u *core.Url, body io.ReadSeeker) (cid string, err error) {
+	if blobs == nil || !shouldStoreContent(u) {
+		return "", nil
+	}
+	if err := blobs.PutReader(u.Hash, body); err != nil {
+		return "", err
+	}
+
+	if cs, ok := blobs.(ContentIdStore); ok {
+		return cs.ContentId(u.Hash)
+	}
+	return "", nil
+}
+
+// shouldStoreContent reports weather u's body should be kept, checking both
+// it's reported & sniffed content types against cfg.StoreContentTypes.
+// entries can end in a wildcard subtype to match a whole family, eg: "image/*"
+func shouldStoreContent(u *core.Url) bool {
+	types := []string{}
+	for _, ct := range []string{u.ContentType, u.ContentSniff} {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			types = append(types, mt)
+		}
+	}
+
+	for _, want := range cfg.StoreContentTypes {
+		want = strings.ToLower(strings.TrimSpace(want))
+		if want == "" {
+			continue
+		}
+		for _, mt := range types {
+			if mt == want || (strings.HasSuffix(want, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(want, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"github.com/datatogether/core"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"time"
 
 	"github.com/PuerkitoBio/fetchbot"
 )
@@ -28,49 +29,86 @@ func startCrawlingContent() {
 	// Handle all errors the same
 	mux.HandleErrors(fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
 		log.Infof("content res error - %s %s - %s\n", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
-		mu.Lock()
-		delete(enqued, ctx.Cmd.URL().String())
-		mu.Unlock()
+		failUrl(ctx.Cmd.URL().String(), err)
 	}))
 
+	// responses no other handler wants are finished as soon as they arrive
+	mux.DefaultHandler = ackHandler
+
 	// Handle GET requests for html responses, to parse the body and enqueue all links as HEAD requests.
 	mux.Response().Method("GET").Handler(fetchbot.HandlerFunc(
 		func(ctx *fetchbot.Context, res *http.Response, err error) {
 
 			u := &core.Url{Url: ctx.Cmd.URL().String()}
-			if err := u.Read(store); err != nil {
+			if err := readUrl(store, u); err != nil {
 				// log.Printf("[ERR] url read error: %s - (%s) - %s\n", ctx.Cmd.URL(), NormalizeURL(ctx.Cmd.URL()), err)
 				log.Infof("content url read error: %s - %s\n", u.Url, err)
+				failUrl(u.Url, err)
+				return
+			}
+
+			if res.StatusCode == http.StatusNotModified {
+				if err := handleNotModified(appDB, u, res); err != nil {
+					log.Infof("not modified error: %s - %s", u.Url, err)
+					failUrl(u.Url, err)
+					return
+				}
+				ackGet(u, u)
 				return
 			}
 
-			mu.Lock()
-			delete(enqued, u.Url)
-			mu.Unlock()
+			// redirected GETs are recorded against the url that finally
+			// answered, the frontier entry stays with the requested url
+			requested := u
+			if u, err = handleRedirects(appDB, requested, res); err != nil {
+				log.Infof("redirect error: %s - %s", requested.Url, err)
+				failUrl(requested.Url, err)
+				return
+			}
 
-			_, _, err = u.HandleGetResponse(store, res)
+			// content can be arbitrarily large, so it's streamed to disk
+			// instead of being read into memory
+			d, err := handleDownloadResponse(appDB, contentFetcher.HttpClient, u, res)
 			if err != nil {
 				log.Info(err.Error())
+				failUrl(requested.Url, err)
 				return
 			}
+			defer d.Close()
 
-			// Enqueue all links as HEAD requests
-			// if err := enqueueDstLinks(u, links, ctx); err != nil {
-			// 	log.Info(err.Error())
-			// }
+			if p, err := d.WarcPayload(); err != nil {
+				log.Infof("error reading download for %s: %s", u.Url, err)
+			} else {
+				writeWarcGet(appDB, u, res, p)
+			}
+
+			ackGet(requested, u)
+
+			// stylesheets pull in fonts, images & other stylesheets that
+			// pages need to render
+			if isCss(u) {
+				if err := enqueueCssLinks(requested, u, d); err != nil {
+					log.Infof("link extraction error: %s - %s", u.Url, err)
+				}
+			}
 		}))
 
 	// Create the Fetcher, handle the logging first, then dispatch to the Muxer
-	h := logHandler("B", mux)
+	h := logHandler("B", statusHandler(mux))
 
 	contentFetcher = fetchbot.New(h)
 	contentFetcher.DisablePoliteness = !cfg.Polite
-	contentFetcher.CrawlDelay = time.Duration(cfg.CrawlDelaySeconds) * time.Second
+	// delays are handled per-host by the shared limiter
+	contentFetcher.CrawlDelay = 0
+	contentFetcher.HttpClient = newLimitedDoer(crawlClient)
+	contentFetcher.UserAgent = cfg.UserAgentString()
 
 	// Start processing
 	log.Info("starting B crawler (content)")
 	q := contentFetcher.Start()
 	contentQueue = q
+	fetcherStarted(crawlerContent)
+	go feedQueue(frontier, crawlerContent, q)
 
 	stopFunc := q.Close
 	stopContentCrawler = make(chan bool)
@@ -81,4 +119,22 @@ func startCrawlingContent() {
 	}()
 
 	q.Block()
+	fetcherStopped(crawlerContent)
+}
+
+// enqueueCssLinks extracts & enqueues links from a downloaded stylesheet
+func enqueueCssLinks(requested, u *core.Url, d *Download) error {
+	r, err := d.Reader()
+	if err != nil {
+		return err
+	}
+	css, err := ioutil.ReadAll(io.LimitReader(r, maxCssSize))
+	if err != nil {
+		return err
+	}
+	links, err := extractLinks(appDB, u, css)
+	if err != nil {
+		return err
+	}
+	return enqueueDstLinks(requested, links)
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShouldStoreContent(t *testing.T) {
+	prev := cfg.StoreContentTypes
+	defer func() { cfg.StoreContentTypes = prev }()
+	cfg.StoreContentTypes = []string{"application/pdf", " image/* ", ""}
+
+	cases := []struct {
+		contentType, sniff string
+		expect             bool
+	}{
+		{"application/pdf", "", true},
+		{"application/PDF; charset=binary", "", true},
+		{"application/octet-stream", "application/pdf", true},
+		{"image/png", "image/png", true},
+		{"text/html; charset=utf-8", "text/html; charset=utf-8", false},
+		{"", "", false},
+		{"imagery/png", "", false},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{ContentType: c.contentType, ContentSniff: c.sniff}
+		if got := shouldStoreContent(u); got != c.expect {
+			t.Errorf("case %d: %s / %s expected: %t, got: %t", i, c.contentType, c.sniff, c.expect, got)
+		}
+	}
+}
+
+func TestMaxPageSize(t *testing.T) {
+	prevScopes, prevSettings := crawlingScopes, sourceSettings
+	prevContent, prevPage := cfg.MaxContentSizeMb, cfg.MaxPageSizeMb
+	defer func() {
+		crawlingScopes, sourceSettings = prevScopes, prevSettings
+		cfg.MaxContentSizeMb, cfg.MaxPageSizeMb = prevContent, prevPage
+	}()
+
+	crawlingScopes = testScopes(t,
+		&core.Source{Id: "small", Url: "small.gov"},
+		&core.Source{Id: "unlimited", Url: "unlimited.gov"},
+	)
+	sourceSettings = map[string]*SourceSettings{
+		"small":     {SourceId: "small", MaxContentSize: 1024},
+		"unlimited": {SourceId: "unlimited", MaxContentSize: -1},
+	}
+
+	const mb = 1024 * 1024
+	cases := []struct {
+		contentMb, pageMb int
+		url               string
+		expect            int64
+	}{
+		{0, 0, "http://other.gov/", 10 * mb},
+		{0, 2, "http://other.gov/", 2 * mb},
+		{1, 0, "http://other.gov/", mb},
+		{20, 0, "http://other.gov/", 10 * mb},
+		{0, 0, "http://small.gov/page", 1024},
+		{0, 0, "http://unlimited.gov/page", 10 * mb},
+	}
+
+	for i, c := range cases {
+		cfg.MaxContentSizeMb, cfg.MaxPageSizeMb = c.contentMb, c.pageMb
+		if got := maxPageSize(c.url); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %d, got: %d", i, c.expect, got)
+		}
+	}
+}
+
+func TestHandleGetResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	prevBlobs, prevTypes := blobs, cfg.StoreContentTypes
+	defer func() { blobs, cfg.StoreContentTypes = prevBlobs, prevTypes }()
+	if blobs, err = NewLocalBlobStore(dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	cfg.StoreContentTypes = []string{"application/pdf"}
+
+	bodies := map[string]string{
+		"/a.pdf":  "%PDF-1.4 pretend",
+		"/a.html": "<html><head><title>a page</title></head></html>",
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".pdf") {
+			w.Header().Set("Content-Type", "application/pdf")
+		}
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer s.Close()
+
+	cases := []struct {
+		path, title string
+		stored      bool
+	}{
+		{"/a.pdf", "", true},
+		{"/a.html", "a page", false},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: s.URL + c.path}
+		if err := u.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := http.Get(u.Url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		body, truncated, err := handleGetResponse(appDB, u, res)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if string(body) != bodies[c.path] || truncated {
+			t.Errorf("case %d body mismatch. got: %s, truncated: %t", i, string(body), truncated)
+		}
+		if u.Title != c.title {
+			t.Errorf("case %d title mismatch. expected: %s, got: %s", i, c.title, u.Title)
+		}
+
+		hash, _ := core.CalcHash(body)
+		if u.Hash != hash {
+			t.Errorf("case %d url hash mismatch. expected: %s, got: %s", i, hash, u.Hash)
+		}
+
+		// the snapshot must be complete as soon as handleGetResponse returns
+		var urlHash, snapshotHash string
+		if err := appDB.QueryRow("select hash from urls where url = $1", u.Url).Scan(&urlHash); err != nil {
+			t.Errorf("case %d error reading url: %s", i, err.Error())
+		}
+		if err := appDB.QueryRow("select hash from snapshots where url = $1", u.Url).Scan(&snapshotHash); err != nil {
+			t.Errorf("case %d error reading snapshot: %s", i, err.Error())
+		}
+		if urlHash != hash || snapshotHash != hash {
+			t.Errorf("case %d stored hash mismatch. expected: %s, got url: %s, snapshot: %s", i, hash, urlHash, snapshotHash)
+		}
+
+		if has, _ := blobs.Has(hash); has != c.stored {
+			t.Errorf("case %d stored mismatch. expected: %t, got: %t", i, c.stored, has)
+		}
+	}
+}
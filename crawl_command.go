@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the manifest file written alongside a crawl's WARC files
+const crawlManifestName = "manifest.json"
+
+// CrawlOptions configures a one-off crawl, see crawlCommand
+type CrawlOptions struct {
+	// url to start crawling from
+	Seed string
+	// glob or "re:" prefixed regex rules, see Scope
+	Include []string
+	Exclude []string
+	// max number of links to follow from the seed, 0 is unlimited
+	MaxDepth int
+	// max number of urls to fetch, 0 is unlimited
+	MaxPages int
+	// wait between requests to the same host
+	Delay time.Duration
+	// fetch images, stylesheets & scripts pages need to render, from any host
+	Requisites bool
+	// directory to write WARC files & the manifest to
+	Dir string
+
+	// automatically stop or cancel the crawl after a given time or once a
+	// given url is reached. stopping lets in-flight requests finish
+	StopAfter, CancelAfter time.Duration
+	StopAt, CancelAt       string
+	// print memory statistics at this interval, 0 disables
+	MemStats time.Duration
+}
+
+// CrawlManifest lists everything a one-off crawl captured
+type CrawlManifest struct {
+	Seed     string    `json:"seed"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// WARC files written, relative to the manifest
+	Warcs []string `json:"warcs"`
+	// urls in the order they were fetched
+	Urls []*CrawlCapture `json:"urls"`
+}
+
+// CrawlCapture records a single fetch in a CrawlManifest
+type CrawlCapture struct {
+	// url that answered
+	Url string `json:"url"`
+	// url that was asked for, if it redirected
+	Requested string `json:"requested,omitempty"`
+	// urls passed through on the way to Url
+	Redirects []string `json:"redirects,omitempty"`
+	// number of links followed from the seed
+	Depth int `json:"depth"`
+	// how the url was linked to
+	Kind          LinkKind  `json:"kind"`
+	Fetched       time.Time `json:"fetched"`
+	Status        int       `json:"status,omitempty"`
+	ContentType   string    `json:"contentType,omitempty"`
+	ContentLength int64     `json:"contentLength"`
+	Truncated     bool      `json:"truncated,omitempty"`
+	PayloadDigest string    `json:"payloadDigest,omitempty"`
+	// WARC file & response record id holding the capture
+	WarcFile     string `json:"warcFile,omitempty"`
+	WarcRecordId string `json:"warcRecordId,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// stringsFlag is a flag that can be given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// crawlCommand runs "sentry crawl [flags] <url>", crawling from a url
+// without a database & writing WARC files & a manifest of captured urls to
+// an output directory. configuration is read from the environment as usual,
+// but postgres isn't required. it returns the process exit code
+func crawlCommand(args []string) int {
+	o := &CrawlOptions{}
+	var include, exclude stringsFlag
+	var maxSizeMb int
+	var polite bool
+	var userAgent string
+
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sentry crawl [flags] <url>")
+		flags.PrintDefaults()
+	}
+	flags.Var(&include, "include", "only crawl urls matching this glob or re: rule, may be repeated")
+	flags.Var(&exclude, "exclude", "never crawl urls matching this glob or re: rule, may be repeated")
+	flags.IntVar(&o.MaxDepth, "depth", 2, "max number of links to follow from the seed url, 0 is unlimited")
+	flags.IntVar(&o.MaxPages, "max-pages", 100, "max number of urls to fetch, 0 is unlimited")
+	flags.DurationVar(&o.Delay, "delay", time.Second, "wait between requests to the same host")
+	flags.BoolVar(&o.Requisites, "requisites", true, "fetch images, stylesheets & scripts pages need to render")
+	flags.StringVar(&o.Dir, "out", "", "output directory, defaults to crawl-HOST-TIMESTAMP")
+	flags.IntVar(&maxSizeMb, "max-size", 100, "largest response body to keep in megabytes, 0 is unlimited")
+	flags.BoolVar(&polite, "polite", true, "respect robots.txt")
+	flags.StringVar(&userAgent, "user-agent", "", "User-Agent to send, defaults to the configured one")
+	flags.DurationVar(&o.StopAfter, "stopafter", 0, "automatically stop the fetchbot after a given time")
+	flags.DurationVar(&o.CancelAfter, "cancelafter", 0, "automatically cancel the fetchbot after a given time")
+	flags.StringVar(&o.StopAt, "stopat", "", "automatically stop the fetchbot at a given URL")
+	flags.StringVar(&o.CancelAt, "cancelat", "", "automatically cancel the fetchbot at a given URL")
+	flags.DurationVar(&o.MemStats, "memstats", 0, "display memory statistics at a given interval")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	o.Seed = flags.Arg(0)
+	o.Include, o.Exclude = include, exclude
+
+	// postgres isn't needed here, so a missing db url isn't an error
+	cfg, _ = initConfig(os.Getenv("GOLANG_ENV"))
+	cfg.Polite = polite
+	cfg.MaxContentSizeMb = maxSizeMb
+	cfg.CrawlDelaySeconds = int(o.Delay / time.Second)
+	if userAgent != "" {
+		cfg.UserAgent = userAgent
+	}
+	crawlClient = &redirectDoer{client: newCrawlClient()}
+
+	m, err := runCrawl(o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "crawl error: %s\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, c := range m.Urls {
+		if c.Error != "" {
+			failed++
+		}
+	}
+	fmt.Printf("captured %d urls (%d failed) to %s\n", len(m.Urls)-failed, failed, o.Dir)
+	if len(m.Urls) == failed {
+		return 1
+	}
+	return 0
+}
+
+// runCrawl crawls from o.Seed, writing WARC files & a manifest to o.Dir.
+// the crawl runs through the same fetch pipeline as the server's crawlers,
+// sharing host rate limiting, scope rules & link extraction, but keeps all
+// state in memory. it replaces the crawling scopes & WARC writer for the
+// duration
+func runCrawl(o *CrawlOptions) (*CrawlManifest, error) {
+	seed, err := url.Parse(o.Seed)
+	if err != nil {
+		return nil, err
+	}
+	if seed.Scheme == "" {
+		if seed, err = url.Parse("http://" + o.Seed); err != nil {
+			return nil, err
+		}
+	}
+	if seed.Scheme != "http" && seed.Scheme != "https" {
+		return nil, fmt.Errorf("can't crawl %s urls", seed.Scheme)
+	}
+
+	set := &SourceSettings{
+		SourceId:   "crawl",
+		Include:    o.Include,
+		Exclude:    o.Exclude,
+		MaxDepth:   o.MaxDepth,
+		CrawlDelay: o.Delay,
+	}
+	sourceUrl, err := normalizeSourceUrl(seed.String())
+	if err != nil {
+		return nil, err
+	}
+	sc, err := NewScope(&core.Source{Id: set.SourceId, Url: sourceUrl}, set)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Dir == "" {
+		o.Dir = fmt.Sprintf("crawl-%s-%s", strings.Replace(seed.Host, ":", "_", -1), time.Now().In(time.UTC).Format("20060102150405"))
+	}
+	w, err := NewWarcWriter(o.Dir, "sentry-crawl", cfg.WarcMaxSize())
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	crawlingUrls = []*url.URL{seed}
+	crawlingScopes = []*Scope{sc}
+	sourceSettings = map[string]*SourceSettings{set.SourceId: set}
+	mu.Unlock()
+	warcs = w
+
+	j := &crawlJob{
+		opts:     o,
+		scope:    sc,
+		found:    map[string]bool{},
+		depths:   map[string]int{},
+		kinds:    map[string]LinkKind{},
+		manifest: &CrawlManifest{Seed: seed.String(), Started: time.Now().In(time.UTC), Urls: []*CrawlCapture{}},
+	}
+	j.run(seed.String())
+
+	if err := w.Close(); err != nil {
+		return j.manifest, err
+	}
+	warcs = nil
+
+	j.manifest.Finished = time.Now().In(time.UTC)
+	if j.manifest.Warcs, err = crawlWarcFiles(o.Dir); err != nil {
+		return j.manifest, err
+	}
+	data, err := json.MarshalIndent(j.manifest, "", "  ")
+	if err != nil {
+		return j.manifest, err
+	}
+	return j.manifest, ioutil.WriteFile(filepath.Join(o.Dir, crawlManifestName), data, 0644)
+}
+
+// crawlWarcFiles lists finished WARC files in dir
+func crawlWarcFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+	return files, nil
+}
+
+// crawlJob is the in-memory state of a one-off crawl
+type crawlJob struct {
+	opts  *CrawlOptions
+	scope *Scope
+	q     *fetchbot.Queue
+
+	lock sync.Mutex
+	// urls that have been sent to the queue
+	found  map[string]bool
+	depths map[string]int
+	kinds  map[string]LinkKind
+	// sent urls that haven't been handled yet, the queue closes at zero
+	pending  int
+	closed   bool
+	manifest *CrawlManifest
+}
+
+// run crawls from seed until there's nothing left to fetch or the crawl is
+// stopped
+func (j *crawlJob) run(seed string) {
+	var h fetchbot.Handler = fetchbot.HandlerFunc(j.handle)
+	if j.opts.StopAt != "" {
+		h = j.stopAt(j.opts.StopAt, false, h)
+	}
+	if j.opts.CancelAt != "" {
+		h = j.stopAt(j.opts.CancelAt, true, h)
+	}
+
+	f := fetchbot.New(logHandler("CLI", h))
+	f.DisablePoliteness = !cfg.Polite
+	// delays are handled per-host by the shared limiter
+	f.CrawlDelay = 0
+	f.HttpClient = newLimitedDoer(crawlClient)
+	f.UserAgent = cfg.UserAgentString()
+
+	q := f.Start()
+	j.q = q
+
+	if j.opts.StopAfter > 0 {
+		time.AfterFunc(j.opts.StopAfter, j.close)
+	}
+	if j.opts.CancelAfter > 0 {
+		time.AfterFunc(j.opts.CancelAfter, func() { q.Cancel() })
+	}
+	if j.opts.MemStats > 0 {
+		tick := time.NewTicker(j.opts.MemStats)
+		defer tick.Stop()
+		dbg := f.Debug()
+		go func() {
+			for range tick.C {
+				select {
+				case di := <-dbg:
+					fmt.Println(string(memStats(di)))
+				default:
+					fmt.Println(string(memStats(nil)))
+				}
+			}
+		}()
+	}
+
+	if !j.enqueue(seed, 0, LinkAnchor) {
+		j.close()
+	}
+	q.Block()
+}
+
+// enqueue sends rawurl to the queue if it hasn't been seen & the page
+// limit hasn't been reached, reporting weather it was sent
+func (j *crawlJob) enqueue(rawurl string, depth int, kind LinkKind) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.closed || j.found[rawurl] || (j.opts.MaxPages > 0 && len(j.found) >= j.opts.MaxPages) {
+		return false
+	}
+
+	j.found[rawurl] = true
+	j.depths[rawurl] = depth
+	j.kinds[rawurl] = kind
+	j.pending++
+	if _, err := j.q.SendStringGet(rawurl); err != nil {
+		log.Infof("enqueue error: %s - %s", rawurl, err)
+		j.pending--
+		return false
+	}
+	return true
+}
+
+// done marks a url handled, closing the queue once nothing is pending
+func (j *crawlJob) done() {
+	j.lock.Lock()
+	j.pending--
+	finished := j.pending <= 0
+	j.lock.Unlock()
+	if finished {
+		j.close()
+	}
+}
+
+// close stops the crawl, letting in-flight requests finish. it's safe to
+// call from a handler
+func (j *crawlJob) close() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.closed {
+		j.closed = true
+		// closing blocks until handlers return, so it can't happen on
+		// a handler goroutine
+		go j.q.Close()
+	}
+}
+
+// cancel stops the crawl without fetching urls that are still queued. it's
+// safe to call from a handler
+func (j *crawlJob) cancel() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.closed {
+		j.closed = true
+		go j.q.Cancel()
+	}
+}
+
+// stopAt wraps h to stop, or cancel, the crawl once stopurl is reached.
+// unlike stopHandler, the stop url is still handled so it's captured &
+// listed in the manifest, but none of it's links are followed
+func (j *crawlJob) stopAt(stopurl string, cancel bool, h fetchbot.Handler) fetchbot.Handler {
+	return fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
+		if ctx.Cmd.URL().String() == stopurl {
+			log.Infof("stop url reached: %s", stopurl)
+			if cancel {
+				j.cancel()
+			} else {
+				j.close()
+			}
+		}
+		h.Handle(ctx, res, err)
+	})
+}
+
+// record adds a capture to the manifest
+func (j *crawlJob) record(c *CrawlCapture) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.manifest.Urls = append(j.manifest.Urls, c)
+}
+
+// handle archives a response & follows it's links
+func (j *crawlJob) handle(ctx *fetchbot.Context, res *http.Response, err error) {
+	defer j.done()
+
+	requested := ctx.Cmd.URL().String()
+	j.lock.Lock()
+	c := &CrawlCapture{Url: requested, Depth: j.depths[requested], Kind: j.kinds[requested], Fetched: time.Now().In(time.UTC)}
+	j.lock.Unlock()
+	defer j.record(c)
+
+	if err != nil {
+		c.Error = err.Error()
+		return
+	}
+	defer res.Body.Close()
+
+	for _, h := range redirectsFor(res) {
+		c.Redirects = append(c.Redirects, h.Src)
+		writeWarc(h.res, h.body, h.at)
+	}
+	if final := res.Request.URL.String(); final != requested {
+		c.Url = final
+		c.Requested = requested
+	}
+
+	lb := limitBody(res, maxContentSize(c.Url))
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		c.Error = err.Error()
+		return
+	}
+	c.Status = res.StatusCode
+	c.ContentType = res.Header.Get("Content-Type")
+	c.ContentLength = int64(len(body))
+	c.Truncated = lb.Truncated
+
+	p := NewWarcPayload(body, lb.Truncated)
+	c.PayloadDigest = p.Digest
+	if c.WarcRecordId, c.WarcFile, err = warcs.WriteCapture(res, p, c.Fetched); err != nil {
+		c.Error = err.Error()
+		return
+	}
+
+	if failureStatus(res.StatusCode) {
+		c.Error = NewStatusError(res).Error()
+		return
+	}
+
+	u := &core.Url{Url: c.Url, ContentType: c.ContentType, ContentSniff: http.DetectContentType(body)}
+	found, err := findLinks(u, body)
+	if err != nil {
+		log.Infof("link extraction error: %s - %s", c.Url, err)
+	}
+	for _, f := range found {
+		j.follow(f, c.Depth)
+	}
+}
+
+// follow enqueues a link found on a page at depth. pages must be in scope
+// & within the depth limit, requisites share their page's depth & can come
+// from any host the scope doesn't exclude
+func (j *crawlJob) follow(f *foundLink, depth int) {
+	dst, err := url.Parse(f.url)
+	if err != nil || (dst.Scheme != "http" && dst.Scheme != "https") {
+		return
+	}
+	dst.Fragment = ""
+
+	if f.kind.Requisite() {
+		if !j.opts.Requisites || (j.scope.Matches(dst) && !j.scope.Contains(dst)) {
+			return
+		}
+		j.enqueue(dst.String(), depth, f.kind)
+		return
+	}
+
+	if !j.scope.Contains(dst) || !j.scope.AllowsDepth(depth+1) {
+		return
+	}
+	j.enqueue(dst.String(), depth+1, f.kind)
+}
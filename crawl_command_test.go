@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// swapCrawlGlobals sets up config & a crawl client for runCrawl, returning
+// a func that puts back everything a crawl replaces
+func swapCrawlGlobals() func() {
+	prevCfg, prevClient, prevWarcs := cfg, crawlClient, warcs
+	mu.Lock()
+	prevUrls, prevScopes, prevSettings := crawlingUrls, crawlingScopes, sourceSettings
+	mu.Unlock()
+
+	cfg = &config{}
+	crawlClient = &redirectDoer{client: newCrawlClient()}
+	return func() {
+		cfg, crawlClient, warcs = prevCfg, prevClient, prevWarcs
+		mu.Lock()
+		crawlingUrls, crawlingScopes, sourceSettings = prevUrls, prevScopes, prevSettings
+		mu.Unlock()
+	}
+}
+
+func TestRunCrawl(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer other.Close()
+
+	pages := map[string]string{
+		"/": fmt.Sprintf(`<html><head><link rel="stylesheet" href="/style.css"></head><body>
+			<a href="/a">a</a> <a href="/moved">moved</a> <a href="/private/x">private</a>
+			<a href="%[1]s/page">other page</a> <img src="%[1]s/logo.png"></body></html>`, other.URL),
+		"/a": `<html><body><a href="/c">too deep</a><img src="/img.png"></body></html>`,
+		"/b": `<html><body><a href="/a#top">back</a></body></html>`,
+	}
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/moved":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case r.URL.Path == "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte(`body { background: url("bg.png"); }`))
+		case strings.HasSuffix(r.URL.Path, ".png"):
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		case pages[r.URL.Path] != "":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(pages[r.URL.Path]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	defer swapCrawlGlobals()()
+
+	dir, err := ioutil.TempDir("", "sentry_crawl")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	o := &CrawlOptions{
+		Seed:       site.URL + "/",
+		Exclude:    []string{"*/private/*"},
+		MaxDepth:   1,
+		Requisites: true,
+		Dir:        dir,
+	}
+	if _, err := runCrawl(o); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, crawlManifestName))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m := &CrawlManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(m.Warcs) == 0 {
+		t.Errorf("expected manifest to list warc files")
+	}
+	for _, f := range m.Warcs {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("listed warc file missing: %s", err)
+		}
+	}
+
+	got := map[string]*CrawlCapture{}
+	urls := []string{}
+	for _, c := range m.Urls {
+		u, err := url.Parse(c.Url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		key := u.Path
+		if u.Host != strings.TrimPrefix(site.URL, "http://") {
+			key = "other" + u.Path
+		}
+		got[key] = c
+		urls = append(urls, key)
+	}
+	sort.Strings(urls)
+
+	expect := []string{"/", "/a", "/b", "/bg.png", "/img.png", "/style.css", "other/logo.png"}
+	if strings.Join(urls, " ") != strings.Join(expect, " ") {
+		t.Fatalf("captured urls mismatch. expected: %v, got: %v", expect, urls)
+	}
+
+	cases := []struct {
+		key   string
+		depth int
+		kind  LinkKind
+	}{
+		{"/", 0, LinkAnchor},
+		{"/a", 1, LinkAnchor},
+		{"/b", 1, LinkAnchor},
+		{"/style.css", 0, LinkStylesheet},
+		{"/bg.png", 0, LinkEmbed},
+		{"/img.png", 1, LinkEmbed},
+		{"other/logo.png", 0, LinkEmbed},
+	}
+	for i, c := range cases {
+		cap := got[c.key]
+		if cap.Depth != c.depth || cap.Kind != c.kind {
+			t.Errorf("case %d %s mismatch. expected depth %d kind %s, got depth %d kind %s", i, c.key, c.depth, c.kind, cap.Depth, cap.Kind)
+		}
+		if cap.Status != http.StatusOK || cap.WarcRecordId == "" || cap.Error != "" {
+			t.Errorf("case %d %s expected a successful capture, got: %#v", i, c.key, cap)
+		}
+	}
+
+	if b := got["/b"]; b.Requested != site.URL+"/moved" || len(b.Redirects) != 1 {
+		t.Errorf("expected /b to record it's redirect, got: %#v", b)
+	}
+}
+
+func TestRunCrawlStopAt(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><body><a href="%snext/">next</a></body></html>`, r.URL.Path)
+	}))
+	defer site.Close()
+
+	defer swapCrawlGlobals()()
+
+	stop := site.URL + "/next/"
+	cases := []*CrawlOptions{
+		{Seed: site.URL, StopAt: stop},
+		{Seed: site.URL, CancelAt: stop},
+	}
+
+	for i, o := range cases {
+		dir, err := ioutil.TempDir("", "sentry_crawl")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		o.MaxPages = 10
+		o.Dir = dir
+
+		m, err := runCrawl(o)
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if len(m.Urls) != 2 {
+			t.Errorf("case %d: expected crawl to stop after 2 urls, got %d", i, len(m.Urls))
+			continue
+		}
+		if last := m.Urls[1]; last.Url != stop || last.Status != http.StatusOK || last.Error != "" {
+			t.Errorf("case %d: expected the stop url to be captured, got: %#v", i, last)
+		}
+	}
+}
+
+func TestRunCrawlMaxPages(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><body><a href="%snext/">next</a></body></html>`, r.URL.Path)
+	}))
+	defer site.Close()
+
+	defer swapCrawlGlobals()()
+
+	dir, err := ioutil.TempDir("", "sentry_crawl")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := runCrawl(&CrawlOptions{Seed: site.URL, MaxPages: 3, Dir: dir})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(m.Urls) != 3 {
+		t.Errorf("expected crawl to stop at 3 pages, got %d", len(m.Urls))
+	}
+}
@@ -24,9 +24,11 @@ var (
 	mu sync.Mutex
 	// slice of urls currently crawling
 	crawlingUrls []*url.URL
-	// enqued map of url : method (HEAD|GET) to prevent double-adding
-	// to the que
-	enqued = map[string]string{}
+	// scopes of sources currently crawling
+	crawlingScopes []*Scope
+	// frontier is the durable record of urls waiting to be crawled,
+	// shared by all crawlers
+	frontier *Frontier
 	// chan to stop the crawler
 	stopCrawler chan bool
 )
@@ -41,35 +43,59 @@ func startCrawling() {
 
 	// Handle all errors the same
 	mux.HandleErrors(fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
-		mu.Lock()
-		delete(enqued, ctx.Cmd.URL().String())
-		mu.Unlock()
-
 		log.Infof("res error - %s %s - %s", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
+		failUrl(ctx.Cmd.URL().String(), err)
 	}))
 
+	// responses no other handler wants are finished as soon as they arrive
+	mux.DefaultHandler = ackHandler
+
 	// Handle GET requests for html responses, to parse the body and enqueue all links as HEAD requests.
 	mux.Response().Method("GET").Handler(fetchbot.HandlerFunc(
 		func(ctx *fetchbot.Context, res *http.Response, err error) {
 
 			u := &core.Url{Url: ctx.Cmd.URL().String()}
-			if err := u.Read(store); err != nil {
+			if err := readUrl(store, u); err != nil {
 				// log.Infof("[ERR] url read error: %s - (%s) - %s\n", ctx.Cmd.URL(), NormalizeURL(ctx.Cmd.URL()), err)
 				log.Infof("url read error: %s - %s", u.Url, err)
+				failUrl(u.Url, err)
+				return
+			}
+
+			if res.StatusCode == http.StatusNotModified {
+				if err := handleNotModified(appDB, u, res); err != nil {
+					log.Infof("not modified error: %s - %s", u.Url, err)
+					failUrl(u.Url, err)
+					return
+				}
+				ackGet(u, u)
 				return
 			}
 
-			mu.Lock()
-			delete(enqued, u.Url)
-			mu.Unlock()
+			// redirected GETs are recorded against the url that finally
+			// answered, the frontier entry stays with the requested url
+			requested := u
+			if u, err = handleRedirects(appDB, requested, res); err != nil {
+				log.Infof("redirect error: %s - %s", requested.Url, err)
+				failUrl(requested.Url, err)
+				return
+			}
 
-			_, links, err := u.HandleGetResponse(store, res)
+			body, truncated, err := handleGetResponse(appDB, u, res)
 			if err != nil {
 				log.Debugf("error handling get response: %s - %s", ctx.Cmd.URL().String(), err.Error())
+				failUrl(requested.Url, err)
 				return
 			}
+			writeWarcGet(appDB, u, res, NewWarcPayload(body, truncated))
 
-			if err := enqueueDstLinks(u, links, ctx.Q); err != nil {
+			ackGet(requested, u)
+
+			links, err := extractLinks(appDB, u, body)
+			if err != nil {
+				log.Infof("link extraction error: %s - %s", u.Url, err)
+			}
+			if err := enqueueDstLinks(requested, links); err != nil {
 				log.Debugf("enque links error: %s", err.Error())
 			}
 		}))
@@ -82,12 +108,16 @@ func startCrawling() {
 
 			u := &core.Url{Url: addr.String()}
 
-			mu.Lock()
-			enqued[u.Url] = ""
-			mu.Unlock()
-
-			if err := u.Read(store); err != nil {
+			if err := readUrl(store, u); err != nil {
 				log.Info("%s %s reading - ", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
+				failUrl(u.Url, err)
+				return
+			}
+
+			requested := u
+			if u, err = handleRedirects(appDB, requested, res); err != nil {
+				log.Infof("redirect error: %s - %s", requested.Url, err)
+				failUrl(requested.Url, err)
 				return
 			}
 
@@ -98,34 +128,51 @@ func startCrawling() {
 			// TODO u.HeadersTook = 0
 			now := time.Now()
 			u.LastHead = &now
+			if cfg.WarcHeads {
+				writeWarc(res, nil, now)
+			}
 
 			if err := u.Save(store); err != nil {
 				log.Infof("update error: %s %s - %s\n", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
 				log.Infof("%#v", u)
 			}
 
-			// if we're currently crawling this url's domain, attept to add it to the
-			// queue
-			if urlIsWhitelisted(addr) {
-				if err := enqueueDomainGet(u, ctx); err != nil {
+			if err := frontier.Ack(requested.Url); err != nil {
+				log.Infof("frontier ack error: %s - %s", requested.Url, err)
+			}
+
+			depth, err := frontier.Depth(requested.Url)
+			if err != nil {
+				log.Infof("frontier depth error: %s - %s", requested.Url, err)
+			}
+
+			// if this url is inside the scope of a source we're currently crawling,
+			// attept to add it to the queue
+			if err == nil && urlInScope(u.Url, depth) {
+				if err := enqueueDomainGet(u, depth); err != nil {
 					log.Infof("error enquing domain get: %s %s - %s\n", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
 				}
 			} else {
-				log.Debugf("%s isn't whitelisted", addr.String())
+				log.Debugf("%s isn't in scope", addr.String())
 			}
 		}))
 
 	// Create the Fetcher, handle the logging first, then dispatch to the Muxer
-	h := logHandler("A", mux)
+	h := logHandler("A", statusHandler(mux))
 
 	log.Info("starting A crawler (main)")
 	f = fetchbot.New(h)
 	f.DisablePoliteness = !cfg.Polite
-	f.CrawlDelay = time.Duration(cfg.CrawlDelaySeconds) * time.Second
+	// delays are handled per-host by the shared limiter
+	f.CrawlDelay = 0
+	f.HttpClient = newLimitedDoer(crawlClient)
+	f.UserAgent = cfg.UserAgentString()
 
 	// Start processing
 	q := f.Start()
 	queue = q
+	fetcherStarted(crawlerMain)
+	go feedQueue(frontier, crawlerMain, q)
 
 	stopFunc := q.Close
 	stopCrawler = make(chan bool)
@@ -136,29 +183,34 @@ func startCrawling() {
 	}()
 
 	// do an initial domain seed
-	seedCrawlingSources(appDB, q)
-	seedUrls(appDB, q, 10)
+	seedCrawlingSources(appDB)
+	seedUrls(appDB, 10)
+	seedRevisits(appDB, 100)
+	go seedSitemaps(appDB)
 
 	// check to see if top levels need to be re-crawled for staleness
 	go func() {
-		c := time.Tick(time.Minute * 30)
-		select {
-		case <-c:
-			if len(enqued) < 100 {
+		for range time.Tick(time.Minute * 30) {
+			if pending, err := frontier.PendingCount(); err == nil && pending < 100 {
 				log.Info("que is low, adding urls")
-				seedCrawlingSources(appDB, q)
-				seedUrls(appDB, q, 400)
+				seedCrawlingSources(appDB)
+				seedUrls(appDB, 400)
+				seedRevisits(appDB, 400)
+			}
+			if err := seedSitemaps(appDB); err != nil {
+				log.Infof("sitemap seeding error: %s", err)
 			}
 		}
 	}()
 
 	q.Block()
+	fetcherStopped(crawlerMain)
 }
 
 // seedCrawlingSources grabs a list of sources that are currently set to crawl
-// and adds them to the que
-func seedCrawlingSources(db *sql.DB, q *fetchbot.Queue) error {
-	urls, err := core.CrawlingSources(db, 200, 0)
+// and adds them to the frontier
+func seedCrawlingSources(db *sql.DB) error {
+	urls, err := crawlingSources(store, 200, 0)
 	if err != nil {
 		return err
 	}
@@ -166,12 +218,25 @@ func seedCrawlingSources(db *sql.DB, q *fetchbot.Queue) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	crawlingUrls = make([]*url.URL, len(urls))
-	for i, c := range urls {
+	settings, err := loadSourceSettings(db, urls)
+	if err != nil {
+		return err
+	}
+	sourceSettings = settings
+
+	crawlingUrls = make([]*url.URL, 0, len(urls))
+	crawlingScopes = make([]*Scope, 0, len(urls))
+	for _, c := range urls {
 
 		log.Debugf("crawling url: %s", c.Url)
 
-		u, err := c.AsUrl(db)
+		sc, err := NewScope(c, settings[c.Id])
+		if err != nil {
+			log.Infof("invalid scope for source %s: %s", c.Url, err)
+			continue
+		}
+
+		u, err := sourceAsUrl(c)
 		if err != nil {
 			log.Info(err.Error())
 			return err
@@ -182,9 +247,9 @@ func seedCrawlingSources(db *sql.DB, q *fetchbot.Queue) error {
 			return err
 		}
 
-		crawlingUrls[i] = url
-		enqued[u.Url] = "GET"
-		_, err = q.SendStringGet(u.Url)
+		crawlingUrls = append(crawlingUrls, url)
+		crawlingScopes = append(crawlingScopes, sc)
+		_, err = frontier.Enqueue(crawlerMain, "GET", u.Url, priorityCrawlingSource, 0, time.Now())
 		if err != nil {
 			log.Info("error enquing string get", err.Error())
 			return err
@@ -194,38 +259,27 @@ func seedCrawlingSources(db *sql.DB, q *fetchbot.Queue) error {
 	return nil
 }
 
-// urlIsWhitelisted scans the slice of crawlingUrls to see if we should GET
-// the passed-in url
-func urlIsWhitelisted(u *url.URL) bool {
-	for _, c := range crawlingUrls {
-		// TODO - do we need more than host comparison here
-		// to avoid crawling all of a site?
-		if c.Host == u.Host {
-			return true
-		}
-	}
-	return false
-}
-
 // try to read a list of unfetched known urls
-func seedUrls(db *sql.DB, q *fetchbot.Queue, count int) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if ufd, err := core.UnfetchedUrls(db, count, 0); err == nil && len(ufd) >= 0 {
+func seedUrls(db *sql.DB, count int) error {
+	if ufd, err := unfetchedUrls(store, count, 0); err == nil && len(ufd) >= 0 {
 		i := 0
 		for _, unfetched := range ufd {
-			u, err := unfetched.ParsedUrl()
-			if err != nil {
+			// urls only found as links the crawler chose not to follow have
+			// no frontier history, & no depth to scope them by
+			depth, err := frontier.Depth(unfetched.Url)
+			if err == core.ErrNotFound {
+				continue
+			} else if err != nil {
 				return err
 			}
-			if urlIsWhitelisted(u) {
-				_, err = q.SendStringGet(unfetched.Url)
+			if urlInScope(unfetched.Url, depth) {
+				added, err := frontier.Enqueue(crawlerMain, "GET", unfetched.Url, priorityDefault, depth, time.Now())
 				if err != nil {
 					return err
 				}
-				enqued[unfetched.Url] = "GET"
-				i++
+				if added {
+					i++
+				}
 			}
 		}
 		log.Infof("adding %d unfetched urls to que", i)
@@ -233,64 +287,147 @@ func seedUrls(db *sql.DB, q *fetchbot.Queue, count int) error {
 	return nil
 }
 
-// enqueDomainGet adds a url GET request to the que if the url is valid
+// seedRevisits adds urls that are due for a revisit to the frontier. due
+// urls that can't be added, because they're out of scope, dead or already
+// waiting, are postponed by an interval so they don't hold up the rest
+func seedRevisits(db *sql.DB, count int) error {
+	due, err := DueRevisits(db, count, 0)
+	if err != nil {
+		return err
+	}
+
+	i := 0
+	for _, r := range due {
+		added := false
+		depth, err := frontier.Depth(r.Url)
+		if err != nil && err != core.ErrNotFound {
+			return err
+		}
+		if err == nil && urlInScope(r.Url, depth) {
+			u := &core.Url{Url: r.Url}
+			if err := readUrl(store, u); err != nil && err != core.ErrNotFound {
+				return err
+			}
+			if added, err = frontier.Enqueue(getCrawler(u), "GET", r.Url, priorityDefault, depth, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		if added {
+			i++
+		} else if err := r.postpone(db); err != nil {
+			return err
+		}
+	}
+	log.Infof("adding %d urls due for revisit to que", i)
+	return nil
+}
+
+// getCrawler picks the crawler to GET u with. files go to the content
+// crawler so they're streamed to disk instead of read into memory
+func getCrawler(u *core.Url) string {
+	if u.SuspectedContentUrl() {
+		return crawlerContent
+	}
+	return crawlerMain
+}
+
+// enqueDomainGet adds a url GET request to the frontier if the url is valid
 // for queing & not already enqued
-func enqueueDomainGet(u *core.Url, ctx *fetchbot.Context) error {
+func enqueueDomainGet(u *core.Url, depth int) error {
 	// log.Infof("url: %s, should head: %t, isFetchable: %t", u.Url, u.ShouldEnqueueHead(), u.isFetchable())
-	if enqued[u.Url] == "" && u.ShouldEnqueueGet() {
-		_, err := ctx.Q.SendStringGet(u.Url)
-		if err == nil {
-			mu.Lock()
-			defer mu.Unlock()
-			enqued[u.Url] = "GET"
-		}
+	if shouldEnqueueGet(u) {
+		_, err := frontier.Enqueue(crawlerMain, "GET", u.Url, priorityDefault, depth, time.Now())
 		return err
-	} else if enqued[u.Url] == "" {
-		log.Debugf("skipped url: %s last head: %s, last get: %s, content type: %s, content sniff: %s", u.Url, u.LastHead, u.LastGet, u.ContentType, u.ContentSniff)
 	}
+	log.Debugf("skipped url: %s last head: %s, last get: %s, content type: %s, content sniff: %s", u.Url, u.LastHead, u.LastGet, u.ContentType, u.ContentSniff)
 	return nil
 }
 
-// enqueDstLinks works through all linked urls
-func enqueueDstLinks(u *core.Url, links []*core.Link, q *fetchbot.Queue) error {
+// enqueDstLinks works through all linked urls. links that fall under a
+// crawling source but are excluded by it's scope or depth limit are dropped,
+// links to elsewhere are only ever HEAD'd. page requisites are handed to
+// enqueueRequisite instead
+func enqueueDstLinks(u *core.Url, links []*PageLink) error {
 	if links == nil || len(links) == 0 {
 		return nil
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	depth, err := frontier.Depth(u.Url)
+	if err != nil {
+		return err
+	}
 
 	heads := 0
 	gets := 0
 	for _, l := range links {
-		// log.Infof("url: %s, should head: %t, isFetchable: %t", l.Dst.Url, l.Dst.ShouldEnqueueHead(), l.Dst.isFetchable())
-		if enqued[l.Dst.Url] == "" && l.Dst.ShouldEnqueueHead() {
-			// skip the que & go straight to content archiving if it's a
-			if l.Dst.SuspectedContentUrl() && contentQueue != nil {
+		if l.Kind.Requisite() {
+			if added, err := enqueueRequisite(l.Dst, depth); err != nil {
+				log.Debugf("error: enqueue requisite %s - %s\n", l.Dst.Url, err)
+			} else if added {
 				gets++
-				enqued[l.Dst.Url] = "GET"
-				contentQueue.SendStringGet(l.Dst.Url)
+			}
+			continue
+		}
+
+		dst, err := l.Dst.ParsedUrl()
+		if err != nil {
+			continue
+		}
+
+		inScope := false
+		if sc := scopeForUrl(dst.String()); sc != nil {
+			if !sc.Contains(dst) || !sc.AllowsDepth(depth+1) {
+				log.Debugf("skipped url: %s out of scope for source: %s", l.Dst.Url, sc.Source.Url)
 				continue
 			}
+			inScope = true
+		}
 
-			if q != nil {
-				if _, err := q.SendStringHead(l.Dst.Url); err != nil {
-					log.Debugf("error: enqueue head %s - %s\n", l.Dst.Url, err)
-				} else {
-					heads++
-					enqued[l.Dst.Url] = "HEAD"
+		// log.Infof("url: %s, should head: %t, isFetchable: %t", l.Dst.Url, l.Dst.ShouldEnqueueHead(), l.Dst.isFetchable())
+		if shouldEnqueueHead(l.Dst) {
+			// skip the que & go straight to content archiving if it's a
+			if inScope && l.Dst.SuspectedContentUrl() {
+				if added, err := frontier.Enqueue(crawlerContent, "GET", l.Dst.Url, priorityDefault, depth+1, time.Now()); err != nil {
+					log.Debugf("error: enqueue content get %s - %s\n", l.Dst.Url, err)
+				} else if added {
+					gets++
 				}
+				continue
 			}
-		} else {
-			if enqued[l.Dst.Url] == "" {
-				log.Debugf("skipped url: %s last head: %s, last get: %s", l.Dst.Url, l.Dst.LastHead, l.Dst.LastGet)
+
+			if added, err := frontier.Enqueue(crawlerMain, "HEAD", l.Dst.Url, priorityDefault, depth+1, time.Now()); err != nil {
+				log.Debugf("error: enqueue head %s - %s\n", l.Dst.Url, err)
+			} else if added {
+				heads++
 			}
+		} else {
+			log.Debugf("skipped url: %s last head: %s, last get: %s", l.Dst.Url, l.Dst.LastHead, l.Dst.LastGet)
 		}
 	}
 	log.Debugf("enqued %d GET, %d HEAD from %d links for source: %s", gets, heads, len(links), u.Url)
 	return nil
 }
 
+// enqueueRequisite sends a url a page needs to render (images, styles,
+// scripts) straight to the content crawler. requisites share the depth of
+// the page that uses them so depth limits never leave a page half-archived,
+// & are fetched from any host unless a crawling source's scope excludes them
+func enqueueRequisite(u *core.Url, depth int) (bool, error) {
+	dst, err := u.ParsedUrl()
+	if err != nil {
+		return false, nil
+	}
+	if sc := scopeForUrl(dst.String()); sc != nil && !sc.Contains(dst) {
+		log.Debugf("skipped requisite: %s out of scope for source: %s", u.Url, sc.Source.Url)
+		return false, nil
+	}
+	if !shouldEnqueueGet(u) {
+		return false, nil
+	}
+	return frontier.Enqueue(crawlerContent, "GET", u.Url, priorityRequisite, depth, time.Now())
+}
+
 // stopHandler stops the fetcher if the stopurl is reached. Otherwise it dispatches
 // the call to the wrapped Handler.
 func stopHandler(stopurl string, cancel bool, wrapped fetchbot.Handler) fetchbot.Handler {
@@ -325,11 +462,37 @@ func logHandler(crawlerId string, wrapped fetchbot.Handler) fetchbot.Handler {
 	return fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
 		if err == nil {
 			log.Infof("[%d] %s %s %s - %s", res.StatusCode, ctx.Cmd.Method(), crawlerId, ctx.Cmd.URL(), res.Header.Get("Content-Type"))
+			if res.StatusCode < 400 {
+				fetchSucceeded(crawlerId)
+			}
 		}
 		wrapped.Handle(ctx, res, err)
 	})
 }
 
+// statusHandler routes failed responses. statuses worth retrying are
+// recorded as failures without reaching wrapped, any other 4xx response is
+// handled as usual & then marked as a permanent failure
+func statusHandler(wrapped fetchbot.Handler) fetchbot.Handler {
+	return fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
+		if err != nil || res == nil {
+			wrapped.Handle(ctx, res, err)
+			return
+		}
+
+		if retryStatus(res.StatusCode) {
+			res.Body.Close()
+			failUrl(ctx.Cmd.URL().String(), NewStatusError(res))
+			return
+		}
+
+		wrapped.Handle(ctx, res, err)
+		if failureStatus(res.StatusCode) {
+			failUrl(ctx.Cmd.URL().String(), NewStatusError(res))
+		}
+	})
+}
+
 // memStats prints off this server's current memory statistics
 func memStats(di *fetchbot.DebugInfo) []byte {
 	var mem runtime.MemStats
@@ -348,18 +511,50 @@ func memStats(di *fetchbot.DebugInfo) []byte {
 	return buf.Bytes()
 }
 
-// enquedUrls lists out all urls currently in the que in no particular order
-// TODO - order based on position within the que, or at least confirm that
-// the order is in fact random
-func enquedUrls() []byte {
+// enquedUrls lists out urls currently in the frontier, in the order
+// they'll be leased
+func enquedUrls(limit, offset int) ([]byte, error) {
+	entries, err := frontier.List(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString("Enqued Urls:\n")
-	i := 1
-	for u, v := range enqued {
-		if v != "" {
-			buf.WriteString(fmt.Sprintf("%d - %s - %s\n", i, v, u))
-			i++
+	for i, e := range entries {
+		buf.WriteString(fmt.Sprintf("%d - %s %s - %s - %s\n", offset+i+1, e.Crawler, e.Method, e.State, e.Url))
+	}
+	return buf.Bytes(), nil
+}
+
+// ackGet marks a GET of requested finished in the frontier & updates
+// revisit schedules. u is the url that answered, which is only different
+// from requested if the GET was redirected
+func ackGet(requested, u *core.Url) {
+	if err := frontier.Ack(requested.Url); err != nil {
+		log.Infof("frontier ack error: %s - %s", requested.Url, err)
+	}
+	if err := updateRevisit(appDB, u); err != nil {
+		log.Infof("revisit update error: %s - %s", u.Url, err)
+	}
+	if requested != u {
+		if err := updateRevisit(appDB, requested); err != nil {
+			log.Infof("revisit update error: %s - %s", requested.Url, err)
 		}
 	}
-	return buf.Bytes()
 }
+
+// ackHandler marks any response it receives as finished in the frontier,
+// recording any redirects that led to it
+var ackHandler = fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
+	if len(redirectsFor(res)) > 0 {
+		if u, err := readOrCreateUrl(ctx.Cmd.URL().String()); err != nil {
+			log.Infof("url read error: %s - %s", ctx.Cmd.URL(), err)
+		} else if _, err := handleRedirects(appDB, u, res); err != nil {
+			log.Infof("redirect error: %s - %s", ctx.Cmd.URL(), err)
+		}
+	}
+	if err := frontier.Ack(ctx.Cmd.URL().String()); err != nil {
+		log.Infof("frontier ack error: %s - %s", ctx.Cmd.URL(), err)
+	}
+})
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/datatogether/core"
 	"time"
 )
 
@@ -31,12 +30,12 @@ func StartCron(d time.Duration) (stop func()) {
 // TODO - this currently spins up at least 1Gig of ram to do it's work, need to refactor
 func CalcBasePrimerStats() error {
 	log.Info("[INFO] starting base primer stat calculation")
-	ps, err := core.BasePrimers(appDB, 100, 0)
+	ps, err := basePrimers(store, 100, 0)
 	if err != nil {
 		return err
 	}
 	for _, p := range ps {
-		if err := p.CalcStats(appDB); err != nil {
+		if err := calcPrimerStats(store, p); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"github.com/datatogether/ffi"
+	"github.com/multiformats/go-multihash"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// sniffLen is the number of bytes http.DetectContentType considers
+const sniffLen = 512
+
+// Download is a response body spooled to a temp file instead of memory.
+// The body is hashed as it's written, so nothing ever needs to hold the
+// whole thing at once
+type Download struct {
+	// temp file holding the body
+	File *os.File
+	// number of bytes written
+	Size int64
+	// hex-encoded sha2-256 multihash of the body, same as core.CalcHash
+	Hash string
+	// sha1 digest of the body in WARC-Payload-Digest form
+	PayloadDigest string
+	// content type sniffed from the first 512 bytes
+	Sniff string
+	// true if the body was cut off at the size limit
+	Truncated bool
+
+	maxSize int64
+	sha     hash.Hash
+	sha1    hash.Hash
+	sniff   *prefixWriter
+}
+
+// NewDownload copies r to a temp file, reading at most maxSize bytes. A
+// maxSize of 0 or less reads all of r. Callers must Close the download
+// to remove the temp file
+func NewDownload(r io.Reader, maxSize int64) (*Download, error) {
+	d, err := newDownload(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.copyFrom(r); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if err := d.finish(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// newDownload creates an empty download backed by a new temp file
+func newDownload(maxSize int64) (*Download, error) {
+	f, err := ioutil.TempFile("", "sentry-download-")
+	if err != nil {
+		return nil, err
+	}
+	d := &Download{File: f, maxSize: maxSize}
+	d.reset()
+	return d, nil
+}
+
+// reset clears any hashing state, for a download that's been
+// truncated to start over
+func (d *Download) reset() {
+	d.Size = 0
+	d.Truncated = false
+	d.sha = sha256.New()
+	d.sha1 = sha1.New()
+	d.sniff = &prefixWriter{limit: sniffLen}
+}
+
+// restart throws away everything written so far
+func (d *Download) restart() error {
+	if err := d.File.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.reset()
+	return nil
+}
+
+// copyFrom appends r to the download, up to the size limit. If reading r
+// fails partway through everything read so far is kept, so the download
+// can carry on from where it left off
+func (d *Download) copyFrom(r io.Reader) error {
+	w := io.MultiWriter(d.File, d.sha, d.sha1, d.sniff)
+	if d.maxSize <= 0 {
+		n, err := io.Copy(w, r)
+		d.Size += n
+		return err
+	}
+
+	n, err := io.Copy(w, io.LimitReader(r, d.maxSize-d.Size))
+	d.Size += n
+	if err == nil && d.Size >= d.maxSize {
+		// read one past the limit to tell a body of exactly maxSize bytes
+		// from one that's been cut off
+		d.Truncated = hasMore(r)
+	}
+	return err
+}
+
+// maxEmptyReads is the number of reads in a row that can return nothing
+// before hasMore gives up, matching bufio's limit
+const maxEmptyReads = 100
+
+// hasMore reports weather r has at least one more byte to read. readers
+// are allowed to return (0, nil), which says nothing about what's left, so
+// it keeps trying until it gets a byte or an error
+func hasMore(r io.Reader) bool {
+	b := make([]byte, 1)
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := r.Read(b)
+		if n > 0 {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// finish calculates hashes once the whole body is written & rewinds the file
+func (d *Download) finish() error {
+	mh, err := multihash.Encode(d.sha.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return err
+	}
+	d.Hash = hex.EncodeToString(mh)
+	d.PayloadDigest = "sha1:" + base32.StdEncoding.EncodeToString(d.sha1.Sum(nil))
+	d.Sniff = http.DetectContentType(d.sniff.buf)
+
+	_, err = d.File.Seek(0, io.SeekStart)
+	return err
+}
+
+// handleDownloadResponse is a streaming stand-in for handleGetResponse, for
+// responses that won't be parsed for links. The body is spooled to disk,
+// capped at the size limit for u, passed to storeBlob, & u is updated, saved
+// & snapshotted. Interrupted transfers are resumed with client. Callers must
+// Close the returned download
+func handleDownloadResponse(db *sql.DB, client fetchbot.Doer, u *core.Url, res *http.Response) (*Download, error) {
+	d, err := fetchDownload(client, res, maxContentSize(u.Url))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	u.Status = res.StatusCode
+	u.ContentLength = d.Size
+	u.ContentType = res.Header.Get("Content-Type")
+	u.ContentSniff = d.Sniff
+	u.Headers = rawHeadersSlice(res)
+	u.Hash = d.Hash
+	u.LastGet = &now
+	if u.SuspectedContentUrl() {
+		if filename, err := ffi.FilenameFromUrlString(u.Url); err == nil {
+			u.FileName = filename
+		}
+	}
+
+	s := newSnapshot(u)
+	s.Truncated = d.Truncated
+	if r, err := d.Reader(); err != nil {
+		log.Infof("content storage error: %s - %s", u.Url, err)
+	} else if s.Cid, err = storeBlob(u, r); err != nil {
+		log.Infof("content storage error: %s - %s", u.Url, err)
+	}
+	if err := saveGet(db, u, s); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// maxContentSize gives the largest body to download for rawurl in bytes,
+// 0 meaning unlimited
+func maxContentSize(rawurl string) int64 {
+	switch set := settingsForUrl(rawurl); {
+	case set.MaxContentSize < 0:
+		return 0
+	case set.MaxContentSize > 0:
+		return set.MaxContentSize
+	}
+	return int64(cfg.MaxContentSizeMb) * 1024 * 1024
+}
+
+// WarcPayload rewinds the download for archiving
+func (d *Download) WarcPayload() (*WarcPayload, error) {
+	r, err := d.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &WarcPayload{Body: r, Size: d.Size, Digest: d.PayloadDigest, Truncated: d.Truncated}, nil
+}
+
+// Reader rewinds the download & returns it for reading
+func (d *Download) Reader() (io.ReadSeeker, error) {
+	if _, err := d.File.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return d.File, nil
+}
+
+// Close removes the temp file
+func (d *Download) Close() error {
+	d.File.Close()
+	return os.Remove(d.File.Name())
+}
+
+// prefixWriter keeps the first limit bytes written to it, discarding the rest
+type prefixWriter struct {
+	limit int
+	buf   []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if rest := p.limit - len(p.buf); rest > 0 {
+		if len(b) < rest {
+			rest = len(b)
+		}
+		p.buf = append(p.buf, b[:rest]...)
+	}
+	return len(b), nil
+}
+
+// limitedBody caps the number of bytes read from a response body,
+// recording weather anything was left over. It lets in-memory response
+// handling enforce the same size limits as downloads
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	Truncated bool
+}
+
+// limitBody wraps res.Body to stop reading after maxSize bytes. a maxSize
+// of 0 or less leaves the body unlimited
+func limitBody(res *http.Response, maxSize int64) *limitedBody {
+	lb := &limitedBody{ReadCloser: res.Body, remaining: maxSize}
+	if maxSize > 0 {
+		res.Body = lb
+	}
+	return lb
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// peek to see if the body really is longer than the limit
+		if !l.Truncated && hasMore(l.ReadCloser) {
+			l.Truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/datatogether/core"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDownload(t *testing.T) {
+	cases := []struct {
+		body      string
+		maxSize   int64
+		expect    string
+		truncated bool
+		sniff     string
+	}{
+		{"", 0, "", false, "text/plain; charset=utf-8"},
+		{"<html><body>hi</body></html>", 0, "<html><body>hi</body></html>", false, "text/html; charset=utf-8"},
+		{"hello world", 5, "hello", true, "text/plain; charset=utf-8"},
+		{"hello", 5, "hello", false, "text/plain; charset=utf-8"},
+		{"%PDF-1.4 " + strings.Repeat("a", sniffLen*2), -1, "%PDF-1.4 " + strings.Repeat("a", sniffLen*2), false, "application/pdf"},
+	}
+
+	for i, c := range cases {
+		d, err := NewDownload(strings.NewReader(c.body), c.maxSize)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+
+		data, err := ioutil.ReadAll(d.File)
+		if err != nil {
+			t.Errorf("case %d read error: %s", i, err.Error())
+		}
+		if string(data) != c.expect {
+			t.Errorf("case %d body mismatch. expected: %q, got: %q", i, c.expect, string(data))
+		}
+		if d.Size != int64(len(c.expect)) {
+			t.Errorf("case %d size mismatch. expected: %d, got: %d", i, len(c.expect), d.Size)
+		}
+		if d.Truncated != c.truncated {
+			t.Errorf("case %d truncated mismatch. expected: %t, got: %t", i, c.truncated, d.Truncated)
+		}
+		if d.Sniff != c.sniff {
+			t.Errorf("case %d sniff mismatch. expected: %s, got: %s", i, c.sniff, d.Sniff)
+		}
+		if hash, _ := core.CalcHash([]byte(c.expect)); d.Hash != hash {
+			t.Errorf("case %d hash mismatch. expected: %s, got: %s", i, hash, d.Hash)
+		}
+		if digest := warcDigest([]byte(c.expect)); d.PayloadDigest != digest {
+			t.Errorf("case %d payload digest mismatch. expected: %s, got: %s", i, digest, d.PayloadDigest)
+		}
+
+		if err := d.Close(); err != nil {
+			t.Errorf("case %d close error: %s", i, err.Error())
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	cases := []struct {
+		body      string
+		maxSize   int64
+		expect    string
+		truncated bool
+	}{
+		{"hello world", 0, "hello world", false},
+		{"hello world", 5, "hello", true},
+		{"hello", 5, "hello", false},
+		{"hello", 10, "hello", false},
+	}
+
+	for i, c := range cases {
+		res := &http.Response{Body: ioutil.NopCloser(strings.NewReader(c.body))}
+		lb := limitBody(res, c.maxSize)
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if string(data) != c.expect {
+			t.Errorf("case %d body mismatch. expected: %q, got: %q", i, c.expect, string(data))
+		}
+		if lb.Truncated != c.truncated {
+			t.Errorf("case %d truncated mismatch. expected: %t, got: %t", i, c.truncated, lb.Truncated)
+		}
+	}
+}
+
+// stallingReader returns (0, nil) stalls times before every read that
+// returns data, which io.Reader allows
+type stallingReader struct {
+	r      io.Reader
+	stalls int
+	count  int
+}
+
+func (s *stallingReader) Read(p []byte) (int, error) {
+	if s.count < s.stalls {
+		s.count++
+		return 0, nil
+	}
+	s.count = 0
+	return s.r.Read(p)
+}
+
+func TestTruncationEmptyReads(t *testing.T) {
+	cases := []struct {
+		body      string
+		maxSize   int64
+		truncated bool
+	}{
+		{"hello world", 5, true},
+		{"hello", 5, false},
+	}
+
+	for i, c := range cases {
+		res := &http.Response{Body: ioutil.NopCloser(&stallingReader{r: strings.NewReader(c.body), stalls: 3})}
+		lb := limitBody(res, c.maxSize)
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if lb.Truncated != c.truncated {
+			t.Errorf("case %d limitBody truncated mismatch. expected: %t, got: %t", i, c.truncated, lb.Truncated)
+		}
+
+		d, err := NewDownload(&stallingReader{r: strings.NewReader(c.body), stalls: 3}, c.maxSize)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if d.Truncated != c.truncated {
+			t.Errorf("case %d download truncated mismatch. expected: %t, got: %t", i, c.truncated, d.Truncated)
+		}
+		d.Close()
+	}
+}
+
+func TestHandleDownloadResponse(t *testing.T) {
+	prev := cfg.MaxContentSizeMb
+	cfg.MaxContentSizeMb = 1
+	defer func() { cfg.MaxContentSizeMb = prev }()
+
+	large := bytes.Repeat([]byte("a"), 1024*1024+10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.csv" {
+			w.Write(large)
+			return
+		}
+		fmt.Fprint(w, "a,b,c\n1,2,3\n")
+	}))
+	defer s.Close()
+
+	cases := []struct {
+		path      string
+		size      int64
+		truncated bool
+	}{
+		{"/small.csv", 12, false},
+		{"/large.csv", 1024 * 1024, true},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: s.URL + c.path}
+		if err := u.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		res, err := http.Get(u.Url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		d, err := handleDownloadResponse(appDB, http.DefaultClient, u, res)
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		d.Close()
+
+		if u.ContentLength != c.size {
+			t.Errorf("case %d content length mismatch. expected: %d, got: %d", i, c.size, u.ContentLength)
+		}
+		if u.Hash != d.Hash || u.LastGet == nil {
+			t.Errorf("case %d: expected url hash & last get to be set", i)
+			continue
+		}
+
+		var (
+			hash      string
+			truncated bool
+		)
+		created := u.LastGet.In(time.UTC).Round(time.Second)
+		if err := appDB.QueryRow("select hash, truncated from snapshots where url = $1 and created = $2", u.Url, created).Scan(&hash, &truncated); err != nil {
+			t.Errorf("case %d error reading snapshot: %s", i, err.Error())
+			continue
+		}
+		if hash != d.Hash {
+			t.Errorf("case %d snapshot hash mismatch. expected: %s, got: %s", i, d.Hash, hash)
+		}
+		if truncated != c.truncated {
+			t.Errorf("case %d snapshot truncated mismatch. expected: %t, got: %t", i, c.truncated, truncated)
+		}
+	}
+}
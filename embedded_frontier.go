@@ -0,0 +1,362 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"sort"
+	"time"
+)
+
+// an embedded frontier keeps entries in an EmbeddedStore, indexed by state.
+// only one process uses it, so there are no host claims & the frontier's
+// lock stands in for the row locks the frontier table relies on. lease
+// renewals are kept in memory instead of being written on every heartbeat,
+// a restarted process recovers it's leases without them
+
+// frontierKey gives the embedded store key for rawurl's entry
+func frontierKey(rawurl string) datastore.Key {
+	return embeddedKey("FrontierEntry", rawurl)
+}
+
+// pendingState gives the state an entry waiting for method is in
+func pendingState(method string) FrontierState {
+	if method == "GET" {
+		return FrontierPendingGet
+	}
+	return FrontierPendingHead
+}
+
+// readEntry reads rawurl's entry, returning core.ErrNotFound if the frontier
+// hasn't seen it
+func (f *Frontier) readEntry(rawurl string) (*FrontierEntry, error) {
+	v, err := f.Store.Get(frontierKey(rawurl))
+	if err == datastore.ErrNotFound {
+		return nil, core.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return v.(*FrontierEntry), nil
+}
+
+// entriesIn lists entries in any of states, highest priority first
+func (f *Frontier) entriesIn(states ...FrontierState) ([]*FrontierEntry, error) {
+	entries := []*FrontierEntry{}
+	for _, state := range states {
+		found, err := f.Store.lookup("frontier.state", string(state))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range found {
+			entries = append(entries, v.(*FrontierEntry))
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].NextEligible.Before(entries[j].NextEligible)
+	})
+	return entries, nil
+}
+
+// leaseExpires gives when e's lease runs out, counting heartbeat renewals.
+// callers must hold f.lock
+func (f *Frontier) leaseExpires(e *FrontierEntry) *time.Time {
+	if at, ok := f.renewed[e.Url]; ok {
+		return &at
+	}
+	return e.LeaseExpires
+}
+
+// release clears the lease on e
+func (e *FrontierEntry) release() {
+	e.LeaseOwner = ""
+	e.LeaseExpires = nil
+}
+
+// updateEntry changes rawurl's entry with fn, saving it if fn returns true.
+// urls the frontier hasn't seen are left alone
+func (f *Frontier) updateEntry(rawurl string, fn func(e *FrontierEntry, now time.Time) bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	e, err := f.readEntry(rawurl)
+	if err == core.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := time.Now().In(time.UTC)
+	if !fn(e, now) {
+		return nil
+	}
+	e.Updated = now
+	delete(f.renewed, e.Url)
+	return f.Store.Put(frontierKey(e.Url), e)
+}
+
+// updateInFlight changes every in-flight entry with fn, saving the ones fn
+// returns true for
+func (f *Frontier) updateInFlight(fn func(e *FrontierEntry, now time.Time) bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	entries, err := f.entriesIn(FrontierInFlight)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(time.UTC)
+	for _, e := range entries {
+		if !fn(e, now) {
+			continue
+		}
+		e.Updated = now
+		delete(f.renewed, e.Url)
+		if err := f.Store.Put(frontierKey(e.Url), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embeddedEnqueue adds or re-adds rawurl. like qFrontierEnqueue, only urls
+// that are finished, or failed without being dead, go back in
+func (f *Frontier) embeddedEnqueue(crawler, method, rawurl, host string, state FrontierState, priority, depth int, eligible, now time.Time) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	e, err := f.readEntry(rawurl)
+	if err == core.ErrNotFound {
+		e = &FrontierEntry{Url: rawurl, Created: now, Host: host, Depth: depth}
+	} else if err != nil {
+		return false, err
+	} else {
+		switch e.State {
+		case FrontierDone:
+		case FrontierFailed:
+			failure := &UrlFailure{}
+			if v, err := f.Store.Get(failureKey(rawurl)); err == nil {
+				failure = v.(*UrlFailure)
+			} else if err != datastore.ErrNotFound {
+				return false, err
+			}
+			if failure.Dead {
+				return false, nil
+			}
+		default:
+			return false, nil
+		}
+		if depth < e.Depth {
+			e.Depth = depth
+		}
+	}
+
+	e.Updated = now
+	e.Crawler = crawler
+	e.Method = method
+	e.State = state
+	e.Priority = priority
+	e.NextEligible = eligible
+	e.release()
+	e.Attempts = 0
+	e.LastError = ""
+	return true, f.Store.Put(frontierKey(rawurl), e)
+}
+
+// embeddedPromote moves a pending rawurl to crawler at a higher priority
+func (f *Frontier) embeddedPromote(crawler, method, rawurl string, state FrontierState, priority, depth int, eligible time.Time) (moved bool, err error) {
+	err = f.updateEntry(rawurl, func(e *FrontierEntry, now time.Time) bool {
+		if (e.State != FrontierPendingHead && e.State != FrontierPendingGet) || e.Priority >= priority {
+			return false
+		}
+		e.Crawler = crawler
+		e.Method = method
+		e.State = state
+		e.Priority = priority
+		if eligible.Before(e.NextEligible) {
+			e.NextEligible = eligible
+		}
+		if depth < e.Depth {
+			e.Depth = depth
+		}
+		moved = true
+		return true
+	})
+	return moved, err
+}
+
+// embeddedLease marks up to limit eligible entries for crawler as in-flight.
+// in-flight entries with an expired lease are eligible as well
+func (f *Frontier) embeddedLease(crawler string, limit int) ([]*FrontierEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	entries, err := f.entriesIn(FrontierPendingHead, FrontierPendingGet, FrontierInFlight)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(time.UTC)
+	expires := now.Add(f.LeaseDuration)
+	leased := []*FrontierEntry{}
+	for _, e := range entries {
+		if len(leased) == limit {
+			break
+		}
+		if e.Crawler != crawler || e.NextEligible.After(now) {
+			continue
+		}
+		if expires := f.leaseExpires(e); e.State == FrontierInFlight && (expires == nil || !expires.Before(now)) {
+			continue
+		}
+
+		e.State = FrontierInFlight
+		e.LeaseOwner = f.Owner
+		e.LeaseExpires = &expires
+		e.Updated = now
+		e.Attempts++
+		delete(f.renewed, e.Url)
+		if err := f.Store.Put(frontierKey(e.Url), e); err != nil {
+			return nil, err
+		}
+		leased = append(leased, e)
+	}
+	return leased, nil
+}
+
+// embeddedHeartbeat renews the leases this frontier holds & reclaims
+// expired ones. renewals only change f.renewed, nothing is written
+func (f *Frontier) embeddedHeartbeat() error {
+	f.lock.Lock()
+	entries, err := f.entriesIn(FrontierInFlight)
+	if err == nil {
+		if f.renewed == nil {
+			f.renewed = map[string]time.Time{}
+		}
+		expires := time.Now().In(time.UTC).Add(f.LeaseDuration)
+		for _, e := range entries {
+			if e.LeaseOwner == f.Owner {
+				f.renewed[e.Url] = expires
+			}
+		}
+	}
+	f.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.Reclaim()
+}
+
+// embeddedReclaim returns entries with leases that expired before now to
+// the pending pool
+func (f *Frontier) embeddedReclaim(now time.Time) error {
+	return f.updateInFlight(func(e *FrontierEntry, _ time.Time) bool {
+		if expires := f.leaseExpires(e); expires == nil || !expires.Before(now) {
+			return false
+		}
+		e.State = pendingState(e.Method)
+		e.release()
+		return true
+	})
+}
+
+// embeddedAck marks rawurl as done & deletes it's failure record
+func (f *Frontier) embeddedAck(rawurl string) error {
+	err := f.updateEntry(rawurl, func(e *FrontierEntry, now time.Time) bool {
+		e.State = FrontierDone
+		e.release()
+		e.LastError = ""
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Store.Delete(failureKey(rawurl)); err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// embeddedFail marks rawurl as failed with msg
+func (f *Frontier) embeddedFail(rawurl, msg string) error {
+	return f.updateEntry(rawurl, func(e *FrontierEntry, now time.Time) bool {
+		e.State = FrontierFailed
+		e.release()
+		e.LastError = msg
+		return true
+	})
+}
+
+// embeddedRetry sends rawurl back to the pending pool to be tried at
+func (f *Frontier) embeddedRetry(rawurl, msg string, at time.Time) error {
+	return f.updateEntry(rawurl, func(e *FrontierEntry, now time.Time) bool {
+		e.State = pendingState(e.Method)
+		e.release()
+		e.NextEligible = at
+		e.LastError = msg
+		return true
+	})
+}
+
+// embeddedRelease hands an in-flight rawurl back without counting the attempt
+func (f *Frontier) embeddedRelease(rawurl string) error {
+	return f.updateEntry(rawurl, func(e *FrontierEntry, now time.Time) bool {
+		if e.State != FrontierInFlight {
+			return false
+		}
+		e.State = pendingState(e.Method)
+		e.release()
+		if e.Attempts > 0 {
+			e.Attempts--
+		}
+		return true
+	})
+}
+
+// embeddedRecover releases every entry leased under this frontier's owner
+func (f *Frontier) embeddedRecover() error {
+	return f.updateInFlight(func(e *FrontierEntry, now time.Time) bool {
+		if e.LeaseOwner != f.Owner {
+			return false
+		}
+		e.State = pendingState(e.Method)
+		e.release()
+		return true
+	})
+}
+
+// embeddedLeasedCount counts in-flight entries crawler holds
+func (f *Frontier) embeddedLeasedCount(crawler string) (int, error) {
+	entries, err := f.entriesIn(FrontierInFlight)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, e := range entries {
+		if e.Crawler == crawler && e.LeaseOwner == f.Owner {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// embeddedList pages through pending & in-flight entries
+func (f *Frontier) embeddedList(limit, offset int) ([]*FrontierEntry, error) {
+	entries, err := f.entriesIn(FrontierPendingHead, FrontierPendingGet, FrontierInFlight)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	for _, e := range entries {
+		e.LeaseExpires = f.leaseExpires(e)
+	}
+	f.lock.Unlock()
+	if offset >= len(entries) {
+		return []*FrontierEntry{}, nil
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
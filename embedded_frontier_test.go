@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedFrontierEnqueue(t *testing.T) {
+	s, done := useEmbeddedStore(t)
+	defer done()
+	fr := NewEmbeddedFrontier(s, "test-enqueue")
+
+	cases := []struct {
+		method, url string
+		added       bool
+	}{
+		{"HEAD", "http://a.test/one", true},
+		{"GET", "http://a.test/one", false},
+		{"GET", "http://a.test/two", true},
+		{"HEAD", "http://a.test/two", false},
+	}
+
+	for i, c := range cases {
+		added, err := fr.Enqueue(crawlerMain, c.method, c.url, priorityDefault, 2, time.Now())
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if added != c.added {
+			t.Errorf("case %d: %s %s added mismatch. expected: %t, got: %t", i, c.method, c.url, c.added, added)
+		}
+	}
+	if n, err := fr.PendingCount(); err != nil || n != 2 {
+		t.Errorf("expected 2 pending entries, got: %d, %v", n, err)
+	}
+
+	// finished entries can be enqueued again, keeping the shallowest depth
+	if err := fr.Ack("http://a.test/one"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if added, err := fr.Enqueue(crawlerMain, "GET", "http://a.test/one", priorityDefault, 1, time.Now()); err != nil || !added {
+		t.Errorf("expected acked url to be re-enqueued, got: %t, %v", added, err)
+	}
+	if depth, err := fr.Depth("http://a.test/one"); err != nil || depth != 1 {
+		t.Errorf("expected depth 1, got: %d, %v", depth, err)
+	}
+	if _, err := fr.Depth("http://a.test/never-seen"); err != core.ErrNotFound {
+		t.Errorf("expected a url with no frontier history to be not found, got: %v", err)
+	}
+
+	// failed urls only go back in while they aren't dead
+	for _, dead := range []bool{false, true} {
+		if err := fr.Fail("http://a.test/two", fmt.Errorf("boom")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := (&UrlFailure{Url: "http://a.test/two", Dead: dead}).Save(appDB); err != nil {
+			t.Fatal(err.Error())
+		}
+		if added, err := fr.Enqueue(crawlerMain, "GET", "http://a.test/two", priorityDefault, 0, time.Now()); err != nil || added == dead {
+			t.Errorf("dead: %t re-enqueue mismatch. expected: %t, got: %t, %v", dead, !dead, added, err)
+		}
+	}
+}
+
+func TestEmbeddedFrontierLease(t *testing.T) {
+	s, done := useEmbeddedStore(t)
+	defer done()
+	fr := NewEmbeddedFrontier(s, "test-lease")
+
+	entries := []struct {
+		url      string
+		priority int
+		eligible time.Time
+	}{
+		{"http://a.test/low", priorityDefault, time.Now()},
+		{"http://a.test/seed", prioritySeed, time.Now()},
+		{"http://a.test/later", prioritySeed, time.Now().Add(time.Hour)},
+		{"http://b.test/requisite", priorityRequisite, time.Now()},
+	}
+	for _, e := range entries {
+		if _, err := fr.Enqueue(crawlerMain, "GET", e.url, e.priority, 0, e.eligible); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := fr.Enqueue(crawlerContent, "GET", "http://a.test/content", priorityDefault, 0, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if moved, err := fr.Promote(crawlerMain, "GET", "http://a.test/low", priorityCrawlingSource, 0, time.Now()); err != nil || !moved {
+		t.Errorf("expected low priority url to be promoted, got: %t, %v", moved, err)
+	}
+
+	leased, err := fr.Lease(crawlerMain, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := []string{"http://a.test/low", "http://a.test/seed"}
+	if len(leased) != len(expect) {
+		t.Fatalf("expected %d leased entries, got: %d", len(expect), len(leased))
+	}
+	for i, e := range leased {
+		if e.Url != expect[i] || e.State != FrontierInFlight || e.LeaseOwner != fr.Owner || e.Attempts != 1 {
+			t.Errorf("lease %d mismatch. expected: %s, got: %#v", i, expect[i], e)
+		}
+	}
+	if moved, err := fr.Promote(crawlerSeeds, "GET", "http://a.test/seed", priorityCrawlingSource, 0, time.Now()); err != nil || moved {
+		t.Errorf("expected leased url to be left alone, got: %t, %v", moved, err)
+	}
+
+	if n, err := fr.LeasedCount(crawlerMain); err != nil || n != 2 {
+		t.Errorf("expected 2 leased entries, got: %d, %v", n, err)
+	}
+	if err := fr.Release("http://a.test/seed"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fr.Retry("http://a.test/low", fmt.Errorf("503 Service Unavailable"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// released urls don't count the attempt, retried urls wait their turn
+	leased, err = fr.Lease(crawlerMain, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect = []string{"http://a.test/seed", "http://b.test/requisite"}
+	if len(leased) != len(expect) {
+		t.Fatalf("expected %d leased entries, got: %d", len(expect), len(leased))
+	}
+	for i, e := range leased {
+		if e.Url != expect[i] || e.Attempts != 1 {
+			t.Errorf("lease %d mismatch. expected: %s with 1 attempt, got: %s with %d", i, expect[i], e.Url, e.Attempts)
+		}
+	}
+
+	list, err := fr.List(10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != 5 || list[0].Url != "http://a.test/low" {
+		t.Errorf("expected 5 listed entries starting with the promoted url, got: %d", len(list))
+	}
+}
+
+func TestEmbeddedFrontierReclaim(t *testing.T) {
+	s, dir := tempEmbeddedStore(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	fr := NewEmbeddedFrontier(s, "test-reclaim")
+	fr.LeaseDuration = time.Millisecond * 200
+	for i := 0; i < 3; i++ {
+		if _, err := fr.Enqueue(crawlerMain, "HEAD", fmt.Sprintf("http://reclaim.test/%d", i), priorityDefault, 0, time.Now()); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got, err := fr.Lease(crawlerMain, 10); err != nil || len(got) != 3 {
+		t.Fatalf("expected 3 leased entries, got: %d, %v", len(got), err)
+	}
+
+	// heartbeats keep leases alive, without writing to the store
+	path := filepath.Join(dir, embeddedStoreFile)
+	before, _ := os.Stat(path)
+	time.Sleep(time.Millisecond * 120)
+	if err := fr.Heartbeat(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Errorf("expected heartbeat not to write. before: %d bytes, after: %d bytes", before.Size(), after.Size())
+	}
+	time.Sleep(time.Millisecond * 120)
+	if err := fr.Reclaim(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n, err := fr.LeasedCount(crawlerMain); err != nil || n != 3 {
+		t.Errorf("expected heartbeat to keep 3 leases, got: %d, %v", n, err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	if err := fr.Reclaim(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n, err := fr.PendingCount(); err != nil || n != 3 {
+		t.Errorf("expected expired leases to be pending, got: %d, %v", n, err)
+	}
+
+	// a restarted process picks up it's own leases from the store on disk
+	if _, err := fr.Lease(crawlerMain, 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s, err := NewEmbeddedStore(dir); err != nil {
+		t.Fatal(err.Error())
+	} else {
+		defer s.Close()
+		restarted := NewEmbeddedFrontier(s, fr.Owner)
+		if err := restarted.Recover(); err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := restarted.Lease(crawlerMain, 10)
+		if err != nil || len(got) != 3 {
+			t.Fatalf("expected 3 recovered entries, got: %d, %v", len(got), err)
+		}
+		if got[0].Attempts != 3 {
+			t.Errorf("expected 3 attempts, got: %d", got[0].Attempts)
+		}
+	}
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the log file an EmbeddedStore keeps in it's directory
+const embeddedStoreFile = "store.jsonl"
+
+var (
+	// fewest superseded records an open store's log holds before it's
+	// compacted, so small stores aren't rewritten every few writes
+	embeddedCompactMin = 1000
+)
+
+// EmbeddedStore is a datastore.Datastore that persists core models & sentry's
+// crawl state without a database server. every write is appended to a log file as a line of
+// json & replayed into memory on open, so reads never touch disk. the log
+// is compacted once superseded records outnumber live ones, on open & as
+// it's written to.
+//
+// core's sql_datastore answers lookups by url, hash & subject with queries,
+// EmbeddedStore keeps in-memory indexes for them instead, see readUrl,
+// writeSnapshot & writeMetadata
+type EmbeddedStore struct {
+	lock sync.RWMutex
+	path string
+	file *os.File
+	// registered model types by datastore type name
+	types map[string]reflect.Type
+	// live values by key string
+	entries map[string]*embeddedEntry
+	// index name -> indexed value -> set of keys
+	indexes map[string]map[string]map[string]bool
+	// number of writes, orders query results
+	seq int64
+	// number of log records that have been superseded
+	dead int
+}
+
+// embeddedEntry is a live value
+type embeddedEntry struct {
+	// sequence number of the key's first write
+	seq  int64
+	data json.RawMessage
+	// values this entry is indexed under, by index name
+	indexed map[string]string
+}
+
+// embeddedRecord is a single line in the log
+type embeddedRecord struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// NewEmbeddedStore opens the store kept in dir, creating it if it doesn't
+// exist. core's Url, Link, Primer, Source & Metadata models are registered,
+// along with sentry's Snapshot & the crawl state sentry keeps
+func NewEmbeddedStore(dir string) (*EmbeddedStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &EmbeddedStore{
+		path:    filepath.Join(dir, embeddedStoreFile),
+		types:   map[string]reflect.Type{},
+		entries: map[string]*embeddedEntry{},
+		indexes: map[string]map[string]map[string]bool{},
+	}
+	s.Register(&core.Url{}, &core.Link{}, &core.Primer{}, &core.Source{}, &Snapshot{}, &core.Metadata{})
+	s.Register(&FrontierEntry{}, &UrlFailure{}, &RedirectHop{}, &SourceSettingsRecord{}, &Revisit{}, &WarcOriginal{})
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if s.dead > len(s.entries) {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.openLog(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openLog opens the log for appending
+func (s *EmbeddedStore) openLog() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+// Register adds model types the store can hand back from Get & Query.
+// models must be struct pointers, & are stored under keys named by their
+// type, eg: "/Url:<id>"
+func (s *EmbeddedStore) Register(models ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range models {
+		t := reflect.TypeOf(m).Elem()
+		s.types[t.Name()] = t
+	}
+}
+
+// load replays the log into memory
+func (s *EmbeddedStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var size int64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 && data[len(data)-1] == '\n' {
+			rec := &embeddedRecord{}
+			if jerr := json.Unmarshal(data, rec); jerr != nil {
+				return fmt.Errorf("%s line %d: %s", s.path, line, jerr)
+			}
+			if aerr := s.apply(rec); aerr != nil {
+				return fmt.Errorf("%s line %d: %s", s.path, line, aerr)
+			}
+			size += int64(len(data))
+		} else if len(data) > 0 {
+			// a write was cut off part way, drop it so appends start on
+			// a fresh line
+			log.Infof("%s: dropping incomplete record at line %d", s.path, line)
+			return os.Truncate(s.path, size)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log with only live values. the new log is written to
+// a temp file & moved into place, so a failed compaction loses nothing
+func (s *EmbeddedStore) compact() error {
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.entries[keys[i]].seq < s.entries[keys[j]].seq })
+
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, key := range keys {
+		data, err := json.Marshal(&embeddedRecord{Key: key, Value: s.entries[key].data})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.dead = 0
+	return nil
+}
+
+// apply updates in-memory state with a record
+func (s *EmbeddedStore) apply(rec *embeddedRecord) error {
+	prev := s.entries[rec.Key]
+	if prev != nil {
+		s.unindex(rec.Key, prev)
+		s.dead++
+	}
+
+	if rec.Deleted {
+		delete(s.entries, rec.Key)
+		s.dead++
+		return nil
+	}
+
+	v, err := s.decode(datastore.NewKey(rec.Key), rec.Value)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	e := &embeddedEntry{seq: s.seq, data: rec.Value, indexed: embeddedIndexValues(v)}
+	if prev != nil {
+		e.seq = prev.seq
+	}
+	s.entries[rec.Key] = e
+	s.index(rec.Key, e)
+	return nil
+}
+
+// write appends a record to the log & applies it
+func (s *EmbeddedStore) write(rec *embeddedRecord) error {
+	if s.file == nil {
+		return fmt.Errorf("embedded store is closed")
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := s.apply(rec); err != nil {
+		return err
+	}
+
+	if s.dead > len(s.entries) && s.dead >= embeddedCompactMin {
+		if err := s.compactOpen(); err != nil {
+			log.Infof("%s: compaction error: %s", s.path, err)
+		}
+	}
+	return nil
+}
+
+// compactOpen compacts the log of an open store. compact moves a new log
+// into place, so the log is closed first & reopened after. the record that
+// triggered compaction is already written, a failed compaction is only an
+// error for the next write if the log can't be reopened
+func (s *EmbeddedStore) compactOpen() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	cerr := s.compact()
+	if err := s.openLog(); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// modelType gives the registered type name for a key, the part of it's
+// last namespace before the first colon
+func modelType(key datastore.Key) string {
+	return strings.SplitN(key.BaseNamespace(), ":", 2)[0]
+}
+
+// decode reads data into a new value of the type registered for key
+func (s *EmbeddedStore) decode(key datastore.Key, data json.RawMessage) (interface{}, error) {
+	t, ok := s.types[modelType(key)]
+	if !ok {
+		return nil, datastore.ErrInvalidType
+	}
+	v := reflect.New(t).Interface()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// embeddedIndexValues lists the values a model is looked up by
+func embeddedIndexValues(v interface{}) map[string]string {
+	idx := map[string]string{}
+	switch m := v.(type) {
+	case *core.Url:
+		idx["url"] = m.Url
+		idx["url.hash"] = m.Hash
+	case *core.Source:
+		idx["source.url"] = m.Url
+	case *core.Link:
+		if m.Src != nil {
+			idx["link.src"] = m.Src.Url
+		}
+		if m.Dst != nil {
+			idx["link.dst"] = m.Dst.Url
+		}
+	case *Snapshot:
+		idx["snapshot.url"] = m.Url
+	case *core.Metadata:
+		idx["metadata.subject"] = m.Subject
+	case *FrontierEntry:
+		idx["frontier.state"] = string(m.State)
+	case *RedirectHop:
+		idx["redirect.url"] = m.Url
+		idx["redirect.src"] = m.Src
+		idx["redirect.dst"] = m.Dst
+	}
+	for name, value := range idx {
+		if value == "" {
+			delete(idx, name)
+		}
+	}
+	return idx
+}
+
+func (s *EmbeddedStore) index(key string, e *embeddedEntry) {
+	for name, value := range e.indexed {
+		if s.indexes[name] == nil {
+			s.indexes[name] = map[string]map[string]bool{}
+		}
+		if s.indexes[name][value] == nil {
+			s.indexes[name][value] = map[string]bool{}
+		}
+		s.indexes[name][value][key] = true
+	}
+}
+
+func (s *EmbeddedStore) unindex(key string, e *embeddedEntry) {
+	for name, value := range e.indexed {
+		keys := s.indexes[name][value]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.indexes[name], value)
+		}
+	}
+}
+
+// Put stores value under key. value must be a registered model type.
+// like the urls & sources tables, url strings are unique to one key
+func (s *EmbeddedStore) Put(key datastore.Key, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.types[modelType(key)]; !ok {
+		return datastore.ErrInvalidType
+	}
+	for name, value := range embeddedIndexValues(value) {
+		if name != "url" && name != "source.url" {
+			continue
+		}
+		for k := range s.indexes[name][value] {
+			if k != key.String() {
+				return fmt.Errorf("%s '%s' already exists", name, value)
+			}
+		}
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.write(&embeddedRecord{Key: key.String(), Value: data})
+}
+
+// Get reads the value for key
+func (s *EmbeddedStore) Get(key datastore.Key) (interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e := s.entries[key.String()]
+	if e == nil {
+		return nil, datastore.ErrNotFound
+	}
+	return s.decode(key, e.data)
+}
+
+// Has checks for a value for key
+func (s *EmbeddedStore) Has(key datastore.Key) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.entries[key.String()] != nil, nil
+}
+
+// Delete removes the value for key
+func (s *EmbeddedStore) Delete(key datastore.Key) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.entries[key.String()] == nil {
+		return datastore.ErrNotFound
+	}
+	return s.write(&embeddedRecord{Key: key.String(), Deleted: true})
+}
+
+// Query lists values from most to least recently created. a q.Prefix
+// without a leading slash is a model type, which is how core's list funcs
+// query, eg: "Source"
+func (s *EmbeddedStore) Query(q query.Query) (query.Results, error) {
+	s.lock.RLock()
+	prefix := q.Prefix
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = modelPrefix(prefix)
+	}
+	keys := s.keysWithPrefix(prefix)
+	entries, err := s.queryEntries(keys, q.KeysOnly)
+	s.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// filters & orders are applied in memory. offset & limit are applied
+	// here, NaiveQueryApply's limit is broken
+	var res query.Results = query.ResultsWithEntries(q, entries)
+	for _, f := range q.Filters {
+		res = query.NaiveFilter(res, f)
+	}
+	for _, o := range q.Orders {
+		res = query.NaiveOrder(res, o)
+	}
+	if q.Offset == 0 && q.Limit == 0 {
+		return res, nil
+	}
+
+	all, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	if q.Offset >= len(all) {
+		all = nil
+	} else {
+		all = all[q.Offset:]
+	}
+	if q.Limit > 0 && len(all) > q.Limit {
+		all = all[:q.Limit]
+	}
+	return query.ResultsWithEntries(q, all), nil
+}
+
+// modelPrefix gives the key prefix all values of a model type share
+func modelPrefix(model string) string {
+	return "/" + model + ":"
+}
+
+// keysWithPrefix lists keys starting with prefix, from most to least
+// recently created
+func (s *EmbeddedStore) keysWithPrefix(prefix string) []string {
+	keys := []string{}
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	s.sortKeys(keys)
+	return keys
+}
+
+// sortKeys orders keys from most to least recently created
+func (s *EmbeddedStore) sortKeys(keys []string) {
+	sort.Slice(keys, func(i, j int) bool { return s.entries[keys[i]].seq > s.entries[keys[j]].seq })
+}
+
+// queryEntries reads keys into query entries
+func (s *EmbeddedStore) queryEntries(keys []string, keysOnly bool) ([]query.Entry, error) {
+	entries := make([]query.Entry, len(keys))
+	for i, key := range keys {
+		entries[i].Key = key
+		if keysOnly {
+			continue
+		}
+		v, err := s.decode(datastore.NewKey(key), s.entries[key].data)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Value = v
+	}
+	return entries, nil
+}
+
+// lookup gives the values indexed under name with value, from most to
+// least recently created
+func (s *EmbeddedStore) lookup(name, value string) ([]interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]string, 0, len(s.indexes[name][value]))
+	for key := range s.indexes[name][value] {
+		keys = append(keys, key)
+	}
+	s.sortKeys(keys)
+	return s.values(keys)
+}
+
+// count gives the number of values indexed under name with value
+func (s *EmbeddedStore) count(name, value string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.indexes[name][value])
+}
+
+// list gives values of a model type that keep returns true for, from most
+// to least recently created. limit & offset page through the kept values,
+// a limit of 0 is no limit
+func (s *EmbeddedStore) list(model string, limit, offset int, keep func(v interface{}) bool) ([]interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	values := []interface{}{}
+	for _, key := range s.keysWithPrefix(modelPrefix(model)) {
+		v, err := s.decode(datastore.NewKey(key), s.entries[key].data)
+		if err != nil {
+			return nil, err
+		}
+		if !keep(v) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		values = append(values, v)
+		if limit > 0 && len(values) == limit {
+			break
+		}
+	}
+	return values, nil
+}
+
+// values decodes the values for keys
+func (s *EmbeddedStore) values(keys []string) ([]interface{}, error) {
+	entries, err := s.queryEntries(keys, false)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(entries))
+	for i, e := range entries {
+		values[i] = e.Value
+	}
+	return values, nil
+}
+
+// Close flushes the log to disk & closes it
+func (s *EmbeddedStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+// Ping errors if the store has been closed
+func (s *EmbeddedStore) Ping() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("embedded store is closed")
+	}
+	_, err := s.file.Stat()
+	return err
+}
+
+// IsThreadSafe marks EmbeddedStore as a datastore.ThreadSafeDatastore
+func (s *EmbeddedStore) IsThreadSafe() {}
+
+// NewStore creates the datastore core models are kept in, as configured
+// by cfg.Store
+func NewStore(cfg *config) (datastore.Datastore, error) {
+	switch cfg.Store {
+	case "", "postgres":
+		return sql_datastore.DefaultStore, nil
+	case "embedded":
+		if cfg.StoreDir == "" {
+			return nil, fmt.Errorf("STORE_DIR must be set to use an embedded store")
+		}
+		return NewEmbeddedStore(cfg.StoreDir)
+	default:
+		return nil, fmt.Errorf("unknown store: '%s'", cfg.Store)
+	}
+}
+
+// readUrl reads u by id, or by url string or hash if it has no id. core
+// only supports reading by url string from an sql store
+func readUrl(store datastore.Datastore, u *core.Url) error {
+	es, ok := store.(*EmbeddedStore)
+	if !ok || u.Id != "" {
+		return u.Read(store)
+	}
+
+	for _, idx := range []struct{ name, value string }{{"url", u.Url}, {"url.hash", u.Hash}} {
+		if idx.value == "" {
+			continue
+		}
+		found, err := es.lookup(idx.name, idx.value)
+		if err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			*u = *found[0].(*core.Url)
+			return nil
+		}
+	}
+	return core.ErrNotFound
+}
+
+// embeddedKey gives the key for the value of a model type with id. ids
+// are hashed, so any string, like a url, can be used as one
+func embeddedKey(model, id string) datastore.Key {
+	sum := sha256.Sum256([]byte(id))
+	return datastore.NewKey(model + ":" + hex.EncodeToString(sum[:]))
+}
+
+// snapshotKey gives the embedded store key for a snapshot, unique to it's
+// url & creation time
+func snapshotKey(s *core.Snapshot) datastore.Key {
+	return embeddedKey("Snapshot", s.Url+" "+s.Created.In(time.UTC).Format(time.RFC3339Nano))
+}
+
+// writeSnapshot records a snapshot. core only writes snapshots to an sql
+// store, & doesn't know about the columns sentry adds
+func writeSnapshot(store datastore.Datastore, s *Snapshot) error {
+	if s.Created.IsZero() {
+		return fmt.Errorf("url %s has no GET to snapshot", s.Url)
+	}
+
+	switch st := store.(type) {
+	case *EmbeddedStore:
+		return st.Put(snapshotKey(&s.Snapshot), s)
+	case *sql_datastore.Datastore:
+		headers, err := json.Marshal(s.Headers)
+		if err != nil {
+			return err
+		}
+		_, err = st.DB.Exec(qSnapshotInsert, s.Url, s.Created, s.Status, s.Duration, headers, s.Hash, s.Cid, s.Truncated, s.Revisit)
+		return err
+	}
+	return fmt.Errorf("can't write snapshots to a %T", store)
+}
+
+// snapshotsForUrl lists snapshots of rawurl, most recent first
+func snapshotsForUrl(store datastore.Datastore, rawurl string) ([]*Snapshot, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		rows, err := appDB.Query(qSnapshotsByUrl, rawurl)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		snaps := []*Snapshot{}
+		for rows.Next() {
+			s := &Snapshot{}
+			if err := s.UnmarshalSQL(rows); err != nil {
+				return nil, err
+			}
+			snaps = append(snaps, s)
+		}
+		return snaps, rows.Err()
+	}
+
+	found, err := es.lookup("snapshot.url", rawurl)
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]*Snapshot, len(found))
+	for i, v := range found {
+		snaps[i] = v.(*Snapshot)
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].Created.After(snaps[j].Created) })
+	return snaps, nil
+}
+
+// writeMetadata timestamps, hashes & stores m. core only writes metadata
+// to an sql store
+func writeMetadata(store datastore.Datastore, m *core.Metadata) error {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return m.Write(store)
+	}
+
+	m.Timestamp = time.Now().Round(time.Second)
+	data, err := m.HashableBytes()
+	if err != nil {
+		return err
+	}
+	if m.Hash, err = core.CalcHash(data); err != nil {
+		return err
+	}
+	return es.Put(m.Key(), m)
+}
+
+// metadataBySubject lists metadata describing subject, most recent first
+func metadataBySubject(store datastore.Datastore, subject string) ([]*core.Metadata, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.MetadataBySubject(appDB, subject)
+	}
+
+	found, err := es.lookup("metadata.subject", subject)
+	if err != nil {
+		return nil, err
+	}
+	meta := make([]*core.Metadata, len(found))
+	for i, v := range found {
+		meta[i] = v.(*core.Metadata)
+	}
+	sort.SliceStable(meta, func(i, j int) bool { return meta[i].Timestamp.After(meta[j].Timestamp) })
+	return meta, nil
+}
+
+// linksFrom lists links with rawurl as their source
+func linksFrom(store datastore.Datastore, rawurl string) ([]*core.Link, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.ReadDstLinks(appDB, &core.Url{Url: rawurl})
+	}
+
+	found, err := es.lookup("link.src", rawurl)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*core.Link, len(found))
+	for i, v := range found {
+		links[i] = v.(*core.Link)
+	}
+	return links, nil
+}
+
+// crawlingSources lists sources set to crawl, most recently created first.
+// core only lists crawling sources from an sql store
+func crawlingSources(store datastore.Datastore, limit, offset int) ([]*core.Source, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.CrawlingSources(appDB, limit, offset)
+	}
+	return embeddedSources(es, limit, offset, func(s *core.Source) bool { return s.Crawl })
+}
+
+// embeddedSources lists sources in es that keep returns true for
+func embeddedSources(es *EmbeddedStore, limit, offset int, keep func(s *core.Source) bool) ([]*core.Source, error) {
+	found, err := es.list("Source", limit, offset, func(v interface{}) bool { return keep(v.(*core.Source)) })
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]*core.Source, len(found))
+	for i, v := range found {
+		sources[i] = v.(*core.Source)
+	}
+	return sources, nil
+}
+
+// fetchedUrls lists urls that have been GET'd, most recently created first
+func fetchedUrls(store datastore.Datastore, limit, offset int) ([]*core.Url, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.FetchedUrls(appDB, limit, offset)
+	}
+	return embeddedUrls(es, limit, offset, func(u *core.Url) bool { return u.LastGet != nil })
+}
+
+// unfetchedUrls lists urls that have never been GET'd, most recently
+// created first
+func unfetchedUrls(store datastore.Datastore, limit, offset int) ([]*core.Url, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.UnfetchedUrls(appDB, limit, offset)
+	}
+	return embeddedUrls(es, limit, offset, func(u *core.Url) bool { return u.LastGet == nil })
+}
+
+// embeddedUrls lists urls in es that keep returns true for
+func embeddedUrls(es *EmbeddedStore, limit, offset int, keep func(u *core.Url) bool) ([]*core.Url, error) {
+	found, err := es.list("Url", limit, offset, func(v interface{}) bool { return keep(v.(*core.Url)) })
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]*core.Url, len(found))
+	for i, v := range found {
+		urls[i] = v.(*core.Url)
+	}
+	return urls, nil
+}
+
+// basePrimers lists primers without a parent, most recently created first
+func basePrimers(store datastore.Datastore, limit, offset int) ([]*core.Primer, error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return core.BasePrimers(appDB, limit, offset)
+	}
+	return embeddedPrimers(es, limit, offset, func(p *core.Primer) bool { return p.Parent == nil || p.Parent.Id == "" })
+}
+
+// embeddedPrimers lists primers in es that keep returns true for
+func embeddedPrimers(es *EmbeddedStore, limit, offset int, keep func(p *core.Primer) bool) ([]*core.Primer, error) {
+	found, err := es.list("Primer", limit, offset, func(v interface{}) bool { return keep(v.(*core.Primer)) })
+	if err != nil {
+		return nil, err
+	}
+	primers := make([]*core.Primer, len(found))
+	for i, v := range found {
+		primers[i] = v.(*core.Primer)
+	}
+	return primers, nil
+}
+
+// readPrimerChildren reads p's sources & sub-primers. core only reads
+// them from an sql store
+func readPrimerChildren(store datastore.Datastore, p *core.Primer) (err error) {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		if err := p.ReadSources(appDB); err != nil {
+			return err
+		}
+		return p.ReadSubPrimers(appDB)
+	}
+
+	if p.Sources, err = embeddedSources(es, 0, 0, func(s *core.Source) bool {
+		return s.Primer != nil && s.Primer.Id == p.Id
+	}); err != nil {
+		return err
+	}
+	p.SubPrimers, err = embeddedPrimers(es, 0, 0, func(sp *core.Primer) bool {
+		return sp.Parent != nil && sp.Parent.Id == p.Id
+	})
+	return err
+}
+
+// calcPrimerStats tallies urls under p's sources & sub-primers, saving the
+// stats to p & each of them. core only calculates stats from an sql store
+func calcPrimerStats(store datastore.Datastore, p *core.Primer) error {
+	es, ok := store.(*EmbeddedStore)
+	if !ok {
+		return p.CalcStats(appDB)
+	}
+
+	if err := readPrimerChildren(es, p); err != nil {
+		return err
+	}
+	p.Stats = &core.PrimerStats{}
+	for _, s := range p.Sources {
+		if err := calcSourceStats(es, s); err != nil {
+			return err
+		}
+		p.Stats.UrlCount += s.Stats.UrlCount
+		p.Stats.ContentMetadataCount += s.Stats.ContentMetadataCount
+		p.Stats.ContentUrlCount += s.Stats.ContentUrlCount
+	}
+	for _, sp := range p.SubPrimers {
+		if err := calcPrimerStats(es, sp); err != nil {
+			return err
+		}
+		p.Stats.UrlCount += sp.Stats.UrlCount
+		p.Stats.ContentMetadataCount += sp.Stats.ContentMetadataCount
+		p.Stats.ContentUrlCount += sp.Stats.ContentUrlCount
+	}
+	return p.Save(es)
+}
+
+// calcSourceStats counts the urls under s, the content urls among them &
+// the content urls that have metadata. like core, a url is under a source
+// if it contains the source url
+func calcSourceStats(es *EmbeddedStore, s *core.Source) error {
+	emptyHash, err := core.CalcHash([]byte{})
+	if err != nil {
+		return err
+	}
+
+	pattern := strings.ToLower(s.Url)
+	urls, err := embeddedUrls(es, 0, 0, func(u *core.Url) bool {
+		return strings.Contains(strings.ToLower(u.Url), pattern)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Stats = &core.SourceStats{UrlCount: len(urls)}
+	for _, u := range urls {
+		if u.Hash == "" || u.Hash == emptyHash || u.ContentSniff == "text/html; charset=utf-8" {
+			continue
+		}
+		s.Stats.ContentUrlCount++
+		if es.count("metadata.subject", u.Hash) > 0 {
+			s.Stats.ContentMetadataCount++
+		}
+	}
+	return s.Save(es)
+}
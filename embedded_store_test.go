@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempEmbeddedStore(t *testing.T) (*EmbeddedStore, string) {
+	dir, err := ioutil.TempDir("", "sentry_embedded")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewEmbeddedStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err.Error())
+	}
+	return s, dir
+}
+
+// useEmbeddedStore sets the global store to a new embedded store, call
+// done to put the previous store back & remove the new one
+func useEmbeddedStore(t *testing.T) (s *EmbeddedStore, done func()) {
+	s, dir := tempEmbeddedStore(t)
+	prev := store
+	store = s
+	return s, func() {
+		store = prev
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEmbeddedStore(t *testing.T) {
+	s, dir := tempEmbeddedStore(t)
+	defer os.RemoveAll(dir)
+
+	p := &core.Primer{Title: "embedded primer"}
+	if err := p.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, rawurl := range []string{"epa.gov", "noaa.gov", "nasa.gov"} {
+		src := &core.Source{Url: rawurl, Primer: &core.Primer{Id: p.Id}}
+		if err := src.Save(s); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := (&core.Source{Url: "epa.gov"}).Save(s); err == nil {
+		t.Errorf("expected duplicate source url to error")
+	}
+
+	u := &core.Url{Url: "http://epa.gov/a", Hash: "1220abc"}
+	if err := u.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&core.Url{Url: "http://epa.gov/a"}).Save(s); err == nil {
+		t.Errorf("expected duplicate url to error")
+	}
+	l := &core.Link{Src: u, Dst: &core.Url{Url: "http://epa.gov/b"}}
+	if err := l.Insert(s); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// everything should come back after reopening
+	if err := s.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+
+	got := &core.Primer{Id: p.Id}
+	if err := got.Read(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Title != p.Title {
+		t.Errorf("primer title mismatch. expected: %s, got: %s", p.Title, got.Title)
+	}
+
+	sources, err := core.ListSources(s, 2, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sources) != 2 || sources[0].Url != "nasa.gov" || sources[1].Url != "noaa.gov" {
+		t.Errorf("expected the two newest sources, got: %v", sources)
+	}
+	if sources, err = core.ListSources(s, 2, 2); err != nil || len(sources) != 1 || sources[0].Url != "epa.gov" {
+		t.Errorf("expected the oldest source on page two, got: %v, %v", sources, err)
+	}
+
+	cases := []struct {
+		u  *core.Url
+		id string
+	}{
+		{&core.Url{Url: "http://epa.gov/a"}, u.Id},
+		{&core.Url{Hash: "1220abc"}, u.Id},
+		{&core.Url{Id: u.Id}, u.Id},
+		{&core.Url{Url: "http://epa.gov/missing"}, ""},
+	}
+	for i, c := range cases {
+		err := readUrl(s, c.u)
+		if c.id == "" {
+			if err != core.ErrNotFound {
+				t.Errorf("case %d expected not found, got: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err)
+		} else if c.u.Id != c.id || c.u.Url != u.Url {
+			t.Errorf("case %d mismatch. expected id: %s, got: %s", i, c.id, c.u.Id)
+		}
+	}
+
+	links, err := linksFrom(s, u.Url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(links) != 1 || links[0].Dst.Url != "http://epa.gov/b" {
+		t.Errorf("expected one link to http://epa.gov/b, got: %v", links)
+	}
+	link := &core.Link{Src: &core.Url{Url: u.Url}, Dst: &core.Url{Url: "http://epa.gov/b"}}
+	if err := link.Read(s); err != nil || link.Created.IsZero() {
+		t.Errorf("expected link to be read by src & dst. err: %v", err)
+	}
+
+	if err := got.Delete(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := got.Delete(s); err != datastore.ErrNotFound {
+		t.Errorf("expected deleting twice to not be found, got: %v", err)
+	}
+	if has, _ := s.Has(got.Key()); has {
+		t.Errorf("expected deleted primer to be gone")
+	}
+}
+
+func TestEmbeddedStoreCompact(t *testing.T) {
+	s, dir := tempEmbeddedStore(t)
+	defer os.RemoveAll(dir)
+
+	u := &core.Url{Url: "http://epa.gov"}
+	for i := 0; i < 10; i++ {
+		u.Status = 200 + i
+		if err := u.Save(s); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	s.Close()
+
+	path := filepath.Join(dir, embeddedStoreFile)
+	before, _ := os.Stat(path)
+	// simulate a write cut off by a crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"key":"/Url:cut`))
+	f.Close()
+
+	s, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("expected log to be compacted. before: %d bytes, after: %d bytes", before.Size(), after.Size())
+	}
+	got := &core.Url{Url: "http://epa.gov"}
+	if err := readUrl(s, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Id != u.Id || got.Status != 209 {
+		t.Errorf("expected last write to survive compaction, got: %#v", got)
+	}
+}
+
+func TestEmbeddedStoreCompactOpen(t *testing.T) {
+	prev := embeddedCompactMin
+	embeddedCompactMin = 10
+	defer func() { embeddedCompactMin = prev }()
+
+	s, dir := tempEmbeddedStore(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	urls := []*core.Url{{Url: "http://a.gov"}, {Url: "http://b.gov"}}
+	for i := 0; i < 100; i++ {
+		u := urls[i%len(urls)]
+		u.Status = 200 + i
+		if err := u.Save(s); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if s.dead > embeddedCompactMin {
+		t.Errorf("expected log to be compacted while open, %d superseded records", s.dead)
+	}
+
+	// the reopened log takes new writes & a restart sees them all
+	if err := s.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	for i, u := range urls {
+		got := &core.Url{Url: u.Url}
+		if err := readUrl(s, got); err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if got.Id != u.Id || got.Status != u.Status {
+			t.Errorf("case %d: expected last write to survive compaction, got status %d", i, got.Status)
+		}
+	}
+}
+
+func TestEmbeddedSnapshotsAndMetadata(t *testing.T) {
+	s, dir := tempEmbeddedStore(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	u := &core.Url{Url: "http://epa.gov/data.csv", Status: 200, Hash: "1220aaa", Headers: []string{"Etag", "v1"}}
+	for i, at := range []time.Time{time.Now().Add(-time.Hour), time.Now()} {
+		at := at
+		u.LastGet = &at
+		if i == 1 {
+			u.Hash = "1220bbb"
+		}
+		if err := writeSnapshot(s, newSnapshot(u)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	snaps, err := snapshotsForUrl(s, u.Url)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snaps) != 2 || snaps[0].Hash != "1220bbb" || snaps[1].Hash != "1220aaa" {
+		t.Errorf("expected snapshots newest first, got: %v", snaps)
+	}
+	if len(snaps) > 0 && (snaps[0].Status != 200 || len(snaps[0].Headers) != 2) {
+		t.Errorf("snapshot fields not stored: %#v", snaps[0])
+	}
+
+	m := &core.Metadata{KeyId: "key", Subject: "1220bbb", Meta: map[string]interface{}{"title": "data"}}
+	if err := writeMetadata(s, m); err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.Hash == "" || m.Timestamp.IsZero() {
+		t.Errorf("expected metadata to be hashed & timestamped: %#v", m)
+	}
+	meta, err := metadataBySubject(s, "1220bbb")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(meta) != 1 || meta[0].Hash != m.Hash || meta[0].Meta["title"] != "data" {
+		t.Errorf("metadata mismatch: %v", meta)
+	}
+}
+
+func TestEmbeddedCoreHelpers(t *testing.T) {
+	s, done := useEmbeddedStore(t)
+	defer done()
+
+	p := &core.Primer{Title: "agency"}
+	if err := p.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	sub := &core.Primer{Title: "office", Parent: &core.Primer{Id: p.Id}}
+	if err := sub.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	crawling := &SourceBody{Source: &core.Source{Url: "epa.gov", Crawl: true, Primer: &core.Primer{Id: p.Id}}}
+	idle := &SourceBody{Source: &core.Source{Url: "noaa.gov", Primer: &core.Primer{Id: p.Id}}}
+	for _, src := range []*SourceBody{crawling, idle} {
+		if err := CreateSource(appDB, src); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := CreateSource(appDB, &SourceBody{Source: &core.Source{Url: "epa.gov"}}); err == nil {
+		t.Errorf("expected duplicate source url to conflict")
+	}
+
+	sources, err := crawlingSources(s, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sources) != 1 || sources[0].Id != crawling.Id {
+		t.Errorf("expected only the crawling source, got: %v", sources)
+	}
+	if bases, err := basePrimers(s, 10, 0); err != nil || len(bases) != 1 || bases[0].Id != p.Id {
+		t.Errorf("expected one base primer, got: %v, %v", bases, err)
+	}
+	if err := readPrimerChildren(s, p); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(p.Sources) != 2 || len(p.SubPrimers) != 1 || p.SubPrimers[0].Id != sub.Id {
+		t.Errorf("expected 2 sources & 1 sub-primer, got: %v, %v", p.Sources, p.SubPrimers)
+	}
+
+	page, err := sourceAsUrl(crawling.Source)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if page.Url != "http://epa.gov" || page.Id == "" {
+		t.Errorf("expected a saved url for the source, got: %#v", page)
+	}
+	data := &core.Url{Url: "http://epa.gov/data.csv"}
+	if err := data.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&PageLink{Link: &core.Link{Src: page, Dst: data}, Kind: LinkAnchor}).Save(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+	if links, err := linksFrom(s, page.Url); err != nil || len(links) != 1 || links[0].Dst.Url != data.Url {
+		t.Errorf("expected a link to %s, got: %v, %v", data.Url, links, err)
+	}
+
+	// the data url is fetched twice, the second capture cut off
+	for i, at := range []time.Time{time.Now().Add(-time.Hour), time.Now()} {
+		at := at
+		data.LastGet = &at
+		data.Hash = fmt.Sprintf("1220a%d", i)
+		data.ContentSniff = "text/plain; charset=utf-8"
+		snap := newSnapshot(data)
+		snap.Truncated = i == 1
+		if err := saveGet(appDB, data, snap); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := markSnapshotRevisit(appDB, data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if last, err := lastGetSnapshot(appDB, data.Url); err != nil || last.Hash != "1220a0" {
+		t.Errorf("expected the last complete snapshot, got: %v, %v", last, err)
+	}
+	if history, err := snapshotHashes(appDB, data.Url); err != nil || len(history) != 2 || history[0].Hash != "1220a0" {
+		t.Errorf("expected snapshot history oldest first, got: %v, %v", history, err)
+	}
+	if snaps, err := snapshotsForUrl(s, data.Url); err != nil || len(snaps) != 2 || !snaps[0].Revisit || !snaps[0].Truncated || snaps[1].Revisit {
+		t.Errorf("expected only the newest snapshot to be a truncated revisit, got: %v, %v", snaps, err)
+	}
+
+	if urls, err := fetchedUrls(s, 10, 0); err != nil || len(urls) != 1 || urls[0].Url != data.Url {
+		t.Errorf("expected %s to be the only fetched url, got: %v, %v", data.Url, urls, err)
+	}
+	if urls, err := unfetchedUrls(s, 10, 0); err != nil || len(urls) != 1 || urls[0].Url != page.Url {
+		t.Errorf("expected %s to be the only unfetched url, got: %v, %v", page.Url, urls, err)
+	}
+
+	if err := writeMetadata(s, &core.Metadata{KeyId: "key", Subject: data.Hash}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := calcPrimerStats(s, p); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := core.PrimerStats{UrlCount: 2, ContentUrlCount: 1, ContentMetadataCount: 1}
+	if got := (&core.Primer{Id: p.Id}); got.Read(s) != nil || got.Stats == nil || *got.Stats != expect {
+		t.Errorf("primer stats mismatch. expected: %v, got: %v", expect, got.Stats)
+	}
+
+	if err := DeletePrimer(appDB, p.Id); err == nil {
+		t.Errorf("expected primer with sources to not be deleted")
+	}
+	for _, src := range []*SourceBody{crawling, idle} {
+		if err := DeleteSource(appDB, src.Id); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := DeleteSource(appDB, idle.Id); err != core.ErrNotFound {
+		t.Errorf("expected deleting a missing source to be not found, got: %v", err)
+	}
+	if _, _, err := sourceIdByUrl(appDB, "epa.gov"); err != core.ErrNotFound {
+		t.Errorf("expected deleted source url to be free, got: %v", err)
+	}
+	for _, id := range []string{sub.Id, p.Id} {
+		if err := DeletePrimer(appDB, id); err != nil {
+			t.Errorf("error deleting primer %s: %s", id, err)
+		}
+	}
+}
+
+func TestEmbeddedCrawlState(t *testing.T) {
+	s, done := useEmbeddedStore(t)
+	defer done()
+
+	// model type prefixes can't match longer type names
+	if err := (&core.Url{Url: "http://a.test"}).Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := recordFailure(appDB, "http://a.test/gone", &StatusError{Status: 404}); err != nil {
+		t.Fatal(err.Error())
+	}
+	failing, err := recordFailure(appDB, "http://a.test/busy", &StatusError{Status: 503})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res, err := s.Query(query.Query{Prefix: "Url"}); err != nil {
+		t.Fatal(err.Error())
+	} else if all, _ := res.Rest(); len(all) != 1 {
+		t.Errorf("expected 1 url, got: %d", len(all))
+	}
+
+	if failing.Dead || failing.Attempts != 1 || failing.NextAttempt == nil {
+		t.Errorf("expected a retryable failure, got: %#v", failing)
+	}
+	dead := true
+	if failures, err := ListUrlFailures(appDB, "", &dead, 10, 0); err != nil || len(failures) != 1 || failures[0].Url != "http://a.test/gone" {
+		t.Errorf("expected one dead failure, got: %v, %v", failures, err)
+	}
+	if err := failing.Delete(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+	if failures, err := ListUrlFailures(appDB, "", nil, 10, 0); err != nil || len(failures) != 1 {
+		t.Errorf("expected deleted failure to be gone, got: %v, %v", failures, err)
+	}
+
+	created := time.Now().Round(time.Second).In(time.UTC)
+	for i, hop := range [][2]string{{"http://a.test/old", "http://a.test/mid"}, {"http://a.test/mid", "http://a.test/new"}} {
+		h := &RedirectHop{Url: "http://a.test/old", Created: created, Hop: i, Src: hop[0], Dst: hop[1], Status: 301}
+		if err := h.Save(appDB); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if hops, err := RedirectsForUrl(appDB, "http://a.test/new", 10, 0); err != nil || len(hops) != 2 || hops[0].Src != "http://a.test/old" || hops[1].Dst != "http://a.test/new" {
+		t.Errorf("expected the whole chain in hop order, got: %v, %v", hops, err)
+	}
+
+	p := &core.Primer{Title: "agency"}
+	if err := p.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	src := &SourceBody{Source: &core.Source{Url: "a.test", Primer: &core.Primer{Id: p.Id}}, Settings: &SourceSettings{MaxDepth: 3, Headers: map[string]string{"X-Key": "secret"}}}
+	if err := CreateSource(appDB, src); err != nil {
+		t.Fatal(err.Error())
+	}
+	set := &SourceSettings{SourceId: src.Id}
+	if err := set.Read(appDB); err != nil || set.MaxDepth != 3 || set.Headers["X-Key"] != "secret" || set.Created.IsZero() {
+		t.Errorf("expected saved settings, got: %#v, %v", set, err)
+	}
+	if err := DeleteSource(appDB, src.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&SourceSettings{SourceId: src.Id}).Read(appDB); err != core.ErrNotFound {
+		t.Errorf("expected settings to be deleted with their source, got: %v", err)
+	}
+
+	for i, rawurl := range []string{"http://a.test/later", "http://a.test/due", "http://a.test/overdue"} {
+		r := &Revisit{Url: rawurl, Interval: time.Hour, NextVisit: time.Now().Add(time.Hour * time.Duration(1-i))}
+		if err := r.Save(appDB); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if due, err := DueRevisits(appDB, 10, 0); err != nil || len(due) != 2 || due[0].Url != "http://a.test/overdue" {
+		t.Errorf("expected 2 due revisits, most overdue first, got: %v, %v", due, err)
+	}
+
+	o := &WarcOriginal{Url: "http://a.test", Created: created, RecordId: "<urn:uuid:1>", PayloadDigest: "sha1:ABC", Filename: "sentry.warc.gz"}
+	if err := o.Save(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+	read := &WarcOriginal{Url: o.Url}
+	if err := read.Read(appDB); err != nil || read.RecordId != o.RecordId || !read.Created.Equal(o.Created) {
+		t.Errorf("warc original mismatch. expected: %#v, got: %#v, %v", o, read, err)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	cases := []struct {
+		store, dir string
+		err        string
+	}{
+		{"", "", ""},
+		{"postgres", "", ""},
+		{"embedded", "", "STORE_DIR must be set to use an embedded store"},
+		{"mongo", "", "unknown store: 'mongo'"},
+	}
+
+	for i, c := range cases {
+		got := ""
+		if _, err := NewStore(&config{Store: c.store, StoreDir: c.dir}); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.err, got)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	// wait before retrying a url the first time, doubling with each
+	// failed attempt after that
+	RetryBackoff = time.Second * 30
+	// longest wait between retries
+	MaxRetryBackoff = time.Hour * 6
+)
+
+// ErrorKind classifies why a request failed
+type ErrorKind string
+
+const (
+	// hostname couldn't be resolved
+	ErrorKindDNS ErrorKind = "dns"
+	// request timed out
+	ErrorKindTimeout ErrorKind = "timeout"
+	// connection refused, reset or closed early
+	ErrorKindConnection ErrorKind = "connection"
+	// certificate couldn't be verified
+	ErrorKindTLS ErrorKind = "tls"
+	// 429 Too Many Requests
+	ErrorKindRateLimited ErrorKind = "rate_limited"
+	// 5xx responses
+	ErrorKindServer ErrorKind = "server"
+	// 404 Not Found & 410 Gone
+	ErrorKindNotFound ErrorKind = "not_found"
+	// any other 4xx response
+	ErrorKindClient ErrorKind = "client"
+	// blocked by robots.txt
+	ErrorKindDisallowed ErrorKind = "disallowed"
+	// anything else
+	ErrorKindOther ErrorKind = "other"
+)
+
+// Retryable reports weather a failure of this kind might succeed if tried again
+func (k ErrorKind) Retryable() bool {
+	switch k {
+	case ErrorKindTLS, ErrorKindNotFound, ErrorKindClient, ErrorKindDisallowed:
+		return false
+	}
+	return true
+}
+
+// StatusError is a response with a status code that counts as a failure
+type StatusError struct {
+	Status int
+	// server-requested wait before trying again, from the Retry-After header
+	RetryAfter time.Duration
+}
+
+// NewStatusError creates an error for res, reading any Retry-After header
+func NewStatusError(res *http.Response) *StatusError {
+	return &StatusError{
+		Status:     res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+// failureStatus reports weather a response status counts as a failure
+func failureStatus(status int) bool {
+	return status >= 400
+}
+
+// retryStatus reports weather a response status should be retried
+// instead of being handled as a response
+func retryStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// classifyError gives the kind of a request error
+func classifyError(err error) ErrorKind {
+	if err == fetchbot.ErrDisallowed {
+		return ErrorKindDisallowed
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+
+	switch e := err.(type) {
+	case *StatusError:
+		switch {
+		case e.Status == http.StatusNotFound || e.Status == http.StatusGone:
+			return ErrorKindNotFound
+		case e.Status == http.StatusRequestTimeout:
+			return ErrorKindTimeout
+		case e.Status == http.StatusTooManyRequests:
+			return ErrorKindRateLimited
+		case e.Status >= 500:
+			return ErrorKindServer
+		}
+		return ErrorKindClient
+	case *net.DNSError:
+		return ErrorKindDNS
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return ErrorKindTLS
+	case net.Error:
+		if e.Timeout() {
+			return ErrorKindTimeout
+		}
+		if oerr, ok := e.(*net.OpError); ok {
+			if _, ok := oerr.Err.(*net.DNSError); ok {
+				return ErrorKindDNS
+			}
+		}
+		return ErrorKindConnection
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrorKindConnection
+	}
+	return ErrorKindOther
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number
+// of seconds or an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay gives the wait before the next attempt at a url that has
+// failed attempts times. a longer Retry-After from the server wins
+func retryDelay(attempts int, retryAfter time.Duration) time.Duration {
+	wait := MaxRetryBackoff
+	if attempts > 0 && attempts < 32 {
+		if d := RetryBackoff << uint(attempts-1); d > 0 && d < MaxRetryBackoff {
+			wait = d
+		}
+	}
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// UrlFailure tracks consecutive failed requests for a url. records are
+// cleared once the url is fetched successfully
+type UrlFailure struct {
+	// url that failed
+	Url string `json:"url"`
+	// id of the crawling source the url falls under, if any
+	SourceId string `json:"sourceId,omitempty"`
+	// Created timestamp rounded to seconds in UTC
+	Created time.Time `json:"created"`
+	// Updated timestamp rounded to seconds in UTC
+	Updated time.Time `json:"updated"`
+	// number of failed attempts in a row
+	Attempts int `json:"attempts"`
+	// kind of the most recent failure
+	Kind ErrorKind `json:"kind"`
+	// most recent error message
+	LastError string `json:"lastError"`
+	// time of the next retry, nil for dead urls
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	// true once the url has failed permanently or run out of attempts,
+	// dead urls aren't enqueued again
+	Dead bool `json:"dead"`
+}
+
+// recordFailure adds a failed attempt at rawurl to it's failure record,
+// deciding when it should be retried or if it's dead
+func recordFailure(db *sql.DB, rawurl string, reason error) (*UrlFailure, error) {
+	now := time.Now().Round(time.Second).In(time.UTC)
+
+	f := &UrlFailure{Url: rawurl}
+	if err := f.Read(db); err == core.ErrNotFound {
+		f.Created = now
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s := sourceForUrl(rawurl); s != nil {
+		f.SourceId = s.Id
+	}
+	f.Updated = now
+	f.Attempts++
+	f.Kind = classifyError(reason)
+	f.LastError = reason.Error()
+	f.Dead = !f.Kind.Retryable() || f.Attempts >= cfg.MaxAttempts()
+	f.NextAttempt = nil
+
+	if !f.Dead {
+		var retryAfter time.Duration
+		if serr, ok := reason.(*StatusError); ok {
+			retryAfter = serr.RetryAfter
+		}
+		next := now.Add(retryDelay(f.Attempts, retryAfter))
+		f.NextAttempt = &next
+	}
+
+	return f, f.Save(db)
+}
+
+// failUrl handles a failed request for rawurl, sending it back to the
+// frontier for a retry or marking it failed for good once it's dead
+func failUrl(rawurl string, reason error) {
+	f, err := recordFailure(appDB, rawurl, reason)
+	if err != nil {
+		log.Infof("record failure error: %s - %s", rawurl, err)
+		if err := frontier.Fail(rawurl, reason); err != nil {
+			log.Infof("frontier fail error: %s - %s", rawurl, err)
+		}
+		return
+	}
+
+	if f.Dead {
+		log.Infof("%s failure, giving up after %d attempts: %s - %s", f.Kind, f.Attempts, rawurl, reason)
+		err = frontier.Fail(rawurl, reason)
+	} else {
+		log.Infof("%s failure, retrying at %s: %s - %s", f.Kind, f.NextAttempt, rawurl, reason)
+		err = frontier.Retry(rawurl, reason, *f.NextAttempt)
+	}
+	if err != nil {
+		log.Infof("frontier fail error: %s - %s", rawurl, err)
+	}
+}
+
+// ListUrlFailures reads failure records, filtered by source id if sourceId
+// isn't empty & by dead if dead isn't nil
+func ListUrlFailures(db sqlutil.Queryable, sourceId string, dead *bool, limit, offset int) ([]*UrlFailure, error) {
+	var source interface{}
+	if sourceId != "" {
+		source = sourceId
+	}
+	var deadArg interface{}
+	if dead != nil {
+		deadArg = *dead
+	}
+
+	if es, ok := store.(*EmbeddedStore); ok {
+		found, err := es.list("UrlFailure", 0, 0, func(v interface{}) bool {
+			f := v.(*UrlFailure)
+			return (sourceId == "" || f.SourceId == sourceId) && (dead == nil || f.Dead == *dead)
+		})
+		if err != nil {
+			return nil, err
+		}
+		failures := make([]*UrlFailure, len(found))
+		for i, v := range found {
+			failures[i] = v.(*UrlFailure)
+		}
+		sort.SliceStable(failures, func(i, j int) bool { return failures[i].Updated.After(failures[j].Updated) })
+		if offset >= len(failures) {
+			return []*UrlFailure{}, nil
+		}
+		failures = failures[offset:]
+		if len(failures) > limit {
+			failures = failures[:limit]
+		}
+		return failures, nil
+	}
+
+	rows, err := db.Query(qUrlFailuresList, limit, offset, source, deadArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []*UrlFailure{}
+	for rows.Next() {
+		f := &UrlFailure{}
+		if err := f.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// failureKey gives the embedded store key for rawurl's failure record
+func failureKey(rawurl string) datastore.Key {
+	return embeddedKey("UrlFailure", rawurl)
+}
+
+// Read the failure record for a url from the db
+func (f *UrlFailure) Read(db sqlutil.Queryable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		v, err := es.Get(failureKey(f.Url))
+		if err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		*f = *v.(*UrlFailure)
+		return nil
+	}
+	return f.UnmarshalSQL(db.QueryRow(qUrlFailureByUrl, f.Url))
+}
+
+// Save a failure record to the db, creating or updating as needed
+func (f *UrlFailure) Save(db sqlutil.Execable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(failureKey(f.Url), f)
+	}
+	var next *time.Time
+	if f.NextAttempt != nil {
+		utc := f.NextAttempt.In(time.UTC)
+		next = &utc
+	}
+	_, err := db.Exec(qUrlFailureUpsert, f.Url, f.SourceId, f.Created.In(time.UTC), f.Updated.In(time.UTC), f.Attempts, string(f.Kind), f.LastError, next, f.Dead)
+	return err
+}
+
+// Delete a url's failure record
+func (f *UrlFailure) Delete(db sqlutil.Execable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		if err := es.Delete(failureKey(f.Url)); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	_, err := db.Exec(qUrlFailureDelete, f.Url)
+	return err
+}
+
+// UnmarshalSQL reads an sql response into the failure receiver
+func (f *UrlFailure) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		rawurl, sourceId, kind, lastErr string
+		created, updated                time.Time
+		next                            *time.Time
+		attempts                        int
+		dead                            bool
+	)
+
+	if err := row.Scan(&rawurl, &sourceId, &created, &updated, &attempts, &kind, &lastErr, &next, &dead); err != nil {
+		if err == sql.ErrNoRows {
+			return core.ErrNotFound
+		}
+		return err
+	}
+
+	if next != nil {
+		utc := next.In(time.UTC)
+		next = &utc
+	}
+
+	*f = UrlFailure{
+		Url:         rawurl,
+		SourceId:    sourceId,
+		Created:     created.In(time.UTC),
+		Updated:     updated.In(time.UTC),
+		Attempts:    attempts,
+		Kind:        ErrorKind(kind),
+		LastError:   lastErr,
+		NextAttempt: next,
+		Dead:        dead,
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err       error
+		kind      ErrorKind
+		retryable bool
+	}{
+		{&StatusError{Status: 404}, ErrorKindNotFound, false},
+		{&StatusError{Status: 410}, ErrorKindNotFound, false},
+		{&StatusError{Status: 403}, ErrorKindClient, false},
+		{&StatusError{Status: 408}, ErrorKindTimeout, true},
+		{&StatusError{Status: 429}, ErrorKindRateLimited, true},
+		{&StatusError{Status: 503}, ErrorKindServer, true},
+		{&url.Error{Op: "Get", URL: "http://a.com", Err: &net.DNSError{Err: "no such host", Name: "a.com"}}, ErrorKindDNS, true},
+		{&url.Error{Op: "Get", URL: "http://a.com", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "a.com"}}}, ErrorKindDNS, true},
+		{&url.Error{Op: "Get", URL: "http://a.com", Err: timeoutError{}}, ErrorKindTimeout, true},
+		{&url.Error{Op: "Get", URL: "http://a.com", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, ErrorKindConnection, true},
+		{&url.Error{Op: "Get", URL: "http://a.com", Err: x509.HostnameError{}}, ErrorKindTLS, false},
+		{io.ErrUnexpectedEOF, ErrorKindConnection, true},
+		{fetchbot.ErrDisallowed, ErrorKindDisallowed, false},
+		{fmt.Errorf("something else"), ErrorKindOther, true},
+	}
+
+	for i, c := range cases {
+		kind := classifyError(c.err)
+		if kind != c.kind {
+			t.Errorf("case %d kind mismatch. expected: %s, got: %s", i, c.kind, kind)
+		}
+		if kind.Retryable() != c.retryable {
+			t.Errorf("case %d retryable mismatch. expected: %t, got: %t", i, c.retryable, kind.Retryable())
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header string
+		expect time.Duration
+	}{
+		{"", 0},
+		{"120", time.Minute * 2},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(time.Hour).Format(http.TimeFormat), time.Hour},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+	}
+
+	for i, c := range cases {
+		if got := parseRetryAfter(c.header, now); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts   int
+		retryAfter time.Duration
+		expect     time.Duration
+	}{
+		{1, 0, RetryBackoff},
+		{2, 0, RetryBackoff * 2},
+		{4, 0, RetryBackoff * 8},
+		{1, time.Hour, time.Hour},
+		{4, time.Second, RetryBackoff * 8},
+		{100, 0, MaxRetryBackoff},
+		{100, MaxRetryBackoff * 2, MaxRetryBackoff * 2},
+	}
+
+	for i, c := range cases {
+		if got := retryDelay(c.attempts, c.retryAfter); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	rawurl := "http://failures.test/flaky"
+	if _, err := frontier.Enqueue(crawlerMain, "GET", rawurl, priorityDefault, 0, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 1; i <= cfg.MaxAttempts(); i++ {
+		f, err := recordFailure(appDB, rawurl, &StatusError{Status: 503, RetryAfter: time.Hour * 100})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if f.Attempts != i {
+			t.Errorf("attempt %d: attempts mismatch, got: %d", i, f.Attempts)
+		}
+		if f.Kind != ErrorKindServer {
+			t.Errorf("attempt %d: kind mismatch, got: %s", i, f.Kind)
+		}
+		if dead := i >= cfg.MaxAttempts(); f.Dead != dead {
+			t.Errorf("attempt %d: dead mismatch. expected: %t, got: %t", i, dead, f.Dead)
+		}
+		if !f.Dead && (f.NextAttempt == nil || f.NextAttempt.Sub(f.Updated) != time.Hour*100) {
+			t.Errorf("attempt %d: expected next attempt to honor retry-after, got: %v", i, f.NextAttempt)
+		}
+	}
+
+	// dead urls stay out of the frontier
+	if err := frontier.Fail(rawurl, fmt.Errorf("dead")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if added, err := frontier.Enqueue(crawlerMain, "GET", rawurl, priorityDefault, 0, time.Now()); err != nil || added {
+		t.Errorf("expected dead url not to be enqueued. added: %t, err: %v", added, err)
+	}
+
+	failures, err := ListUrlFailures(appDB, "", nil, 100, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found := false
+	for _, f := range failures {
+		found = found || f.Url == rawurl
+	}
+	if !found {
+		t.Errorf("expected failing url to be listed")
+	}
+
+	// permanent failures are dead right away
+	f, err := recordFailure(appDB, "http://failures.test/missing", &StatusError{Status: 404})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !f.Dead || f.Attempts != 1 {
+		t.Errorf("expected 404 to be dead after 1 attempt. dead: %t, attempts: %d", f.Dead, f.Attempts)
+	}
+
+	// success clears failures
+	if err := frontier.Ack(rawurl); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&UrlFailure{Url: rawurl}).Read(appDB); err == nil {
+		t.Errorf("expected ack to clear failures")
+	}
+}
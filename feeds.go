@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how often the feed watcher checks for feeds that are due
+	FeedCheckInterval = time.Minute
+	// largest feed document read
+	maxFeedSize int64 = 10 * 1024 * 1024
+	// poll state for each feed url, protected by feedsLock
+	feeds     = map[string]*feedState{}
+	feedsLock sync.Mutex
+)
+
+// feedState tracks polling of a single feed
+type feedState struct {
+	polled time.Time
+	// validators from the last response, for conditional polling
+	etag, lastModified string
+}
+
+// FeedEntry is an item from an RSS or Atom feed
+type FeedEntry struct {
+	// feed the entry came from
+	Feed string
+	// guid or id, if given
+	Id string
+	// absolute url the entry links to
+	Link      string
+	Title     string
+	Summary   string
+	Published *time.Time
+	Updated   *time.Time
+}
+
+// stamp gives the entry's latest timestamp as a string, "" if it has none
+func (e *FeedEntry) stamp() string {
+	switch {
+	case e.Updated != nil:
+		return e.Updated.Format(time.RFC3339)
+	case e.Published != nil:
+		return e.Published.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// meta gives the entry as url metadata
+func (e *FeedEntry) meta() map[string]interface{} {
+	m := map[string]interface{}{
+		"feed":  e.Feed,
+		"id":    e.Id,
+		"title": e.Title,
+	}
+	if e.Summary != "" {
+		m["summary"] = e.Summary
+	}
+	if e.Published != nil {
+		m["published"] = e.Published.Format(time.RFC3339)
+	}
+	if stamp := e.stamp(); stamp != "" {
+		m["updated"] = stamp
+	}
+	return m
+}
+
+// feedXML covers RSS 2.0 (<rss><channel><item>), RSS 1.0 (<rdf:RDF><item>)
+// & Atom (<feed><entry>) documents
+type feedXML struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Guid        string `xml:"guid"`
+	About       string `xml:"about,attr"`
+	Link        string `xml:"link"`
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"date"`
+}
+
+type atomEntry struct {
+	Id    string `xml:"id"`
+	Title string `xml:"title"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Summary   string `xml:"summary"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+}
+
+// date formats seen in feeds. RSS uses RFC 822 with plenty of variation,
+// Atom & dublin core dates are RFC 3339
+var feedTimeFormats = []string{
+	time.RFC3339Nano,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	"2006-01-02",
+}
+
+// parseFeedTime reads a feed timestamp, returning nil if it's missing or
+// unreadable
+func parseFeedTime(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	for _, f := range feedTimeFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			t = t.In(time.UTC)
+			return &t
+		}
+	}
+	return nil
+}
+
+// parseFeed reads entries from an RSS or Atom feed found at feedUrl,
+// resolving entry links against it. entries without a link are dropped
+func parseFeed(feedUrl *url.URL, r io.Reader) ([]*FeedEntry, error) {
+	doc := &feedXML{}
+	if err := xml.NewDecoder(io.LimitReader(r, maxFeedSize)).Decode(doc); err != nil {
+		return nil, err
+	}
+
+	entries := []*FeedEntry{}
+	add := func(e *FeedEntry, link string) {
+		ref, err := url.Parse(strings.TrimSpace(link))
+		if err != nil || link == "" {
+			return
+		}
+		e.Feed = feedUrl.String()
+		e.Link = feedUrl.ResolveReference(ref).String()
+		e.Title = strings.TrimSpace(e.Title)
+		e.Summary = strings.TrimSpace(e.Summary)
+		entries = append(entries, e)
+	}
+
+	switch doc.XMLName.Local {
+	case "rss", "RDF":
+		for _, item := range append(doc.Channel.Items, doc.Items...) {
+			e := &FeedEntry{
+				Id:      strings.TrimSpace(item.Guid),
+				Title:   item.Title,
+				Summary: item.Description,
+			}
+			if e.Id == "" {
+				e.Id = item.About
+			}
+			if e.Published = parseFeedTime(item.PubDate); e.Published == nil {
+				e.Published = parseFeedTime(item.Date)
+			}
+			add(e, item.Link)
+		}
+	case "feed":
+		for _, entry := range doc.Entries {
+			e := &FeedEntry{
+				Id:        strings.TrimSpace(entry.Id),
+				Title:     entry.Title,
+				Summary:   entry.Summary,
+				Published: parseFeedTime(entry.Published),
+				Updated:   parseFeedTime(entry.Updated),
+			}
+			link := ""
+			for _, l := range entry.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			add(e, link)
+		}
+	default:
+		return nil, fmt.Errorf("not a feed: <%s>", doc.XMLName.Local)
+	}
+	return entries, nil
+}
+
+// feedEntryChanged reports weather e is new or updated since it was last
+// recorded on u's metadata
+func feedEntryChanged(u *core.Url, e *FeedEntry) bool {
+	prev, ok := u.Meta["feed"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	if id, _ := prev["id"].(string); id != e.Id {
+		return true
+	}
+	updated, _ := prev["updated"].(string)
+	return updated != e.stamp()
+}
+
+// fetchFeed GETs a feed, conditional on validators from the last poll.
+// it returns nil entries if the feed hasn't changed
+func fetchFeed(client fetchbot.Doer, rawurl string, st *feedState) ([]*FeedEntry, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cfg.UserAgentString())
+	if st.etag != "" {
+		req.Header.Set("If-None-Match", st.etag)
+	}
+	if st.lastModified != "" {
+		req.Header.Set("If-Modified-Since", st.lastModified)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, NewStatusError(res)
+	}
+
+	entries, err := parseFeed(res.Request.URL, res.Body)
+	if err != nil {
+		return nil, err
+	}
+	st.etag = res.Header.Get("ETag")
+	st.lastModified = res.Header.Get("Last-Modified")
+	return entries, nil
+}
+
+// enqueueFeedEntries sends new or updated entries straight to the seed
+// crawler, moving any already waiting on another crawler, & records entry
+// metadata on the url each entry links to once it's queued. links excluded
+// by the scope of a crawling source are skipped
+func enqueueFeedEntries(entries []*FeedEntry) (added int, err error) {
+	for _, e := range entries {
+		if sc := scopeForUrl(e.Link); sc != nil {
+			if u, err := url.Parse(e.Link); err != nil || !sc.Contains(u) {
+				continue
+			}
+		}
+
+		u, err := readOrCreateUrl(e.Link)
+		if err != nil {
+			return added, err
+		}
+		if !isFetchable(u) || !feedEntryChanged(u, e) {
+			continue
+		}
+
+		ok, err := frontier.Enqueue(crawlerSeeds, "GET", u.Url, prioritySeed, 0, time.Now())
+		if err != nil {
+			return added, err
+		}
+		if !ok {
+			// entries already waiting on another crawler are moved over
+			if ok, err = frontier.Promote(crawlerSeeds, "GET", u.Url, prioritySeed, 0, time.Now()); err != nil {
+				return added, err
+			}
+		}
+		if !ok {
+			// in-flight, leave the entry unseen to try again next poll
+			continue
+		}
+
+		if u.Meta == nil {
+			u.Meta = map[string]interface{}{}
+		}
+		u.Meta["feed"] = e.meta()
+		if err := u.Save(store); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return
+}
+
+// dueFeeds lists feed urls of crawling sources that haven't been polled
+// within their source's feed interval
+func dueFeeds(now time.Time) []string {
+	mu.Lock()
+	intervals := map[string]time.Duration{}
+	for _, set := range sourceSettings {
+		for _, f := range set.Feeds {
+			interval := set.FeedInterval
+			if interval <= 0 {
+				interval = cfg.FeedInterval()
+			}
+			if prev, ok := intervals[f]; !ok || interval < prev {
+				intervals[f] = interval
+			}
+		}
+	}
+	mu.Unlock()
+
+	feedsLock.Lock()
+	defer feedsLock.Unlock()
+	due := []string{}
+	for f, interval := range intervals {
+		if st := feeds[f]; st == nil || now.Sub(st.polled) >= interval {
+			due = append(due, f)
+		}
+	}
+	return due
+}
+
+// pollFeeds checks all due feeds, enqueueing new & updated entries
+func pollFeeds(client fetchbot.Doer) {
+	now := time.Now()
+	for _, f := range dueFeeds(now) {
+		feedsLock.Lock()
+		st := feeds[f]
+		if st == nil {
+			st = &feedState{}
+			feeds[f] = st
+		}
+		st.polled = now
+		prev := *st
+		feedsLock.Unlock()
+
+		entries, err := fetchFeed(client, f, &prev)
+		if err != nil {
+			log.Infof("feed error: %s - %s", f, err)
+			continue
+		}
+
+		feedsLock.Lock()
+		st.etag, st.lastModified = prev.etag, prev.lastModified
+		feedsLock.Unlock()
+
+		if entries == nil {
+			continue
+		}
+		added, err := enqueueFeedEntries(entries)
+		if err != nil {
+			log.Infof("feed error: %s - %s", f, err)
+			continue
+		}
+		log.Infof("adding %d of %d feed entries from %s to que", added, len(entries), f)
+	}
+}
+
+// watchFeeds polls source feeds every FeedCheckInterval until stop closes
+func watchFeeds(stop chan bool) {
+	client := newLimitedDoer(crawlClient)
+	t := time.NewTicker(FeedCheckInterval)
+	defer t.Stop()
+
+	for {
+		pollFeeds(client)
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRss = `<?xml version="1.0"?>
+<rss version="2.0">
+  <channel>
+    <title>Agency News</title>
+    <item>
+      <title> New data release </title>
+      <link>http://agency.gov/data/2017.csv</link>
+      <guid>release-2017</guid>
+      <pubDate>Sat, 04 Mar 2017 10:00:00 -0500</pubDate>
+      <description>this year's numbers</description>
+    </item>
+    <item>
+      <title>Relative link</title>
+      <link>/news/today.html</link>
+    </item>
+    <item>
+      <title>No link</title>
+    </item>
+  </channel>
+</rss>`
+
+const testAtom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Agency Updates</title>
+  <entry>
+    <title>Updated report</title>
+    <link rel="self" href="http://agency.gov/feed/1"/>
+    <link href="http://agency.gov/reports/1.pdf"/>
+    <id>urn:uuid:1</id>
+    <published>2017-03-01T00:00:00Z</published>
+    <updated>2017-03-04T15:00:00Z</updated>
+    <summary>revised</summary>
+  </entry>
+</feed>`
+
+const testRdf = `<?xml version="1.0"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <channel rdf:about="http://agency.gov/"><title>Agency</title></channel>
+  <item rdf:about="http://agency.gov/notice/5">
+    <title>Notice</title>
+    <link>http://agency.gov/notice/5</link>
+    <dc:date>2017-03-04T12:00:00Z</dc:date>
+  </item>
+</rdf:RDF>`
+
+func TestParseFeed(t *testing.T) {
+	feedUrl, _ := url.Parse("http://agency.gov/feed.xml")
+	cases := []struct {
+		data   string
+		links  []string
+		first  FeedEntry
+		hasErr bool
+	}{
+		{testRss, []string{"http://agency.gov/data/2017.csv", "http://agency.gov/news/today.html"}, FeedEntry{Id: "release-2017", Title: "New data release", Summary: "this year's numbers"}, false},
+		{testAtom, []string{"http://agency.gov/reports/1.pdf"}, FeedEntry{Id: "urn:uuid:1", Title: "Updated report", Summary: "revised"}, false},
+		{testRdf, []string{"http://agency.gov/notice/5"}, FeedEntry{Id: "http://agency.gov/notice/5", Title: "Notice"}, false},
+		{"<html></html>", nil, FeedEntry{}, true},
+		{"not xml", nil, FeedEntry{}, true},
+	}
+
+	for i, c := range cases {
+		entries, err := parseFeed(feedUrl, strings.NewReader(c.data))
+		if (err != nil) != c.hasErr {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.hasErr, err)
+			continue
+		}
+		links := []string{}
+		for _, e := range entries {
+			links = append(links, e.Link)
+			if e.Feed != feedUrl.String() {
+				t.Errorf("case %d expected entry feed to be set, got: %s", i, e.Feed)
+			}
+		}
+		if strings.Join(links, ",") != strings.Join(c.links, ",") {
+			t.Errorf("case %d links mismatch. expected: %v, got: %v", i, c.links, links)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		e := entries[0]
+		if e.Id != c.first.Id || e.Title != c.first.Title || e.Summary != c.first.Summary {
+			t.Errorf("case %d entry mismatch. expected: %s/%s/%s, got: %s/%s/%s", i, c.first.Id, c.first.Title, c.first.Summary, e.Id, e.Title, e.Summary)
+		}
+		if e.stamp() == "" {
+			t.Errorf("case %d expected entry to have a timestamp", i)
+		}
+	}
+}
+
+func TestParseFeedTime(t *testing.T) {
+	cases := []struct {
+		in, expect string
+	}{
+		{"", ""},
+		{"last tuesday", ""},
+		{"Sat, 04 Mar 2017 10:00:00 -0500", "2017-03-04T15:00:00Z"},
+		{"Sat, 4 Mar 2017 10:00:00 GMT", "2017-03-04T10:00:00Z"},
+		{"04 Mar 2017 10:00:00 +0000", "2017-03-04T10:00:00Z"},
+		{"2017-03-04T10:00:00-05:00", "2017-03-04T15:00:00Z"},
+		{"2017-03-04", "2017-03-04T00:00:00Z"},
+	}
+
+	for i, c := range cases {
+		got := ""
+		if ft := parseFeedTime(c.in); ft != nil {
+			got = ft.Format(time.RFC3339)
+		}
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.expect, got)
+		}
+	}
+}
+
+func TestFeedEntryChanged(t *testing.T) {
+	published := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	updated := published.Add(time.Hour)
+	entry := &FeedEntry{Id: "a", Link: "http://agency.gov/a", Published: &published}
+	revised := &FeedEntry{Id: "a", Link: "http://agency.gov/a", Published: &published, Updated: &updated}
+
+	cases := []struct {
+		meta   map[string]interface{}
+		entry  *FeedEntry
+		expect bool
+	}{
+		{nil, entry, true},
+		{map[string]interface{}{"other": "data"}, entry, true},
+		{map[string]interface{}{"feed": entry.meta()}, entry, false},
+		{map[string]interface{}{"feed": entry.meta()}, revised, true},
+		{map[string]interface{}{"feed": revised.meta()}, revised, false},
+		{map[string]interface{}{"feed": entry.meta()}, &FeedEntry{Id: "b", Published: &published}, true},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: "http://agency.gov/a", Meta: c.meta}
+		if got := feedEntryChanged(u, c.entry); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestFetchFeed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(testAtom))
+	}))
+	defer s.Close()
+
+	st := &feedState{}
+	entries, err := fetchFeed(http.DefaultClient, s.URL, st)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected 1 entry, got: %d", len(entries))
+	}
+	if st.etag != `"v1"` {
+		t.Errorf("expected etag to be kept, got: %s", st.etag)
+	}
+
+	entries, err = fetchFeed(http.DefaultClient, s.URL, st)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if entries != nil {
+		t.Errorf("expected unchanged feed to give no entries, got: %d", len(entries))
+	}
+}
+
+func TestDueFeeds(t *testing.T) {
+	prevSettings := sourceSettings
+	feedsLock.Lock()
+	prevFeeds := feeds
+	feedsLock.Unlock()
+	defer func() {
+		sourceSettings = prevSettings
+		feedsLock.Lock()
+		feeds = prevFeeds
+		feedsLock.Unlock()
+	}()
+
+	now := time.Now()
+	sourceSettings = map[string]*SourceSettings{
+		"a": {Feeds: []string{"http://a.gov/rss", "http://shared.gov/rss"}, FeedInterval: time.Hour},
+		"b": {Feeds: []string{"http://b.gov/atom", "http://shared.gov/rss"}, FeedInterval: time.Minute * 5},
+	}
+	feeds = map[string]*feedState{
+		"http://a.gov/rss":      {polled: now.Add(-time.Minute * 10)},
+		"http://b.gov/atom":     {polled: now.Add(-time.Minute * 10)},
+		"http://shared.gov/rss": {polled: now.Add(-time.Minute * 10)},
+	}
+
+	due := dueFeeds(now)
+	sort.Strings(due)
+	expect := []string{"http://b.gov/atom", "http://shared.gov/rss"}
+	if strings.Join(due, ",") != strings.Join(expect, ",") {
+		t.Errorf("due feeds mismatch. expected: %v, got: %v", expect, due)
+	}
+}
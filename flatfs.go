@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// flatfsExt is added to every value file, so a key can't collide with
+// the directory holding it's children
+const flatfsExt = ".data"
+
+// FlatfsDatastore is a datastore.Datastore that keeps each value in it's
+// own file beneath Dir, with key namespaces as directories. values must
+// be byte slices
+type FlatfsDatastore struct {
+	Dir string
+}
+
+// NewFlatfsDatastore creates a datastore, creating dir if it doesn't exist
+func NewFlatfsDatastore(dir string) (*FlatfsDatastore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FlatfsDatastore{Dir: dir}, nil
+}
+
+// path gives the file location for a key
+func (d *FlatfsDatastore) path(key datastore.Key) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(key.String())) + flatfsExt
+}
+
+// Put writes value to disk, value must be a []byte. values are written to
+// a temp file & moved into place, so partial writes are never visible
+func (d *FlatfsDatastore) Put(key datastore.Key, value interface{}) error {
+	data, ok := value.([]byte)
+	if !ok {
+		return datastore.ErrInvalidType
+	}
+
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads a value from disk
+func (d *FlatfsDatastore) Get(key datastore.Key) (interface{}, error) {
+	data, err := ioutil.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, datastore.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Has checks for a value on disk
+func (d *FlatfsDatastore) Has(key datastore.Key) (bool, error) {
+	if _, err := os.Stat(d.path(key)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes a value from disk
+func (d *FlatfsDatastore) Delete(key datastore.Key) error {
+	if err := os.Remove(d.path(key)); os.IsNotExist(err) {
+		return datastore.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Query walks the directory tree for matching keys. only q.Prefix narrows
+// the walk, all other query options are applied in memory
+func (d *FlatfsDatastore) Query(q query.Query) (query.Results, error) {
+	root := d.Dir
+	if q.Prefix != "" {
+		root = filepath.Join(d.Dir, filepath.FromSlash(datastore.NewKey(q.Prefix).Parent().String()))
+	}
+
+	entries := []query.Entry{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, flatfsExt) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.Dir, strings.TrimSuffix(path, flatfsExt))
+		if err != nil {
+			return err
+		}
+		e := query.Entry{Key: datastore.NewKey(filepath.ToSlash(rel)).String()}
+		if !q.KeysOnly {
+			if e.Value, err = ioutil.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)), nil
+}
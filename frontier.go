@@ -0,0 +1,497 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/fetchbot"
+)
+
+// crawler identifiers. Each fetcher only leases frontier entries
+// that carry it's id
+const (
+	// main crawler, HEAD's everything & GET's whitelisted html
+	crawlerMain = "A"
+	// sideband crawler for urls that look like content
+	crawlerContent = "B"
+	// crawler for urls seeded through the api
+	crawlerSeeds = "C"
+)
+
+// FrontierState is the lifecycle position of an entry in the frontier
+type FrontierState string
+
+const (
+	// waiting for a HEAD request
+	FrontierPendingHead FrontierState = "pending_head"
+	// waiting for a GET request
+	FrontierPendingGet FrontierState = "pending_get"
+	// leased to a crawler, request underway
+	FrontierInFlight FrontierState = "in_flight"
+	// request completed
+	FrontierDone FrontierState = "done"
+	// request errored
+	FrontierFailed FrontierState = "failed"
+)
+
+// frontier priorities, higher priorities are leased first
+const (
+	priorityDefault        = 0
+	priorityRequisite      = 5
+	prioritySeed           = 10
+	priorityCrawlingSource = 20
+)
+
+var (
+	// how long a leased entry or host belongs to a process before
+	// it's considered abandoned & can be leased again. leases are kept
+	// alive by heartbeats, so this only needs to outlast a few missed beats
+	FrontierLeaseDuration = time.Minute * 2
+	// how often a process renews it's leases
+	FrontierHeartbeatInterval = time.Second * 30
+	// how often crawlers check the frontier for new work
+	FrontierPollInterval = time.Second * 5
+	// max number of entries a single crawler will hold at once
+	FrontierMaxLeased = 200
+	// max number of hosts a single process will claim at once
+	FrontierMaxHosts = 50
+)
+
+// FrontierEntry is a single url waiting to be (or being) crawled
+type FrontierEntry struct {
+	// absolute url string
+	Url string `json:"url"`
+	// Created timestamp rounded to seconds in UTC
+	Created time.Time `json:"created"`
+	// Updated timestamp rounded to seconds in UTC
+	Updated time.Time `json:"updated"`
+	// host portion of the url, entries are partitioned between
+	// processes by host
+	Host string `json:"host"`
+	// id of the crawler that should process this entry
+	Crawler string `json:"crawler"`
+	// HTTP method to issue, HEAD or GET
+	Method string `json:"method"`
+	// current lifecycle position
+	State FrontierState `json:"state"`
+	// higher priorities are leased first
+	Priority int `json:"priority"`
+	// entry won't be leased before this time
+	NextEligible time.Time `json:"nextEligible"`
+	// number of links followed from a crawling source to reach this url
+	Depth int `json:"depth"`
+	// identifier of the process currently holding this entry
+	LeaseOwner string `json:"leaseOwner,omitempty"`
+	// time the current lease runs out
+	LeaseExpires *time.Time `json:"leaseExpires,omitempty"`
+	// number of times this entry has been leased
+	Attempts int `json:"attempts"`
+	// most recent error, if any
+	LastError string `json:"lastError,omitempty"`
+}
+
+// UnmarshalSQL reads an sql response into the entry receiver
+func (e *FrontierEntry) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		rawurl, host, crawler, method, state, owner, lastErr string
+		created, updated, eligible                           time.Time
+		expires                                              *time.Time
+		priority, depth, attempts                            int
+	)
+
+	if err := row.Scan(&rawurl, &created, &updated, &host, &crawler, &method, &state, &priority, &eligible, &depth, &owner, &expires, &attempts, &lastErr); err != nil {
+		return err
+	}
+
+	if expires != nil {
+		utc := expires.In(time.UTC)
+		expires = &utc
+	}
+
+	*e = FrontierEntry{
+		Url:          rawurl,
+		Created:      created.In(time.UTC),
+		Updated:      updated.In(time.UTC),
+		Host:         host,
+		Crawler:      crawler,
+		Method:       method,
+		State:        FrontierState(state),
+		Priority:     priority,
+		NextEligible: eligible.In(time.UTC),
+		Depth:        depth,
+		LeaseOwner:   owner,
+		LeaseExpires: expires,
+		Attempts:     attempts,
+		LastError:    lastErr,
+	}
+	return nil
+}
+
+// Frontier is the durable crawl queue, persisted to the frontier table.
+// crawlers lease entries from the frontier, and acknowledge them once
+// handled, so a restarted process picks up exactly where it left off.
+//
+// Any number of processes can share one frontier. Each process claims a
+// set of hosts & only leases urls from those hosts, so two processes never
+// hit the same host at once. Leases on both hosts & entries expire unless
+// renewed with Heartbeat, handing the work of a dead process to the others.
+//
+// A frontier with a Store keeps it's entries in an embedded store instead,
+// see embedded_frontier.go. only one process can use an embedded frontier
+type Frontier struct {
+	// db the frontier is persisted to
+	DB *sql.DB
+	// embedded store the frontier is persisted to instead of DB, if set
+	Store *EmbeddedStore
+	// name for this process when holding leases, must be unique
+	// among all processes sharing the frontier
+	Owner string
+	// how long leases last without a heartbeat
+	LeaseDuration time.Duration
+	// max number of hosts to claim at once
+	MaxHosts int
+
+	// serializes changes to an embedded frontier
+	lock sync.Mutex
+	// lease expiries Heartbeat has renewed on an embedded frontier, by url.
+	// protected by lock
+	renewed map[string]time.Time
+}
+
+// NewFrontier creates a frontier backed by db
+func NewFrontier(db *sql.DB, owner string) *Frontier {
+	return &Frontier{
+		DB:            db,
+		Owner:         owner,
+		LeaseDuration: FrontierLeaseDuration,
+		MaxHosts:      FrontierMaxHosts,
+	}
+}
+
+// NewEmbeddedFrontier creates a frontier backed by an embedded store
+func NewEmbeddedFrontier(s *EmbeddedStore, owner string) *Frontier {
+	f := NewFrontier(nil, owner)
+	f.Store = s
+	return f
+}
+
+// frontierOwner gives the lease owner name for this process. owner names
+// should be stable across restarts, so a restarted process can reclaim
+// it's own leases right away instead of waiting for them to expire
+func frontierOwner(cfg *config) string {
+	if cfg.InstanceName != "" {
+		return cfg.InstanceName
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "sentry"
+	}
+	return host
+}
+
+// Enqueue adds a url found depth links away from a crawling source to the
+// frontier for a crawler to issue method against.
+// it returns false if the url is already waiting or in-flight
+func (f *Frontier) Enqueue(crawler, method, rawurl string, priority, depth int, eligible time.Time) (bool, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false, err
+	}
+
+	state := FrontierPendingHead
+	if method == "GET" {
+		state = FrontierPendingGet
+	}
+
+	now := time.Now().In(time.UTC)
+	if f.Store != nil {
+		return f.embeddedEnqueue(crawler, method, rawurl, strings.ToLower(u.Host), state, priority, depth, eligible.In(time.UTC), now)
+	}
+	var added string
+	err = f.DB.QueryRow(qFrontierEnqueue, rawurl, now, crawler, method, string(state), priority, eligible.In(time.UTC), strings.ToLower(u.Host), depth).Scan(&added)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Promote moves a url that's waiting to be crawled over to crawler at a
+// higher priority, to issue method against by eligible. urls that are
+// in-flight, finished, failed or already at priority or above are left
+// alone. it returns false if the url wasn't moved
+func (f *Frontier) Promote(crawler, method, rawurl string, priority, depth int, eligible time.Time) (bool, error) {
+	state := FrontierPendingHead
+	if method == "GET" {
+		state = FrontierPendingGet
+	}
+
+	if f.Store != nil {
+		return f.embeddedPromote(crawler, method, rawurl, state, priority, depth, eligible.In(time.UTC))
+	}
+
+	res, err := f.DB.Exec(qFrontierPromote, rawurl, time.Now().In(time.UTC), crawler, method, string(state), priority, eligible.In(time.UTC), depth)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Depth gives the number of links followed from a crawling source to reach
+// rawurl, returning core.ErrNotFound if the frontier hasn't seen it. a url
+// with no frontier history has no known depth, so can't be scoped
+func (f *Frontier) Depth(rawurl string) (depth int, err error) {
+	if f.Store != nil {
+		e, err := f.readEntry(rawurl)
+		if err != nil {
+			return 0, err
+		}
+		return e.Depth, nil
+	}
+
+	err = f.DB.QueryRow(qFrontierDepth, rawurl).Scan(&depth)
+	if err == sql.ErrNoRows {
+		return 0, core.ErrNotFound
+	}
+	return
+}
+
+// Lease claims up to limit entries for crawler, ordered by priority.
+// if this frontier has room for more hosts it'll try to claim them first
+func (f *Frontier) Lease(crawler string, limit int) ([]*FrontierEntry, error) {
+	if f.Store != nil {
+		return f.embeddedLease(crawler, limit)
+	}
+	if err := f.claimHosts(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(time.UTC)
+	rows, err := f.DB.Query(qFrontierLease, crawler, f.Owner, limit, now.Add(f.LeaseDuration), now)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalFrontierEntries(rows)
+}
+
+// claimHosts tops up the set of hosts this frontier owns
+func (f *Frontier) claimHosts() error {
+	now := time.Now().In(time.UTC)
+
+	var owned int
+	if err := f.DB.QueryRow(qFrontierOwnedHostsCount, f.Owner, now).Scan(&owned); err != nil {
+		return err
+	}
+	if owned >= f.MaxHosts {
+		return nil
+	}
+
+	_, err := f.DB.Exec(qFrontierClaimHosts, f.Owner, now.Add(f.LeaseDuration), now, f.MaxHosts-owned)
+	return err
+}
+
+// Heartbeat renews all leases held by this frontier, lets go of hosts
+// that have run out of work, and reclaims expired leases held by others
+func (f *Frontier) Heartbeat() error {
+	if f.Store != nil {
+		return f.embeddedHeartbeat()
+	}
+
+	now := time.Now().In(time.UTC)
+	expires := now.Add(f.LeaseDuration)
+
+	if _, err := f.DB.Exec(qFrontierHeartbeat, f.Owner, expires); err != nil {
+		return err
+	}
+	if _, err := f.DB.Exec(qFrontierHeartbeatHosts, f.Owner, expires); err != nil {
+		return err
+	}
+	if _, err := f.DB.Exec(qFrontierReleaseIdleHosts, f.Owner); err != nil {
+		return err
+	}
+	return f.Reclaim()
+}
+
+// Reclaim returns entries & hosts with expired leases to the pool
+func (f *Frontier) Reclaim() error {
+	now := time.Now().In(time.UTC)
+	if f.Store != nil {
+		return f.embeddedReclaim(now)
+	}
+	if _, err := f.DB.Exec(qFrontierReclaim, now); err != nil {
+		return err
+	}
+	_, err := f.DB.Exec(qFrontierReclaimHosts, now)
+	return err
+}
+
+// StartHeartbeat calls Heartbeat every d until stop is called
+func (f *Frontier) StartHeartbeat(d time.Duration) (stop func()) {
+	t := time.NewTicker(d)
+	go func() {
+		for range t.C {
+			if err := f.Heartbeat(); err != nil {
+				log.Infof("frontier heartbeat error: %s", err)
+			}
+		}
+	}()
+
+	return t.Stop
+}
+
+// Ack marks a url as successfully handled, clearing any failures
+// recorded against it
+func (f *Frontier) Ack(rawurl string) error {
+	if f.Store != nil {
+		return f.embeddedAck(rawurl)
+	}
+	if _, err := f.DB.Exec(qFrontierAck, rawurl, time.Now().In(time.UTC)); err != nil {
+		return err
+	}
+	_, err := f.DB.Exec(qUrlFailureDelete, rawurl)
+	return err
+}
+
+// Fail marks a url as failed, recording reason
+func (f *Frontier) Fail(rawurl string, reason error) error {
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	if f.Store != nil {
+		return f.embeddedFail(rawurl, msg)
+	}
+	_, err := f.DB.Exec(qFrontierFail, rawurl, time.Now().In(time.UTC), msg)
+	return err
+}
+
+// Retry sends a url back to be tried again no earlier than at, recording reason
+func (f *Frontier) Retry(rawurl string, reason error, at time.Time) error {
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	if f.Store != nil {
+		return f.embeddedRetry(rawurl, msg, at.In(time.UTC))
+	}
+	_, err := f.DB.Exec(qFrontierRetry, rawurl, time.Now().In(time.UTC), at.In(time.UTC), msg)
+	return err
+}
+
+// Release gives a leased url back to the frontier untouched
+func (f *Frontier) Release(rawurl string) error {
+	if f.Store != nil {
+		return f.embeddedRelease(rawurl)
+	}
+	_, err := f.DB.Exec(qFrontierRelease, rawurl, time.Now().In(time.UTC))
+	return err
+}
+
+// Recover releases any entries & hosts still leased under this frontier's
+// owner, which can only be left over from a previous run that didn't finish
+func (f *Frontier) Recover() error {
+	if f.Store != nil {
+		return f.embeddedRecover()
+	}
+	if _, err := f.DB.Exec(qFrontierReleaseOwner, f.Owner, time.Now().In(time.UTC)); err != nil {
+		return err
+	}
+	_, err := f.DB.Exec(qFrontierReleaseOwnerHosts, f.Owner)
+	return err
+}
+
+// LeasedCount gives the number of entries crawler is currently holding
+func (f *Frontier) LeasedCount(crawler string) (count int, err error) {
+	if f.Store != nil {
+		return f.embeddedLeasedCount(crawler)
+	}
+	err = f.DB.QueryRow(qFrontierLeasedCount, crawler, f.Owner).Scan(&count)
+	return
+}
+
+// PendingCount gives the number of entries waiting to be crawled
+func (f *Frontier) PendingCount() (count int, err error) {
+	if f.Store != nil {
+		return f.Store.count("frontier.state", string(FrontierPendingHead)) + f.Store.count("frontier.state", string(FrontierPendingGet)), nil
+	}
+	err = f.DB.QueryRow(qFrontierPendingCount).Scan(&count)
+	return
+}
+
+// List returns pending & in-flight entries, paginated
+func (f *Frontier) List(limit, offset int) ([]*FrontierEntry, error) {
+	if f.Store != nil {
+		return f.embeddedList(limit, offset)
+	}
+	rows, err := f.DB.Query(qFrontierList, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalFrontierEntries(rows)
+}
+
+// unmarshalFrontierEntries reads all rows into a slice of entries,
+// closing rows when finished
+func unmarshalFrontierEntries(rows *sql.Rows) ([]*FrontierEntry, error) {
+	defer rows.Close()
+	entries := []*FrontierEntry{}
+	for rows.Next() {
+		e := &FrontierEntry{}
+		if err := e.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// feedQueue leases work for crawler from the frontier & sends it to q
+// every FrontierPollInterval, until q is closed
+func feedQueue(fr *Frontier, crawler string, q *fetchbot.Queue) {
+	t := time.NewTicker(FrontierPollInterval)
+	defer t.Stop()
+
+	for range t.C {
+		leased, err := fr.LeasedCount(crawler)
+		if err != nil {
+			log.Infof("%s crawler frontier count error: %s", crawler, err)
+			continue
+		}
+		if leased >= FrontierMaxLeased {
+			continue
+		}
+
+		entries, err := fr.Lease(crawler, FrontierMaxLeased-leased)
+		if err != nil {
+			log.Infof("%s crawler frontier lease error: %s", crawler, err)
+			continue
+		}
+
+		for i, e := range entries {
+			cmd, err := newCrawlCmd(fr.DB, e)
+			if err != nil {
+				fr.Fail(e.Url, err)
+				continue
+			}
+
+			if err := q.Send(cmd); err != nil {
+				if err == fetchbot.ErrQueueClosed {
+					// hand back everything we didn't get to
+					for _, rest := range entries[i:] {
+						fr.Release(rest.Url)
+					}
+					return
+				}
+				fr.Fail(e.Url, err)
+			}
+		}
+	}
+}
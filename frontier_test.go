@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetFrontier clears out any frontier state left by other tests
+func resetFrontier(t *testing.T) {
+	for _, table := range []string{"frontier", "frontier_hosts"} {
+		if _, err := appDB.Exec(fmt.Sprintf("delete from %s", table)); err != nil {
+			t.Fatalf("error clearing %s: %s", table, err.Error())
+		}
+	}
+}
+
+func TestFrontierEnqueue(t *testing.T) {
+	resetFrontier(t)
+	fr := NewFrontier(appDB, "test-enqueue")
+
+	cases := []struct {
+		method, url string
+		added       bool
+	}{
+		{"HEAD", "http://a.test/one", true},
+		{"GET", "http://a.test/one", false},
+		{"GET", "http://a.test/two", true},
+		{"HEAD", "http://a.test/two", false},
+	}
+
+	for i, c := range cases {
+		added, err := fr.Enqueue(crawlerMain, c.method, c.url, priorityDefault, 0, time.Now())
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if added != c.added {
+			t.Errorf("case %d: %s %s added mismatch. expected: %t, got: %t", i, c.method, c.url, c.added, added)
+		}
+	}
+
+	// finished entries can be enqueued again
+	if err := fr.Ack("http://a.test/one"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if added, err := fr.Enqueue(crawlerMain, "GET", "http://a.test/one", priorityDefault, 0, time.Now()); err != nil {
+		t.Error(err.Error())
+	} else if !added {
+		t.Errorf("expected acked url to be re-enqueued")
+	}
+}
+
+func TestFrontierPromote(t *testing.T) {
+	resetFrontier(t)
+	fr := NewFrontier(appDB, "test-promote")
+
+	for _, rawurl := range []string{"http://a.test/waiting", "http://b.test/leased"} {
+		if _, err := fr.Enqueue(crawlerMain, "HEAD", rawurl, priorityDefault, 2, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := appDB.Exec("update frontier set state = 'in_flight', lease_owner = 'other' where url = 'http://b.test/leased'"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		url   string
+		moved bool
+	}{
+		{"http://a.test/waiting", true},
+		// already at the seed priority
+		{"http://a.test/waiting", false},
+		{"http://b.test/leased", false},
+		{"http://c.test/unknown", false},
+	}
+
+	for i, c := range cases {
+		moved, err := fr.Promote(crawlerSeeds, "GET", c.url, prioritySeed, 0, time.Now())
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if moved != c.moved {
+			t.Errorf("case %d %s moved mismatch. expected: %t, got: %t", i, c.url, c.moved, moved)
+		}
+	}
+
+	var (
+		crawler, method string
+		priority, depth int
+		eligible        time.Time
+	)
+	if err := appDB.QueryRow("select crawler, method, priority, depth, next_eligible from frontier where url = 'http://a.test/waiting'").Scan(&crawler, &method, &priority, &depth, &eligible); err != nil {
+		t.Fatal(err.Error())
+	}
+	if crawler != crawlerSeeds || method != "GET" || priority != prioritySeed || depth != 0 || eligible.After(time.Now()) {
+		t.Errorf("promoted entry mismatch. got crawler: %s, method: %s, priority: %d, depth: %d, eligible: %s", crawler, method, priority, depth, eligible)
+	}
+}
+
+func TestFrontierDepth(t *testing.T) {
+	resetFrontier(t)
+	fr := NewFrontier(appDB, "test-depth")
+
+	if _, err := fr.Enqueue(crawlerMain, "GET", "http://a.test/deep", priorityDefault, 3, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if depth, err := fr.Depth("http://a.test/deep"); err != nil || depth != 3 {
+		t.Errorf("expected depth 3, got: %d, %v", depth, err)
+	}
+	if _, err := fr.Depth("http://a.test/never-seen"); err != core.ErrNotFound {
+		t.Errorf("expected a url with no frontier history to be not found, got: %v", err)
+	}
+}
+
+// TestFrontierInstances runs a number of frontiers against the same database,
+// checking that every url is leased exactly once & no host is ever
+// worked by more than one instance at a time
+func TestFrontierInstances(t *testing.T) {
+	resetFrontier(t)
+
+	const (
+		instances   = 4
+		hosts       = 10
+		urlsPerHost = 20
+	)
+
+	seed := NewFrontier(appDB, "test-seed")
+	for h := 0; h < hosts; h++ {
+		for i := 0; i < urlsPerHost; i++ {
+			rawurl := fmt.Sprintf("http://host-%d.test/page-%d", h, i)
+			if _, err := seed.Enqueue(crawlerMain, "GET", rawurl, priorityDefault, 0, time.Now()); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	var (
+		lock sync.Mutex
+		// url : number of times leased
+		leased = map[string]int{}
+		// host : owner
+		hostOwners = map[string]string{}
+		wg         sync.WaitGroup
+	)
+
+	for n := 0; n < instances; n++ {
+		fr := NewFrontier(appDB, fmt.Sprintf("test-instance-%d", n))
+		fr.MaxHosts = 3
+
+		wg.Add(1)
+		go func(fr *Frontier) {
+			defer wg.Done()
+			for {
+				entries, err := fr.Lease(crawlerMain, 5)
+				if err != nil {
+					t.Errorf("%s lease error: %s", fr.Owner, err.Error())
+					return
+				}
+				if len(entries) == 0 {
+					if pending, err := fr.PendingCount(); err != nil || pending == 0 {
+						return
+					}
+					// other instances still hold the remaining hosts
+					if err := fr.Heartbeat(); err != nil {
+						t.Errorf("%s heartbeat error: %s", fr.Owner, err.Error())
+						return
+					}
+					time.Sleep(time.Millisecond * 10)
+					continue
+				}
+
+				lock.Lock()
+				for _, e := range entries {
+					leased[e.Url]++
+					if owner, ok := hostOwners[e.Host]; ok && owner != fr.Owner {
+						t.Errorf("host %s leased by both %s and %s", e.Host, owner, fr.Owner)
+					}
+					hostOwners[e.Host] = fr.Owner
+				}
+				lock.Unlock()
+
+				for _, e := range entries {
+					if err := fr.Ack(e.Url); err != nil {
+						t.Errorf("%s ack error: %s", fr.Owner, err.Error())
+					}
+				}
+
+				// a host's claim is released once it's out of work, it
+				// may then never be claimed again by anyone
+				if err := fr.Heartbeat(); err != nil {
+					t.Errorf("%s heartbeat error: %s", fr.Owner, err.Error())
+					return
+				}
+			}
+		}(fr)
+	}
+	wg.Wait()
+
+	if len(leased) != hosts*urlsPerHost {
+		t.Errorf("leased url count mismatch. expected: %d, got: %d", hosts*urlsPerHost, len(leased))
+	}
+	for u, count := range leased {
+		if count != 1 {
+			t.Errorf("%s leased %d times", u, count)
+		}
+	}
+}
+
+func TestFrontierReclaim(t *testing.T) {
+	resetFrontier(t)
+
+	dead := NewFrontier(appDB, "test-dead")
+	dead.LeaseDuration = time.Millisecond * 500
+	alive := NewFrontier(appDB, "test-alive")
+
+	for i := 0; i < 5; i++ {
+		if _, err := dead.Enqueue(crawlerMain, "HEAD", fmt.Sprintf("http://reclaim.test/%d", i), priorityDefault, 0, time.Now()); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	entries, err := dead.Lease(crawlerMain, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 5 {
+		t.Fatalf("expected dead instance to lease 5 entries, got: %d", len(entries))
+	}
+
+	// while the lease is live no one else can have the host
+	if got, err := alive.Lease(crawlerMain, 10); err != nil {
+		t.Fatal(err.Error())
+	} else if len(got) != 0 {
+		t.Errorf("expected no entries for live lease, got: %d", len(got))
+	}
+
+	// dead instance never heartbeats
+	time.Sleep(time.Second)
+	if err := alive.Heartbeat(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := alive.Lease(crawlerMain, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got) != 5 {
+		t.Errorf("expected expired leases to be reclaimed. expected: 5, got: %d", len(got))
+	}
+	for _, e := range got {
+		if e.LeaseOwner != alive.Owner {
+			t.Errorf("%s owner mismatch. expected: %s, got: %s", e.Url, alive.Owner, e.LeaseOwner)
+		}
+		if e.Attempts != 2 {
+			t.Errorf("%s attempts mismatch. expected: 2, got: %d", e.Url, e.Attempts)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
 	"io"
 	"net/http"
 	"net/url"
@@ -20,9 +21,8 @@ func reqParamBool(key string, r *http.Request) (bool, error) {
 	return strconv.ParseBool(r.FormValue(key))
 }
 
-// HealthCheckHandler is a basic "hey I'm fine" for load balancers & co
-// TODO - add Database connection & proper configuration checks here for more accurate
-// health reporting
+// HealthCheckHandler is a basic "hey I'm fine" for load balancers & co. it
+// only says the process is alive, see ReadyHandler for component checks
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{ "status" : 200 }`))
@@ -42,9 +42,14 @@ func MemStatsHandler(w http.ResponseWriter, r *http.Request) {
 func QueHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		mu.Lock()
-		w.Write(enquedUrls())
-		mu.Unlock()
+		p := PageFromRequest(r)
+		data, err := enquedUrls(p.Size, p.Offset())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+		w.Write(data)
 	case "POST":
 		SeedUrlHandler(w, r)
 	default:
@@ -72,7 +77,7 @@ func SeedUrlHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err = appDB.Exec("insert into core_requests (created,url,user_id) values ($1, $2, $3)", time.Now().Round(time.Second).In(time.UTC), parsedUrl.String(), "")
+		_, err = appDB.Exec(qArchiveRequestInsert, time.Now().Round(time.Second).In(time.UTC), parsedUrl.String(), "")
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			io.WriteString(w, fmt.Sprintf("save url error: %s", err.Error()))
@@ -80,7 +85,7 @@ func SeedUrlHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		u := &core.Url{Url: parsedUrl.String()}
-		if err := u.Read(store); err != nil {
+		if err := readUrl(store, u); err != nil {
 			if err == core.ErrNotFound {
 				if err := u.Save(store); err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
@@ -94,11 +99,12 @@ func SeedUrlHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		mu.Lock()
-		defer mu.Unlock()
-		enqued[parsedUrl.String()] = "GET"
+		if _, err := frontier.Enqueue(crawlerSeeds, "GET", parsedUrl.String(), prioritySeed, 0, time.Now()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, fmt.Sprintf("enqueue url error: %s", err.Error()))
+			return
+		}
 
-		seedQueue.SendStringGet(parsedUrl.String())
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, fmt.Sprintf("added url: %s", parsedUrl.String()))
 	} else {
@@ -107,29 +113,242 @@ func SeedUrlHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// TODO - fix
-// AddPrimerHandler adds a primer for crawling.
-// func AddPrimerHandler(w http.ResponseWriter, r *http.Request) {
-// 	parsed, err := url.Parse(r.FormValue("url"))
-// 	if err != nil {
-// 		w.WriteHeader(http.StatusBadRequest)
-// 		io.WriteString(w, fmt.Sprintf("parse url '%s' error: %s", r.FormValue("url"), err.Error()))
-// 		return
-// 	}
+// maximum size of a json request body
+const maxJsonBodySize = 1024 * 1024
 
-// 	d := &Primer{
-// 		Host:  parsed.Host,
-// 		Crawl: true,
-// 	}
+// readJsonBody decodes a json request body into v
+func readJsonBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxJsonBodySize)).Decode(v); err != nil {
+		return InvalidError{fmt.Errorf("json formatting error: %s", err.Error())}
+	}
+	return nil
+}
 
-// 	if err := d.Insert(appDB); err != nil {
-// 		w.WriteHeader(http.StatusBadRequest)
-// 		io.WriteString(w, err.Error())
-// 		return
-// 	}
+// writeJson responds with v as indented json
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Debug(err.Error())
+		return
+	}
 
-// 	w.WriteHeader(http.StatusOK)
-// }
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeError responds with the status that fits err
+func writeError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case InvalidError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ConflictError:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == core.ErrNotFound || err == datastore.ErrNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	log.Debug(err.Error())
+}
+
+// reqId reads the required "id" param
+func reqId(r *http.Request) (string, error) {
+	id := r.FormValue("id")
+	if id == "" {
+		return "", InvalidError{fmt.Errorf("id param is required")}
+	}
+	return id, nil
+}
+
+// PrimersHandler manages primers. GET with an "id" param reads a single
+// primer with it's sources & sub-primers, otherwise primers are listed.
+// POST creates a primer from a json body, PUT replaces the primer with
+// "id" & DELETE marks it deleted
+func PrimersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.FormValue("id") == "" {
+			p := PageFromRequest(r)
+			primers, err := core.ListPrimers(store, p.Size, p.Offset())
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJson(w, http.StatusOK, primers)
+			return
+		}
+
+		p := &core.Primer{Id: r.FormValue("id")}
+		if err := p.Read(store); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := readPrimerChildren(store, p); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, p)
+	case "POST":
+		p := &core.Primer{}
+		if err := readJsonBody(r, p); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := CreatePrimer(p); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusCreated, p)
+	case "PUT":
+		id, err := reqId(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		update := &core.Primer{}
+		if err := readJsonBody(r, update); err != nil {
+			writeError(w, err)
+			return
+		}
+		p, err := UpdatePrimer(id, update)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, p)
+	case "DELETE":
+		id, err := reqId(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := DeletePrimer(appDB, id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, fmt.Sprintf("deleted primer: %s", id))
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// SourcesHandler manages sources & their crawler settings. GET with an
+// "id" param reads a single source, otherwise sources are listed, only
+// crawling ones with "crawling=true". POST creates a source from a json
+// body, PUT replaces the source with "id" & DELETE marks it deleted. basic
+// auth passwords are never included in responses
+func SourcesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.FormValue("id") == "" {
+			p := PageFromRequest(r)
+			var (
+				sources []*core.Source
+				err     error
+			)
+			if crawling, _ := reqParamBool("crawling", r); crawling {
+				sources, err = crawlingSources(store, p.Size, p.Offset())
+			} else {
+				sources, err = core.ListSources(store, p.Size, p.Offset())
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJson(w, http.StatusOK, sources)
+			return
+		}
+
+		s, err := ReadSourceBody(appDB, r.FormValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s.Settings = s.Settings.redacted()
+		writeJson(w, http.StatusOK, s)
+	case "POST":
+		s := &SourceBody{}
+		if err := readJsonBody(r, s); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := CreateSource(appDB, s); err != nil {
+			writeError(w, err)
+			return
+		}
+		reloadSources(appDB)
+		s.Settings = s.Settings.redacted()
+		writeJson(w, http.StatusCreated, s)
+	case "PUT":
+		id, err := reqId(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		update := &SourceBody{}
+		if err := readJsonBody(r, update); err != nil {
+			writeError(w, err)
+			return
+		}
+		s, err := UpdateSource(appDB, id, update)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		reloadSources(appDB)
+		s.Settings = s.Settings.redacted()
+		writeJson(w, http.StatusOK, s)
+	case "DELETE":
+		id, err := reqId(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := DeleteSource(appDB, id); err != nil {
+			writeError(w, err)
+			return
+		}
+		reloadSources(appDB)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, fmt.Sprintf("deleted source: %s", id))
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// SourceCrawlHandler turns crawling of a source on or off with a POST of
+// "id" & "crawl=true" or "crawl=false" params
+func SourceCrawlHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		id, err := reqId(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		crawl, err := reqParamBool("crawl", r)
+		if err != nil {
+			writeError(w, InvalidError{fmt.Errorf("invalid crawl param: %s", err)})
+			return
+		}
+		s, err := SetSourceCrawl(appDB, id, crawl)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		reloadSources(appDB)
+		writeJson(w, http.StatusOK, s)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
 
 // func UrlMetadataHandler(w http.ResponseWriter, r *http.Request) {
 // 	reqUrl, err := reqUrl(r)
@@ -263,6 +482,11 @@ func ShutdownHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		stopCrawler <- true
+		if warcs != nil {
+			if err := warcs.Close(); err != nil {
+				log.Infof("error closing warc file: %s", err)
+			}
+		}
 		w.Write([]byte("shutting down\n"))
 	default:
 		NotFoundHandler(w, r)
@@ -281,7 +505,7 @@ func UrlsHandler(w http.ResponseWriter, r *http.Request) {
 		url := r.FormValue("url")
 		if url != "" {
 			u := &core.Url{Url: url}
-			if err := u.Read(store); err != nil {
+			if err := readUrl(store, u); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Debug(err.Error())
 				return
@@ -304,7 +528,7 @@ func UrlsHandler(w http.ResponseWriter, r *http.Request) {
 				err  error
 			)
 			if fetched, _ := reqParamBool("fetched", r); fetched {
-				urls, err = core.FetchedUrls(appDB, p.Size, p.Offset())
+				urls, err = fetchedUrls(store, p.Size, p.Offset())
 			} else {
 				urls, err = core.ListUrls(store, p.Size, p.Offset())
 			}
@@ -349,3 +573,88 @@ func CrawlingSourcesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(data)
 }
+
+// FailuresHandler lists urls that are failing to crawl, most recent first.
+// results can be narrowed with a "source" id param, & "dead=true" or
+// "dead=false". DELETE with a "url" param forgets a url's failures, so a
+// dead url can be crawled again
+func FailuresHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		p := PageFromRequest(r)
+		var dead *bool
+		if r.FormValue("dead") != "" {
+			d, err := reqParamBool("dead", r)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid dead param: %s", err), http.StatusBadRequest)
+				return
+			}
+			dead = &d
+		}
+
+		failures, err := ListUrlFailures(appDB, r.FormValue("source"), dead, p.Size, p.Offset())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+
+		data, err := json.MarshalIndent(failures, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case "DELETE":
+		f := &UrlFailure{Url: r.FormValue("url")}
+		if f.Url == "" {
+			http.Error(w, "url param is required", http.StatusBadRequest)
+			return
+		}
+		if err := f.Delete(appDB); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, fmt.Sprintf("cleared failures for: %s", f.Url))
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// RedirectsHandler lists redirect chains that start from, pass through or
+// end at the url param
+func RedirectsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rawurl := r.FormValue("url")
+		if rawurl == "" {
+			http.Error(w, "url param is required", http.StatusBadRequest)
+			return
+		}
+
+		p := PageFromRequest(r)
+		hops, err := RedirectsForUrl(appDB, rawurl, p.Size, p.Offset())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+
+		data, err := json.MarshalIndent(hops, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Debug(err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sql_datastore"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadinessCheckTimeout is how long a readiness check gets before the
+// component it checks is reported as failing
+var ReadinessCheckTimeout = time.Second * 5
+
+// component health statuses
+const (
+	healthOk       = "ok"
+	healthFailing  = "failing"
+	healthDisabled = "disabled"
+)
+
+var (
+	// protect access to fetcherHealth
+	healthMu sync.Mutex
+	// fetcherHealth is the state of each crawler's fetcher, by crawler id
+	fetcherHealth = map[string]*FetcherHealth{}
+)
+
+// FetcherHealth is weather a crawler's fetcher is running & when it last
+// fetched a url successfully
+type FetcherHealth struct {
+	Running     bool       `json:"running"`
+	Started     *time.Time `json:"started,omitempty"`
+	Stopped     *time.Time `json:"stopped,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// fetcherState gives a copy of crawler's fetcher state
+func fetcherState(crawler string) FetcherHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if h := fetcherHealth[crawler]; h != nil {
+		return *h
+	}
+	return FetcherHealth{}
+}
+
+// updateFetcher changes crawler's fetcher state with fn
+func updateFetcher(crawler string, fn func(h *FetcherHealth, now time.Time)) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := fetcherHealth[crawler]
+	if h == nil {
+		h = &FetcherHealth{}
+		fetcherHealth[crawler] = h
+	}
+	fn(h, time.Now().In(time.UTC))
+}
+
+// fetcherStarted records crawler's fetcher has started processing it's queue
+func fetcherStarted(crawler string) {
+	updateFetcher(crawler, func(h *FetcherHealth, now time.Time) {
+		h.Running = true
+		h.Started = &now
+		h.Stopped = nil
+	})
+}
+
+// fetcherStopped records crawler's fetcher queue has closed
+func fetcherStopped(crawler string) {
+	updateFetcher(crawler, func(h *FetcherHealth, now time.Time) {
+		h.Running = false
+		h.Stopped = &now
+	})
+}
+
+// fetchSucceeded records crawler got a successful response
+func fetchSucceeded(crawler string) {
+	updateFetcher(crawler, func(h *FetcherHealth, now time.Time) {
+		h.LastSuccess = &now
+	})
+}
+
+// ComponentHealth is the result of checking one thing sentry depends on
+type ComponentHealth struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthReport is the readiness of sentry & all it's components. Status is
+// only ok if no component is failing
+type HealthReport struct {
+	Status     string                      `json:"status"`
+	Checked    time.Time                   `json:"checked"`
+	Components map[string]*ComponentHealth `json:"components"`
+}
+
+// readinessCheck checks a single named component
+type readinessCheck struct {
+	name  string
+	check func() *ComponentHealth
+}
+
+// componentOk wraps details in an ok component
+func componentOk(details interface{}) *ComponentHealth {
+	return &ComponentHealth{Status: healthOk, Details: details}
+}
+
+// componentFailing reports err for a component
+func componentFailing(err error, details interface{}) *ComponentHealth {
+	return &ComponentHealth{Status: healthFailing, Error: err.Error(), Details: details}
+}
+
+// checkReadiness runs all checks at once, giving each until timeout to
+// finish. a check that panics or runs out of time is failing, so a hung
+// database can't hang the report
+func checkReadiness(checks []readinessCheck, timeout time.Duration) *HealthReport {
+	type result struct {
+		name string
+		res  *ComponentHealth
+	}
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func(c readinessCheck) {
+			defer func() {
+				if r := recover(); r != nil {
+					results <- result{c.name, componentFailing(fmt.Errorf("check panicked: %v", r), nil)}
+				}
+			}()
+			results <- result{c.name, c.check()}
+		}(c)
+	}
+
+	report := &HealthReport{
+		Status:     healthOk,
+		Checked:    time.Now().Round(time.Second).In(time.UTC),
+		Components: map[string]*ComponentHealth{},
+	}
+	deadline := time.After(timeout)
+	for range checks {
+		select {
+		case r := <-results:
+			report.Components[r.name] = r.res
+		case <-deadline:
+			for _, c := range checks {
+				if report.Components[c.name] == nil {
+					report.Components[c.name] = componentFailing(fmt.Errorf("timed out after %s", timeout), nil)
+				}
+			}
+		}
+		if len(report.Components) == len(checks) {
+			break
+		}
+	}
+
+	for _, c := range report.Components {
+		if c.Status == healthFailing {
+			report.Status = healthFailing
+		}
+	}
+	return report
+}
+
+// readinessChecks gives the checks for this process. A & B crawlers are
+// only expected to be running when cfg.Crawl is set
+func readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{"database", checkDatabase},
+		{"store", checkStore},
+		{"blobs", checkBlobs},
+		{"frontier", checkFrontier},
+	}
+	for _, c := range []struct {
+		crawler  string
+		expected bool
+	}{
+		{crawlerMain, cfg.Crawl},
+		{crawlerContent, cfg.Crawl},
+		{crawlerSeeds, true},
+	} {
+		c := c
+		checks = append(checks, readinessCheck{"fetcher" + c.crawler, func() *ComponentHealth {
+			return checkFetcher(c.crawler, c.expected)
+		}})
+	}
+	return checks
+}
+
+// checkDatabase pings the postgres app db, which isn't used with an
+// embedded store
+func checkDatabase() *ComponentHealth {
+	if _, ok := store.(*EmbeddedStore); ok {
+		return &ComponentHealth{Status: healthDisabled}
+	}
+	if err := appDB.Ping(); err != nil {
+		return componentFailing(err, nil)
+	}
+	return componentOk(nil)
+}
+
+// checkStore makes sure the store core models are kept in is usable
+func checkStore() *ComponentHealth {
+	details := map[string]string{"type": "postgres"}
+	switch s := store.(type) {
+	case *EmbeddedStore:
+		details["type"] = "embedded"
+		if err := s.Ping(); err != nil {
+			return componentFailing(err, details)
+		}
+	case *sql_datastore.Datastore:
+		if s.DB == nil {
+			return componentFailing(fmt.Errorf("store has no database"), details)
+		}
+		if err := s.DB.Ping(); err != nil {
+			return componentFailing(err, details)
+		}
+	default:
+		details["type"] = fmt.Sprintf("%T", store)
+	}
+	return componentOk(details)
+}
+
+// checkBlobs asks the blob store weather it has the empty blob, which
+// only errors if the store can't be reached
+func checkBlobs() *ComponentHealth {
+	if blobs == nil {
+		return &ComponentHealth{Status: healthDisabled}
+	}
+	details := map[string]string{"type": cfg.BlobStore}
+	hash, err := core.CalcHash([]byte{})
+	if err != nil {
+		return componentFailing(err, details)
+	}
+	if _, err := blobs.Has(hash); err != nil {
+		return componentFailing(err, details)
+	}
+	return componentOk(details)
+}
+
+// checkFrontier reports the number of urls waiting to be crawled
+func checkFrontier() *ComponentHealth {
+	if frontier == nil {
+		return componentFailing(fmt.Errorf("frontier isn't set up"), nil)
+	}
+	pending, err := frontier.PendingCount()
+	if err != nil {
+		return componentFailing(err, nil)
+	}
+	return queueHealth(pending, cfg.ReadyMaxPending)
+}
+
+// queueHealth fails if more than max urls are pending, 0 is no max
+func queueHealth(pending, max int) *ComponentHealth {
+	details := map[string]int{"pending": pending}
+	if max > 0 && pending > max {
+		return componentFailing(fmt.Errorf("%d urls pending, more than the max of %d", pending, max), details)
+	}
+	return componentOk(details)
+}
+
+// FetcherDetails adds the urls a fetcher holds & how long it's been since it
+// last succeeded to it's state
+type FetcherDetails struct {
+	FetcherHealth
+	Leased           int    `json:"leased"`
+	SinceLastSuccess string `json:"sinceLastSuccess,omitempty"`
+}
+
+// checkFetcher reports on crawler's fetcher
+func checkFetcher(crawler string, expected bool) *ComponentHealth {
+	leased := 0
+	if frontier != nil {
+		var err error
+		if leased, err = frontier.LeasedCount(crawler); err != nil {
+			return componentFailing(err, nil)
+		}
+	}
+	return fetcherHealthAt(fetcherState(crawler), expected, leased, cfg.MaxFetchAge(), time.Now())
+}
+
+// fetcherHealthAt judges a fetcher's state at now. a running fetcher is
+// wedged if it's holding urls but hasn't had a successful fetch in maxAge.
+// an idle fetcher with nothing leased is fine no matter how long it's been
+func fetcherHealthAt(state FetcherHealth, expected bool, leased int, maxAge time.Duration, now time.Time) *ComponentHealth {
+	details := &FetcherDetails{FetcherHealth: state, Leased: leased}
+	if !state.Running {
+		if !expected {
+			return &ComponentHealth{Status: healthDisabled, Details: details}
+		}
+		return componentFailing(fmt.Errorf("fetcher isn't running"), details)
+	}
+
+	since := state.Started
+	if state.LastSuccess != nil {
+		since = state.LastSuccess
+		details.SinceLastSuccess = now.Sub(*state.LastSuccess).Round(time.Second).String()
+	}
+	if since != nil && leased > 0 && now.Sub(*since) > maxAge {
+		return componentFailing(fmt.Errorf("no successful fetch in %s with %d urls leased", maxAge, leased), details)
+	}
+	return componentOk(details)
+}
+
+// ReadyHandler reports weather sentry is ready for work, responding with
+// 503 Service Unavailable if any component is failing
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := checkReadiness(readinessChecks(), ReadinessCheckTimeout)
+	status := http.StatusOK
+	if report.Status != healthOk {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFetcherHealthAt(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+
+	cases := []struct {
+		state    FetcherHealth
+		expected bool
+		leased   int
+		status   string
+		err      string
+	}{
+		{FetcherHealth{}, false, 0, healthDisabled, ""},
+		{FetcherHealth{}, true, 0, healthFailing, "fetcher isn't running"},
+		{FetcherHealth{Running: true, Started: ago(time.Minute)}, true, 10, healthOk, ""},
+		{FetcherHealth{Running: true, Started: ago(time.Hour)}, true, 10, healthFailing, "no successful fetch in 15m0s with 10 urls leased"},
+		{FetcherHealth{Running: true, Started: ago(time.Hour)}, true, 0, healthOk, ""},
+		{FetcherHealth{Running: true, Started: ago(time.Hour), LastSuccess: ago(time.Minute)}, true, 10, healthOk, ""},
+		{FetcherHealth{Running: true, Started: ago(time.Hour), LastSuccess: ago(time.Minute * 20)}, true, 3, healthFailing, "no successful fetch in 15m0s with 3 urls leased"},
+		{FetcherHealth{Running: false, Started: ago(time.Hour), Stopped: ago(time.Minute)}, true, 0, healthFailing, "fetcher isn't running"},
+	}
+
+	for i, c := range cases {
+		got := fetcherHealthAt(c.state, c.expected, c.leased, time.Minute*15, now)
+		if got.Status != c.status || got.Error != c.err {
+			t.Errorf("case %d mismatch. expected: %s '%s', got: %s '%s'", i, c.status, c.err, got.Status, got.Error)
+		}
+	}
+}
+
+func TestFetcherState(t *testing.T) {
+	crawler := "test-fetcher"
+	if s := fetcherState(crawler); s.Running || s.Started != nil {
+		t.Errorf("expected unknown fetcher to be stopped, got: %#v", s)
+	}
+	fetcherStarted(crawler)
+	fetchSucceeded(crawler)
+	if s := fetcherState(crawler); !s.Running || s.Started == nil || s.LastSuccess == nil {
+		t.Errorf("expected running fetcher with a success, got: %#v", s)
+	}
+	fetcherStopped(crawler)
+	if s := fetcherState(crawler); s.Running || s.Stopped == nil || s.LastSuccess == nil {
+		t.Errorf("expected stopped fetcher to keep it's last success, got: %#v", s)
+	}
+}
+
+func TestQueueHealth(t *testing.T) {
+	cases := []struct {
+		pending, max int
+		status       string
+	}{
+		{0, 0, healthOk},
+		{5000, 0, healthOk},
+		{100, 100, healthOk},
+		{101, 100, healthFailing},
+	}
+
+	for i, c := range cases {
+		if got := queueHealth(c.pending, c.max); got.Status != c.status {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.status, got.Status)
+		}
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	ok := func() *ComponentHealth { return componentOk(nil) }
+	disabled := func() *ComponentHealth { return &ComponentHealth{Status: healthDisabled} }
+	failing := func() *ComponentHealth { return componentFailing(fmt.Errorf("down"), nil) }
+	panics := func() *ComponentHealth { panic("boom") }
+	hangs := func() *ComponentHealth {
+		time.Sleep(time.Second)
+		return componentOk(nil)
+	}
+
+	cases := []struct {
+		checks []readinessCheck
+		status string
+		errs   map[string]string
+	}{
+		{[]readinessCheck{{"a", ok}, {"b", disabled}}, healthOk, map[string]string{"a": "", "b": ""}},
+		{[]readinessCheck{{"a", ok}, {"b", failing}}, healthFailing, map[string]string{"a": "", "b": "down"}},
+		{[]readinessCheck{{"a", panics}, {"b", ok}}, healthFailing, map[string]string{"a": "check panicked: boom", "b": ""}},
+		{[]readinessCheck{{"a", ok}, {"b", hangs}}, healthFailing, map[string]string{"a": "", "b": "timed out after 50ms"}},
+	}
+
+	for i, c := range cases {
+		report := checkReadiness(c.checks, time.Millisecond*50)
+		if report.Status != c.status {
+			t.Errorf("case %d status mismatch. expected: %s, got: %s", i, c.status, report.Status)
+		}
+		if len(report.Components) != len(c.checks) {
+			t.Errorf("case %d expected %d components, got %d", i, len(c.checks), len(report.Components))
+			continue
+		}
+		for name, err := range c.errs {
+			if got := report.Components[name]; got.Error != err {
+				t.Errorf("case %d component %s error mismatch. expected: '%s', got: '%s'", i, name, err, got.Error)
+			}
+		}
+	}
+}
+
+func TestCheckStoreEmbedded(t *testing.T) {
+	s, dir := tempEmbeddedStore(t)
+	defer os.RemoveAll(dir)
+
+	prev := store
+	store = s
+	defer func() { store = prev }()
+
+	if got := checkStore(); got.Status != healthOk {
+		t.Errorf("expected open embedded store to be ok, got: %#v", got)
+	}
+	if got := checkDatabase(); got.Status != healthDisabled {
+		t.Errorf("expected database to be disabled with an embedded store, got: %#v", got)
+	}
+	s.Close()
+	if got := checkStore(); got.Status != healthFailing {
+		t.Errorf("expected closed embedded store to be failing, got: %#v", got)
+	}
+}
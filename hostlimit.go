@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/temoto/robotstxt-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// hosts is the per-host limiter shared by all crawlers, so the A, B & C
+	// fetchers never add up to more than one host's allowance
+	hosts = NewHostLimiter()
+
+	// largest multiple of a host's base delay backoff will grow to
+	MaxHostBackoff = 32.0
+	// longest delay between requests to a host, not counting Retry-After
+	MaxHostDelay = time.Minute * 2
+	// largest robots.txt body read when looking for a Crawl-delay
+	maxRobotsSize int64 = 512 * 1024
+)
+
+// HostLimiter spaces out & caps concurrent requests to each host. The delay
+// between requests to a host starts at the most specific of source settings
+// or cfg.CrawlDelaySeconds, raised to the host's robots.txt Crawl-delay.
+// 429 & 503 responses & timeouts double it, successful responses ease it
+// back down, and it never drops below the host's average response time
+type HostLimiter struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	hosts map[string]*hostLimit
+
+	// clock funcs, swapped out in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// hostLimit is the limiter state for a single host
+type hostLimit struct {
+	// requests currently in flight
+	inflight int
+	// earliest time the next request can start
+	next time.Time
+	// Crawl-delay from robots.txt, if any
+	robotsDelay time.Duration
+	// backoff multiple applied to the base delay, never below 1
+	backoff float64
+	// moving average of response times
+	latency time.Duration
+}
+
+// NewHostLimiter creates an empty host limiter
+func NewHostLimiter() *HostLimiter {
+	l := &HostLimiter{
+		hosts: map[string]*hostLimit{},
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// host gets the state for a host, creating it if needed. l.lock must be held
+func (l *HostLimiter) host(name string) *hostLimit {
+	name = strings.ToLower(name)
+	h := l.hosts[name]
+	if h == nil {
+		h = &hostLimit{backoff: 1}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// Wait blocks until a request to u is allowed to start, returning a func
+// that must be called once the request is done
+func (l *HostLimiter) Wait(u *url.URL) (done func()) {
+	set := settingsForUrl(u.String())
+	base := time.Duration(cfg.CrawlDelaySeconds) * time.Second
+	if set.CrawlDelay > 0 {
+		base = set.CrawlDelay
+	}
+	conns := cfg.HostConnections()
+	if set.MaxConnections > 0 {
+		conns = set.MaxConnections
+	}
+
+	l.lock.Lock()
+	h := l.host(u.Host)
+	for h.inflight >= conns {
+		l.cond.Wait()
+	}
+	h.inflight++
+
+	now := l.now()
+	start := h.next
+	if start.Before(now) {
+		start = now
+	}
+	h.next = start.Add(h.delay(base))
+	l.lock.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		l.sleep(wait)
+	}
+
+	return func() {
+		l.lock.Lock()
+		h.inflight--
+		l.lock.Unlock()
+		l.cond.Broadcast()
+	}
+}
+
+// Observe adjusts a host's rate from the outcome of a request that took took
+func (l *HostLimiter) Observe(u *url.URL, res *http.Response, err error, took time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	h := l.host(u.Host)
+
+	if err != nil {
+		if classifyError(err) == ErrorKindTimeout {
+			h.slowDown()
+		}
+		return
+	}
+
+	if h.latency == 0 {
+		h.latency = took
+	} else {
+		h.latency = (h.latency*4 + took) / 5
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		h.slowDown()
+		if wait := parseRetryAfter(res.Header.Get("Retry-After"), l.now()); wait > 0 {
+			if until := l.now().Add(wait); until.After(h.next) {
+				h.next = until
+			}
+		}
+	default:
+		if res.StatusCode < 400 {
+			h.speedUp()
+		}
+	}
+}
+
+// SetRobotsDelay records the robots.txt Crawl-delay for a host
+func (l *HostLimiter) SetRobotsDelay(host string, d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.host(host).robotsDelay = d
+}
+
+// delay gives the wait between requests to the host given a base delay
+func (h *hostLimit) delay(base time.Duration) time.Duration {
+	if h.robotsDelay > base {
+		base = h.robotsDelay
+	}
+	d := time.Duration(float64(base) * h.backoff)
+	if h.latency > d {
+		d = h.latency
+	}
+	if d > MaxHostDelay {
+		d = MaxHostDelay
+	}
+	return d
+}
+
+func (h *hostLimit) slowDown() {
+	if h.backoff *= 2; h.backoff > MaxHostBackoff {
+		h.backoff = MaxHostBackoff
+	}
+}
+
+func (h *hostLimit) speedUp() {
+	if h.backoff *= 0.75; h.backoff < 1 {
+		h.backoff = 1
+	}
+}
+
+// limitedDoer is a fetchbot.Doer that waits on a HostLimiter before each
+// request & reports back how it went. robots.txt responses are read for
+// a Crawl-delay on the way through. connection slots are given back once
+// response headers arrive, so handlers can make follow-up requests to the
+// same host (eg. resuming a download) without deadlocking
+type limitedDoer struct {
+	fetchbot.Doer
+	limiter *HostLimiter
+}
+
+// newLimitedDoer wraps client with the shared host limiter
+func newLimitedDoer(client fetchbot.Doer) fetchbot.Doer {
+	return &limitedDoer{Doer: client, limiter: hosts}
+}
+
+func (d *limitedDoer) Do(req *http.Request) (*http.Response, error) {
+	done := d.limiter.Wait(req.URL)
+	defer done()
+
+	start := time.Now()
+	res, err := d.Doer.Do(req)
+	d.limiter.Observe(req.URL, res, err, time.Since(start))
+
+	if err == nil && req.URL.Path == "/robots.txt" {
+		d.readRobots(req, res)
+	}
+	return res, err
+}
+
+// readRobots picks the Crawl-delay for the requesting user agent out of a
+// robots.txt response, leaving the body intact for the caller
+func (d *limitedDoer) readRobots(req *http.Request, res *http.Response) {
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRobotsSize))
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	robots, err := robotstxt.FromStatusAndBytes(res.StatusCode, data)
+	if err != nil {
+		return
+	}
+	if group := robots.FindGroup(req.Header.Get("User-Agent")); group != nil {
+		d.limiter.SetRobotsDelay(req.URL.Host, group.CrawlDelay)
+	}
+}
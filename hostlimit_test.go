@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeClockLimiter creates a host limiter with a clock that only moves
+// when the limiter sleeps, recording each sleep
+func fakeClockLimiter(sleeps *[]time.Duration) *HostLimiter {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewHostLimiter()
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+		now = now.Add(d)
+	}
+	return l
+}
+
+func TestHostLimitDelay(t *testing.T) {
+	cases := []struct {
+		base, robots time.Duration
+		backoff      float64
+		latency      time.Duration
+		expect       time.Duration
+	}{
+		{0, 0, 1, 0, 0},
+		{time.Second, 0, 1, 0, time.Second},
+		{time.Second, time.Second * 10, 1, 0, time.Second * 10},
+		{time.Second * 10, time.Second, 1, 0, time.Second * 10},
+		{time.Second, 0, 4, 0, time.Second * 4},
+		{time.Second, 0, 1, time.Second * 3, time.Second * 3},
+		{time.Second, 0, 2, time.Millisecond * 100, time.Second * 2},
+		{time.Minute, 0, MaxHostBackoff, 0, MaxHostDelay},
+	}
+
+	for i, c := range cases {
+		h := &hostLimit{robotsDelay: c.robots, backoff: c.backoff, latency: c.latency}
+		if got := h.delay(c.base); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestHostLimiterWait(t *testing.T) {
+	prev := cfg.CrawlDelaySeconds
+	cfg.CrawlDelaySeconds = 2
+	defer func() { cfg.CrawlDelaySeconds = prev }()
+
+	sleeps := []time.Duration{}
+	l := fakeClockLimiter(&sleeps)
+	a, _ := url.Parse("http://a.test/one")
+	b, _ := url.Parse("http://b.test/one")
+
+	// first request to each host starts right away, the next waits
+	l.Wait(a)()
+	l.Wait(b)()
+	l.Wait(a)()
+	if len(sleeps) != 1 || sleeps[0] != time.Second*2 {
+		t.Errorf("expected a single 2s wait, got: %v", sleeps)
+	}
+
+	// rate limiting doubles the delay & honors Retry-After
+	res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"30"}}}
+	l.Observe(a, res, nil, 0)
+	sleeps = sleeps[:0]
+	l.Wait(a)()
+	l.Wait(a)()
+	if len(sleeps) != 2 || sleeps[0] != time.Second*30 || sleeps[1] != time.Second*4 {
+		t.Errorf("expected 30s then 4s waits, got: %v", sleeps)
+	}
+
+	// successes ease back to the base delay
+	for i := 0; i < 10; i++ {
+		l.Observe(a, &http.Response{StatusCode: http.StatusOK}, nil, 0)
+	}
+	sleeps = sleeps[:0]
+	l.Wait(a)()
+	l.Wait(a)()
+	if len(sleeps) != 2 || sleeps[1] != time.Second*2 {
+		t.Errorf("expected backoff to recover to 2s, got: %v", sleeps)
+	}
+
+	// slow responses stretch the delay
+	l.Observe(b, &http.Response{StatusCode: http.StatusOK}, nil, time.Second*5)
+	sleeps = sleeps[:0]
+	l.Wait(b)()
+	l.Wait(b)()
+	if len(sleeps) != 1 || sleeps[0] != time.Second*5 {
+		t.Errorf("expected latency to set a 5s delay, got: %v", sleeps)
+	}
+}
+
+func TestHostLimiterConnections(t *testing.T) {
+	l := NewHostLimiter()
+	u, _ := url.Parse("http://conns.test/")
+
+	done := l.Wait(u)
+	started := make(chan bool)
+	go func() {
+		l.Wait(u)()
+		started <- true
+	}()
+
+	select {
+	case <-started:
+		t.Fatalf("expected second request to wait for the first")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	done()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Errorf("expected second request to start once the first was done")
+	}
+}
+
+func TestLimitedDoerRobots(t *testing.T) {
+	robots := "User-agent: *\nCrawl-delay: 7\nDisallow: /private\n"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(robots))
+	}))
+	defer s.Close()
+
+	sleeps := []time.Duration{}
+	l := fakeClockLimiter(&sleeps)
+	d := &limitedDoer{Doer: http.DefaultClient, limiter: l}
+
+	req, err := http.NewRequest("GET", s.URL+"/robots.txt", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("User-Agent", "sentry")
+	res, err := d.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != robots {
+		t.Errorf("expected robots.txt body to be left intact, got: %s", string(data))
+	}
+
+	u, _ := url.Parse(s.URL)
+	l.lock.Lock()
+	delay := l.host(u.Host).robotsDelay
+	l.lock.Unlock()
+	if delay != time.Second*7 {
+		t.Errorf("expected 7s robots delay, got: %s", delay)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/multiformats/go-multihash"
+	"io"
+	"strings"
+)
+
+// IPFS content is addressed by CIDv1 identifiers. Bodies are chunked &
+// assembled into a UnixFS file DAG the same way `ipfs add --cid-version=1`
+// does by default: fixed-size chunks stored as raw leaves, linked by
+// dag-pb nodes in a balanced tree. Adding the same body to any IPFS node
+// gives the same CID, so stored content can be pinned straight from sentry's
+// block store.
+const (
+	// size of each leaf chunk
+	ipfsChunkSize = 256 * 1024
+	// max number of links per intermediate node
+	ipfsMaxLinks = 174
+
+	// multicodec codes
+	cidCodecRaw    = 0x55
+	cidCodecDagPb  = 0x70
+	cidVersion     = 1
+	unixfsTypeFile = 2
+)
+
+// cidBase32 is the multibase encoding used for CIDv1 strings
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ContentIdStore is a BlobStore that also addresses blobs by IPFS CID
+type ContentIdStore interface {
+	BlobStore
+	// ContentId gives the CID of the blob stored for hash
+	ContentId(hash string) (string, error)
+}
+
+// IpfsBlobStore keeps blobs as IPFS blocks in a datastore. Each blob is
+// chunked into a UnixFS DAG, & the sha2-256 hash of the whole blob is mapped
+// to the CID of the DAG root
+type IpfsBlobStore struct {
+	Store datastore.Datastore
+}
+
+// NewIpfsBlobStore creates a blob store backed by ds
+func NewIpfsBlobStore(ds datastore.Datastore) *IpfsBlobStore {
+	return &IpfsBlobStore{Store: ds}
+}
+
+// blockKey gives the datastore key for a block. blocks are sharded by
+// the next-to-last two characters of their CID, as go-ipfs does
+func (s *IpfsBlobStore) blockKey(cid string) datastore.Key {
+	shard := cid
+	if len(cid) > 3 {
+		shard = cid[len(cid)-3 : len(cid)-1]
+	}
+	return datastore.NewKey(fmt.Sprintf("/blocks/%s/%s", shard, cid))
+}
+
+// hashKey gives the datastore key mapping a hash to a root CID
+func (s *IpfsBlobStore) hashKey(hash string) datastore.Key {
+	return datastore.NewKey("/hashes/" + hash)
+}
+
+// Put chunks data into a DAG & stores each block
+func (s *IpfsBlobStore) Put(data []byte) (string, error) {
+	hash, err := core.CalcHash(data)
+	if err != nil {
+		return "", err
+	}
+	return hash, s.PutReader(hash, bytes.NewReader(data))
+}
+
+// PutReader chunks r into a DAG as it's read, storing each block
+func (s *IpfsBlobStore) PutReader(hash string, r io.ReadSeeker) error {
+	if has, err := s.Has(hash); err != nil {
+		return err
+	} else if has {
+		return nil
+	}
+
+	hr := newHashCheckReader(r)
+	root, err := buildUnixfsDag(hr, func(cid string, block []byte) error {
+		return s.Store.Put(s.blockKey(cid), block)
+	})
+	if err != nil {
+		return err
+	}
+	if err := hr.Check(hash); err != nil {
+		return err
+	}
+	return s.Store.Put(s.hashKey(hash), []byte(root.Cid))
+}
+
+// Get reassembles a blob from it's DAG
+func (s *IpfsBlobStore) Get(hash string) ([]byte, error) {
+	cid, err := s.ContentId(hash)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := s.readDag(cid, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Has checks for a stored blob
+func (s *IpfsBlobStore) Has(hash string) (bool, error) {
+	return s.Store.Has(s.hashKey(hash))
+}
+
+// Delete forgets a blob & removes it's root block. leaf blocks can be
+// shared between blobs, so they're left in place
+func (s *IpfsBlobStore) Delete(hash string) error {
+	cid, err := s.ContentId(hash)
+	if err == core.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := s.Store.Delete(s.hashKey(hash)); err != nil {
+		return err
+	}
+	if err := s.Store.Delete(s.blockKey(cid)); err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// ContentId gives the root CID for a hash
+func (s *IpfsBlobStore) ContentId(hash string) (string, error) {
+	v, err := s.Store.Get(s.hashKey(hash))
+	if err == datastore.ErrNotFound {
+		return "", core.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return "", datastore.ErrInvalidType
+	}
+	return string(data), nil
+}
+
+// readDag writes the file data for the DAG rooted at cid to buf
+func (s *IpfsBlobStore) readDag(cid string, buf *bytes.Buffer) error {
+	v, err := s.Store.Get(s.blockKey(cid))
+	if err != nil {
+		return fmt.Errorf("error reading block %s: %s", cid, err)
+	}
+	block, ok := v.([]byte)
+	if !ok {
+		return datastore.ErrInvalidType
+	}
+
+	codec, err := cidCodec(cid)
+	if err != nil {
+		return err
+	}
+	if codec == cidCodecRaw {
+		buf.Write(block)
+		return nil
+	}
+
+	links, data, err := decodeDagPbNode(block)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		inline, err := decodeUnixfsData(data)
+		if err != nil {
+			return err
+		}
+		buf.Write(inline)
+	}
+	for _, l := range links {
+		if err := s.readDag(l, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dagLink is a reference to a node in a UnixFS DAG
+type dagLink struct {
+	// CID of the node
+	Cid string
+	// binary form of Cid
+	cid []byte
+	// bytes of file data below this node
+	FileSize uint64
+	// total size of all blocks below & including this node
+	TreeSize uint64
+}
+
+// buildUnixfsDag chunks r into a balanced UnixFS DAG, calling put with
+// each block, & returns a link to the root. only one chunk is held in
+// memory at a time, along with the links for each level of the tree
+func buildUnixfsDag(r io.Reader, put func(cid string, block []byte) error) (*dagLink, error) {
+	level := []*dagLink{}
+	for {
+		// chunks are handed to put, so each gets it's own buffer
+		buf := make([]byte, ipfsChunkSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && len(level) > 0 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		chunk := buf[:n]
+
+		l, err := newDagLink(cidCodecRaw, chunk)
+		if err != nil {
+			return nil, err
+		}
+		l.FileSize = uint64(len(chunk))
+		l.TreeSize = uint64(len(chunk))
+		if err := put(l.Cid, chunk); err != nil {
+			return nil, err
+		}
+		level = append(level, l)
+
+		if n < ipfsChunkSize {
+			break
+		}
+	}
+
+	for len(level) > 1 {
+		next := []*dagLink{}
+		for i := 0; i < len(level); i += ipfsMaxLinks {
+			end := i + ipfsMaxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+
+			block := encodeUnixfsFileNode(level[i:end])
+			l, err := newDagLink(cidCodecDagPb, block)
+			if err != nil {
+				return nil, err
+			}
+			l.TreeSize = uint64(len(block))
+			for _, child := range level[i:end] {
+				l.FileSize += child.FileSize
+				l.TreeSize += child.TreeSize
+			}
+			if err := put(l.Cid, block); err != nil {
+				return nil, err
+			}
+			next = append(next, l)
+		}
+		level = next
+	}
+
+	return level[0], nil
+}
+
+// newDagLink creates a link to block, encoded with codec
+func newDagLink(codec uint64, block []byte) (*dagLink, error) {
+	mh, err := multihash.Sum(block, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(mh)+4)
+	buf = appendUvarint(buf, cidVersion)
+	buf = appendUvarint(buf, codec)
+	buf = append(buf, mh...)
+
+	return &dagLink{
+		Cid: "b" + strings.ToLower(cidBase32.EncodeToString(buf)),
+		cid: buf,
+	}, nil
+}
+
+// cidCodec reads the multicodec from a CIDv1 string
+func cidCodec(cid string) (uint64, error) {
+	if len(cid) < 2 || cid[0] != 'b' {
+		return 0, fmt.Errorf("unsupported cid: '%s'", cid)
+	}
+	data, err := cidBase32.DecodeString(strings.ToUpper(cid[1:]))
+	if err != nil {
+		return 0, err
+	}
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != cidVersion {
+		return 0, fmt.Errorf("unsupported cid version: '%s'", cid)
+	}
+	codec, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return 0, fmt.Errorf("invalid cid: '%s'", cid)
+	}
+	return codec, nil
+}
+
+// encodeUnixfsFileNode builds the dag-pb block for a file node linking to
+// children. Fields are written in the same order as go-ipfs, which is
+// required for CIDs to match
+func encodeUnixfsFileNode(children []*dagLink) []byte {
+	meta := &bytes.Buffer{}
+	pbUvarint(meta, 1, unixfsTypeFile)
+	var size uint64
+	for _, c := range children {
+		size += c.FileSize
+	}
+	pbUvarint(meta, 3, size)
+	for _, c := range children {
+		pbUvarint(meta, 4, c.FileSize)
+	}
+
+	node := &bytes.Buffer{}
+	for _, c := range children {
+		link := &bytes.Buffer{}
+		pbBytes(link, 1, c.cid)
+		pbBytes(link, 2, nil)
+		pbUvarint(link, 3, c.TreeSize)
+		pbBytes(node, 2, link.Bytes())
+	}
+	pbBytes(node, 1, meta.Bytes())
+	return node.Bytes()
+}
+
+// decodeDagPbNode reads the CIDs of links & the data field from a dag-pb block
+func decodeDagPbNode(block []byte) (links []string, data []byte, err error) {
+	err = pbRange(block, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			data = value
+		case 2:
+			return pbRange(value, func(f int, v []byte) error {
+				if f == 1 {
+					links = append(links, "b"+strings.ToLower(cidBase32.EncodeToString(v)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return
+}
+
+// decodeUnixfsData reads inline file data from a UnixFS data field
+func decodeUnixfsData(data []byte) (inline []byte, err error) {
+	err = pbRange(data, func(field int, value []byte) error {
+		if field == 2 {
+			inline = value
+		}
+		return nil
+	})
+	return
+}
+
+// appendUvarint appends v to buf as an unsigned varint
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return append(buf, tmp[:binary.PutUvarint(tmp, v)]...)
+}
+
+// pbUvarint writes a protobuf varint field
+func pbUvarint(buf *bytes.Buffer, field int, v uint64) {
+	buf.Write(appendUvarint(nil, uint64(field<<3)))
+	buf.Write(appendUvarint(nil, v))
+}
+
+// pbBytes writes a protobuf length-delimited field
+func pbBytes(buf *bytes.Buffer, field int, v []byte) {
+	buf.Write(appendUvarint(nil, uint64(field<<3|2)))
+	buf.Write(appendUvarint(nil, uint64(len(v))))
+	buf.Write(v)
+}
+
+// pbRange calls fn with each length-delimited field in a protobuf message,
+// skipping varint fields
+func pbRange(msg []byte, fn func(field int, value []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		msg = msg[n:]
+
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			msg = msg[n:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return fmt.Errorf("invalid protobuf length")
+			}
+			if err := fn(int(key>>3), msg[n:n+int(l)]); err != nil {
+				return err
+			}
+			msg = msg[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type: %d", key&7)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"github.com/datatogether/core"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnixfsDagCid(t *testing.T) {
+	cases := []struct {
+		data string
+		cid  string
+	}{
+		// single chunk files are a lone raw leaf, same as `ipfs add --cid-version=1`
+		{"", "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"hello world", "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"},
+	}
+
+	for i, c := range cases {
+		root, err := buildUnixfsDag(strings.NewReader(c.data), func(string, []byte) error { return nil })
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if root.Cid != c.cid {
+			t.Errorf("case %d cid mismatch. expected: %s, got: %s", i, c.cid, root.Cid)
+		}
+	}
+}
+
+// ipfsFixture gives size bytes of a repeating pattern that doesn't
+// compress or dedupe to a single chunk
+func ipfsFixture(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte((i*31 + i/7) % 251)
+	}
+	return data
+}
+
+func TestUnixfsDagCidChunked(t *testing.T) {
+	// cids are from go-ipfs's balanced importer with 256KiB raw leaves &
+	// 174 links per node, as `ipfs add --cid-version=1 --raw-leaves`
+	cases := []struct {
+		size int
+		cid  string
+	}{
+		{ipfsChunkSize, "bafkreibohs5sp5wuduf4pnqzoklw7usygujvbkte6sxnlcm6dzp6zt2z74"},
+		{ipfsChunkSize + 1, "bafybeidn25kwxb3gpgk4pzssema7rdojcgpkfuodw77eprnrzcomjgywxi"},
+		{ipfsChunkSize * 3, "bafybeienqrop4uqksofb47k3bh4cuwf4czk36zro5veppaxbqtkxh7iwbe"},
+		{1000000, "bafybeifv45kspkt6t4fd2jnbmhipzvyb3kpguvpadmtqfunn4iwahhou2y"},
+		// a single full node of leaves
+		{ipfsChunkSize * ipfsMaxLinks, "bafybeif2wjchqcrvzjf3hta3icd3wjakqurlmfn5fwvfbnepe3jiio2mui"},
+		// one leaf past a full node needs a second layer
+		{ipfsChunkSize * (ipfsMaxLinks + 1), "bafybeicxhhm7hbjsaih4iusjhh2agqcmn2j4x7ly63c5y3jxyr2oguixpe"},
+	}
+
+	for i, c := range cases {
+		root, err := buildUnixfsDag(bytes.NewReader(ipfsFixture(c.size)), func(string, []byte) error { return nil })
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if root.Cid != c.cid {
+			t.Errorf("case %d %d bytes cid mismatch. expected: %s, got: %s", i, c.size, c.cid, root.Cid)
+		}
+	}
+}
+
+func TestUnixfsDagShape(t *testing.T) {
+	cases := []struct {
+		size   int
+		blocks int
+		codec  uint64
+	}{
+		{10, 1, cidCodecRaw},
+		{ipfsChunkSize, 1, cidCodecRaw},
+		{ipfsChunkSize + 1, 3, cidCodecDagPb},
+		{ipfsChunkSize * 3, 4, cidCodecDagPb},
+	}
+
+	for i, c := range cases {
+		blocks := 0
+		root, err := buildUnixfsDag(bytes.NewReader(bytes.Repeat([]byte("a"), c.size)), func(string, []byte) error {
+			blocks++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if blocks != c.blocks {
+			t.Errorf("case %d block count mismatch. expected: %d, got: %d", i, c.blocks, blocks)
+		}
+		if root.FileSize != uint64(c.size) {
+			t.Errorf("case %d file size mismatch. expected: %d, got: %d", i, c.size, root.FileSize)
+		}
+		if codec, err := cidCodec(root.Cid); err != nil || codec != c.codec {
+			t.Errorf("case %d codec mismatch. expected: %x, got: %x, err: %v", i, c.codec, codec, err)
+		}
+	}
+}
+
+func TestIpfsBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_ipfs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := NewFlatfsDatastore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := NewIpfsBlobStore(ds)
+
+	large := make([]byte, ipfsChunkSize*2+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	cases := [][]byte{
+		[]byte("hello world"),
+		large,
+	}
+
+	for i, c := range cases {
+		hash, err := s.Put(c)
+		if err != nil {
+			t.Errorf("case %d put error: %s", i, err.Error())
+			continue
+		}
+		if expect, _ := core.CalcHash(c); hash != expect {
+			t.Errorf("case %d hash mismatch. expected: %s, got: %s", i, expect, hash)
+		}
+
+		root, _ := buildUnixfsDag(bytes.NewReader(c), func(string, []byte) error { return nil })
+		if cid, err := s.ContentId(hash); err != nil || cid != root.Cid {
+			t.Errorf("case %d cid mismatch. expected: %s, got: %s, err: %v", i, root.Cid, cid, err)
+		}
+
+		data, err := s.Get(hash)
+		if err != nil {
+			t.Errorf("case %d get error: %s", i, err.Error())
+			continue
+		}
+		if !bytes.Equal(data, c) {
+			t.Errorf("case %d data mismatch", i)
+		}
+
+		if err := s.Delete(hash); err != nil {
+			t.Errorf("case %d delete error: %s", i, err.Error())
+		}
+		if _, err := s.Get(hash); err != core.ErrNotFound {
+			t.Errorf("case %d: expected ErrNotFound after delete, got: %v", i, err)
+		}
+	}
+}
+
+func TestFlatfsDatastore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentry_flatfs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := NewFlatfsDatastore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	keys := []string{"/a", "/a/b", "/a/c", "/d/e"}
+	for i, k := range keys {
+		if err := ds.Put(datastore.NewKey(k), []byte(k)); err != nil {
+			t.Errorf("case %d put error: %s", i, err.Error())
+		}
+	}
+
+	if err := ds.Put(datastore.NewKey("/bad"), "not bytes"); err != datastore.ErrInvalidType {
+		t.Errorf("expected ErrInvalidType for non-byte value, got: %v", err)
+	}
+
+	for i, k := range keys {
+		v, err := ds.Get(datastore.NewKey(k))
+		if err != nil {
+			t.Errorf("case %d get error: %s", i, err.Error())
+			continue
+		}
+		if string(v.([]byte)) != k {
+			t.Errorf("case %d value mismatch. expected: %s, got: %s", i, k, v)
+		}
+	}
+
+	res, err := ds.Query(query.Query{Prefix: "/a"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected 3 entries under /a, got %d: %v", len(entries), entries)
+	}
+
+	if err := ds.Delete(datastore.NewKey("/a")); err != nil {
+		t.Error(err.Error())
+	}
+	if has, _ := ds.Has(datastore.NewKey("/a")); has {
+		t.Errorf("expected /a to be deleted")
+	}
+	if has, _ := ds.Has(datastore.NewKey("/a/b")); !has {
+		t.Errorf("expected /a/b to survive deleting /a")
+	}
+	if err := ds.Delete(datastore.NewKey("/a")); err != datastore.ErrNotFound {
+		t.Errorf("expected ErrNotFound deleting a missing key, got: %v", err)
+	}
+}
+
+func TestSaveGetContentId(t *testing.T) {
+	now := time.Now()
+	u := &core.Url{Url: "http://cid.test/page", LastGet: &now}
+	s := newSnapshot(u)
+	s.Cid = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	if err := saveGet(appDB, u, s); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var urlCid, snapshotCid string
+	if err := appDB.QueryRow("select cid from urls where url = $1", u.Url).Scan(&urlCid); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := appDB.QueryRow("select cid from snapshots where url = $1", u.Url).Scan(&snapshotCid); err != nil {
+		t.Fatal(err.Error())
+	}
+	if urlCid != s.Cid || snapshotCid != s.Cid {
+		t.Errorf("cid mismatch. expected: %s, got url: %s, snapshot: %s", s.Cid, urlCid, snapshotCid)
+	}
+
+	// a later capture that isn't stored clears the url's cid
+	later := now.Add(time.Hour)
+	u.LastGet = &later
+	if err := saveGet(appDB, u, newSnapshot(u)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := appDB.QueryRow("select cid from urls where url = $1", u.Url).Scan(&urlCid); err != nil {
+		t.Fatal(err.Error())
+	}
+	if urlCid != "" {
+		t.Errorf("expected url cid to be cleared, got: %s", urlCid)
+	}
+}
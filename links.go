@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// largest stylesheet read for links by the content crawler
+var maxCssSize int64 = 5 * 1024 * 1024
+
+// LinkKind describes how a page refers to a url
+type LinkKind string
+
+const (
+	// navigational links, eg: <a href>, <form action>
+	LinkAnchor LinkKind = "anchor"
+	// media & frames the page shows, eg: <img src>, srcset, css url(...)
+	LinkEmbed LinkKind = "embed"
+	// <link rel="stylesheet"> & css @import
+	LinkStylesheet LinkKind = "stylesheet"
+	// <script src>
+	LinkScript LinkKind = "script"
+	// <meta http-equiv="refresh"> & http redirects
+	LinkRedirect LinkKind = "redirect"
+)
+
+// Requisite reports weather links of this kind are needed for a page to
+// render, as opposed to pages a user could go to next
+func (k LinkKind) Requisite() bool {
+	return k == LinkEmbed || k == LinkStylesheet || k == LinkScript
+}
+
+// PageLink is a link along with the kind of reference that made it
+type PageLink struct {
+	*core.Link
+	Kind LinkKind
+}
+
+// LinkExtractor finds references in an html document, calling add with
+// each raw reference & it's kind. references are resolved by the caller
+type LinkExtractor func(doc *goquery.Document, add func(ref string, kind LinkKind))
+
+// linkExtractors are run on every html page crawled. order matters when
+// the same url is referenced more than one way, the first kind found
+// wins unless a later one is a requisite
+var linkExtractors = []LinkExtractor{
+	extractAnchors,
+	extractLinkTags,
+	extractEmbeds,
+	extractScripts,
+	extractMetaRefresh,
+	extractStyles,
+}
+
+// extractAnchors finds navigational links
+func extractAnchors(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("a[href], area[href]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("href", ""), LinkAnchor)
+	})
+	doc.Find("form[action]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("action", ""), LinkAnchor)
+	})
+}
+
+// extractLinkTags sorts <link> tags by their rel attribute
+func extractLinkTags(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("link[href]").Each(func(i int, s *goquery.Selection) {
+		kind := LinkAnchor
+		rels := strings.Fields(strings.ToLower(s.AttrOr("rel", "")))
+		for _, rel := range rels {
+			switch rel {
+			case "stylesheet":
+				kind = LinkStylesheet
+			case "icon", "apple-touch-icon":
+				kind = LinkEmbed
+			case "preload", "prefetch":
+				switch s.AttrOr("as", "") {
+				case "style":
+					kind = LinkStylesheet
+				case "script":
+					kind = LinkScript
+				default:
+					kind = LinkEmbed
+				}
+			}
+		}
+		add(s.AttrOr("href", ""), kind)
+	})
+}
+
+// extractEmbeds finds media, frames & objects
+func extractEmbeds(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("img[src], iframe[src], frame[src], embed[src], video[src], audio[src], source[src], track[src], input[src]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("src", ""), LinkEmbed)
+	})
+	doc.Find("video[poster]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("poster", ""), LinkEmbed)
+	})
+	doc.Find("object[data]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("data", ""), LinkEmbed)
+	})
+	doc.Find("img[srcset], source[srcset]").Each(func(i int, s *goquery.Selection) {
+		for _, ref := range parseSrcset(s.AttrOr("srcset", "")) {
+			add(ref, LinkEmbed)
+		}
+	})
+}
+
+// extractScripts finds external scripts
+func extractScripts(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("script[src]").Each(func(i int, s *goquery.Selection) {
+		add(s.AttrOr("src", ""), LinkScript)
+	})
+}
+
+// extractMetaRefresh finds <meta http-equiv="refresh" content="0; url=...">
+func extractMetaRefresh(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("meta[http-equiv]").Each(func(i int, s *goquery.Selection) {
+		if strings.EqualFold(s.AttrOr("http-equiv", ""), "refresh") {
+			if ref := parseMetaRefresh(s.AttrOr("content", "")); ref != "" {
+				add(ref, LinkRedirect)
+			}
+		}
+	})
+}
+
+// extractStyles finds url(...) & @import references in <style> blocks &
+// style attributes
+func extractStyles(doc *goquery.Document, add func(string, LinkKind)) {
+	doc.Find("style").Each(func(i int, s *goquery.Selection) {
+		parseCssLinks(s.Text(), add)
+	})
+	doc.Find("[style]").Each(func(i int, s *goquery.Selection) {
+		parseCssLinks(s.AttrOr("style", ""), add)
+	})
+}
+
+// parseSrcset pulls urls out of a srcset attribute, eg:
+// "small.jpg 480w, large.jpg 1080w"
+func parseSrcset(srcset string) (refs []string) {
+	for _, candidate := range strings.Split(srcset, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			refs = append(refs, fields[0])
+		}
+	}
+	return
+}
+
+// parseMetaRefresh gives the url from a refresh header value, "" if it
+// only reloads the page
+func parseMetaRefresh(content string) string {
+	i := strings.Index(strings.ToLower(content), "url")
+	if i < 0 {
+		return ""
+	}
+	ref := strings.TrimSpace(content[i+3:])
+	if !strings.HasPrefix(ref, "=") {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(ref[1:]), `"'`)
+}
+
+var (
+	cssImport = regexp.MustCompile(`@import\s+(?:url\(\s*)?["']?([^"'()\s;]+)`)
+	cssUrl    = regexp.MustCompile(`url\(\s*["']?([^"'()]+?)["']?\s*\)`)
+)
+
+// parseCssLinks finds @import (stylesheet) & url(...) (embed) references
+// in css text
+func parseCssLinks(css string, add func(string, LinkKind)) {
+	imported := map[string]bool{}
+	for _, m := range cssImport.FindAllStringSubmatch(css, -1) {
+		imported[m[1]] = true
+		add(m[1], LinkStylesheet)
+	}
+	for _, m := range cssUrl.FindAllStringSubmatch(css, -1) {
+		if !imported[m[1]] {
+			add(m[1], LinkEmbed)
+		}
+	}
+}
+
+// foundLink is a resolved reference waiting to be stored
+type foundLink struct {
+	url  string
+	kind LinkKind
+}
+
+// linkCollector resolves & de-duplicates references as extractors find them
+type linkCollector struct {
+	base  *url.URL
+	links []*foundLink
+	seen  map[string]*foundLink
+}
+
+func newLinkCollector(base *url.URL) *linkCollector {
+	return &linkCollector{base: base, seen: map[string]*foundLink{}}
+}
+
+func (c *linkCollector) add(ref string, kind LinkKind) {
+	ref = strings.TrimSpace(ref)
+	lower := strings.ToLower(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(lower, "javascript:") || strings.HasPrefix(lower, "data:") {
+		return
+	}
+	u, err := c.base.Parse(ref)
+	if err != nil {
+		return
+	}
+
+	rawurl := u.String()
+	if f, ok := c.seen[rawurl]; ok {
+		if !f.kind.Requisite() && kind.Requisite() {
+			f.kind = kind
+		}
+		return
+	}
+	f := &foundLink{url: rawurl, kind: kind}
+	c.seen[rawurl] = f
+	c.links = append(c.links, f)
+}
+
+// findDocLinks runs all link extractors over doc, resolving references
+// against pageUrl or the document's <base href> if it has one
+func findDocLinks(pageUrl *url.URL, doc *goquery.Document) []*foundLink {
+	base := pageUrl
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if b, err := pageUrl.Parse(strings.TrimSpace(href)); err == nil {
+			base = b
+		}
+	}
+
+	c := newLinkCollector(base)
+	for _, extract := range linkExtractors {
+		extract(doc, c.add)
+	}
+	return c.links
+}
+
+// findCssLinks finds references in a stylesheet, resolved against cssUrl
+func findCssLinks(cssUrl *url.URL, css string) []*foundLink {
+	c := newLinkCollector(cssUrl)
+	parseCssLinks(css, c.add)
+	return c.links
+}
+
+// isHtml reports weather a url's sniffed content type is one links are
+// extracted from, matching core's check
+func isHtml(u *core.Url) bool {
+	return u.ContentSniff == "text/html; charset=utf-8" || u.ContentSniff == "text/plain; charset=utf-8"
+}
+
+// isCss reports weather a url was served as a stylesheet
+func isCss(u *core.Url) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(u.ContentType)), "text/css")
+}
+
+// findLinks finds all references from u to other urls in body, which is
+// html for pages & css for stylesheets. other content has no links
+func findLinks(u *core.Url, body []byte) ([]*foundLink, error) {
+	pageUrl, err := u.ParsedUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	// stylesheets sniff as text/plain, so they're checked first
+	switch {
+	case isCss(u):
+		return findCssLinks(pageUrl, string(body)), nil
+	case isHtml(u):
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return findDocLinks(pageUrl, doc), nil
+	}
+	return nil, nil
+}
+
+// extractLinks finds & stores all links from u to other urls in body.
+// destination urls are created if they don't exist yet
+func extractLinks(db sqlutil.Execable, u *core.Url, body []byte) ([]*PageLink, error) {
+	found, err := findLinks(u, body)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+
+	links := make([]*PageLink, 0, len(found))
+	for _, f := range found {
+		dst, err := readOrCreateUrl(f.url)
+		if err != nil {
+			return links, err
+		}
+		l := &PageLink{Link: &core.Link{Src: u, Dst: dst}, Kind: f.kind}
+		if err := l.Save(db); err != nil {
+			return links, err
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// saveLink creates or updates a link from src to dst of the given kind
+func saveLink(db sqlutil.Execable, src, dst *core.Url, kind LinkKind) error {
+	return (&PageLink{Link: &core.Link{Src: src, Dst: dst}, Kind: kind}).Save(db)
+}
+
+// Save creates the link or updates it's kind. an embedded store keeps the
+// kind alongside the link, but hands back plain core links
+func (l *PageLink) Save(db sqlutil.Execable) error {
+	now := time.Now().Round(time.Second).In(time.UTC)
+	if l.Created.IsZero() {
+		l.Created = now
+	}
+	l.Updated = now
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(l.Key(), l)
+	}
+	_, err := db.Exec(qLinkUpsert, l.Created, l.Updated, l.Src.Url, l.Dst.Url, string(l.Kind))
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/datatogether/core"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testPage = `<html>
+<head>
+  <base href="http://a.gov/docs/">
+  <meta http-equiv="Refresh" content="5; URL='http://a.gov/moved'">
+  <link rel="stylesheet" href="style.css">
+  <link rel="shortcut icon" href="/favicon.ico">
+  <link rel="alternate" type="application/rss+xml" href="/feed.xml">
+  <link rel="preload" as="script" href="/preload.js">
+  <script src="app.js"></script>
+  <script>var inline = true;</script>
+  <style>
+    @import url("print.css");
+    body { background: url(img/bg.png); }
+  </style>
+</head>
+<body>
+  <a href="page.html">page</a>
+  <a href="#top">top</a>
+  <a href="javascript:void(0)">nothing</a>
+  <a href="img/logo.png">logo</a>
+  <img src="img/logo.png" srcset="img/logo-2x.png 2x, img/logo-3x.png 3x">
+  <img src="data:image/png;base64,AAAA">
+  <iframe src="https://maps.a.gov/embed"></iframe>
+  <video src="clip.mp4" poster="clip.jpg"></video>
+  <object data="chart.svg"></object>
+  <form action="/search"></form>
+  <div style="background-image: url('img/hero.jpg')"></div>
+</body>
+</html>`
+
+func linkStrings(found []*foundLink) []string {
+	links := make([]string, len(found))
+	for i, f := range found {
+		links[i] = fmt.Sprintf("%s %s", f.kind, f.url)
+	}
+	return links
+}
+
+func TestFindDocLinks(t *testing.T) {
+	pageUrl, _ := url.Parse("http://a.gov/index.html")
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(testPage))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []string{
+		"anchor http://a.gov/docs/page.html",
+		"embed http://a.gov/docs/img/logo.png",
+		"anchor http://a.gov/search",
+		"stylesheet http://a.gov/docs/style.css",
+		"embed http://a.gov/favicon.ico",
+		"anchor http://a.gov/feed.xml",
+		"script http://a.gov/preload.js",
+		"embed https://maps.a.gov/embed",
+		"embed http://a.gov/docs/clip.mp4",
+		"embed http://a.gov/docs/clip.jpg",
+		"embed http://a.gov/docs/chart.svg",
+		"embed http://a.gov/docs/img/logo-2x.png",
+		"embed http://a.gov/docs/img/logo-3x.png",
+		"script http://a.gov/docs/app.js",
+		"redirect http://a.gov/moved",
+		"stylesheet http://a.gov/docs/print.css",
+		"embed http://a.gov/docs/img/bg.png",
+		"embed http://a.gov/docs/img/hero.jpg",
+	}
+	got := linkStrings(findDocLinks(pageUrl, doc))
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("links mismatch. expected:\n%s\ngot:\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestFindCssLinks(t *testing.T) {
+	cssUrl, _ := url.Parse("http://a.gov/css/main.css")
+	cases := []struct {
+		css    string
+		expect []string
+	}{
+		{"", nil},
+		{"body { color: red; }", nil},
+		{`@import "reset.css";`, []string{"stylesheet http://a.gov/css/reset.css"}},
+		{`@import url(/fonts.css) screen;`, []string{"stylesheet http://a.gov/fonts.css"}},
+		{`@font-face { src: url( "../fonts/a.woff2" ) format("woff2"), url('../fonts/a.woff'); }`, []string{"embed http://a.gov/fonts/a.woff2", "embed http://a.gov/fonts/a.woff"}},
+		{`a { background: url(data:image/png;base64,AAAA); } b { background: url(x.png) } i { background: url(x.png) }`, []string{"embed http://a.gov/css/x.png"}},
+	}
+
+	for i, c := range cases {
+		got := linkStrings(findCssLinks(cssUrl, c.css))
+		if strings.Join(got, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestParseSrcset(t *testing.T) {
+	cases := []struct {
+		in     string
+		expect []string
+	}{
+		{"", nil},
+		{"a.jpg", []string{"a.jpg"}},
+		{"a.jpg 480w, b.jpg 1080w", []string{"a.jpg", "b.jpg"}},
+		{" a.jpg 1x ,b.jpg 2x, ", []string{"a.jpg", "b.jpg"}},
+	}
+
+	for i, c := range cases {
+		got := parseSrcset(c.in)
+		if strings.Join(got, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("case %d mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestParseMetaRefresh(t *testing.T) {
+	cases := []struct {
+		in, expect string
+	}{
+		{"", ""},
+		{"30", ""},
+		{"0; url=http://a.gov/", "http://a.gov/"},
+		{"0;URL='/moved'", "/moved"},
+		{`5; url = "next.html"`, "next.html"},
+		{"0; urlfoo", ""},
+	}
+
+	for i, c := range cases {
+		if got := parseMetaRefresh(c.in); got != c.expect {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.expect, got)
+		}
+	}
+}
+
+func TestLinkKindRequisite(t *testing.T) {
+	cases := []struct {
+		kind   LinkKind
+		expect bool
+	}{
+		{LinkAnchor, false},
+		{LinkRedirect, false},
+		{LinkEmbed, true},
+		{LinkStylesheet, true},
+		{LinkScript, true},
+	}
+
+	for i, c := range cases {
+		if got := c.kind.Requisite(); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestIsCss(t *testing.T) {
+	cases := []struct {
+		contentType string
+		expect      bool
+	}{
+		{"", false},
+		{"text/html", false},
+		{"text/css", true},
+		{"Text/CSS; charset=utf-8", true},
+	}
+
+	for i, c := range cases {
+		if got := isCss(&core.Url{ContentType: c.contentType}); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
@@ -75,3 +75,16 @@ func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	// no-auth middware func
 	return middleware(handler)
 }
+
+// readOpenMiddleware leaves GET requests open to anyone, like middleware, &
+// puts anything that changes state behind authMiddleware
+func readOpenMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	open, auth := middleware(handler), authMiddleware(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			open(w, r)
+			return
+		}
+		auth(w, r)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOpenMiddleware(t *testing.T) {
+	prev := cfg
+	defer func() { cfg = prev }()
+	cfg = &config{HttpAuthUsername: "user", HttpAuthPassword: "pass"}
+
+	h := readOpenMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		method string
+		auth   bool
+		status int
+	}{
+		{"GET", false, http.StatusOK},
+		{"HEAD", false, http.StatusOK},
+		{"DELETE", false, http.StatusUnauthorized},
+		{"POST", false, http.StatusUnauthorized},
+		{"DELETE", true, http.StatusOK},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest(c.method, "/failures?url=http://a.test", nil)
+		if c.auth {
+			req.SetBasicAuth("user", "pass")
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != c.status {
+			t.Errorf("case %d %s status mismatch. expected: %d, got: %d", i, c.method, c.status, w.Code)
+		}
+	}
+}
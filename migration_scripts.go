@@ -0,0 +1,279 @@
+package main
+
+// migrationScripts are the scripts in sql/migrations, compiled in so the
+// binary can migrate without a source checkout. TestMigrationScripts checks
+// they match the files, update both together
+var migrationScripts = map[string]string{
+	"0001_initial.down.sql": `
+-- the initial tables predate versioned migrations & hold production data,
+-- they're kept. Migrate refuses to revert below version 1 in any case
+SELECT 1;
+`,
+	"0001_initial.up.sql": `
+-- tables from before sentry's schema was versioned. existing databases
+-- already have them, so they're only created if missing
+CREATE TABLE IF NOT EXISTS primers (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  short_title      text NOT NULL default '',
+  title            text NOT NULL default '',
+  description      text NOT NULL default '',
+  parent_id        text NOT NULL default '', -- this should be "UUID references primers(id)", but then we'd need to accept null values, no bueno
+  stats            json,
+  meta             json,
+  deleted          boolean default false
+);
+
+CREATE TABLE IF NOT EXISTS sources (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  title            text NOT NULL default '',
+  description      text NOT NULL default '',
+  url              text UNIQUE NOT NULL,
+  primer_id        UUID references primers(id) ON DELETE CASCADE,
+  crawl            boolean default true,
+  stale_duration   integer NOT NULL DEFAULT 43200000, -- defaults to 12 hours, column needs to be multiplied by 1000000 to become a poper duration
+  last_alert_sent  timestamp,
+  stats            json,
+  meta             json,
+  deleted          boolean default false
+);
+
+CREATE TABLE IF NOT EXISTS urls (
+  url              text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  last_head        timestamp,
+  last_get         timestamp,
+  status           integer NOT NULL default 0,
+  content_type     text NOT NULL default '',
+  content_sniff    text NOT NULL default '',
+  content_length   bigint NOT NULL default 0,
+  file_name        text NOT NULL default '',
+  title            text NOT NULL default '',
+  id               text NOT NULL default '',
+  headers_took     integer NOT NULL default 0,
+  download_took    integer NOT NULL default 0,
+  headers          json,
+  meta             json,
+  hash             text NOT NULL default ''
+);
+
+CREATE TABLE IF NOT EXISTS links (
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  src              text NOT NULL references urls(url) ON DELETE CASCADE,
+  dst              text NOT NULL references urls(url) ON DELETE CASCADE,
+  PRIMARY KEY      (src, dst)
+);
+
+CREATE TABLE IF NOT EXISTS metadata (
+  hash             text NOT NULL default '',
+  time_stamp       timestamp NOT NULL,
+  key_id           text NOT NULL default '',
+  subject          text NOT NULL,
+  prev             text NOT NULL default '',
+  meta             json,
+  deleted          boolean default false
+);
+
+CREATE TABLE IF NOT EXISTS snapshots (
+  url              text NOT NULL references urls(url) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  status           integer NOT NULL DEFAULT 0,
+  duration         integer NOT NULL DEFAULT 0,
+  meta             json,
+  hash             text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS collections (
+  id               UUID PRIMARY KEY,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  creator          text NOT NULL DEFAULT '',
+  title            text NOT NULL DEFAULT '',
+  url              text NOT NULL DEFAULT '',
+  schema           json,
+  contents         json
+);
+
+CREATE TABLE IF NOT EXISTS collection_contents (
+  collection_id    UUID NOT NULL,
+  hash             text NOT NULL default '',
+  PRIMARY KEY      (collection_id, hash)
+);
+
+CREATE TABLE IF NOT EXISTS uncrawlables (
+  id               text NOT NULL default '',
+  url              text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  creator_key_id   text NOT NULL default '',
+  name             text NOT NULL default '',
+  email            text NOT NULL default '',
+  event_name       text NOT NULL default '',
+  agency_name      text NOT NULL default '',
+  agency_id        text NOT NULL default '',
+  subagency_id     text NOT NULL default '',
+  org_id           text NOT NULL default '',
+  suborg_id        text NOT NULL default '',
+  subprimer_id     text NOT NULL default '',
+  ftp              boolean default false,
+  database         boolean default false,
+  interactive      boolean default false,
+  many_files       boolean default false,
+  comments         text NOT NULL default '',
+  deleted          boolean NOT NULL default false
+);
+
+CREATE TABLE IF NOT EXISTS archive_requests (
+  id               serial primary key,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  url              text NOT NULL,
+  user_id          text NOT NULL default ''
+);
+
+CREATE TABLE IF NOT EXISTS data_repos (
+  id               UUID PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  title            text NOT NULL default '',
+  description      text NOT NULL default '',
+  url              text NOT NULL default '',
+  deleted          boolean default false
+);
+`,
+	"0002_frontier.down.sql": `
+DROP TABLE IF EXISTS frontier_hosts, frontier;
+`,
+	"0002_frontier.up.sql": `
+-- the crawl frontier, shared between sentry instances
+CREATE TABLE IF NOT EXISTS frontier (
+  url              text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  host             text NOT NULL default '',
+  crawler          text NOT NULL default 'A',
+  method           text NOT NULL default 'HEAD',
+  state            text NOT NULL default 'pending_head',
+  priority         integer NOT NULL default 0,
+  next_eligible    timestamp NOT NULL default (now() at time zone 'utc'),
+  depth            integer NOT NULL default 0,
+  lease_owner      text NOT NULL default '',
+  lease_expires    timestamp,
+  attempts         integer NOT NULL default 0,
+  last_error       text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS frontier_leasable ON frontier (crawler, state, next_eligible);
+CREATE INDEX IF NOT EXISTS frontier_host ON frontier (host);
+
+CREATE TABLE IF NOT EXISTS frontier_hosts (
+  host             text PRIMARY KEY NOT NULL,
+  owner            text NOT NULL default '',
+  lease_expires    timestamp NOT NULL
+);
+`,
+	"0003_revisits.down.sql": `
+DROP TABLE IF EXISTS revisits;
+`,
+	"0003_revisits.up.sql": `
+-- revisit scheduling from observed change frequency
+CREATE TABLE IF NOT EXISTS revisits (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  interval         bigint NOT NULL default 0, -- in milliseconds
+  unchanged        integer NOT NULL default 0,
+  hash             text NOT NULL default '',
+  next_visit       timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS revisits_next_visit ON revisits (next_visit);
+`,
+	"0004_source_settings.down.sql": `
+DROP TABLE IF EXISTS source_settings;
+`,
+	"0004_source_settings.up.sql": `
+-- per-source crawler settings
+CREATE TABLE IF NOT EXISTS source_settings (
+  source_id        UUID PRIMARY KEY NOT NULL references sources(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  settings         json
+);
+`,
+	"0005_warc_revisits.down.sql": `
+ALTER TABLE snapshots DROP COLUMN IF EXISTS revisit;
+DROP TABLE IF EXISTS warc_originals;
+`,
+	"0005_warc_revisits.up.sql": `
+-- WARC revisit records for unchanged re-captures
+CREATE TABLE IF NOT EXISTS warc_originals (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  record_id        text NOT NULL,
+  payload_digest   text NOT NULL,
+  filename         text NOT NULL default ''
+);
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS revisit boolean NOT NULL DEFAULT false;
+`,
+	"0006_content_ids.down.sql": `
+ALTER TABLE snapshots DROP COLUMN IF EXISTS cid;
+ALTER TABLE urls DROP COLUMN IF EXISTS cid;
+`,
+	"0006_content_ids.up.sql": `
+-- IPFS CIDs for stored content
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS cid text NOT NULL default '';
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS cid text NOT NULL DEFAULT '';
+`,
+	"0007_truncated_snapshots.down.sql": `
+ALTER TABLE snapshots DROP COLUMN IF EXISTS truncated;
+`,
+	"0007_truncated_snapshots.up.sql": `
+-- snapshots of bodies cut off at a size limit
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS truncated boolean NOT NULL DEFAULT false;
+`,
+	"0008_url_failures.down.sql": `
+DROP TABLE IF EXISTS url_failures;
+`,
+	"0008_url_failures.up.sql": `
+-- crawl failures, retries & dead urls
+CREATE TABLE IF NOT EXISTS url_failures (
+  url              text PRIMARY KEY NOT NULL,
+  source_id        text NOT NULL default '',
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  attempts         integer NOT NULL default 0,
+  kind             text NOT NULL default '',
+  last_error       text NOT NULL default '',
+  next_attempt     timestamp,
+  dead             boolean NOT NULL default false
+);
+CREATE INDEX IF NOT EXISTS url_failures_source ON url_failures (source_id, updated);
+`,
+	"0009_redirects.down.sql": `
+DROP TABLE IF EXISTS redirects;
+`,
+	"0009_redirects.up.sql": `
+-- redirect hops between requested & final urls
+CREATE TABLE IF NOT EXISTS redirects (
+  url              text NOT NULL, -- url originally requested
+  created          timestamp NOT NULL,
+  hop              integer NOT NULL default 0,
+  src              text NOT NULL references urls(url) ON DELETE CASCADE,
+  dst              text NOT NULL references urls(url) ON DELETE CASCADE,
+  status           integer NOT NULL default 0,
+  location         text NOT NULL default '',
+  duration         bigint NOT NULL default 0, -- in milliseconds
+  PRIMARY KEY      (url, created, hop)
+);
+CREATE INDEX IF NOT EXISTS redirects_dst ON redirects (dst);
+`,
+	"0010_link_kinds.down.sql": `
+ALTER TABLE links DROP COLUMN IF EXISTS kind;
+`,
+	"0010_link_kinds.up.sql": `
+-- typed links, so page requisites can be told apart from anchors
+ALTER TABLE links ADD COLUMN IF NOT EXISTS kind text NOT NULL default 'anchor';
+`,
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/datatogether/sqlutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationLockId is the postgres advisory lock held while migrating, so
+// instances starting at the same time take turns
+const migrationLockId int64 = 7365727472790001
+
+// migrationFile matches migration script names, eg: 0002_frontier.up.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned change to the database schema, with scripts to
+// apply & revert it. migrations live in sql/migrations & are compiled in
+// as migrationScripts, applied versions are recorded in the schema_version
+// table
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations reads migration scripts from dir, in version order.
+// versions must count up from 1 without gaps, & each needs an up & down
+// script
+func LoadMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := map[string]string{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".sql" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		scripts[f.Name()] = string(data)
+	}
+	return parseMigrations(scripts)
+}
+
+// compiledMigrations gives the migrations built into the binary
+func compiledMigrations() ([]*Migration, error) {
+	return parseMigrations(migrationScripts)
+}
+
+// parseMigrations turns scripts, keyed by filename, into migrations
+func parseMigrations(scripts map[string]string) ([]*Migration, error) {
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byVersion := map[int]*Migration{}
+	for _, name := range names {
+		match := migrationFile.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration filename: %s", name)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration version: %s", name)
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s & %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = scripts[name]
+		} else {
+			m.Down = scripts[name]
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up & a down script", m.Version, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// latestVersion gives the version of the last migration, 0 if there are none
+func latestVersion(migrations []*Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion reads the version of the database schema, 0 if no
+// migrations have been applied
+func SchemaVersion(db sqlutil.Queryable) (version int, err error) {
+	exists := false
+	if err = db.QueryRow(qSchemaVersionExists).Scan(&exists); err != nil || !exists {
+		return
+	}
+	err = db.QueryRow(qSchemaVersion).Scan(&version)
+	return
+}
+
+// Migrate applies or reverts migrations to bring the schema to version
+// target, returning the migrations run. each migration runs in it's own
+// transaction along with it's schema_version change, so a failed migration
+// leaves the schema at the last one that succeeded. an advisory lock is held
+// throughout, any other process migrating waits it's turn & then finds the
+// schema already at target. the initial migration can't be reverted, it's
+// tables hold data from before the schema was versioned
+func Migrate(db *sql.DB, migrations []*Migration, target int) ([]*Migration, error) {
+	if target < 1 {
+		return nil, fmt.Errorf("can't revert the initial schema, lowest version is 1")
+	}
+	if target > latestVersion(migrations) {
+		return nil, fmt.Errorf("unknown schema version: %d", target)
+	}
+
+	// advisory locks belong to a session, so everything runs on one connection
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, qMigrationLock, migrationLockId); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, qMigrationUnlock, migrationLockId)
+
+	if _, err := conn.ExecContext(ctx, qSchemaVersionCreate); err != nil {
+		return nil, err
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, qSchemaVersion).Scan(&current); err != nil {
+		return nil, err
+	}
+	if current > latestVersion(migrations) {
+		return nil, fmt.Errorf("unknown schema version: %d, the latest known version is %d", current, latestVersion(migrations))
+	}
+
+	run := []*Migration{}
+	for current != target {
+		var m *Migration
+		var script string
+		if current < target {
+			m = migrations[current]
+			script = m.Up
+		} else {
+			m = migrations[current-1]
+			script = m.Down
+		}
+
+		if err := runMigration(ctx, conn, m, script, current < target); err != nil {
+			return run, fmt.Errorf("migration %d_%s: %s", m.Version, m.Name, err)
+		}
+		run = append(run, m)
+		if current < target {
+			current++
+		} else {
+			current--
+		}
+	}
+	return run, nil
+}
+
+// runMigration runs a migration script & records it in schema_version
+func runMigration(ctx context.Context, conn *sql.Conn, m *Migration, script string, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if up {
+		_, err = tx.Exec(qSchemaVersionInsert, m.Version, m.Name, time.Now().Round(time.Second).In(time.UTC))
+	} else {
+		_, err = tx.Exec(qSchemaVersionDelete, m.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDb brings the schema up to date on startup. it refuses to touch
+// a schema newer than this build knows about, which means a newer sentry
+// has migrated the database
+func migrateDb(db *sql.DB) error {
+	migrations, err := compiledMigrations()
+	if err != nil {
+		return err
+	}
+	run, err := Migrate(db, migrations, latestVersion(migrations))
+	for _, m := range run {
+		log.Infof("applied migration %d_%s", m.Version, m.Name)
+	}
+	return err
+}
+
+// migrateCommand runs "sentry migrate [flags]", migrating the configured
+// database to the latest or a given schema version. it returns the process
+// exit code
+func migrateCommand(args []string) int {
+	var target int
+	var status bool
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sentry migrate [flags]")
+		flags.PrintDefaults()
+	}
+	flags.IntVar(&target, "to", -1, "schema version to migrate up or down to, defaults to the latest")
+	flags.BoolVar(&status, "status", false, "print the current & latest schema versions without migrating")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if cfg, err = initConfig(os.Getenv("GOLANG_ENV")); err != nil {
+		fmt.Fprintf(os.Stderr, "configuration error: %s\n", err)
+		return 1
+	}
+	if cfg.Embedded() {
+		fmt.Fprintln(os.Stderr, "nothing to migrate, an embedded store has no database schema")
+		return 1
+	}
+	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
+		fmt.Fprintf(os.Stderr, "database error: %s\n", err)
+		return 1
+	}
+
+	migrations, err := compiledMigrations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading migrations: %s\n", err)
+		return 1
+	}
+	if target < 0 {
+		target = latestVersion(migrations)
+	}
+
+	current, err := SchemaVersion(appDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading schema version: %s\n", err)
+		return 1
+	}
+	if status {
+		fmt.Printf("schema version %d, latest is %d\n", current, latestVersion(migrations))
+		return 0
+	}
+
+	run, err := Migrate(appDB, migrations, target)
+	for _, m := range run {
+		dir := "applied"
+		if target < current {
+			dir = "reverted"
+		}
+		fmt.Printf("%s %d_%s\n", dir, m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("schema is at version %d\n", target)
+	return 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations("sql/migrations")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected migrations")
+	}
+	if migrations[0].Name != "initial" || !strings.Contains(migrations[0].Up, "CREATE TABLE IF NOT EXISTS urls") {
+		t.Errorf("expected first migration to create the initial tables, got: %s", migrations[0].Name)
+	}
+	if latestVersion(migrations) != len(migrations) {
+		t.Errorf("expected latest version %d, got %d", len(migrations), latestVersion(migrations))
+	}
+}
+
+func TestMigrationScripts(t *testing.T) {
+	loaded, err := LoadMigrations("sql/migrations")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	compiled, err := compiledMigrations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(compiled) != len(loaded) {
+		t.Fatalf("expected %d compiled migrations, got %d", len(loaded), len(compiled))
+	}
+	for i, m := range loaded {
+		c := compiled[i]
+		same := func(a, b string) bool { return strings.TrimSpace(a) == strings.TrimSpace(b) }
+		if c.Version != m.Version || c.Name != m.Name || !same(c.Up, m.Up) || !same(c.Down, m.Down) {
+			t.Errorf("case %d: compiled migration %d_%s doesn't match sql/migrations", i, m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	cases := []struct {
+		files []string
+		err   string
+	}{
+		{[]string{"0001_a.up.sql", "0001_a.down.sql", "readme.md"}, ""},
+		{[]string{"0001_a.up.sql"}, "migration 1_a needs both an up & a down script"},
+		{[]string{"0001_a.up.sql", "0001_a.down.sql", "0003_c.up.sql", "0003_c.down.sql"}, "missing migration 2"},
+		{[]string{"0001_a.up.sql", "0001_b.down.sql"}, "migration 1 has two names: a & b"},
+		{[]string{"create.sql"}, "invalid migration filename: create.sql"},
+		{[]string{"0000_a.up.sql", "0000_a.down.sql"}, "invalid migration version: 0000_a.down.sql"},
+	}
+
+	for i, c := range cases {
+		dir, err := ioutil.TempDir("", "sentry_migrations")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, f := range c.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("SELECT 1;"), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		got := ""
+		if _, err := LoadMigrations(dir); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.err, got)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	migrations, err := compiledMigrations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	latest := latestVersion(migrations)
+
+	if v, err := SchemaVersion(appDB); err != nil {
+		t.Fatal(err.Error())
+	} else if v != latest {
+		t.Errorf("expected test db to be at version %d, got %d", latest, v)
+	}
+
+	// step the last migration down & back up
+	if run, err := Migrate(appDB, migrations, latest-1); err != nil {
+		t.Fatal(err.Error())
+	} else if len(run) != 1 || run[0].Version != latest {
+		t.Errorf("expected migration %d to be reverted, got: %v", latest, run)
+	}
+	if v, _ := SchemaVersion(appDB); v != latest-1 {
+		t.Errorf("expected version %d after reverting, got %d", latest-1, v)
+	}
+	if run, err := Migrate(appDB, migrations, latest); err != nil {
+		t.Fatal(err.Error())
+	} else if len(run) != 1 {
+		t.Errorf("expected one migration to be applied, got: %v", run)
+	}
+
+	if _, err := Migrate(appDB, migrations, 0); err == nil {
+		t.Errorf("expected reverting the initial migration to error")
+	}
+	if _, err := Migrate(appDB, migrations, latest+1); err == nil {
+		t.Errorf("expected migrating past the latest version to error")
+	}
+	if _, err := Migrate(appDB, migrations[:latest-1], latest-1); err == nil {
+		t.Errorf("expected a schema newer than the known migrations to error")
+	}
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	migrations, err := compiledMigrations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	latest := latestVersion(migrations)
+	if _, err := Migrate(appDB, migrations, latest-1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// instances starting together take turns, only one applies the migration
+	const instances = 4
+	runs := make(chan int, instances)
+	errs := make(chan error, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run, err := Migrate(appDB, migrations, latest)
+			runs <- len(run)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(runs)
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent migrate error: %s", err)
+		}
+	}
+	total := 0
+	for n := range runs {
+		total += n
+	}
+	if total != 1 {
+		t.Errorf("expected the migration to be applied once, got %d", total)
+	}
+	if v, _ := SchemaVersion(appDB); v != latest {
+		t.Errorf("expected version %d, got %d", latest, v)
+	}
+}
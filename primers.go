@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/datatogether/core"
+	"strings"
+	"time"
+)
+
+// validatePrimer checks a primer before it's saved
+func validatePrimer(p *core.Primer) error {
+	p.ShortTitle = strings.TrimSpace(p.ShortTitle)
+	p.Title = strings.TrimSpace(p.Title)
+	if p.ShortTitle == "" && p.Title == "" {
+		return fmt.Errorf("title or shortTitle is required")
+	}
+
+	if p.Parent != nil && p.Parent.Id != "" {
+		if p.Parent.Id == p.Id {
+			return fmt.Errorf("primer can't be it's own parent")
+		}
+		if err := (&core.Primer{Id: p.Parent.Id}).Read(store); err != nil {
+			if err == core.ErrNotFound {
+				return fmt.Errorf("parent primer '%s' not found", p.Parent.Id)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatePrimer adds a new primer
+func CreatePrimer(p *core.Primer) error {
+	p.Id = ""
+	if err := validatePrimer(p); err != nil {
+		return InvalidError{err}
+	}
+	p.Stats = nil
+	p.SubPrimers = nil
+	p.Sources = nil
+	return p.Save(store)
+}
+
+// UpdatePrimer replaces the editable fields of the primer with id, keeping
+// it's creation time & stats
+func UpdatePrimer(id string, update *core.Primer) (*core.Primer, error) {
+	p := &core.Primer{Id: id}
+	if err := p.Read(store); err != nil {
+		return nil, err
+	}
+
+	update.Id = id
+	if err := validatePrimer(update); err != nil {
+		return nil, InvalidError{err}
+	}
+
+	p.ShortTitle = update.ShortTitle
+	p.Title = update.Title
+	p.Description = update.Description
+	p.Parent = update.Parent
+	p.Meta = update.Meta
+	if err := p.Save(store); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DeletePrimer marks the primer with id deleted, or removes it from an
+// embedded store. primers that still have sources or sub-primers can't be
+// deleted
+func DeletePrimer(db *sql.DB, id string) error {
+	p := &core.Primer{Id: id}
+	if err := p.Read(store); err != nil {
+		return err
+	}
+	if err := readPrimerChildren(store, p); err != nil {
+		return err
+	}
+	if len(p.Sources) > 0 {
+		return ConflictError{fmt.Errorf("primer '%s' still has %d sources", id, len(p.Sources))}
+	}
+	if len(p.SubPrimers) > 0 {
+		return ConflictError{fmt.Errorf("primer '%s' still has %d sub-primers", id, len(p.SubPrimers))}
+	}
+
+	if _, ok := store.(*EmbeddedStore); ok {
+		return p.Delete(store)
+	}
+	_, err := db.Exec(qPrimerSoftDelete, id, time.Now().Round(time.Second).In(time.UTC))
+	return err
+}
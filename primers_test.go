@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"testing"
+)
+
+func TestPrimerCrud(t *testing.T) {
+	if err := CreatePrimer(&core.Primer{}); err == nil {
+		t.Errorf("expected primer without a title to error")
+	}
+	if err := CreatePrimer(&core.Primer{Title: "child", Parent: &core.Primer{Id: "00000000-0000-0000-0000-000000000000"}}); err == nil {
+		t.Errorf("expected primer with a missing parent to error")
+	}
+
+	p := &core.Primer{ShortTitle: " CRUD ", Title: "crud test primer"}
+	if err := CreatePrimer(p); err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.ShortTitle != "CRUD" {
+		t.Errorf("expected short title to be trimmed, got: '%s'", p.ShortTitle)
+	}
+
+	child := &core.Primer{Title: "crud test child", Parent: &core.Primer{Id: p.Id}}
+	if err := CreatePrimer(child); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := UpdatePrimer(child.Id, &core.Primer{Title: "loop", Parent: &core.Primer{Id: child.Id}}); err == nil {
+		t.Errorf("expected primer to refuse being it's own parent")
+	}
+
+	if err := DeletePrimer(appDB, p.Id); err == nil {
+		t.Errorf("expected primer with sub-primers to refuse deletion")
+	} else if _, ok := err.(ConflictError); !ok {
+		t.Errorf("expected conflict error, got: %v", err)
+	}
+
+	updated, err := UpdatePrimer(child.Id, &core.Primer{Title: "crud test child, updated"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if updated.Title != "crud test child, updated" || updated.Created.IsZero() {
+		t.Errorf("primer not updated: %#v", updated)
+	}
+
+	for _, id := range []string{p.Id, child.Id} {
+		if err := DeletePrimer(appDB, id); err != nil {
+			t.Errorf("error deleting primer %s: %s", id, err)
+		}
+	}
+	if err := (&core.Primer{Id: p.Id}).Read(store); err != core.ErrNotFound {
+		t.Errorf("expected deleted primer to not be found, got: %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+// insert a url into the frontier. urls that are already pending or in-flight
+// are left alone, finished urls are reset to pending with the new method,
+// keeping the shallowest depth the url has been found at. urls that have
+// been marked dead stay failed
+const qFrontierEnqueue = `
+INSERT INTO frontier
+  (url, created, updated, crawler, method, state, priority, next_eligible, host, depth)
+VALUES
+  ($1, $2, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (url) DO UPDATE
+SET
+  updated = excluded.updated, crawler = excluded.crawler, method = excluded.method,
+  state = excluded.state, priority = excluded.priority, next_eligible = excluded.next_eligible,
+  depth = least(frontier.depth, excluded.depth),
+  lease_owner = '', lease_expires = null, attempts = 0, last_error = ''
+WHERE
+  frontier.state = 'done' or
+  (frontier.state = 'failed' and NOT EXISTS (
+    SELECT 1 FROM url_failures WHERE url_failures.url = frontier.url and url_failures.dead))
+RETURNING url;`
+
+// move a pending url to another crawler at a higher priority. leased urls
+// are left with whoever holds them
+const qFrontierPromote = `
+UPDATE frontier
+SET
+  updated = $2, crawler = $3, method = $4, state = $5, priority = $6,
+  next_eligible = least(next_eligible, $7), depth = least(depth, $8)
+WHERE
+  url = $1 and
+  (state = 'pending_head' or state = 'pending_get') and
+  priority < $6;`
+
+// count hosts currently claimed by an owner
+const qFrontierOwnedHostsCount = `
+SELECT count(1) FROM frontier_hosts
+WHERE owner = $1 and lease_expires >= $2;`
+
+// claim up to $4 hosts that have work waiting & no live owner. only the
+// owner of a host may lease it's urls, which keeps per-host politeness
+// intact when many processes share one frontier
+const qFrontierClaimHosts = `
+INSERT INTO frontier_hosts (host, owner, lease_expires)
+SELECT f.host, $1, $2
+FROM frontier f
+LEFT JOIN frontier_hosts h ON h.host = f.host
+WHERE
+  f.next_eligible <= $3 and
+  (f.state = 'pending_head' or f.state = 'pending_get' or
+   (f.state = 'in_flight' and f.lease_expires < $3)) and
+  (h.host is null or h.lease_expires < $3)
+GROUP BY f.host
+LIMIT $4
+ON CONFLICT (host) DO UPDATE
+SET owner = excluded.owner, lease_expires = excluded.lease_expires
+WHERE frontier_hosts.lease_expires < $3 or frontier_hosts.owner = excluded.owner;`
+
+// lease up to $3 eligible entries for a crawler from hosts claimed by the
+// lease owner, marking them as in-flight. rows locked by a concurrent lease
+// are skipped rather than waited on. in-flight entries with an expired lease
+// are eligible as well, so work held by a crashed process is picked back up
+const qFrontierLease = `
+UPDATE frontier
+SET
+  state = 'in_flight', lease_owner = $2, lease_expires = $4, updated = $5,
+  attempts = attempts + 1
+WHERE url in (
+  SELECT f.url FROM frontier f, frontier_hosts h
+  WHERE
+    h.host = f.host and
+    h.owner = $2 and
+    h.lease_expires >= $5 and
+    f.crawler = $1 and
+    f.next_eligible <= $5 and
+    (f.state = 'pending_head' or f.state = 'pending_get' or
+     (f.state = 'in_flight' and f.lease_expires < $5))
+  ORDER BY f.priority DESC, f.next_eligible
+  LIMIT $3
+  FOR UPDATE OF f SKIP LOCKED
+)
+RETURNING
+  url, created, updated, host, crawler, method, state, priority, next_eligible,
+  depth, lease_owner, lease_expires, attempts, last_error;`
+
+// extend the lease on every entry an owner is holding
+const qFrontierHeartbeat = `
+UPDATE frontier
+SET lease_expires = $2
+WHERE lease_owner = $1 and state = 'in_flight';`
+
+// extend the lease on every host an owner is holding
+const qFrontierHeartbeatHosts = `
+UPDATE frontier_hosts
+SET lease_expires = $2
+WHERE owner = $1;`
+
+// give up hosts an owner has no work left for
+const qFrontierReleaseIdleHosts = `
+DELETE FROM frontier_hosts h
+WHERE
+  h.owner = $1 and
+  not exists (
+    SELECT 1 FROM frontier f
+    WHERE f.host = h.host and
+    (f.state = 'pending_head' or f.state = 'pending_get' or f.state = 'in_flight')
+  );`
+
+// return entries with expired leases to the pending pool
+const qFrontierReclaim = `
+UPDATE frontier
+SET
+  state = CASE WHEN method = 'GET' THEN 'pending_get' ELSE 'pending_head' END,
+  lease_owner = '', lease_expires = null, updated = $1
+WHERE state = 'in_flight' and lease_expires < $1;`
+
+// drop host claims with expired leases
+const qFrontierReclaimHosts = `
+DELETE FROM frontier_hosts
+WHERE lease_expires < $1;`
+
+// mark an entry as finished
+const qFrontierAck = `
+UPDATE frontier
+SET state = 'done', lease_owner = '', lease_expires = null, updated = $2, last_error = ''
+WHERE url = $1;`
+
+// mark an entry as failed, recording the error
+const qFrontierFail = `
+UPDATE frontier
+SET state = 'failed', lease_owner = '', lease_expires = null, updated = $2, last_error = $3
+WHERE url = $1;`
+
+// send an entry back to the pending pool to be tried again at $3
+const qFrontierRetry = `
+UPDATE frontier
+SET
+  state = CASE WHEN method = 'GET' THEN 'pending_get' ELSE 'pending_head' END,
+  lease_owner = '', lease_expires = null, updated = $2, next_eligible = $3, last_error = $4
+WHERE url = $1;`
+
+// hand an in-flight entry back to the pending pool without counting
+// the attempt against it
+const qFrontierRelease = `
+UPDATE frontier
+SET
+  state = CASE WHEN method = 'GET' THEN 'pending_get' ELSE 'pending_head' END,
+  lease_owner = '', lease_expires = null, updated = $2, attempts = greatest(attempts - 1, 0)
+WHERE url = $1 and state = 'in_flight';`
+
+// release every entry leased by an owner, used when a process restarts
+// under the same identity
+const qFrontierReleaseOwner = `
+UPDATE frontier
+SET
+  state = CASE WHEN method = 'GET' THEN 'pending_get' ELSE 'pending_head' END,
+  lease_owner = '', lease_expires = null, updated = $2
+WHERE lease_owner = $1 and state = 'in_flight';`
+
+// release every host claimed by an owner
+const qFrontierReleaseOwnerHosts = `
+DELETE FROM frontier_hosts
+WHERE owner = $1;`
+
+// count entries currently leased by an owner for a crawler
+const qFrontierLeasedCount = `
+SELECT count(1) FROM frontier
+WHERE crawler = $1 and lease_owner = $2 and state = 'in_flight';`
+
+// count entries waiting to be crawled
+const qFrontierPendingCount = `
+SELECT count(1) FROM frontier
+WHERE state = 'pending_head' or state = 'pending_get';`
+
+// list pending & in-flight entries, highest priority first, paginated
+const qFrontierList = `
+SELECT
+  url, created, updated, host, crawler, method, state, priority, next_eligible,
+  depth, lease_owner, lease_expires, attempts, last_error
+FROM frontier
+WHERE state = 'pending_head' or state = 'pending_get' or state = 'in_flight'
+ORDER BY priority DESC, next_eligible
+LIMIT $1 OFFSET $2;`
+
+// read the depth a url was found at
+const qFrontierDepth = `
+SELECT depth FROM frontier
+WHERE url = $1;`
+
+// read settings for a source
+const qSourceSettingsBySourceId = `
+SELECT source_id, created, updated, settings
+FROM source_settings
+WHERE source_id = $1;`
+
+// create or replace settings for a source
+const qSourceSettingsUpsert = `
+INSERT INTO source_settings
+  (source_id, created, updated, settings)
+VALUES
+  ($1, $2, $3, $4)
+ON CONFLICT (source_id) DO UPDATE
+SET updated = excluded.updated, settings = excluded.settings;`
+
+// read the revisit schedule for a url
+const qRevisitByUrl = `
+SELECT url, updated, interval, unchanged, hash, next_visit
+FROM revisits
+WHERE url = $1;`
+
+// create or replace the revisit schedule for a url
+const qRevisitUpsert = `
+INSERT INTO revisits
+  (url, updated, interval, unchanged, hash, next_visit)
+VALUES
+  ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (url) DO UPDATE
+SET
+  updated = excluded.updated, interval = excluded.interval, unchanged = excluded.unchanged,
+  hash = excluded.hash, next_visit = excluded.next_visit;`
+
+// list urls that are due for a revisit, most overdue first
+const qRevisitsDue = `
+SELECT url, updated, interval, unchanged, hash, next_visit
+FROM revisits
+WHERE next_visit <= $1
+ORDER BY next_visit
+LIMIT $2 OFFSET $3;`
+
+// snapshot hash history for a url, oldest first
+const qSnapshotHashesByUrl = `
+SELECT created, hash
+FROM snapshots
+WHERE url = $1
+ORDER BY created;`
+
+// most recent complete snapshot of a url with a hash, the basis
+// for conditional GETs
+const qSnapshotLastGet = `
+SELECT url, created, status, duration, meta, hash, cid, truncated, revisit
+FROM snapshots
+WHERE url = $1 AND hash != '' AND NOT truncated
+ORDER BY created DESC
+LIMIT 1;`
+
+// all snapshots of a url, most recent first
+const qSnapshotsByUrl = `
+SELECT url, created, status, duration, meta, hash, cid, truncated, revisit
+FROM snapshots
+WHERE url = $1
+ORDER BY created DESC;`
+
+// record a snapshot of a GET, including the columns core doesn't know about
+const qSnapshotInsert = `
+INSERT INTO snapshots
+  (url, created, status, duration, meta, hash, cid, truncated, revisit)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9);`
+
+// flag a snapshot as a revisit of unchanged content
+const qSnapshotMarkRevisit = `
+UPDATE snapshots
+SET revisit = true
+WHERE url = $1 and created = $2;`
+
+// record the IPFS CID of a url's content
+const qUrlSetCid = `
+UPDATE urls
+SET cid = $2
+WHERE url = $1;`
+
+// read the last full warc capture of a url
+const qWarcOriginalByUrl = `
+SELECT url, created, record_id, payload_digest, filename
+FROM warc_originals
+WHERE url = $1;`
+
+// create or replace the last full warc capture of a url
+const qWarcOriginalUpsert = `
+INSERT INTO warc_originals
+  (url, created, record_id, payload_digest, filename)
+VALUES
+  ($1, $2, $3, $4, $5)
+ON CONFLICT (url) DO UPDATE
+SET
+  created = excluded.created, record_id = excluded.record_id,
+  payload_digest = excluded.payload_digest, filename = excluded.filename;`
+
+// read the failure record for a url
+const qUrlFailureByUrl = `
+SELECT url, source_id, created, updated, attempts, kind, last_error, next_attempt, dead
+FROM url_failures
+WHERE url = $1;`
+
+// create or replace the failure record for a url
+const qUrlFailureUpsert = `
+INSERT INTO url_failures
+  (url, source_id, created, updated, attempts, kind, last_error, next_attempt, dead)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (url) DO UPDATE
+SET
+  source_id = excluded.source_id, updated = excluded.updated, attempts = excluded.attempts,
+  kind = excluded.kind, last_error = excluded.last_error, next_attempt = excluded.next_attempt,
+  dead = excluded.dead;`
+
+// forget failures for a url once it's fetched successfully
+const qUrlFailureDelete = `
+DELETE FROM url_failures
+WHERE url = $1;`
+
+// list failing urls, most recently failed first. $3 filters by source id &
+// $4 by dead, either is ignored if null
+const qUrlFailuresList = `
+SELECT url, source_id, created, updated, attempts, kind, last_error, next_attempt, dead
+FROM url_failures
+WHERE
+  ($3::text is null or source_id = $3) and
+  ($4::boolean is null or dead = $4)
+ORDER BY updated DESC
+LIMIT $1 OFFSET $2;`
+
+// record a single redirect hop
+const qRedirectInsert = `
+INSERT INTO redirects
+  (url, created, hop, src, dst, status, location, duration)
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (url, created, hop) DO NOTHING;`
+
+// list redirect hops that start from, pass through or end at a url, most
+// recent chains first with hops in order
+const qRedirectsForUrl = `
+SELECT url, created, hop, src, dst, status, location, duration
+FROM redirects
+WHERE (url, created) in (
+  SELECT url, created FROM redirects
+  WHERE url = $1 or src = $1 or dst = $1)
+ORDER BY created DESC, url, hop
+LIMIT $2 OFFSET $3;`
+
+// insert a link or update it's kind
+const qLinkUpsert = `
+INSERT INTO links
+  (created, updated, src, dst, kind)
+VALUES
+  ($1, $2, $3, $4, $5)
+ON CONFLICT (src, dst) DO UPDATE
+SET
+  updated = excluded.updated, kind = excluded.kind;`
+
+// look up a source by url, including deleted sources
+const qSourceIdByUrl = `
+SELECT id, deleted FROM sources
+WHERE url = $1;`
+
+// bring back a deleted source
+const qSourceRestore = `
+UPDATE sources SET deleted = false
+WHERE id = $1;`
+
+// 'delete' a source by id, which also stops it being crawled
+const qSourceSoftDelete = `
+UPDATE sources SET
+  deleted = true, crawl = false, updated = $2
+WHERE
+  deleted = false AND
+  id = $1;`
+
+// 'delete' a primer by id
+const qPrimerSoftDelete = `
+UPDATE primers SET
+  deleted = true, updated = $2
+WHERE
+  deleted = false AND
+  id = $1;`
+
+// record of applied schema migrations, see migrations.go
+const qSchemaVersionCreate = `
+CREATE TABLE IF NOT EXISTS schema_version (
+  version          integer PRIMARY KEY NOT NULL,
+  name             text NOT NULL default '',
+  applied          timestamp NOT NULL default (now() at time zone 'utc')
+);`
+
+// check for the schema_version table
+const qSchemaVersionExists = `
+SELECT EXISTS (
+  SELECT 1 FROM information_schema.tables
+  WHERE table_schema = current_schema() AND table_name = 'schema_version'
+);`
+
+// take the migration lock, waiting for any other process to let it go
+const qMigrationLock = `
+SELECT pg_advisory_lock($1);`
+
+// let go of the migration lock
+const qMigrationUnlock = `
+SELECT pg_advisory_unlock($1);`
+
+// highest applied migration
+const qSchemaVersion = `
+SELECT coalesce(max(version), 0) FROM schema_version;`
+
+// mark a migration applied
+const qSchemaVersionInsert = `
+INSERT INTO schema_version
+  (version, name, applied)
+VALUES
+  ($1, $2, $3);`
+
+// mark a migration reverted
+const qSchemaVersionDelete = `
+DELETE FROM schema_version
+WHERE version = $1;`
+
+// record a url submitted for archiving
+const qArchiveRequestInsert = `
+INSERT INTO archive_requests
+  (created, url, user_id)
+VALUES
+  ($1, $2, $3);`
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// largest redirect response body kept for WARC output
+	maxRedirectBody int64 = 64 * 1024
+)
+
+// RedirectHop is a single redirect response on the way from a requested
+// url to the url that finally answered
+type RedirectHop struct {
+	// url originally requested
+	Url string `json:"url"`
+	// time the chain was recorded, shared by all hops in a chain
+	Created time.Time `json:"created"`
+	// position in the chain, starting at 0
+	Hop int `json:"hop"`
+	// url that responded with a redirect
+	Src string `json:"src"`
+	// url the redirect resolved to
+	Dst string `json:"dst"`
+	// redirect status code
+	Status int `json:"status"`
+	// Location header as sent
+	Location string `json:"location"`
+	// time between requesting src & getting a response
+	Duration time.Duration `json:"duration"`
+
+	// redirect response & start of it's body, for WARC output
+	res  *http.Response
+	body []byte
+	// time src was requested
+	at time.Time
+}
+
+// redirectChain collects the hops of a request as the client follows
+// redirects. it travels with the request in it's context
+type redirectChain struct {
+	lock sync.Mutex
+	hops []*RedirectHop
+	// time the current hop was requested
+	last time.Time
+}
+
+type redirectChainKey struct{}
+
+// withRedirectChain adds an empty redirect chain to req
+func withRedirectChain(req *http.Request) *http.Request {
+	chain := &redirectChain{last: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), redirectChainKey{}, chain))
+}
+
+// redirectChainFor gets the chain carried by req, if any
+func redirectChainFor(req *http.Request) *redirectChain {
+	if req == nil {
+		return nil
+	}
+	chain, _ := req.Context().Value(redirectChainKey{}).(*redirectChain)
+	return chain
+}
+
+// add records the redirect response that led to next
+func (c *redirectChain) add(next *http.Request) {
+	res := next.Response
+	if res == nil || res.Request == nil {
+		return
+	}
+
+	now := time.Now()
+	hop := &RedirectHop{
+		Src:      res.Request.URL.String(),
+		Dst:      next.URL.String(),
+		Status:   res.StatusCode,
+		Location: res.Header.Get("Location"),
+		res:      res,
+	}
+	// the client closes redirect bodies once it's done with them, read
+	// what we'll keep now
+	if res.Body != nil {
+		hop.body, _ = ioutil.ReadAll(io.LimitReader(res.Body, maxRedirectBody))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	hop.at = c.last
+	hop.Duration = now.Sub(c.last)
+	hop.Hop = len(c.hops)
+	c.hops = append(c.hops, hop)
+	c.last = now
+}
+
+// redirectsFor gives the hops followed to get res, nil if res wasn't
+// redirected
+func redirectsFor(res *http.Response) []*RedirectHop {
+	if res == nil {
+		return nil
+	}
+	chain := redirectChainFor(res.Request)
+	if chain == nil {
+		return nil
+	}
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	return chain.hops
+}
+
+// redirectDoer is a fetchbot.Doer that sets requests up to record any
+// redirects they follow
+type redirectDoer struct {
+	client *http.Client
+}
+
+func (d *redirectDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.client.Do(withRedirectChain(req))
+}
+
+// handleRedirects stores the redirect chain that led to res, returning the
+// url record for the url that finally answered. requested is returned
+// as-is if res wasn't redirected. each hop gets a redirects row, a url
+// record with the redirect status & headers, a link to where it pointed,
+// and a WARC record
+func handleRedirects(db *sql.DB, requested *core.Url, res *http.Response) (*core.Url, error) {
+	hops := redirectsFor(res)
+	if len(hops) == 0 {
+		return requested, nil
+	}
+
+	created := time.Now().Round(time.Second).In(time.UTC)
+	src := requested
+	for _, h := range hops {
+		if h.Src != src.Url {
+			var err error
+			if src, err = readOrCreateUrl(h.Src); err != nil {
+				return nil, err
+			}
+		}
+		dst, err := readOrCreateUrl(h.Dst)
+		if err != nil {
+			return nil, err
+		}
+
+		at := h.at
+		src.Status = h.Status
+		src.Headers = rawHeadersSlice(h.res)
+		src.ContentLength = h.res.ContentLength
+		src.ContentType = h.res.Header.Get("Content-Type")
+		if res.Request.Method == "HEAD" {
+			src.LastHead = &at
+		} else {
+			src.LastGet = &at
+		}
+		if err := src.Save(store); err != nil {
+			return nil, err
+		}
+
+		if err := saveLink(db, src, dst, LinkRedirect); err != nil {
+			return nil, err
+		}
+
+		h.Url = requested.Url
+		h.Created = created
+		if err := h.Save(db); err != nil {
+			return nil, err
+		}
+
+		if res.Request.Method != "HEAD" || cfg.WarcHeads {
+			writeWarc(h.res, h.body, at)
+		}
+		src = dst
+	}
+
+	final := res.Request.URL.String()
+	if src.Url == final {
+		return src, nil
+	}
+	return readOrCreateUrl(final)
+}
+
+// readOrCreateUrl reads the url record for rawurl, saving a new one if
+// it doesn't exist
+func readOrCreateUrl(rawurl string) (*core.Url, error) {
+	u := &core.Url{Url: rawurl}
+	if err := readUrl(store, u); err == core.ErrNotFound {
+		return u, u.Save(store)
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// RedirectsForUrl reads redirect chains that start from, pass through or
+// end at rawurl
+func RedirectsForUrl(db sqlutil.Queryable, rawurl string, limit, offset int) ([]*RedirectHop, error) {
+	if es, ok := store.(*EmbeddedStore); ok {
+		return embeddedRedirects(es, rawurl, limit, offset)
+	}
+
+	rows, err := db.Query(qRedirectsForUrl, rawurl, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hops := []*RedirectHop{}
+	for rows.Next() {
+		h := &RedirectHop{}
+		if err := h.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		hops = append(hops, h)
+	}
+	return hops, rows.Err()
+}
+
+// embeddedRedirects reads the chains rawurl is part of from an embedded
+// store, ordered like qRedirectsForUrl
+func embeddedRedirects(es *EmbeddedStore, rawurl string, limit, offset int) ([]*RedirectHop, error) {
+	// chain creation times, by the url each chain started from
+	chains := map[string]map[string]bool{}
+	for _, idx := range []string{"redirect.url", "redirect.src", "redirect.dst"} {
+		found, err := es.lookup(idx, rawurl)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range found {
+			h := v.(*RedirectHop)
+			if chains[h.Url] == nil {
+				chains[h.Url] = map[string]bool{}
+			}
+			chains[h.Url][h.Created.In(time.UTC).Format(time.RFC3339Nano)] = true
+		}
+	}
+
+	hops := []*RedirectHop{}
+	for start, created := range chains {
+		found, err := es.lookup("redirect.url", start)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range found {
+			if h := v.(*RedirectHop); created[h.Created.In(time.UTC).Format(time.RFC3339Nano)] {
+				hops = append(hops, h)
+			}
+		}
+	}
+
+	sort.Slice(hops, func(i, j int) bool {
+		a, b := hops[i], hops[j]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		if a.Url != b.Url {
+			return a.Url < b.Url
+		}
+		return a.Hop < b.Hop
+	})
+	if offset >= len(hops) {
+		return []*RedirectHop{}, nil
+	}
+	hops = hops[offset:]
+	if len(hops) > limit {
+		hops = hops[:limit]
+	}
+	return hops, nil
+}
+
+// redirectKey gives the embedded store key for a hop
+func redirectKey(h *RedirectHop) datastore.Key {
+	return embeddedKey("RedirectHop", fmt.Sprintf("%s %s %d", h.Url, h.Created.In(time.UTC).Format(time.RFC3339Nano), h.Hop))
+}
+
+// Save a redirect hop to the db
+func (h *RedirectHop) Save(db sqlutil.Execable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(redirectKey(h), h)
+	}
+	_, err := db.Exec(qRedirectInsert, h.Url, h.Created.In(time.UTC), h.Hop, h.Src, h.Dst, h.Status, h.Location, int64(h.Duration/time.Millisecond))
+	return err
+}
+
+// UnmarshalSQL reads an sql response into the hop receiver
+func (h *RedirectHop) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		rawurl, src, dst, location string
+		created                    time.Time
+		hop, status                int
+		duration                   int64
+	)
+
+	if err := row.Scan(&rawurl, &created, &hop, &src, &dst, &status, &location, &duration); err != nil {
+		if err == sql.ErrNoRows {
+			return core.ErrNotFound
+		}
+		return err
+	}
+
+	*h = RedirectHop{
+		Url:      rawurl,
+		Created:  created.In(time.UTC),
+		Hop:      hop,
+		Src:      src,
+		Dst:      dst,
+		Status:   status,
+		Location: location,
+		Duration: time.Duration(duration) * time.Millisecond,
+	}
+	return nil
+}
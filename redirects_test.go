@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// redirectServer serves /a -> /b -> /c, with /c answering
+func redirectServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		default:
+			w.Write([]byte("final"))
+		}
+	}))
+}
+
+func TestRedirectChain(t *testing.T) {
+	s := redirectServer()
+	defer s.Close()
+
+	client := &redirectDoer{client: newCrawlClient()}
+	cases := []struct {
+		path   string
+		status []int
+	}{
+		{"/c", nil},
+		{"/b", []int{http.StatusFound}},
+		{"/a", []int{http.StatusMovedPermanently, http.StatusFound}},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", s.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+
+		if res.Request.URL.String() != s.URL+"/c" {
+			t.Errorf("case %d expected to end up at /c, got: %s", i, res.Request.URL)
+		}
+
+		hops := redirectsFor(res)
+		if len(hops) != len(c.status) {
+			t.Errorf("case %d hop count mismatch. expected: %d, got: %d", i, len(c.status), len(hops))
+			continue
+		}
+		for j, h := range hops {
+			if h.Hop != j {
+				t.Errorf("case %d hop %d position mismatch, got: %d", i, j, h.Hop)
+			}
+			if h.Status != c.status[j] {
+				t.Errorf("case %d hop %d status mismatch. expected: %d, got: %d", i, j, c.status[j], h.Status)
+			}
+			if j > 0 && h.Src != hops[j-1].Dst {
+				t.Errorf("case %d hop %d doesn't start where the last hop ended: %s != %s", i, j, h.Src, hops[j-1].Dst)
+			}
+			if h.Location == "" || len(h.body) == 0 {
+				t.Errorf("case %d hop %d expected location & body to be recorded", i, j)
+			}
+		}
+	}
+}
+
+func TestHandleRedirects(t *testing.T) {
+	s := redirectServer()
+	defer s.Close()
+
+	requested := &core.Url{Url: s.URL + "/a"}
+	if err := requested.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, err := http.NewRequest("GET", requested.Url, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := (&redirectDoer{client: newCrawlClient()}).Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+
+	u, err := handleRedirects(appDB, requested, res)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if u.Url != s.URL+"/c" {
+		t.Errorf("expected final url /c, got: %s", u.Url)
+	}
+	if requested.Status != http.StatusMovedPermanently {
+		t.Errorf("expected requested url to record it's redirect status, got: %d", requested.Status)
+	}
+
+	if err := (&core.Link{Src: requested, Dst: &core.Url{Url: s.URL + "/b"}}).Read(store); err != nil {
+		t.Errorf("expected a link from /a to /b: %s", err)
+	}
+
+	for _, rawurl := range []string{s.URL + "/a", s.URL + "/b", s.URL + "/c"} {
+		hops, err := RedirectsForUrl(appDB, rawurl, 10, 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(hops) != 2 {
+			t.Errorf("%s: expected 2 hops, got: %d", rawurl, len(hops))
+			continue
+		}
+		if hops[0].Src != s.URL+"/a" || hops[1].Dst != s.URL+"/c" {
+			t.Errorf("%s: expected chain from /a to /c, got: %s -> %s", rawurl, hops[0].Src, hops[1].Dst)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// http client shared by all crawlers, set up from config at startup
+	crawlClient fetchbot.Doer = http.DefaultClient
+)
+
+// crawlCmd is a fetchbot command that carries extra request headers
+// & cookies
+type crawlCmd struct {
+	*fetchbot.Cmd
+	header  http.Header
+	cookies []*http.Cookie
+}
+
+// Header implements fetchbot.HeaderProvider
+func (c *crawlCmd) Header() http.Header {
+	return c.header
+}
+
+// Cookies implements fetchbot.CookiesProvider
+func (c *crawlCmd) Cookies() []*http.Cookie {
+	return c.cookies
+}
+
+// authCmd is a crawlCmd with basic auth credentials. fetchbot sets basic
+// auth for any command that implements BasicAuthProvider, so commands
+// without credentials need to be a different type
+type authCmd struct {
+	*crawlCmd
+	username, password string
+}
+
+// BasicAuth implements fetchbot.BasicAuthProvider
+func (c *authCmd) BasicAuth() (string, string) {
+	return c.username, c.password
+}
+
+// newCrawlCmd creates the fetchbot command for a frontier entry, adding
+// any headers, cookies & credentials set for the url's source. GETs of
+// urls with a previous snapshot are made conditional on that snapshot's
+// ETag & Last-Modified headers
+func newCrawlCmd(db sqlutil.Queryable, e *FrontierEntry) (fetchbot.Command, error) {
+	u, err := url.Parse(e.Url)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &crawlCmd{Cmd: &fetchbot.Cmd{U: u, M: e.Method}, header: http.Header{}}
+
+	set := settingsForUrl(e.Url)
+	for key, val := range set.Headers {
+		cmd.header.Set(key, val)
+	}
+	for name, val := range set.Cookies {
+		cmd.cookies = append(cmd.cookies, &http.Cookie{Name: name, Value: val})
+	}
+
+	if e.Method == "GET" {
+		prev, err := lastGetSnapshot(db, e.Url)
+		if err != nil && err != core.ErrNotFound {
+			return nil, err
+		}
+		if prev != nil {
+			for key, val := range conditionalHeader(&prev.Snapshot) {
+				cmd.header[key] = val
+			}
+		}
+	}
+
+	if set.BasicAuthUsername != "" {
+		return &authCmd{crawlCmd: cmd, username: set.BasicAuthUsername, password: set.BasicAuthPassword}, nil
+	}
+	return cmd, nil
+}
+
+// newCrawlClient creates the http client crawlers make requests with.
+// connecting & reading have timeouts, but there's no limit on how long a
+// request takes as a whole so large downloads aren't cut off while data
+// is still coming in
+func newCrawlClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout(),
+		KeepAlive: 30 * time.Second,
+	}
+	readTimeout := cfg.ReadTimeout()
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &readTimeoutConn{Conn: conn, timeout: readTimeout}, nil
+			},
+			TLSHandshakeTimeout:   cfg.ConnectTimeout(),
+			ResponseHeaderTimeout: readTimeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   4,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// checkRedirect records each redirect followed, stopping after
+// cfg.MaxRedirects & refusing to leave http(s). custom headers set for the
+// source of the first url aren't sent on to other hosts
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if chain := redirectChainFor(req); chain != nil {
+		chain.add(req)
+	}
+	if len(via) > 0 && req.URL.Host != via[0].URL.Host {
+		for key := range settingsForUrl(via[0].URL.String()).Headers {
+			req.Header.Del(key)
+		}
+	}
+	if len(via) >= cfg.Redirects() {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to redirect to %s url", req.URL.Scheme)
+	}
+	return nil
+}
+
+// readTimeoutConn is a net.Conn that fails any read that waits longer
+// than timeout for data
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserAgentString(t *testing.T) {
+	cases := []struct {
+		name, contact, root string
+		expect              string
+	}{
+		{"", "", "", "datatogether-sentry"},
+		{"", "", "https://sentry.example.com", "datatogether-sentry (+https://sentry.example.com)"},
+		{"archivebot/1.0", "https://example.com/about", "https://sentry.example.com", "archivebot/1.0 (+https://example.com/about)"},
+	}
+
+	for i, c := range cases {
+		cfg := &config{UserAgent: c.name, ContactUrl: c.contact, UrlRoot: c.root}
+		if got := cfg.UserAgentString(); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	cases := []struct {
+		url  string
+		via  int
+		fail bool
+	}{
+		{"http://a.com/", 0, false},
+		{"https://a.com/", 5, false},
+		{"https://a.com/", cfg.Redirects(), true},
+		{"ftp://a.com/file", 1, true},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", c.url, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		via := make([]*http.Request, c.via)
+		for j := range via {
+			via[j] = req
+		}
+		err = checkRedirect(req, via)
+		if (err != nil) != c.fail {
+			t.Errorf("case %d error mismatch. expected failure: %t, got: %v", i, c.fail, err)
+		}
+	}
+}
+
+func TestCheckRedirectHeaders(t *testing.T) {
+	prevScopes, prevSettings := crawlingScopes, sourceSettings
+	defer func() { crawlingScopes, sourceSettings = prevScopes, prevSettings }()
+
+	crawlingScopes = testScopes(t, &core.Source{Id: "private", Url: "private.gov"})
+	sourceSettings = map[string]*SourceSettings{
+		"private": {SourceId: "private", Headers: map[string]string{"X-Api-Key": "key123"}},
+	}
+
+	first, _ := http.NewRequest("GET", "http://private.gov/start", nil)
+	cases := []struct {
+		url    string
+		apiKey string
+	}{
+		{"http://private.gov/moved", "key123"},
+		{"https://private.gov/moved", "key123"},
+		{"http://elsewhere.gov/", ""},
+		{"http://cdn.private.gov/file", ""},
+	}
+
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Set("X-Api-Key", "key123")
+		req.Header.Set("Accept", "text/html")
+		if err := checkRedirect(req, []*http.Request{first}); err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+		if got := req.Header.Get("X-Api-Key"); got != c.apiKey {
+			t.Errorf("case %d X-Api-Key mismatch. expected: '%s', got: '%s'", i, c.apiKey, got)
+		}
+		if req.Header.Get("Accept") != "text/html" {
+			t.Errorf("case %d: expected other headers to be kept", i)
+		}
+	}
+}
+
+func TestNewCrawlCmdSourceSettings(t *testing.T) {
+	prevScopes, prevSettings := crawlingScopes, sourceSettings
+	defer func() { crawlingScopes, sourceSettings = prevScopes, prevSettings }()
+
+	crawlingScopes = testScopes(t,
+		&core.Source{Id: "open", Url: "open.gov"},
+		&core.Source{Id: "private", Url: "private.gov"},
+	)
+	sourceSettings = map[string]*SourceSettings{
+		"open": {SourceId: "open", Headers: map[string]string{"Accept-Language": "en"}},
+		"private": {
+			SourceId:          "private",
+			Cookies:           map[string]string{"session": "abc"},
+			BasicAuthUsername: "user",
+			BasicAuthPassword: "pass",
+		},
+	}
+
+	cases := []struct {
+		url            string
+		acceptLanguage string
+		cookies        int
+		user, pass     string
+	}{
+		{"http://open.gov/", "en", 0, "", ""},
+		{"http://private.gov/data", "", 1, "user", "pass"},
+		{"http://unknown.gov/", "", 0, "", ""},
+	}
+
+	for i, c := range cases {
+		cmd, err := newCrawlCmd(appDB, &FrontierEntry{Url: c.url, Method: "HEAD"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		req, _ := http.NewRequest("HEAD", c.url, nil)
+		for key, val := range cmd.(fetchbot.HeaderProvider).Header() {
+			req.Header[key] = val
+		}
+		if got := req.Header.Get("Accept-Language"); got != c.acceptLanguage {
+			t.Errorf("case %d Accept-Language mismatch. expected: %s, got: %s", i, c.acceptLanguage, got)
+		}
+		if got := len(cmd.(fetchbot.CookiesProvider).Cookies()); got != c.cookies {
+			t.Errorf("case %d cookie count mismatch. expected: %d, got: %d", i, c.cookies, got)
+		}
+
+		ba, ok := cmd.(fetchbot.BasicAuthProvider)
+		if ok != (c.user != "") {
+			t.Errorf("case %d basic auth mismatch. expected credentials: %t", i, c.user != "")
+			continue
+		}
+		if ok {
+			if user, pass := ba.BasicAuth(); user != c.user || pass != c.pass {
+				t.Errorf("case %d credentials mismatch. expected: %s:%s, got: %s:%s", i, c.user, c.pass, user, pass)
+			}
+		}
+	}
+}
+
+func TestReadTimeoutConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// nothing is ever written, so the read should give up
+	c := &readTimeoutConn{Conn: conn, timeout: time.Millisecond * 50}
+	_, err = c.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected timeout error, got: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// wait before the first attempt to resume an interrupted download,
+	// doubling with each attempt after that
+	downloadBackoff = time.Second
+	// longest wait between resume attempts
+	maxDownloadBackoff = time.Minute
+)
+
+// fetchDownload spools res's body to a new Download. If the transfer is
+// interrupted the partial body is kept & the rest is requested with Range
+// requests, validated by the response's ETag or Last-Modified header so a
+// resource that changes mid-download is started over instead of being
+// spliced together. Attempts back off exponentially, giving up after
+// cfg.MaxDownloadRetries. A resumed download hashes the same as one that
+// was never interrupted
+func fetchDownload(client fetchbot.Doer, res *http.Response, maxSize int64) (*Download, error) {
+	d, err := newDownload(maxSize)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	err = d.copyFrom(res.Body)
+	res.Body.Close()
+
+	if err != nil && res.Request != nil {
+		validator := rangeValidator(res)
+		for attempt := 0; err != nil && attempt < cfg.MaxDownloadRetries(); attempt++ {
+			log.Infof("download interrupted: %s at %d bytes - %s", res.Request.URL, d.Size, err)
+			time.Sleep(resumeBackoff(attempt))
+			err = d.resume(client, res.Request, validator)
+		}
+	}
+
+	if err == nil {
+		err = d.finish()
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// resume requests the rest of the body from where the download left off.
+// without a validator there's no way to know the resource hasn't changed,
+// so the download is started over instead
+func (d *Download) resume(client fetchbot.Doer, orig *http.Request, validator string) error {
+	req, err := http.NewRequest("GET", orig.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	for key, val := range orig.Header {
+		req.Header[key] = val
+	}
+
+	if validator != "" && d.Size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.Size))
+		req.Header.Set("If-Range", validator)
+	} else if err := d.restart(); err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if start, err := contentRangeStart(res.Header.Get("Content-Range")); err != nil || start != d.Size {
+			err = fmt.Errorf("unexpected Content-Range resuming at %d bytes: '%s'", d.Size, res.Header.Get("Content-Range"))
+			if rerr := d.restart(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	case http.StatusOK:
+		// the server ignored the range or the resource has changed, either
+		// way the whole body is coming
+		if err := d.restart(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected status resuming download: %s", res.Status)
+	}
+
+	return d.copyFrom(res.Body)
+}
+
+// rangeValidator picks the If-Range value for resuming res. If-Range only
+// accepts strong validators, so weak ETags fall back to Last-Modified.
+// an empty string means res can't be resumed
+func rangeValidator(res *http.Response) string {
+	if res.Header.Get("Accept-Ranges") == "none" {
+		return ""
+	}
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+// contentRangeStart gives the first byte position of a Content-Range
+// header, eg: "bytes 100-199/200" is 100
+func contentRangeStart(header string) (int64, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, fmt.Errorf("invalid Content-Range: '%s'", header)
+	}
+	spec := strings.TrimPrefix(header, "bytes ")
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range: '%s'", header)
+	}
+	return strconv.ParseInt(spec[:i], 10, 64)
+}
+
+// resumeBackoff gives the wait before resume attempt number attempt
+func resumeBackoff(attempt int) time.Duration {
+	wait := downloadBackoff << uint(attempt)
+	if wait <= 0 || wait > maxDownloadBackoff {
+		return maxDownloadBackoff
+	}
+	return wait
+}
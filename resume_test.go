@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"github.com/datatogether/core"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// droppingServer serves body, cutting the connection after cutAfter bytes
+// for the first drops requests. Range & If-Range are handled by
+// http.ServeContent
+type droppingServer struct {
+	sync.Mutex
+	body     []byte
+	etag     string
+	modified time.Time
+	drops    int
+	cutAfter int
+	ranges   int
+}
+
+func (s *droppingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	body, etag, drop := s.body, s.etag, s.drops > 0
+	if drop {
+		s.drops--
+	}
+	if r.Header.Get("Range") != "" {
+		s.ranges++
+	}
+	s.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if drop {
+		w = &cutoffWriter{ResponseWriter: w, remaining: s.cutAfter}
+	}
+	http.ServeContent(w, r, "", s.modified, bytes.NewReader(body))
+}
+
+// cutoffWriter aborts the connection once remaining bytes are written
+type cutoffWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (c *cutoffWriter) Write(p []byte) (int, error) {
+	if len(p) > c.remaining {
+		c.ResponseWriter.Write(p[:c.remaining])
+		c.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	c.remaining -= len(p)
+	return c.ResponseWriter.Write(p)
+}
+
+func TestFetchDownload(t *testing.T) {
+	prevBackoff := downloadBackoff
+	downloadBackoff = time.Millisecond
+	defer func() { downloadBackoff = prevBackoff }()
+
+	body := make([]byte, 100000)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	changed := append([]byte("changed"), body...)
+
+	cases := []struct {
+		etag     string
+		modified time.Time
+		drops    int
+		cutAfter int
+		// replaces the served body after the first request
+		change []byte
+		// expected body, nil if the download should fail
+		expect []byte
+		ranges int
+	}{
+		{"", time.Time{}, 0, 30000, nil, body, 0},
+		{`"v1"`, time.Time{}, 1, 30000, nil, body, 1},
+		{`"v1"`, time.Time{}, 3, 30000, nil, body, 3},
+		// weak etags can't validate ranges, but Last-Modified can
+		{`W/"v1"`, time.Now().Add(-time.Hour), 2, 30000, nil, body, 2},
+		// no validator means starting over each time
+		{"", time.Time{}, 2, 30000, nil, body, 0},
+		// changed content starts over, even if it's served as a 200
+		{`"v1"`, time.Time{}, 1, 30000, changed, changed, 1},
+		// too many drops gives up
+		{`"v1"`, time.Time{}, 10, 10000, nil, nil, 5},
+	}
+
+	for i, c := range cases {
+		ds := &droppingServer{body: body, etag: c.etag, modified: c.modified, drops: c.drops, cutAfter: c.cutAfter}
+		s := httptest.NewServer(ds)
+
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if c.change != nil {
+			ds.Lock()
+			ds.body = c.change
+			ds.etag = `"v2"`
+			ds.Unlock()
+		}
+
+		d, err := fetchDownload(http.DefaultClient, res, 0)
+		s.Close()
+
+		if c.expect == nil {
+			if err == nil {
+				t.Errorf("case %d: expected error", i)
+				d.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d error: %s", i, err.Error())
+			continue
+		}
+
+		if hash, _ := core.CalcHash(c.expect); d.Hash != hash {
+			t.Errorf("case %d hash mismatch. expected: %s, got: %s", i, hash, d.Hash)
+		}
+		if d.Size != int64(len(c.expect)) {
+			t.Errorf("case %d size mismatch. expected: %d, got: %d", i, len(c.expect), d.Size)
+		}
+		if ds.ranges != c.ranges {
+			t.Errorf("case %d range request count mismatch. expected: %d, got: %d", i, c.ranges, ds.ranges)
+		}
+		d.Close()
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	cases := []struct {
+		header string
+		start  int64
+		err    bool
+	}{
+		{"bytes 100-199/200", 100, false},
+		{"bytes 0-0/*", 0, false},
+		{"bytes */200", 0, true},
+		{"100-199/200", 0, true},
+		{"", 0, true},
+	}
+
+	for i, c := range cases {
+		start, err := contentRangeStart(c.header)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if start != c.start {
+			t.Errorf("case %d start mismatch. expected: %d, got: %d", i, c.start, start)
+		}
+	}
+}
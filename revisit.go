@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"sort"
+	"time"
+)
+
+var (
+	// default bounds for adaptive revisit scheduling, sources can
+	// override these with SourceSettings
+	DefaultMinRevisit = time.Hour
+	DefaultMaxRevisit = time.Hour * 24 * 30
+)
+
+// Revisit is the adaptive GET schedule for a single url. Each time the url
+// is fetched the response hash is compared to the previous one. Unchanged
+// content doubles the time until the next visit, changed content halves it,
+// so sentry spends it's requests on the pages that actually change
+type Revisit struct {
+	// url this schedule is for
+	Url string `json:"url"`
+	// Updated timestamp rounded to seconds in UTC
+	Updated time.Time `json:"updated"`
+	// current time between visits
+	Interval time.Duration `json:"interval"`
+	// number of consecutive visits that found identical content
+	Unchanged int `json:"unchanged"`
+	// hash of the most recent capture
+	Hash string `json:"hash"`
+	// time the url should next be fetched
+	NextVisit time.Time `json:"nextVisit"`
+}
+
+// snapshotHash is a single entry in a url's snapshot history
+type snapshotHash struct {
+	Created time.Time
+	Hash    string
+}
+
+// Observe folds a capture with hash taken at time at into the schedule,
+// keeping the resulting interval within min & max. Captures without a hash
+// carry no information about change, and keep the current pace
+func (r *Revisit) Observe(hash string, at time.Time, min, max time.Duration) {
+	switch {
+	case hash == "" || r.Hash == "":
+		// nothing to compare against
+	case hash == r.Hash:
+		r.Unchanged++
+		r.Interval *= 2
+	default:
+		r.Unchanged = 0
+		r.Interval /= 2
+	}
+
+	if hash != "" {
+		r.Hash = hash
+	}
+	if r.Interval < min {
+		r.Interval = min
+	} else if r.Interval > max {
+		r.Interval = max
+	}
+	r.NextVisit = at.Add(r.Interval)
+}
+
+// estimateRevisit builds a schedule for rawurl by replaying a snapshot
+// history, starting from an interval of initial
+func estimateRevisit(rawurl string, history []snapshotHash, initial, min, max time.Duration) *Revisit {
+	r := &Revisit{Url: rawurl, Interval: initial}
+	for _, h := range history {
+		r.Observe(h.Hash, h.Created, min, max)
+	}
+	return r
+}
+
+// revisitBounds gives the min & max revisit intervals for a url
+func revisitBounds(rawurl string) (min, max time.Duration) {
+	min, max = DefaultMinRevisit, DefaultMaxRevisit
+	set := settingsForUrl(rawurl)
+	if set.MinRevisit > 0 {
+		min = set.MinRevisit
+	}
+	if set.MaxRevisit > 0 {
+		max = set.MaxRevisit
+	}
+	if max < min {
+		max = min
+	}
+	return
+}
+
+// updateRevisit records a completed GET of u in it's revisit schedule.
+// urls without a schedule get one estimated from their snapshot history
+func updateRevisit(db *sql.DB, u *core.Url) error {
+	if u.LastGet == nil {
+		return nil
+	}
+	min, max := revisitBounds(u.Url)
+
+	r := &Revisit{Url: u.Url}
+	if err := r.Read(db); err == core.ErrNotFound {
+		history, err := snapshotHashes(db, u.Url)
+		if err != nil {
+			return err
+		}
+
+		// the snapshot for this GET may already be written, leave it out
+		// so it isn't counted twice
+		prev := make([]snapshotHash, 0, len(history))
+		for _, h := range history {
+			if d := h.Created.Sub(*u.LastGet); d < -time.Second || d > time.Second {
+				prev = append(prev, h)
+			}
+		}
+		r = estimateRevisit(u.Url, prev, staleDuration(u.Url), min, max)
+	} else if err != nil {
+		return err
+	}
+
+	r.Observe(u.Hash, *u.LastGet, min, max)
+	return r.Save(db)
+}
+
+// revisitDue reports weather u should be fetched again. urls without a
+// schedule fall back to their stale duration
+func revisitDue(db sqlutil.Queryable, u *core.Url) bool {
+	if u.LastGet == nil || u.LastGet.IsZero() {
+		return true
+	}
+
+	r := &Revisit{Url: u.Url}
+	if err := r.Read(db); err == nil {
+		return !time.Now().Before(r.NextVisit)
+	} else if err != core.ErrNotFound {
+		log.Debugf("error reading revisit for %s: %s", u.Url, err)
+	}
+	return isStale(u.LastGet, staleDuration(u.Url))
+}
+
+// postpone pushes a due schedule back by it's interval, for urls that
+// can't be revisited right now. a url that's already waiting has it's
+// schedule set again once it's fetched
+func (r *Revisit) postpone(db sqlutil.Execable) error {
+	wait := r.Interval
+	if min, _ := revisitBounds(r.Url); wait < min {
+		wait = min
+	}
+	r.NextVisit = time.Now().In(time.UTC).Add(wait)
+	return r.Save(db)
+}
+
+// DueRevisits lists schedules that have passed their next visit time
+func DueRevisits(db sqlutil.Queryable, limit, offset int) ([]*Revisit, error) {
+	if es, ok := store.(*EmbeddedStore); ok {
+		now := time.Now()
+		found, err := es.list("Revisit", 0, 0, func(v interface{}) bool {
+			return !v.(*Revisit).NextVisit.After(now)
+		})
+		if err != nil {
+			return nil, err
+		}
+		revisits := make([]*Revisit, len(found))
+		for i, v := range found {
+			revisits[i] = v.(*Revisit)
+		}
+		sort.SliceStable(revisits, func(i, j int) bool { return revisits[i].NextVisit.Before(revisits[j].NextVisit) })
+		if offset >= len(revisits) {
+			return []*Revisit{}, nil
+		}
+		revisits = revisits[offset:]
+		if len(revisits) > limit {
+			revisits = revisits[:limit]
+		}
+		return revisits, nil
+	}
+
+	rows, err := db.Query(qRevisitsDue, time.Now().In(time.UTC), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisits := []*Revisit{}
+	for rows.Next() {
+		r := &Revisit{}
+		if err := r.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		revisits = append(revisits, r)
+	}
+	return revisits, rows.Err()
+}
+
+// snapshotHashes reads the snapshot history for rawurl, oldest first
+func snapshotHashes(db sqlutil.Queryable, rawurl string) ([]snapshotHash, error) {
+	if _, ok := store.(*EmbeddedStore); ok {
+		snaps, err := snapshotsForUrl(store, rawurl)
+		if err != nil {
+			return nil, err
+		}
+		history := make([]snapshotHash, len(snaps))
+		for i, s := range snaps {
+			history[len(snaps)-1-i] = snapshotHash{Created: s.Created.In(time.UTC), Hash: s.Hash}
+		}
+		return history, nil
+	}
+
+	rows, err := db.Query(qSnapshotHashesByUrl, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []snapshotHash{}
+	for rows.Next() {
+		h := snapshotHash{}
+		if err := rows.Scan(&h.Created, &h.Hash); err != nil {
+			return nil, err
+		}
+		h.Created = h.Created.In(time.UTC)
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// revisitKey gives the embedded store key for rawurl's revisit schedule
+func revisitKey(rawurl string) datastore.Key {
+	return embeddedKey("Revisit", rawurl)
+}
+
+// Read a revisit schedule from the db by url
+func (r *Revisit) Read(db sqlutil.Queryable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		v, err := es.Get(revisitKey(r.Url))
+		if err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		*r = *v.(*Revisit)
+		return nil
+	}
+	return r.UnmarshalSQL(db.QueryRow(qRevisitByUrl, r.Url))
+}
+
+// Save a revisit schedule to the db, creating or updating as needed
+func (r *Revisit) Save(db sqlutil.Execable) error {
+	r.Updated = time.Now().Round(time.Second).In(time.UTC)
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(revisitKey(r.Url), r)
+	}
+	_, err := db.Exec(qRevisitUpsert, r.Url, r.Updated, int64(r.Interval/time.Millisecond), r.Unchanged, r.Hash, r.NextVisit.In(time.UTC))
+	return err
+}
+
+// UnmarshalSQL reads an sql response into the revisit receiver
+func (r *Revisit) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		url, hash          string
+		updated, nextVisit time.Time
+		interval           int64
+		unchanged          int
+	)
+
+	if err := row.Scan(&url, &updated, &interval, &unchanged, &hash, &nextVisit); err != nil {
+		if err == sql.ErrNoRows {
+			return core.ErrNotFound
+		}
+		return err
+	}
+
+	*r = Revisit{
+		Url:       url,
+		Updated:   updated.In(time.UTC),
+		Interval:  time.Duration(interval) * time.Millisecond,
+		Unchanged: unchanged,
+		Hash:      hash,
+		NextVisit: nextVisit.In(time.UTC),
+	}
+	return nil
+}
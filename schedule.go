@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"time"
+)
+
+// sourceForUrl finds the most specific crawling source whose scope covers
+// rawurl, returning nil if no source matches. Sources with longer scopes are
+// considered more specific, so a source for "epa.gov/climate" wins
+// over one for "epa.gov"
+func sourceForUrl(rawurl string) *core.Source {
+	if sc := scopeForUrl(rawurl); sc != nil {
+		return sc.Source
+	}
+	return nil
+}
+
+// staleDuration resolves how long a url is considered fresh after it's
+// been fetched, using the most specific matching source's stale duration,
+// falling back to the configured default
+func staleDuration(rawurl string) time.Duration {
+	if s := sourceForUrl(rawurl); s != nil && s.StaleDuration > 0 {
+		return s.StaleDuration
+	}
+	return cfg.StaleDuration()
+}
+
+// isFetchable filters to only usable urls & schemes
+// this filters out stuff like mailto:// and ftp:// schemes
+func isFetchable(u *core.Url) bool {
+	_u, err := u.ParsedUrl()
+	if err != nil {
+		return false
+	}
+	return _u.Scheme == "" || _u.Scheme == "http" || _u.Scheme == "https"
+}
+
+// isStale reports weather more than d has passed since t. a nil or
+// zero time is always stale
+func isStale(t *time.Time, d time.Duration) bool {
+	return t == nil || t.IsZero() || time.Since(*t) > d
+}
+
+// shouldEnqueueHead is a source-aware version of core.Url.ShouldEnqueueHead.
+// It returns true if the url is of http / https scheme and hasn't been
+// HEAD'd within it's stale duration
+func shouldEnqueueHead(u *core.Url) bool {
+	return isFetchable(u) && isStale(u.LastHead, staleDuration(u.Url))
+}
+
+// shouldEnqueueGet is a source-aware version of core.Url.ShouldEnqueueGet.
+// It returns true if the url is of http / https scheme and is due for a
+// revisit, see revisit.go
+func shouldEnqueueGet(u *core.Url) bool {
+	return isFetchable(u) && revisitDue(appDB, u)
+}
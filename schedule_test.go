@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"testing"
+	"time"
+)
+
+func TestStaleDuration(t *testing.T) {
+	prev := crawlingScopes
+	defer func() { crawlingScopes = prev }()
+
+	crawlingScopes = testScopes(t,
+		&core.Source{Url: "agency.gov", StaleDuration: time.Hour * 24 * 30},
+		&core.Source{Url: "agency.gov/news", StaleDuration: time.Hour},
+		&core.Source{Url: "other.gov"},
+	)
+
+	cases := []struct {
+		url    string
+		expect time.Duration
+	}{
+		{"http://agency.gov/data/file.csv", time.Hour * 24 * 30},
+		{"http://agency.gov/news/today.html", time.Hour},
+		{"http://other.gov/about", cfg.StaleDuration()},
+		{"http://unknown.org", cfg.StaleDuration()},
+	}
+
+	for i, c := range cases {
+		if got := staleDuration(c.url); got != c.expect {
+			t.Errorf("case %d: %s stale duration mismatch. expected: %s, got: %s", i, c.url, c.expect, got)
+		}
+	}
+}
+
+func TestShouldEnqueueGet(t *testing.T) {
+	prev := crawlingScopes
+	defer func() { crawlingScopes = prev }()
+
+	crawlingScopes = testScopes(t,
+		&core.Source{Url: "agency.gov/news", StaleDuration: time.Hour},
+	)
+
+	twoHoursAgo := time.Now().Add(-time.Hour * 2)
+	cases := []struct {
+		url     string
+		lastGet *time.Time
+		expect  bool
+	}{
+		{"http://agency.gov/news", nil, true},
+		{"http://agency.gov/news", &twoHoursAgo, true},
+		{"http://agency.gov/about", &twoHoursAgo, false},
+		{"mailto:someone@agency.gov", nil, false},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: c.url, LastGet: c.lastGet}
+		if got := shouldEnqueueGet(u); got != c.expect {
+			t.Errorf("case %d: %s expected: %t, got: %t", i, c.url, c.expect, got)
+		}
+	}
+}
+
+func TestRevisitObserve(t *testing.T) {
+	min, max := time.Hour, time.Hour*8
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		hash      string
+		interval  time.Duration
+		unchanged int
+	}{
+		// first capture has nothing to compare against
+		{"a", time.Hour * 2, 0},
+		{"a", time.Hour * 4, 1},
+		{"a", time.Hour * 8, 2},
+		// capped at max
+		{"a", time.Hour * 8, 3},
+		// changes tighten the schedule
+		{"b", time.Hour * 4, 0},
+		{"c", time.Hour * 2, 0},
+		{"d", time.Hour, 0},
+		// capped at min
+		{"e", time.Hour, 0},
+		// no hash, keep pace
+		{"", time.Hour, 0},
+		{"e", time.Hour * 2, 1},
+	}
+
+	r := &Revisit{Url: "http://agency.gov", Interval: time.Hour * 2}
+	at := start
+	for i, c := range cases {
+		r.Observe(c.hash, at, min, max)
+		if r.Interval != c.interval {
+			t.Errorf("case %d interval mismatch. expected: %s, got: %s", i, c.interval, r.Interval)
+		}
+		if r.Unchanged != c.unchanged {
+			t.Errorf("case %d unchanged mismatch. expected: %d, got: %d", i, c.unchanged, r.Unchanged)
+		}
+		if !r.NextVisit.Equal(at.Add(c.interval)) {
+			t.Errorf("case %d next visit mismatch. expected: %s, got: %s", i, at.Add(c.interval), r.NextVisit)
+		}
+		at = r.NextVisit
+	}
+}
+
+func TestSeedRevisitsPostpones(t *testing.T) {
+	s, done := useEmbeddedStore(t)
+	defer done()
+
+	prevFrontier, prevScopes := frontier, crawlingScopes
+	defer func() { frontier, crawlingScopes = prevFrontier, prevScopes }()
+	frontier = NewEmbeddedFrontier(s, "test-revisits")
+	sc, err := NewScope(&core.Source{Url: "in.test"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	crawlingScopes = []*Scope{sc}
+
+	// more out of scope & unknown urls are due than are seeded at once, &
+	// they're all due before the url that's in scope
+	due := time.Now().Add(-time.Hour * 24)
+	for i := 0; i < 5; i++ {
+		rawurl := fmt.Sprintf("http://out.test/%d", i)
+		if i%2 == 0 {
+			if _, err := frontier.Enqueue(crawlerMain, "GET", rawurl, priorityDefault, 0, time.Now()); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := (&Revisit{Url: rawurl, Interval: time.Hour * 2, NextVisit: due.Add(time.Duration(i) * time.Minute)}).Save(appDB); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	in := "http://in.test/page"
+	if _, err := frontier.Enqueue(crawlerMain, "GET", in, priorityDefault, 1, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := frontier.Ack(in); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&Revisit{Url: in, Interval: time.Hour, NextVisit: time.Now().Add(-time.Hour)}).Save(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := seedRevisits(appDB, 3); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if e, err := frontier.readEntry(in); err != nil || e.State != FrontierPendingGet {
+		t.Errorf("expected in scope url to be waiting for a GET, got: %v, %v", e, err)
+	}
+	remaining, err := DueRevisits(appDB, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(remaining) != 1 || remaining[0].Url != in {
+		t.Errorf("expected only the enqueued url to still be due, got: %v", remaining)
+	}
+	r := &Revisit{Url: "http://out.test/0"}
+	if err := r.Read(appDB); err != nil || r.NextVisit.Before(time.Now().Add(time.Hour)) {
+		t.Errorf("expected skipped url to be postponed by it's interval, got: %s, %v", r.NextVisit, err)
+	}
+}
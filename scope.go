@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/datatogether/core"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Scope decides which urls belong to a source. A url is in scope if it
+// shares the source url's scheme, host & path prefix, matches at least one
+// include rule (if any are set) and matches no exclude rules.
+//
+// Rules are either globs, where * matches any run of characters & ? matches
+// a single character, or regular expressions prefixed with "re:". Rules
+// match against the entire url string, eg:
+//
+//	http://epa.gov/*.pdf
+//	re:^https?://epa\.gov/climate/\d{4}/
+type Scope struct {
+	// source this scope was built from
+	Source *core.Source
+	// schemes to accept, empty accepts both http & https
+	Scheme string
+	// lower-case host, including port if any
+	Host string
+	// path prefix, matched on whole path segments
+	PathPrefix string
+	// urls must match one of these if any are present
+	Include []*regexp.Regexp
+	// urls must match none of these
+	Exclude []*regexp.Regexp
+	// max number of links to follow from the source url, 0 is unlimited
+	MaxDepth int
+}
+
+// NewScope builds a scope for a source & it's settings. set may be nil
+func NewScope(s *core.Source, set *SourceSettings) (*Scope, error) {
+	rawurl := s.Url
+	if !strings.Contains(rawurl, "://") {
+		// sources are often stored without a scheme, eg: "epa.gov/climate"
+		rawurl = "//" + rawurl
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("source url '%s' has no host", s.Url)
+	}
+
+	sc := &Scope{
+		Source:     s,
+		Scheme:     strings.ToLower(u.Scheme),
+		Host:       strings.ToLower(u.Host),
+		PathPrefix: strings.TrimSuffix(u.Path, "/"),
+	}
+
+	if set != nil {
+		sc.MaxDepth = set.MaxDepth
+		if sc.Include, err = compilePatterns(set.Include); err != nil {
+			return nil, err
+		}
+		if sc.Exclude, err = compilePatterns(set.Exclude); err != nil {
+			return nil, err
+		}
+	}
+
+	return sc, nil
+}
+
+// Matches reports weather u falls under the scope's scheme, host &
+// path prefix, ignoring include & exclude rules
+func (sc *Scope) Matches(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if sc.Scheme != "" && scheme != sc.Scheme {
+		return false
+	} else if sc.Scheme == "" && scheme != "http" && scheme != "https" {
+		return false
+	}
+
+	if strings.ToLower(u.Host) != sc.Host {
+		return false
+	}
+
+	if sc.PathPrefix == "" {
+		return true
+	}
+	return u.Path == sc.PathPrefix || strings.HasPrefix(u.Path, sc.PathPrefix+"/")
+}
+
+// Contains reports weather u matches the scope & it's include / exclude rules
+func (sc *Scope) Contains(u *url.URL) bool {
+	if !sc.Matches(u) {
+		return false
+	}
+
+	rawurl := u.String()
+	for _, re := range sc.Exclude {
+		if re.MatchString(rawurl) {
+			return false
+		}
+	}
+
+	if len(sc.Include) == 0 {
+		return true
+	}
+	for _, re := range sc.Include {
+		if re.MatchString(rawurl) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDepth reports weather a url depth links away from the source url
+// can be crawled
+func (sc *Scope) AllowsDepth(depth int) bool {
+	return sc.MaxDepth <= 0 || depth <= sc.MaxDepth
+}
+
+// specificity ranks how narrow a scope is, used to pick
+// between overlapping scopes
+func (sc *Scope) specificity() int {
+	n := len(sc.Host) + len(sc.PathPrefix)
+	if sc.Scheme != "" {
+		n++
+	}
+	return n
+}
+
+// scopeForUrl returns the most specific crawling scope matching rawurl,
+// nil if none match
+func scopeForUrl(rawurl string) *Scope {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return matchScope(crawlingScopes, u)
+}
+
+// matchScope picks the most specific scope that matches u
+func matchScope(scopes []*Scope, u *url.URL) (match *Scope) {
+	for _, sc := range scopes {
+		if sc.Matches(u) && (match == nil || sc.specificity() > match.specificity()) {
+			match = sc
+		}
+	}
+	return
+}
+
+// urlInScope reports weather rawurl is inside it's most specific crawling
+// scope & within that scope's depth limit
+func urlInScope(rawurl string, depth int) bool {
+	sc := scopeForUrl(rawurl)
+	if sc == nil {
+		return false
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	return sc.Contains(u) && sc.AllowsDepth(depth)
+}
+
+// compilePatterns turns a list of glob or "re:" prefixed regex rules
+// into regular expressions
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scope rule '%s': %s", p, err.Error())
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// compilePattern turns a single glob or regex rule into a regular expression
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(p, "re:") {
+		return regexp.Compile(p[len("re:"):])
+	}
+
+	glob := regexp.QuoteMeta(p)
+	glob = strings.Replace(glob, `\*`, `.*`, -1)
+	glob = strings.Replace(glob, `\?`, `.`, -1)
+	return regexp.Compile("^" + glob + "$")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/datatogether/core"
+	"net/url"
+	"testing"
+)
+
+// testScopes builds scopes without settings for a list of sources
+func testScopes(t *testing.T, sources ...*core.Source) []*Scope {
+	scopes := make([]*Scope, len(sources))
+	for i, s := range sources {
+		sc, err := NewScope(s, nil)
+		if err != nil {
+			t.Fatalf("error creating scope for %s: %s", s.Url, err.Error())
+		}
+		scopes[i] = sc
+	}
+	return scopes
+}
+
+func TestScopeContains(t *testing.T) {
+	cases := []struct {
+		source string
+		set    *SourceSettings
+		url    string
+		expect bool
+	}{
+		{"epa.gov", nil, "http://epa.gov/", true},
+		{"epa.gov", nil, "https://epa.gov/climate/index.html", true},
+		{"epa.gov", nil, "http://EPA.gov/climate", true},
+		{"epa.gov", nil, "http://www.epa.gov/climate", false},
+		{"epa.gov", nil, "ftp://epa.gov/climate", false},
+		{"epa.gov", nil, "http://other.gov/?q=epa.gov", false},
+		{"epa.gov/climate", nil, "http://epa.gov/climate", true},
+		{"epa.gov/climate/", nil, "http://epa.gov/climate/data.csv", true},
+		{"epa.gov/climate", nil, "http://epa.gov/climatechange", false},
+		{"epa.gov/climate", nil, "http://epa.gov/water?next=/climate", false},
+		{"https://epa.gov/climate", nil, "http://epa.gov/climate", false},
+		{"https://epa.gov/climate", nil, "https://epa.gov/climate/a", true},
+		{"localhost:8080", nil, "http://localhost:8080/a", true},
+		{"localhost:8080", nil, "http://localhost:8081/a", false},
+
+		{"epa.gov", &SourceSettings{Exclude: []string{"*.pdf"}}, "http://epa.gov/report.pdf", false},
+		{"epa.gov", &SourceSettings{Exclude: []string{"*.pdf"}}, "http://epa.gov/report.html", true},
+		{"epa.gov", &SourceSettings{Exclude: []string{"http://epa.gov/archive/*"}}, "http://epa.gov/archive/2001/a", false},
+		{"epa.gov", &SourceSettings{Include: []string{"http://epa.gov/data/*"}}, "http://epa.gov/data/a.csv", true},
+		{"epa.gov", &SourceSettings{Include: []string{"http://epa.gov/data/*"}}, "http://epa.gov/about", false},
+		{"epa.gov", &SourceSettings{Include: []string{"http://epa.gov/page?.html"}}, "http://epa.gov/page1.html", true},
+		{"epa.gov", &SourceSettings{Include: []string{`re:/\d{4}/`}}, "http://epa.gov/news/2017/a", true},
+		{"epa.gov", &SourceSettings{Include: []string{`re:/\d{4}/`}}, "http://epa.gov/news/a", false},
+		{"epa.gov", &SourceSettings{Include: []string{"*"}, Exclude: []string{"*?print=1"}}, "http://epa.gov/a?print=1", false},
+	}
+
+	for i, c := range cases {
+		sc, err := NewScope(&core.Source{Url: c.source}, c.set)
+		if err != nil {
+			t.Errorf("case %d error creating scope: %s", i, err.Error())
+			continue
+		}
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Errorf("case %d error parsing url: %s", i, err.Error())
+			continue
+		}
+		if got := sc.Contains(u); got != c.expect {
+			t.Errorf("case %d: %s contains %s mismatch. expected: %t, got: %t", i, c.source, c.url, c.expect, got)
+		}
+	}
+}
+
+func TestNewScopeErrors(t *testing.T) {
+	cases := []struct {
+		source string
+		set    *SourceSettings
+	}{
+		{"", nil},
+		{"epa.gov", &SourceSettings{Include: []string{"re:("}}},
+		{"epa.gov", &SourceSettings{Exclude: []string{"re:[a-"}}},
+	}
+
+	for i, c := range cases {
+		if _, err := NewScope(&core.Source{Url: c.source}, c.set); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+}
+
+func TestUrlInScope(t *testing.T) {
+	prev := crawlingScopes
+	defer func() { crawlingScopes = prev }()
+
+	general, err := NewScope(&core.Source{Url: "agency.gov"}, &SourceSettings{MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	specific, err := NewScope(&core.Source{Url: "agency.gov/data"}, &SourceSettings{MaxDepth: 3, Exclude: []string{"*.zip"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	crawlingScopes = []*Scope{general, specific}
+
+	cases := []struct {
+		url    string
+		depth  int
+		expect bool
+	}{
+		{"http://agency.gov/about", 0, true},
+		{"http://agency.gov/about", 1, true},
+		{"http://agency.gov/about", 2, false},
+		{"http://agency.gov/data/set.csv", 3, true},
+		{"http://agency.gov/data/set.csv", 4, false},
+		{"http://agency.gov/data/set.zip", 0, false},
+		{"http://unknown.org", 0, false},
+	}
+
+	for i, c := range cases {
+		if got := urlInScope(c.url, c.depth); got != c.expect {
+			t.Errorf("case %d: %s at depth %d expected: %t, got: %t", i, c.url, c.depth, c.expect, got)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"github.com/datatogether/core"
 	"net/http"
-	"time"
 
 	"github.com/PuerkitoBio/fetchbot"
 )
@@ -28,57 +27,93 @@ func startCrawlingSeeds() {
 	// Handle all errors the same
 	mux.HandleErrors(fetchbot.HandlerFunc(func(ctx *fetchbot.Context, res *http.Response, err error) {
 		log.Infof("content res error - %s %s - %s\n", ctx.Cmd.Method(), ctx.Cmd.URL(), err)
-		mu.Lock()
-		delete(enqued, ctx.Cmd.URL().String())
-		mu.Unlock()
+		failUrl(ctx.Cmd.URL().String(), err)
 	}))
 
+	// responses no other handler wants are finished as soon as they arrive
+	mux.DefaultHandler = ackHandler
+
 	// Handle GET requests for html responses, to parse the body and enqueue all links as HEAD requests.
 	mux.Response().Method("GET").Handler(fetchbot.HandlerFunc(
 		func(ctx *fetchbot.Context, res *http.Response, err error) {
 
 			u := &core.Url{Url: ctx.Cmd.URL().String()}
-			if err := u.Read(store); err != nil {
+			if err := readUrl(store, u); err != nil {
 				// log.Printf("[ERR] url read error: %s - (%s) - %s\n", ctx.Cmd.URL(), NormalizeURL(ctx.Cmd.URL()), err)
 				log.Infof("content url read error: %s - %s\n", u.Url, err)
+				failUrl(u.Url, err)
 				return
 			}
 
-			mu.Lock()
-			delete(enqued, u.Url)
-			mu.Unlock()
+			if res.StatusCode == http.StatusNotModified {
+				if err := handleNotModified(appDB, u, res); err != nil {
+					log.Infof("not modified error: %s - %s", u.Url, err)
+					failUrl(u.Url, err)
+					return
+				}
+				ackGet(u, u)
+				return
+			}
+
+			// redirected GETs are recorded against the url that finally
+			// answered, the frontier entry stays with the requested url
+			requested := u
+			if u, err = handleRedirects(appDB, requested, res); err != nil {
+				log.Infof("redirect error: %s - %s", requested.Url, err)
+				failUrl(requested.Url, err)
+				return
+			}
 
-			_, links, err := u.HandleGetResponse(store, res)
+			body, truncated, err := handleGetResponse(appDB, u, res)
 			if err != nil {
 				log.Info(err.Error())
+				failUrl(requested.Url, err)
 				return
 			}
+			writeWarcGet(appDB, u, res, NewWarcPayload(body, truncated))
+
+			ackGet(requested, u)
 
+			links, err := extractLinks(appDB, u, body)
+			if err != nil {
+				log.Infof("link extraction error: %s - %s", u.Url, err)
+			}
 			// Enqueue all links as HEAD requests
-			if err := enqueueDstLinks(u, links, queue); err != nil {
+			if err := enqueueDstLinks(requested, links); err != nil {
 				log.Info(err.Error())
 			}
 		}))
 
 	// Create the Fetcher, handle the logging first, then dispatch to the Muxer
-	h := logHandler("C", mux)
+	h := logHandler("C", statusHandler(mux))
 
 	seedFetcher = fetchbot.New(h)
 	seedFetcher.DisablePoliteness = !cfg.Polite
-	seedFetcher.CrawlDelay = time.Duration(cfg.CrawlDelaySeconds) * time.Second
+	// delays are handled per-host by the shared limiter
+	seedFetcher.CrawlDelay = 0
+	seedFetcher.HttpClient = newLimitedDoer(crawlClient)
+	seedFetcher.UserAgent = cfg.UserAgentString()
 
 	// Start processing
 	log.Info("starting C crawler (seeds)")
 	q := seedFetcher.Start()
 	seedQueue = q
+	fetcherStarted(crawlerSeeds)
+	go feedQueue(frontier, crawlerSeeds, q)
+
+	// sources' RSS & Atom feeds are watched for new entries to seed
+	stopFeeds := make(chan bool)
+	go watchFeeds(stopFeeds)
 
 	stopFunc := q.Close
 	stopSeedCrawler = make(chan bool)
 	go func() {
 		<-stopSeedCrawler
 		log.Info("stopping C crawler (seeds)")
+		close(stopFeeds)
 		stopFunc()
 	}()
 
 	q.Block()
+	fetcherStopped(crawlerSeeds)
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/datatogether/core"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"net/http"
@@ -27,10 +28,12 @@ var (
 	// logger = logger.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 	log = logrus.New()
 
-	// application database connection
+	// application database connection, left unconnected when cfg.Store
+	// is "embedded"
 	appDB = &sql.DB{}
-	// hoist default store
-	store = sql_datastore.DefaultStore
+	// store core models are kept in, sql_datastore.DefaultStore unless
+	// cfg.Store says otherwise. an embedded store keeps crawl state too
+	store datastore.Datastore = sql_datastore.DefaultStore
 )
 
 func init() {
@@ -42,6 +45,15 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "crawl":
+			os.Exit(crawlCommand(os.Args[2:]))
+		case "migrate":
+			os.Exit(migrateCommand(os.Args[2:]))
+		}
+	}
+
 	var err error
 	cfg, err = initConfig(os.Getenv("GOLANG_ENV"))
 	if err != nil {
@@ -52,26 +64,49 @@ func main() {
 		log.Level = logrus.DebugLevel
 	}
 
-	sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB)
-	sql_datastore.SetDB(appDB)
-	sql_datastore.Register(
-		&core.Url{},
-		&core.Link{},
-	)
+	if !cfg.Embedded() {
+		sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB)
+		sql_datastore.SetDB(appDB)
+		sql_datastore.Register(
+			&core.Url{},
+			&core.Link{},
+			&core.Primer{},
+			&core.Source{},
+		)
+	}
+	if store, err = NewStore(cfg); err != nil {
+		panic(fmt.Errorf("store configuration error: %s", err.Error()))
+	}
 
-	// create any tables if they don't exist
-	sc, err := sqlutil.LoadSchemaCommands(packagePath("sql/schema.sql"))
-	if err != nil {
-		log.Infof("error loading schema file: %s", err)
+	if es, ok := store.(*EmbeddedStore); ok {
+		frontier = NewEmbeddedFrontier(es, frontierOwner(cfg))
 	} else {
-		created, err := sc.Create(appDB, "primers", "sources", "urls", "links", "metadata", "snapshots", "collections")
-		if err != nil {
-			log.Infof("error creating missing tables: %s", err)
-		} else if len(created) > 0 {
-			log.Info("created tables:", created)
+		// bring the schema up to date, refusing to run against a database
+		// migrated by a newer version of sentry
+		if err := migrateDb(appDB); err != nil {
+			panic(fmt.Errorf("database schema error: %s", err.Error()))
+		}
+		frontier = NewFrontier(appDB, frontierOwner(cfg))
+	}
+
+	// pick the crawl frontier back up from wherever the last run left it
+	if err := frontier.Recover(); err != nil {
+		log.Infof("error recovering crawl frontier: %s", err)
+	}
+	frontier.StartHeartbeat(FrontierHeartbeatInterval)
+
+	if blobs, err = NewBlobStore(cfg); err != nil {
+		log.Infof("error creating blob store: %s", err)
+	}
+
+	if cfg.WarcDir != "" {
+		if warcs, err = NewWarcWriter(cfg.WarcDir, "sentry-"+frontierOwner(cfg), cfg.WarcMaxSize()); err != nil {
+			log.Infof("error creating warc writer: %s", err)
 		}
 	}
 
+	crawlClient = &redirectDoer{client: newCrawlClient()}
+
 	// always crawl seeds
 	go startCrawlingSeeds()
 
@@ -105,18 +140,25 @@ func NewServerRoutes() *http.ServeMux {
 	m.HandleFunc("/.well-known/acme-challenge/", CertbotHandler)
 	m.Handle("/", middleware(HealthCheckHandler))
 	m.Handle("/healthcheck", middleware(HealthCheckHandler))
+	// liveness & readiness for orchestrators
+	m.Handle("/healthz", middleware(HealthCheckHandler))
+	m.Handle("/readyz", middleware(ReadyHandler))
 
 	// Seed a url to the crawler
 	// r.POST("/seed", middleware(SeedUrlHandler))
 
-	// List domains
-	// m.Handle("/primers", middleware(ListPrimersHandler))
-	// Add a crawling domain
-	// r.POST("/primers", middleware(AddPrimerHandler))
+	// source urls the crawler is currently working from
+	m.Handle("/sources", middleware(CrawlingSourcesHandler))
+	// manage primers & the sources they group
+	m.Handle("/primers", authMiddleware(PrimersHandler))
+	m.Handle("/sources/manage", authMiddleware(SourcesHandler))
+	m.Handle("/sources/crawl", authMiddleware(SourceCrawlHandler))
 
 	m.Handle("/urls", middleware(UrlsHandler))
 	// m.Handle("/url", middleware(UrlHandler))
-	m.Handle("/sources", middleware(CrawlingSourcesHandler))
+	// clearing failures needs auth, listing them doesn't
+	m.Handle("/failures", readOpenMiddleware(FailuresHandler))
+	m.Handle("/redirects", middleware(RedirectsHandler))
 	m.Handle("/mem", middleware(MemStatsHandler))
 	m.Handle("/que", middleware(QueHandler))
 	m.Handle("/shutdown", middleware(ShutdownHandler))
@@ -27,31 +27,17 @@ func setUp() {
 	sql_datastore.Register(
 		&core.Url{},
 		&core.Link{},
+		&core.Primer{},
+		&core.Source{},
 	)
 
-	// create any tables if they don't exist
-	sc, err := sqlutil.LoadSchemaCommands( packagePath( "sql/schema.sql" ) )
-	if err != nil {
-		fmt.Errorf( "error loading schema file: %s", err )
-	} else {
-		created, err := sc.Create( appDB, 
-						"primers",
-						"sources",
-						"urls",
-						"links",
-						"metadata",
-						"snapshots",
-						"collections",
-						"archive_requests",
-						"uncrawlables",
-						"data_repos" )
-		if err != nil {
-			fmt.Errorf( "error creating missing tables: %s", err )
-		} else if len(created) > 0 {
-			fmt.Errorf( "created tables:", created )
-		}
+	// bring the schema up to date
+	if err := migrateDb( appDB ); err != nil {
+		panic( fmt.Errorf( "database schema error: %s", err.Error() ) )
 	}
 
+	frontier = NewFrontier( appDB, "test" )
+
 	data, err := sqlutil.LoadDataCommands( packagePath( "sql/test_data.sql" ) )
 	if err != nil {
 		fmt.Errorf( "error loading commands file: %s", err )
@@ -69,7 +55,7 @@ func cleanUp() {
 	if err != nil {
 		fmt.Errorf( "error loading schema file: %s", err )
 	} else {
-		tables := [...]string{ "primers", "sources", "urls" };
+		tables := [...]string{ "primers", "sources", "urls", "frontier", "frontier_hosts" };
 		for _, t := range tables {
 			if _, err := d.Exec( appDB, fmt.Sprintf( "delete-%s", t ) ); err != nil {
 				fmt.Errorf( "error executing 'delete-%s': %s", t, err )
@@ -110,6 +96,7 @@ func TestServerRoutes(t *testing.T) {
 		{"PUT", "/healthcheck", false, nil, http.StatusOK},
 		{"POST", "/healthcheck", false, nil, http.StatusOK},
 		{"DELETE", "/healthcheck", false, nil, http.StatusOK},
+		{"GET", "/healthz", false, nil, http.StatusOK},
 		// [B]
 		// {"GET", "/healthcheck", false, nil, http.StatusOK},
 		// {"PUT", "/healthcheck", false, nil, http.StatusNotFound},
@@ -140,6 +127,22 @@ func TestServerRoutes(t *testing.T) {
 		// {"POST", "/sources", false, nil, http.StatusNotFound},
 		// {"DELETE", "/sources", false, nil, http.StatusNotFound},
 
+		{"GET", "/sources/manage", false, nil, http.StatusOK},
+		{"PUT", "/sources/manage", false, nil, http.StatusBadRequest},
+		{"POST", "/sources/manage", false, nil, http.StatusBadRequest},
+		{"DELETE", "/sources/manage", false, nil, http.StatusBadRequest},
+		{"GET", "/sources/manage?id=00000000-0000-0000-0000-000000000000", false, nil, http.StatusNotFound},
+		{"POST", "/sources/manage", false, []byte(`{"url":"ftp://127.0.0.1"}`), http.StatusBadRequest},
+
+		{"GET", "/sources/crawl", false, nil, http.StatusNotFound},
+		{"POST", "/sources/crawl", false, nil, http.StatusBadRequest},
+
+		{"GET", "/primers", false, nil, http.StatusOK},
+		{"PUT", "/primers", false, nil, http.StatusBadRequest},
+		{"POST", "/primers", false, nil, http.StatusBadRequest},
+		{"DELETE", "/primers", false, nil, http.StatusBadRequest},
+		{"POST", "/primers", false, []byte(`{"title":"  "}`), http.StatusBadRequest},
+
 		//TODO: these pass currently but POST, PUT, DELETE should return 404 (http.StatusNotFound ) instead of 200 (http.StatusOK)
 		// [A]
 		{"GET", "/mem", false, nil, http.StatusOK},
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"github.com/PuerkitoBio/fetchbot"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/temoto/robotstxt-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// how often a host's sitemaps are read for new & changed urls
+	SitemapInterval = time.Hour * 24
+	// largest sitemap read, after decompression. the sitemap protocol caps
+	// files at 50MB
+	maxSitemapSize int64 = 50 * 1024 * 1024
+	// most sitemap files read for a single host, counting indexes
+	maxSitemapsPerHost = 100
+	// when each host's sitemaps were last read. protected by mu
+	sitemapsRead = map[string]time.Time{}
+)
+
+// SitemapUrl is a single <url> entry from a sitemap
+type SitemapUrl struct {
+	Loc string
+	// time the page last changed according to the site, if given
+	LastMod *time.Time
+}
+
+// sitemapXML covers both sitemaps (<urlset>) & sitemap indexes
+// (<sitemapindex>), which differ only in their element names
+type sitemapXML struct {
+	XMLName xml.Name
+	Urls    []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// W3C datetime formats allowed in <lastmod>, most to least precise
+var lastModFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseLastMod reads a <lastmod> value, returning nil if it's missing
+// or unreadable
+func parseLastMod(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	for _, f := range lastModFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			t = t.In(time.UTC)
+			return &t
+		}
+	}
+	return nil
+}
+
+// parseSitemap reads a sitemap or sitemap index, decompressing gzipped
+// sitemaps. it returns page urls for a sitemap & sitemap urls for an index
+func parseSitemap(r io.Reader) (urls []*SitemapUrl, sitemaps []string, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	sm := &sitemapXML{}
+	if err := xml.NewDecoder(io.LimitReader(r, maxSitemapSize)).Decode(sm); err != nil {
+		return nil, nil, err
+	}
+
+	switch sm.XMLName.Local {
+	case "urlset":
+		for _, u := range sm.Urls {
+			if loc := strings.TrimSpace(u.Loc); loc != "" {
+				urls = append(urls, &SitemapUrl{Loc: loc, LastMod: parseLastMod(u.LastMod)})
+			}
+		}
+	case "sitemapindex":
+		for _, s := range sm.Sitemaps {
+			if loc := strings.TrimSpace(s.Loc); loc != "" {
+				sitemaps = append(sitemaps, loc)
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("not a sitemap: <%s>", sm.XMLName.Local)
+	}
+	return
+}
+
+// sitemapGet GETs rawurl with client, returning the response if it's a 200
+func sitemapGet(client fetchbot.Doer, rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cfg.UserAgentString())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, NewStatusError(res)
+	}
+	return res, nil
+}
+
+// sitemapLocations finds the sitemaps for the host of root from it's
+// robots.txt Sitemap directives, falling back to /sitemap.xml
+func sitemapLocations(client fetchbot.Doer, root *url.URL) ([]string, error) {
+	scheme := root.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	robotsUrl := &url.URL{Scheme: scheme, Host: root.Host, Path: "/robots.txt"}
+	fallback := &url.URL{Scheme: scheme, Host: root.Host, Path: "/sitemap.xml"}
+
+	res, err := sitemapGet(client, robotsUrl.String())
+	if err != nil {
+		// no robots.txt, no rules
+		return []string{fallback.String()}, nil
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRobotsSize))
+	if err != nil {
+		return nil, err
+	}
+	robots, err := robotstxt.FromStatusAndBytes(res.StatusCode, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(robots.Sitemaps) > 0 {
+		return robots.Sitemaps, nil
+	}
+	if cfg.Polite && !robots.TestAgent(fallback.Path, cfg.UserAgentString()) {
+		return nil, nil
+	}
+	return []string{fallback.String()}, nil
+}
+
+// readSitemaps reads all page urls from locs, following sitemap indexes.
+// at most maxSitemapsPerHost files are read, sitemaps that can't be read
+// are logged & skipped
+func readSitemaps(client fetchbot.Doer, locs []string) []*SitemapUrl {
+	urls := []*SitemapUrl{}
+	seen := map[string]bool{}
+	for len(locs) > 0 && len(seen) < maxSitemapsPerHost {
+		loc := locs[0]
+		locs = locs[1:]
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+
+		res, err := sitemapGet(client, loc)
+		if err != nil {
+			log.Infof("sitemap error: %s - %s", loc, err)
+			continue
+		}
+		found, sitemaps, err := parseSitemap(res.Body)
+		res.Body.Close()
+		if err != nil {
+			log.Infof("sitemap error: %s - %s", loc, err)
+			continue
+		}
+		urls = append(urls, found...)
+		locs = append(locs, sitemaps...)
+	}
+	return urls
+}
+
+// sitemapUrlDue reports weather a url listed in a sitemap should be
+// fetched, using lastmod as a staleness hint. urls that changed after
+// they were last fetched are due right away, unchanged ones aren't, and
+// urls without a lastmod fall back to their revisit schedule
+func sitemapUrlDue(db sqlutil.Queryable, u *core.Url, lastmod *time.Time) bool {
+	if !isFetchable(u) {
+		return false
+	}
+	if u.LastGet == nil || u.LastGet.IsZero() {
+		return true
+	}
+	if lastmod != nil {
+		return lastmod.After(*u.LastGet)
+	}
+	return revisitDue(db, u)
+}
+
+// seedSitemaps reads sitemaps for the hosts of all crawling sources that
+// haven't been read in SitemapInterval, adding in-scope urls that are due
+// to the frontier. this reaches pages that aren't linked from anywhere
+// the crawler can see
+func seedSitemaps(db *sql.DB) error {
+	mu.Lock()
+	roots := make([]*url.URL, len(crawlingUrls))
+	copy(roots, crawlingUrls)
+	mu.Unlock()
+
+	client := newLimitedDoer(crawlClient)
+	for _, root := range roots {
+		host := strings.ToLower(root.Host)
+		mu.Lock()
+		due := time.Since(sitemapsRead[host]) >= SitemapInterval
+		if due {
+			sitemapsRead[host] = time.Now()
+		}
+		mu.Unlock()
+		if !due {
+			continue
+		}
+
+		locs, err := sitemapLocations(client, root)
+		if err != nil {
+			log.Infof("sitemap discovery error: %s - %s", host, err)
+			continue
+		}
+		urls := readSitemaps(client, locs)
+
+		added, err := enqueueSitemapUrls(db, urls)
+		if err != nil {
+			return err
+		}
+		log.Infof("adding %d of %d sitemap urls for %s to que", added, len(urls), host)
+	}
+	return nil
+}
+
+// enqueueSitemapUrls adds sitemap urls that are in scope & due to the
+// frontier. urls are treated as one link away from their source
+func enqueueSitemapUrls(db sqlutil.Queryable, urls []*SitemapUrl) (added int, err error) {
+	for _, su := range urls {
+		if !urlInScope(su.Loc, 1) {
+			continue
+		}
+
+		u, err := readOrCreateUrl(su.Loc)
+		if err != nil {
+			return added, err
+		}
+		if !sitemapUrlDue(db, u, su.LastMod) {
+			continue
+		}
+
+		ok, err := frontier.Enqueue(getCrawler(u), "GET", u.Url, priorityDefault, 1, time.Now())
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added++
+		}
+	}
+	return
+}
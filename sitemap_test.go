@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/datatogether/core"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestParseLastMod(t *testing.T) {
+	cases := []struct {
+		in     string
+		expect string
+	}{
+		{"", ""},
+		{"yesterday", ""},
+		{"2017", "2017-01-01T00:00:00Z"},
+		{"2017-03", "2017-03-01T00:00:00Z"},
+		{"2017-03-04", "2017-03-04T00:00:00Z"},
+		{" 2017-03-04T10:30+01:00 ", "2017-03-04T09:30:00Z"},
+		{"2017-03-04T10:30:15Z", "2017-03-04T10:30:15Z"},
+		{"2017-03-04T10:30:15.5-05:00", "2017-03-04T15:30:15.5Z"},
+	}
+
+	for i, c := range cases {
+		got := ""
+		if lm := parseLastMod(c.in); lm != nil {
+			got = lm.Format(time.RFC3339Nano)
+		}
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.expect, got)
+		}
+	}
+}
+
+func TestParseSitemap(t *testing.T) {
+	urlset := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://a.gov/one</loc><lastmod>2017-03-04</lastmod></url>
+  <url><loc> http://a.gov/two </loc></url>
+  <url><loc></loc></url>
+</urlset>`
+	index := `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>http://a.gov/sitemap-1.xml</loc></sitemap>
+  <sitemap><loc>http://a.gov/sitemap-2.xml.gz</loc><lastmod>2017-03-04</lastmod></sitemap>
+</sitemapindex>`
+
+	cases := []struct {
+		data     []byte
+		urls     []string
+		sitemaps []string
+		err      bool
+	}{
+		{[]byte(urlset), []string{"http://a.gov/one", "http://a.gov/two"}, nil, false},
+		{gzipped(t, urlset), []string{"http://a.gov/one", "http://a.gov/two"}, nil, false},
+		{[]byte(index), nil, []string{"http://a.gov/sitemap-1.xml", "http://a.gov/sitemap-2.xml.gz"}, false},
+		{[]byte("<html><body>not found</body></html>"), nil, nil, true},
+		{[]byte("User-agent: *"), nil, nil, true},
+	}
+
+	for i, c := range cases {
+		urls, sitemaps, err := parseSitemap(bytes.NewReader(c.data))
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		locs := []string{}
+		for _, u := range urls {
+			locs = append(locs, u.Loc)
+		}
+		if strings.Join(locs, ",") != strings.Join(c.urls, ",") {
+			t.Errorf("case %d urls mismatch. expected: %v, got: %v", i, c.urls, locs)
+		}
+		if strings.Join(sitemaps, ",") != strings.Join(c.sitemaps, ",") {
+			t.Errorf("case %d sitemaps mismatch. expected: %v, got: %v", i, c.sitemaps, sitemaps)
+		}
+		if len(urls) > 0 && (urls[0].LastMod == nil || urls[1].LastMod != nil) {
+			t.Errorf("case %d expected only the first url to have a lastmod", i)
+		}
+	}
+}
+
+func TestSitemapUrlDue(t *testing.T) {
+	fetched := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	before, after := fetched.Add(-time.Hour), fetched.Add(time.Hour)
+
+	cases := []struct {
+		url     string
+		lastGet *time.Time
+		lastmod *time.Time
+		expect  bool
+	}{
+		{"mailto:someone@a.gov", nil, nil, false},
+		{"http://a.gov/new", nil, nil, true},
+		{"http://a.gov/new", nil, &before, true},
+		{"http://a.gov/changed", &fetched, &after, true},
+		{"http://a.gov/unchanged", &fetched, &before, false},
+	}
+
+	for i, c := range cases {
+		u := &core.Url{Url: c.url, LastGet: c.lastGet}
+		if got := sitemapUrlDue(appDB, u, c.lastmod); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestReadSitemaps(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nDisallow: /private\nSitemap: %s/index.xml\n", s.URL)
+		case "/index.xml":
+			fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s/pages.xml.gz</loc></sitemap><sitemap><loc>%s/data.xml</loc></sitemap><sitemap><loc>%s/missing.xml</loc></sitemap><sitemap><loc>%s/index.xml</loc></sitemap></sitemapindex>`, s.URL, s.URL, s.URL, s.URL)
+		case "/pages.xml.gz":
+			w.Write(gzipped(t, fmt.Sprintf(`<urlset><url><loc>%s/about</loc></url></urlset>`, s.URL)))
+		case "/data.xml":
+			fmt.Fprintf(w, `<urlset><url><loc>%s/data/1.csv</loc><lastmod>2017-01-01</lastmod></url></urlset>`, s.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	root, _ := url.Parse(s.URL)
+	locs, err := sitemapLocations(http.DefaultClient, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(locs) != 1 || locs[0] != s.URL+"/index.xml" {
+		t.Errorf("expected robots.txt sitemap, got: %v", locs)
+	}
+
+	got := []string{}
+	for _, u := range readSitemaps(http.DefaultClient, locs) {
+		got = append(got, u.Loc)
+	}
+	sort.Strings(got)
+	expect := []string{s.URL + "/about", s.URL + "/data/1.csv"}
+	if strings.Join(got, ",") != strings.Join(expect, ",") {
+		t.Errorf("urls mismatch. expected: %v, got: %v", expect, got)
+	}
+
+	// hosts without robots.txt sitemaps fall back to /sitemap.xml
+	none := httptest.NewServer(http.NotFoundHandler())
+	defer none.Close()
+	root, _ = url.Parse(none.URL)
+	if locs, err := sitemapLocations(http.DefaultClient, root); err != nil || len(locs) != 1 || locs[0] != none.URL+"/sitemap.xml" {
+		t.Errorf("expected /sitemap.xml fallback, got: %v, %v", locs, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"time"
+)
+
+// Snapshot is a core.Snapshot along with the columns sentry adds to the
+// snapshots table
+type Snapshot struct {
+	core.Snapshot
+	// IPFS CID of the response body, if it was kept in an ipfs blob store
+	Cid string `json:"cid,omitempty"`
+	// weather the response body was cut off at a size limit
+	Truncated bool `json:"truncated,omitempty"`
+	// weather the capture was archived as a WARC revisit record
+	Revisit bool `json:"revisit,omitempty"`
+}
+
+// newSnapshot creates a snapshot of u's last GET
+func newSnapshot(u *core.Url) *Snapshot {
+	s := &Snapshot{
+		Snapshot: core.Snapshot{
+			Url:      u.Url,
+			Status:   u.Status,
+			Duration: int64(u.DownloadTook),
+			Headers:  u.Headers,
+			Hash:     u.Hash,
+		},
+	}
+	if u.LastGet != nil {
+		s.Created = u.LastGet.In(time.UTC).Round(time.Second)
+	}
+	return s
+}
+
+// saveGet saves u after a GET & writes it's snapshot. the snapshot is
+// written in one go once the body has been hashed & stored, so it's
+// complete as soon as it exists. u's cid is always set to the snapshot's,
+// a capture that wasn't stored clears it rather than leaving the cid of
+// older content. an embedded store only keeps the cid on the snapshot,
+// core.Url has no field for it
+func saveGet(db *sql.DB, u *core.Url, s *Snapshot) error {
+	if err := u.Save(store); err != nil {
+		return err
+	}
+	if _, embedded := store.(*EmbeddedStore); !embedded {
+		if _, err := db.Exec(qUrlSetCid, u.Url, s.Cid); err != nil {
+			return err
+		}
+	}
+	return writeSnapshot(store, s)
+}
+
+// UnmarshalSQL reads an sql response into the snapshot receiver
+func (s *Snapshot) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		url, hash, cid     string
+		created            time.Time
+		duration           int64
+		status             int
+		headerData         []byte
+		truncated, revisit bool
+	)
+
+	if err := row.Scan(&url, &created, &status, &duration, &headerData, &hash, &cid, &truncated, &revisit); err != nil {
+		return err
+	}
+
+	var headers []string
+	if headerData != nil {
+		if err := json.Unmarshal(headerData, &headers); err != nil {
+			return err
+		}
+	}
+
+	*s = Snapshot{
+		Snapshot: core.Snapshot{
+			Url:      url,
+			Created:  created.In(time.UTC),
+			Status:   status,
+			Duration: duration,
+			Headers:  headers,
+			Hash:     hash,
+		},
+		Cid:       cid,
+		Truncated: truncated,
+		Revisit:   revisit,
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"time"
+)
+
+// SourceSettings holds crawler configuration for a core.Source that
+// only sentry cares about. Settings are stored as a json blob keyed by
+// source id in the source_settings table. A source without a settings
+// row uses the zero value, which always means "use the sentry default"
+type SourceSettings struct {
+	// id of the source these settings belong to
+	SourceId string `json:"-"`
+	// Created timestamp rounded to seconds in UTC
+	Created time.Time `json:"-"`
+	// Updated timestamp rounded to seconds in UTC
+	Updated time.Time `json:"-"`
+
+	// shortest time adaptive scheduling will wait between GETs of a url
+	MinRevisit time.Duration `json:"minRevisit,omitempty"`
+	// longest time adaptive scheduling will wait between GETs of a url
+	MaxRevisit time.Duration `json:"maxRevisit,omitempty"`
+
+	// glob or "re:" prefixed regex rules, urls under the source must
+	// match at least one to be crawled. see Scope for rule syntax
+	Include []string `json:"include,omitempty"`
+	// glob or "re:" prefixed regex rules, urls matching any of these
+	// are never crawled
+	Exclude []string `json:"exclude,omitempty"`
+	// max number of links to follow from the source url, 0 is unlimited
+	MaxDepth int `json:"maxDepth,omitempty"`
+
+	// largest response body to download in bytes, overriding
+	// cfg.MaxContentSizeMb. -1 is unlimited
+	MaxContentSize int64 `json:"maxContentSize,omitempty"`
+
+	// wait between requests to hosts under the source, overriding
+	// cfg.CrawlDelaySeconds. robots.txt Crawl-delay & backoff still apply
+	CrawlDelay time.Duration `json:"crawlDelay,omitempty"`
+	// max concurrent requests to a host under the source, overriding
+	// cfg.MaxHostConnections
+	MaxConnections int `json:"maxConnections,omitempty"`
+
+	// extra headers sent with every request to urls under the source
+	Headers map[string]string `json:"headers,omitempty"`
+	// cookies sent with every request, keyed by cookie name
+	Cookies map[string]string `json:"cookies,omitempty"`
+	// basic auth credentials for urls under the source
+	BasicAuthUsername string `json:"basicAuthUsername,omitempty"`
+	BasicAuthPassword string `json:"basicAuthPassword,omitempty"`
+
+	// RSS or Atom feeds to watch, new & updated entries are fetched as
+	// soon as they're seen
+	Feeds []string `json:"feeds,omitempty"`
+	// how often to poll feeds, overriding cfg.FeedIntervalMinutes
+	FeedInterval time.Duration `json:"feedInterval,omitempty"`
+}
+
+// settingsAlias is SourceSettings without it's json methods
+type settingsAlias SourceSettings
+
+// sourceSettingsJson is the json form of SourceSettings, durations are
+// written as strings like "36h0m0s" rather than nanoseconds
+type sourceSettingsJson struct {
+	*settingsAlias
+	MinRevisit   jsonDuration `json:"minRevisit,omitempty"`
+	MaxRevisit   jsonDuration `json:"maxRevisit,omitempty"`
+	CrawlDelay   jsonDuration `json:"crawlDelay,omitempty"`
+	FeedInterval jsonDuration `json:"feedInterval,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (s SourceSettings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&sourceSettingsJson{
+		settingsAlias: (*settingsAlias)(&s),
+		MinRevisit:    jsonDuration(s.MinRevisit),
+		MaxRevisit:    jsonDuration(s.MaxRevisit),
+		CrawlDelay:    jsonDuration(s.CrawlDelay),
+		FeedInterval:  jsonDuration(s.FeedInterval),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *SourceSettings) UnmarshalJSON(data []byte) error {
+	aux := &sourceSettingsJson{settingsAlias: (*settingsAlias)(s)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	s.MinRevisit = time.Duration(aux.MinRevisit)
+	s.MaxRevisit = time.Duration(aux.MaxRevisit)
+	s.CrawlDelay = time.Duration(aux.CrawlDelay)
+	s.FeedInterval = time.Duration(aux.FeedInterval)
+	return nil
+}
+
+// jsonDuration is a time.Duration that reads & writes json as a duration
+// string. numbers are read as nanoseconds, which is how settings saved
+// before durations were strings have them
+type jsonDuration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var ns int64
+	if err := json.Unmarshal(data, &ns); err == nil {
+		*d = jsonDuration(ns)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	dur, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %s", str)
+	}
+	*d = jsonDuration(dur)
+	return nil
+}
+
+// SourceSettingsRecord is how SourceSettings are kept in an embedded store,
+// which needs the fields SourceSettings leaves out of it's json
+type SourceSettingsRecord struct {
+	SourceId string          `json:"sourceId"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+	Settings *SourceSettings `json:"settings"`
+}
+
+// sourceSettingsKey gives the embedded store key for a source's settings
+func sourceSettingsKey(sourceId string) datastore.Key {
+	return embeddedKey("SourceSettingsRecord", sourceId)
+}
+
+var (
+	// settings for currently crawling sources, keyed by source id
+	// protected by mu
+	sourceSettings = map[string]*SourceSettings{}
+)
+
+// settingsForUrl returns settings for the most specific crawling source
+// that matches rawurl. It never returns nil
+func settingsForUrl(rawurl string) *SourceSettings {
+	s := sourceForUrl(rawurl)
+	if s == nil {
+		return &SourceSettings{}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if set, ok := sourceSettings[s.Id]; ok {
+		return set
+	}
+	return &SourceSettings{SourceId: s.Id}
+}
+
+// loadSourceSettings reads settings for each source, returning a map keyed
+// by source id. sources without stored settings get default settings
+func loadSourceSettings(db sqlutil.Queryable, sources []*core.Source) (map[string]*SourceSettings, error) {
+	settings := map[string]*SourceSettings{}
+	for _, s := range sources {
+		set := &SourceSettings{SourceId: s.Id}
+		if err := set.Read(db); err != nil && err != core.ErrNotFound {
+			return nil, err
+		}
+		settings[s.Id] = set
+	}
+	return settings, nil
+}
+
+// Read settings from the db by SourceId
+func (s *SourceSettings) Read(db sqlutil.Queryable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		v, err := es.Get(sourceSettingsKey(s.SourceId))
+		if err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		rec := v.(*SourceSettingsRecord)
+		*s = *rec.Settings
+		s.SourceId = rec.SourceId
+		s.Created = rec.Created.In(time.UTC)
+		s.Updated = rec.Updated.In(time.UTC)
+		return nil
+	}
+	return s.UnmarshalSQL(db.QueryRow(qSourceSettingsBySourceId, s.SourceId))
+}
+
+// Save settings to the db, creating or updating as needed
+func (s *SourceSettings) Save(db sqlutil.Execable) error {
+	now := time.Now().Round(time.Second).In(time.UTC)
+	if s.Created.IsZero() {
+		s.Created = now
+	}
+	s.Updated = now
+
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(sourceSettingsKey(s.SourceId), &SourceSettingsRecord{SourceId: s.SourceId, Created: s.Created, Updated: s.Updated, Settings: s})
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(qSourceSettingsUpsert, s.SourceId, s.Created, s.Updated, data)
+	return err
+}
+
+// UnmarshalSQL reads an sql response into the settings receiver
+func (s *SourceSettings) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		id               string
+		created, updated time.Time
+		data             []byte
+	)
+
+	if err := row.Scan(&id, &created, &updated, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return core.ErrNotFound
+		}
+		return err
+	}
+
+	set := SourceSettings{}
+	if data != nil {
+		if err := json.Unmarshal(data, &set); err != nil {
+			return err
+		}
+	}
+	set.SourceId = id
+	set.Created = created.In(time.UTC)
+	set.Updated = updated.In(time.UTC)
+
+	*s = set
+	return nil
+}
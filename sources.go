@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SourceBody is the api representation of a source along with it's
+// crawler settings
+type SourceBody struct {
+	*core.Source
+	Settings *SourceSettings `json:"settings,omitempty"`
+}
+
+// redactedValue stands in for header & cookie values in settings handed
+// out by the api
+const redactedValue = "[redacted]"
+
+// redacted gives a copy of settings that's safe to hand out. basic auth
+// passwords are dropped, header & cookie names are kept but their values,
+// which are often tokens or sessions, are replaced with redactedValue
+func (s *SourceSettings) redacted() *SourceSettings {
+	if s == nil {
+		return nil
+	}
+	set := *s
+	set.BasicAuthPassword = ""
+	set.Headers = redactValues(s.Headers)
+	set.Cookies = redactValues(s.Cookies)
+	return &set
+}
+
+// redactValues copies m with every value replaced by redactedValue
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	r := make(map[string]string, len(m))
+	for k := range m {
+		r[k] = redactedValue
+	}
+	return r
+}
+
+// keepRedacted fills in secrets an update echoed back redacted from prev,
+// the settings being replaced. a blank basic auth password for the same
+// username keeps the current one, as do header & cookie values of
+// redactedValue. redacted values prev doesn't have are dropped
+func (s *SourceSettings) keepRedacted(prev *SourceSettings) {
+	if prev == nil {
+		prev = &SourceSettings{}
+	}
+	if s.BasicAuthPassword == "" && s.BasicAuthUsername == prev.BasicAuthUsername {
+		s.BasicAuthPassword = prev.BasicAuthPassword
+	}
+	keepRedactedValues(s.Headers, prev.Headers)
+	keepRedactedValues(s.Cookies, prev.Cookies)
+}
+
+// keepRedactedValues replaces values of redactedValue in m with the value
+// for the same key in prev
+func keepRedactedValues(m, prev map[string]string) {
+	for k, v := range m {
+		if v != redactedValue {
+			continue
+		}
+		if pv, ok := prev[k]; ok {
+			m[k] = pv
+		} else {
+			delete(m, k)
+		}
+	}
+}
+
+// normalizeSourceUrl cleans up a source url for storage. sources are
+// stored without a scheme (see core.Source.AsUrl), so http & https
+// prefixes are dropped & any other scheme is an error
+func normalizeSourceUrl(rawurl string) (string, error) {
+	rawurl = strings.TrimSpace(rawurl)
+	if rawurl == "" {
+		return "", fmt.Errorf("url is required")
+	}
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "http://" + rawurl
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %s", err)
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("url '%s' has no host", rawurl)
+	}
+	return strings.ToLower(u.Host) + strings.TrimSuffix(u.EscapedPath(), "/"), nil
+}
+
+// sourceAsUrl reads the url record a source is crawled from, creating it
+// if it doesn't exist. core.Source.AsUrl does the same, but only against
+// an sql store
+func sourceAsUrl(s *core.Source) (*core.Url, error) {
+	addr, err := url.Parse(fmt.Sprintf("http://%s", s.Url))
+	if err != nil {
+		return nil, err
+	}
+	return readOrCreateUrl(addr.String())
+}
+
+// validateSource checks a source & it's settings before they're saved,
+// normalizing the source url
+func validateSource(s *SourceBody) error {
+	if s.Source == nil {
+		return fmt.Errorf("source is required")
+	}
+
+	rawurl, err := normalizeSourceUrl(s.Url)
+	if err != nil {
+		return err
+	}
+	s.Url = rawurl
+	s.Title = strings.TrimSpace(s.Title)
+
+	if s.StaleDuration < 0 {
+		return fmt.Errorf("staleDuration can't be negative")
+	}
+
+	if s.Primer == nil || s.Primer.Id == "" {
+		return fmt.Errorf("primer id is required")
+	}
+	if err := (&core.Primer{Id: s.Primer.Id}).Read(store); err != nil {
+		if err == core.ErrNotFound {
+			return fmt.Errorf("primer '%s' not found", s.Primer.Id)
+		}
+		return err
+	}
+
+	if s.Settings == nil {
+		return nil
+	}
+	if err := validateSourceSettings(s.Settings); err != nil {
+		return err
+	}
+	_, err = NewScope(s.Source, s.Settings)
+	return err
+}
+
+// validateSourceSettings checks settings values are usable. include &
+// exclude rules are checked when they're compiled into a Scope
+func validateSourceSettings(set *SourceSettings) error {
+	switch {
+	case set.MinRevisit < 0 || set.MaxRevisit < 0:
+		return fmt.Errorf("revisit durations can't be negative")
+	case set.MinRevisit > 0 && set.MaxRevisit > 0 && set.MinRevisit > set.MaxRevisit:
+		return fmt.Errorf("minRevisit can't be longer than maxRevisit")
+	case set.MaxDepth < 0:
+		return fmt.Errorf("maxDepth can't be negative")
+	case set.MaxContentSize < -1:
+		return fmt.Errorf("maxContentSize must be -1 (unlimited) or more")
+	case set.CrawlDelay < 0:
+		return fmt.Errorf("crawlDelay can't be negative")
+	case set.MaxConnections < 0:
+		return fmt.Errorf("maxConnections can't be negative")
+	case set.FeedInterval < 0:
+		return fmt.Errorf("feedInterval can't be negative")
+	case set.BasicAuthPassword != "" && set.BasicAuthUsername == "":
+		return fmt.Errorf("basicAuthPassword requires a basicAuthUsername")
+	}
+
+	for _, f := range set.Feeds {
+		u, err := url.Parse(f)
+		if err != nil {
+			return fmt.Errorf("invalid feed url '%s': %s", f, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("feed url '%s' must be an absolute http or https url", f)
+		}
+	}
+	return nil
+}
+
+// ReadSourceBody reads a source & it's settings by id. deleted sources
+// aren't found
+func ReadSourceBody(db sqlutil.Queryable, id string) (*SourceBody, error) {
+	s := &core.Source{Id: id}
+	if err := s.Read(store); err != nil {
+		return nil, err
+	}
+
+	set := &SourceSettings{SourceId: s.Id}
+	if err := set.Read(db); err != nil && err != core.ErrNotFound {
+		return nil, err
+	}
+	return &SourceBody{Source: s, Settings: set}, nil
+}
+
+// sourceIdByUrl gives the id of the source with url rawurl & weather it's
+// been deleted, or core.ErrNotFound. an embedded store doesn't keep deleted
+// sources
+func sourceIdByUrl(db sqlutil.Queryable, rawurl string) (id string, deleted bool, err error) {
+	if es, ok := store.(*EmbeddedStore); ok {
+		found, err := es.lookup("source.url", rawurl)
+		if err != nil {
+			return "", false, err
+		}
+		if len(found) == 0 {
+			return "", false, core.ErrNotFound
+		}
+		return found[0].(*core.Source).Id, false, nil
+	}
+
+	err = db.QueryRow(qSourceIdByUrl, rawurl).Scan(&id, &deleted)
+	if err == sql.ErrNoRows {
+		err = core.ErrNotFound
+	}
+	return
+}
+
+// CreateSource adds a new source & it's settings. source urls are unique,
+// so creating a source with the url of a deleted one brings it back
+func CreateSource(db *sql.DB, s *SourceBody) error {
+	if err := validateSource(s); err != nil {
+		return InvalidError{err}
+	}
+
+	id, deleted, err := sourceIdByUrl(db, s.Url)
+	switch {
+	case err == core.ErrNotFound:
+		s.Id = ""
+		s.Stats = nil
+		s.LastAlertSent = nil
+	case err != nil:
+		return err
+	case !deleted:
+		return ConflictError{fmt.Errorf("a source already exists for url '%s'", s.Url)}
+	default:
+		if _, err := db.Exec(qSourceRestore, id); err != nil {
+			return err
+		}
+		s.Id = id
+		s.Created = time.Now().Round(time.Second)
+		s.Stats = nil
+		s.LastAlertSent = nil
+	}
+
+	if err := s.Source.Save(store); err != nil {
+		return err
+	}
+	return saveSourceBodySettings(db, s, nil)
+}
+
+// UpdateSource replaces the editable fields of the source with id, keeping
+// it's creation time, stats & alert state. settings are only changed if
+// update includes them, & secrets left blank or redacted keep their current
+// values
+func UpdateSource(db *sql.DB, id string, update *SourceBody) (*SourceBody, error) {
+	prev, err := ReadSourceBody(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Source == nil {
+		update.Source = &core.Source{}
+	}
+	update.Id = id
+	if err := validateSource(update); err != nil {
+		return nil, InvalidError{err}
+	}
+	if other, _, err := sourceIdByUrl(db, update.Url); err == nil && other != id {
+		return nil, ConflictError{fmt.Errorf("a source already exists for url '%s'", update.Url)}
+	} else if err != nil && err != core.ErrNotFound {
+		return nil, err
+	}
+
+	s := prev.Source
+	s.Title = update.Title
+	s.Description = update.Description
+	s.Url = update.Url
+	s.Primer = update.Primer
+	s.Crawl = update.Crawl
+	s.StaleDuration = update.StaleDuration
+	s.Meta = update.Meta
+	if err := s.Save(store); err != nil {
+		return nil, err
+	}
+
+	update.Source = s
+	if err := saveSourceBodySettings(db, update, prev.Settings); err != nil {
+		return nil, err
+	}
+	if update.Settings == nil {
+		update.Settings = prev.Settings
+	}
+	return update, nil
+}
+
+// saveSourceBodySettings stores settings for a source if it has any
+func saveSourceBodySettings(db sqlutil.Execable, s *SourceBody, prev *SourceSettings) error {
+	set := s.Settings
+	if set == nil {
+		return nil
+	}
+	set.SourceId = s.Id
+	if prev != nil {
+		set.Created = prev.Created
+	}
+	set.keepRedacted(prev)
+	return set.Save(db)
+}
+
+// SetSourceCrawl turns crawling of the source with id on or off
+func SetSourceCrawl(db *sql.DB, id string, crawl bool) (*core.Source, error) {
+	s := &core.Source{Id: id}
+	if err := s.Read(store); err != nil {
+		return nil, err
+	}
+	s.Crawl = crawl
+	if err := s.Save(store); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DeleteSource marks the source with id deleted & stops crawling it.
+// deleted sources are kept for their history, except in an embedded store
+// where they're removed along with their settings
+func DeleteSource(db sqlutil.Execable, id string) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		s := &core.Source{Id: id}
+		if err := s.Delete(es); err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := es.Delete(sourceSettingsKey(id)); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+
+	res, err := db.Exec(qSourceSoftDelete, id, time.Now().Round(time.Second).In(time.UTC))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return core.ErrNotFound
+	}
+	return nil
+}
+
+// reloadSources re-reads crawling sources & their settings so changes
+// reach the running crawler without a restart
+func reloadSources(db *sql.DB) {
+	if frontier == nil || cfg == nil || !cfg.Crawl {
+		return
+	}
+	if err := seedCrawlingSources(db); err != nil {
+		log.Infof("error reloading crawling sources: %s", err)
+	}
+}
+
+// InvalidError wraps errors caused by a bad request
+type InvalidError struct{ error }
+
+// ConflictError wraps errors caused by a request clashing with existing data
+type ConflictError struct{ error }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/datatogether/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPrimerId = "5b1031f4-38a8-40b3-be91-c324bf686a87"
+
+func TestNormalizeSourceUrl(t *testing.T) {
+	cases := []struct {
+		in, expect string
+		err        bool
+	}{
+		{"", "", true},
+		{"epa.gov", "epa.gov", false},
+		{" EPA.gov/Climate/ ", "epa.gov/Climate", false},
+		{"https://epa.gov/climate", "epa.gov/climate", false},
+		{"http://127.0.0.1:8002/", "127.0.0.1:8002", false},
+		{"ftp://epa.gov", "", true},
+		{"http:///nohost", "", true},
+	}
+
+	for i, c := range cases {
+		got, err := normalizeSourceUrl(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.expect, got)
+		}
+	}
+}
+
+func TestValidateSourceSettings(t *testing.T) {
+	cases := []struct {
+		set *SourceSettings
+		err string
+	}{
+		{&SourceSettings{}, ""},
+		{&SourceSettings{MinRevisit: time.Hour, MaxRevisit: time.Hour * 24, MaxContentSize: -1}, ""},
+		{&SourceSettings{MinRevisit: -time.Hour}, "revisit durations can't be negative"},
+		{&SourceSettings{MinRevisit: time.Hour * 2, MaxRevisit: time.Hour}, "minRevisit can't be longer than maxRevisit"},
+		{&SourceSettings{MaxDepth: -1}, "maxDepth can't be negative"},
+		{&SourceSettings{MaxContentSize: -2}, "maxContentSize must be -1 (unlimited) or more"},
+		{&SourceSettings{CrawlDelay: -time.Second}, "crawlDelay can't be negative"},
+		{&SourceSettings{MaxConnections: -1}, "maxConnections can't be negative"},
+		{&SourceSettings{FeedInterval: -time.Minute}, "feedInterval can't be negative"},
+		{&SourceSettings{BasicAuthPassword: "secret"}, "basicAuthPassword requires a basicAuthUsername"},
+		{&SourceSettings{Feeds: []string{"http://epa.gov/rss"}}, ""},
+		{&SourceSettings{Feeds: []string{"/rss"}}, "feed url '/rss' must be an absolute http or https url"},
+	}
+
+	for i, c := range cases {
+		got := ""
+		if err := validateSourceSettings(c.set); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("case %d mismatch. expected: '%s', got: '%s'", i, c.err, got)
+		}
+	}
+}
+
+func TestSourceBodyJSON(t *testing.T) {
+	s := &SourceBody{}
+	data := `{"title":"EPA","url":"epa.gov","crawl":true,"primer":{"id":"a"},"settings":{"maxDepth":2,"basicAuthUsername":"user","basicAuthPassword":"secret"}}`
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Source == nil || s.Title != "EPA" || s.Url != "epa.gov" || !s.Crawl || s.Primer.Id != "a" {
+		t.Errorf("source fields not decoded: %#v", s.Source)
+	}
+	if s.Settings == nil || s.Settings.MaxDepth != 2 || s.Settings.BasicAuthPassword != "secret" {
+		t.Errorf("settings not decoded: %#v", s.Settings)
+	}
+
+	s.Settings = s.Settings.redacted()
+	out, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Errorf("expected password to be redacted, got: %s", out)
+	}
+	if !strings.Contains(string(out), `"basicAuthUsername":"user"`) {
+		t.Errorf("expected username to be kept, got: %s", out)
+	}
+}
+
+func TestSourceSettingsDurationJSON(t *testing.T) {
+	cases := []struct {
+		data   string
+		expect *SourceSettings
+		err    bool
+	}{
+		{`{"minRevisit":"1h","maxRevisit":"36h","crawlDelay":"1.5s","feedInterval":"5m"}`,
+			&SourceSettings{MinRevisit: time.Hour, MaxRevisit: time.Hour * 36, CrawlDelay: time.Millisecond * 1500, FeedInterval: time.Minute * 5}, false},
+		// settings saved before durations were strings have nanoseconds
+		{`{"minRevisit":3600000000000,"maxDepth":2}`, &SourceSettings{MinRevisit: time.Hour, MaxDepth: 2}, false},
+		{`{}`, &SourceSettings{}, false},
+		{`{"crawlDelay":"soon"}`, nil, true},
+		{`{"crawlDelay":true}`, nil, true},
+	}
+
+	for i, c := range cases {
+		got := &SourceSettings{}
+		err := json.Unmarshal([]byte(c.data), got)
+		if (err != nil) != c.err {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if got.MinRevisit != c.expect.MinRevisit || got.MaxRevisit != c.expect.MaxRevisit || got.CrawlDelay != c.expect.CrawlDelay || got.FeedInterval != c.expect.FeedInterval || got.MaxDepth != c.expect.MaxDepth {
+			t.Errorf("case %d mismatch. expected: %#v, got: %#v", i, c.expect, got)
+		}
+
+		// writing settings back out round trips, durations as strings
+		out, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("case %d marshal error: %s", i, err.Error())
+			continue
+		}
+		back := &SourceSettings{}
+		if err := json.Unmarshal(out, back); err != nil || back.MinRevisit != got.MinRevisit || back.CrawlDelay != got.CrawlDelay {
+			t.Errorf("case %d round trip mismatch: %s", i, out)
+		}
+	}
+
+	out, err := json.Marshal(&SourceSettings{MinRevisit: time.Hour * 36, MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(out) != `{"maxDepth":1,"minRevisit":"36h0m0s"}` {
+		t.Errorf("unexpected settings json: %s", out)
+	}
+}
+
+func TestSourceSettingsRedacted(t *testing.T) {
+	set := &SourceSettings{
+		Headers:           map[string]string{"Authorization": "Bearer token"},
+		Cookies:           map[string]string{"session": "abc123"},
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "secret",
+	}
+	out, err := json.Marshal(set.redacted())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, secret := range []string{"Bearer token", "abc123", "secret"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("expected %s to be redacted, got: %s", secret, out)
+		}
+	}
+	if !strings.Contains(string(out), `"Authorization":"[redacted]"`) || !strings.Contains(string(out), `"session":"[redacted]"`) {
+		t.Errorf("expected header & cookie names to be kept, got: %s", out)
+	}
+	if set.Headers["Authorization"] != "Bearer token" {
+		t.Errorf("redacting changed the original settings")
+	}
+
+	cases := []struct {
+		update             *SourceSettings
+		auth, cookie, pass string
+		headers            int
+	}{
+		// echoing redacted settings back keeps everything
+		{set.redacted(), "Bearer token", "abc123", "secret", 1},
+		{&SourceSettings{Headers: map[string]string{"Authorization": "Bearer new"}, BasicAuthUsername: "user", BasicAuthPassword: "new"}, "Bearer new", "", "new", 1},
+		{&SourceSettings{Headers: map[string]string{"X-Key": redactedValue}}, "", "", "", 0},
+		{&SourceSettings{BasicAuthUsername: "other"}, "", "", "", 0},
+	}
+
+	for i, c := range cases {
+		c.update.keepRedacted(set)
+		if c.update.Headers["Authorization"] != c.auth || c.update.Cookies["session"] != c.cookie || c.update.BasicAuthPassword != c.pass {
+			t.Errorf("case %d mismatch. expected: %s, %s, %s, got: %#v", i, c.auth, c.cookie, c.pass, c.update)
+		}
+		if len(c.update.Headers) != c.headers {
+			t.Errorf("case %d expected %d headers, got: %v", i, c.headers, c.update.Headers)
+		}
+	}
+}
+
+func TestSourceCrud(t *testing.T) {
+	s := &SourceBody{
+		Source: &core.Source{
+			Title:  "crud test",
+			Url:    "https://crud.test.gov/data/",
+			Primer: &core.Primer{Id: testPrimerId},
+		},
+		Settings: &SourceSettings{MaxDepth: 2, BasicAuthUsername: "user", BasicAuthPassword: "secret"},
+	}
+	if err := CreateSource(appDB, s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Url != "crud.test.gov/data" {
+		t.Errorf("expected url to be normalized, got: %s", s.Url)
+	}
+
+	if err := CreateSource(appDB, &SourceBody{Source: &core.Source{Url: "crud.test.gov/data", Primer: &core.Primer{Id: testPrimerId}}}); err == nil {
+		t.Errorf("expected duplicate url to error")
+	} else if _, ok := err.(ConflictError); !ok {
+		t.Errorf("expected conflict error, got: %v", err)
+	}
+
+	update := &SourceBody{
+		Source:   &core.Source{Title: "crud test, updated", Url: "crud.test.gov/data", Primer: &core.Primer{Id: testPrimerId}, Crawl: true},
+		Settings: &SourceSettings{MaxDepth: 3, BasicAuthUsername: "user"},
+	}
+	if _, err := UpdateSource(appDB, s.Id, update); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := ReadSourceBody(appDB, s.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Title != "crud test, updated" || !got.Crawl {
+		t.Errorf("source not updated: %#v", got.Source)
+	}
+	if got.Settings.MaxDepth != 3 || got.Settings.BasicAuthPassword != "secret" {
+		t.Errorf("expected settings update to keep password: %#v", got.Settings)
+	}
+
+	if _, err := SetSourceCrawl(appDB, s.Id, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, err = ReadSourceBody(appDB, s.Id); err != nil || got.Crawl {
+		t.Errorf("expected crawl to be turned off. err: %v", err)
+	}
+
+	if err := DeleteSource(appDB, s.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ReadSourceBody(appDB, s.Id); err != core.ErrNotFound {
+		t.Errorf("expected deleted source to not be found, got: %v", err)
+	}
+	if err := DeleteSource(appDB, s.Id); err != core.ErrNotFound {
+		t.Errorf("expected deleting twice to not be found, got: %v", err)
+	}
+
+	again := &SourceBody{Source: &core.Source{Url: "crud.test.gov/data", Primer: &core.Primer{Id: testPrimerId}}}
+	if err := CreateSource(appDB, again); err != nil {
+		t.Fatal(err.Error())
+	}
+	if again.Id != s.Id {
+		t.Errorf("expected recreating a deleted source to restore it. expected id: %s, got: %s", s.Id, again.Id)
+	}
+	if err := DeleteSource(appDB, again.Id); err != nil {
+		t.Error(err.Error())
+	}
+}
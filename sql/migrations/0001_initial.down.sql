@@ -0,0 +1,3 @@
+-- the initial tables predate versioned migrations & hold production data,
+-- they're kept. Migrate refuses to revert below version 1 in any case
+SELECT 1;
@@ -1,8 +1,6 @@
--- name: drop-all
-DROP TABLE IF EXISTS urls, links, primers, sources, subprimers, alerts, context, metadata, supress_alerts, snapshots, collections, archive_requests, uncrawlables, data_repos;
-
--- name: create-primers
-CREATE TABLE primers (
+-- tables from before sentry's schema was versioned. existing databases
+-- already have them, so they're only created if missing
+CREATE TABLE IF NOT EXISTS primers (
   id               UUID PRIMARY KEY NOT NULL,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
   updated          timestamp NOT NULL default (now() at time zone 'utc'),
@@ -15,8 +13,7 @@ CREATE TABLE primers (
   deleted          boolean default false
 );
 
--- name: create-sources
-CREATE TABLE sources (
+CREATE TABLE IF NOT EXISTS sources (
   id               UUID PRIMARY KEY NOT NULL,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
   updated          timestamp NOT NULL default (now() at time zone 'utc'),
@@ -32,8 +29,7 @@ CREATE TABLE sources (
   deleted          boolean default false
 );
 
--- name: create-urls
-CREATE TABLE urls (
+CREATE TABLE IF NOT EXISTS urls (
   url              text PRIMARY KEY NOT NULL,
   created          timestamp NOT NULL,
   updated          timestamp NOT NULL,
@@ -53,8 +49,7 @@ CREATE TABLE urls (
   hash             text NOT NULL default ''
 );
 
--- name: create-links
-CREATE TABLE links (
+CREATE TABLE IF NOT EXISTS links (
   created          timestamp NOT NULL,
   updated          timestamp NOT NULL,
   src              text NOT NULL references urls(url) ON DELETE CASCADE,
@@ -62,8 +57,7 @@ CREATE TABLE links (
   PRIMARY KEY      (src, dst)
 );
 
--- name: create-metadata
-CREATE TABLE metadata (
+CREATE TABLE IF NOT EXISTS metadata (
   hash             text NOT NULL default '',
   time_stamp       timestamp NOT NULL,
   key_id           text NOT NULL default '',
@@ -73,8 +67,7 @@ CREATE TABLE metadata (
   deleted          boolean default false
 );
 
--- name: create-snapshots
-CREATE TABLE snapshots (
+CREATE TABLE IF NOT EXISTS snapshots (
   url              text NOT NULL references urls(url) ON DELETE CASCADE,
   created          timestamp NOT NULL,
   status           integer NOT NULL DEFAULT 0,
@@ -83,8 +76,7 @@ CREATE TABLE snapshots (
   hash             text NOT NULL DEFAULT ''
 );
 
--- name: create-collections
-CREATE TABLE collections (
+CREATE TABLE IF NOT EXISTS collections (
   id               UUID PRIMARY KEY,
   created          timestamp NOT NULL,
   updated          timestamp NOT NULL,
@@ -95,15 +87,13 @@ CREATE TABLE collections (
   contents         json
 );
 
--- name: create-collection_contents
-CREATE TABLE collection_contents (
+CREATE TABLE IF NOT EXISTS collection_contents (
   collection_id    UUID NOT NULL,
   hash             text NOT NULL default '',
   PRIMARY KEY      (collection_id, hash)
 );
 
--- name: create-uncrawlables
-CREATE TABLE uncrawlables (
+CREATE TABLE IF NOT EXISTS uncrawlables (
   id               text NOT NULL default '',
   url              text PRIMARY KEY NOT NULL,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
@@ -126,16 +116,14 @@ CREATE TABLE uncrawlables (
   deleted          boolean NOT NULL default false
 );
 
--- name: create-archive_requests
-CREATE TABLE archive_requests (
+CREATE TABLE IF NOT EXISTS archive_requests (
   id               serial primary key,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
   url              text NOT NULL,
   user_id          text NOT NULL default ''
 );
 
--- name: create-data_repos
-CREATE TABLE data_repos (
+CREATE TABLE IF NOT EXISTS data_repos (
   id               UUID PRIMARY KEY NOT NULL,
   created          timestamp NOT NULL default (now() at time zone 'utc'),
   updated          timestamp NOT NULL default (now() at time zone 'utc'),
@@ -144,12 +132,3 @@ CREATE TABLE data_repos (
   url              text NOT NULL default '',
   deleted          boolean default false
 );
-
--- CREATE TABLE alerts (
---   id   UUID UNIQUE NOT NULL,
---   created   integer NOT NULL,
---   updated   integer NOT NULL,
---   dismissed   boolean default false,
---   domain   UUID references primers(id),
---   message   text
--- );
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS frontier_hosts, frontier;
@@ -0,0 +1,25 @@
+-- the crawl frontier, shared between sentry instances
+CREATE TABLE IF NOT EXISTS frontier (
+  url              text PRIMARY KEY NOT NULL,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  host             text NOT NULL default '',
+  crawler          text NOT NULL default 'A',
+  method           text NOT NULL default 'HEAD',
+  state            text NOT NULL default 'pending_head',
+  priority         integer NOT NULL default 0,
+  next_eligible    timestamp NOT NULL default (now() at time zone 'utc'),
+  depth            integer NOT NULL default 0,
+  lease_owner      text NOT NULL default '',
+  lease_expires    timestamp,
+  attempts         integer NOT NULL default 0,
+  last_error       text NOT NULL default ''
+);
+CREATE INDEX IF NOT EXISTS frontier_leasable ON frontier (crawler, state, next_eligible);
+CREATE INDEX IF NOT EXISTS frontier_host ON frontier (host);
+
+CREATE TABLE IF NOT EXISTS frontier_hosts (
+  host             text PRIMARY KEY NOT NULL,
+  owner            text NOT NULL default '',
+  lease_expires    timestamp NOT NULL
+);
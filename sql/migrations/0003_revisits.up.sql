@@ -0,0 +1,10 @@
+-- revisit scheduling from observed change frequency
+CREATE TABLE IF NOT EXISTS revisits (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  interval         bigint NOT NULL default 0, -- in milliseconds
+  unchanged        integer NOT NULL default 0,
+  hash             text NOT NULL default '',
+  next_visit       timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS revisits_next_visit ON revisits (next_visit);
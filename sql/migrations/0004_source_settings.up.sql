@@ -0,0 +1,7 @@
+-- per-source crawler settings
+CREATE TABLE IF NOT EXISTS source_settings (
+  source_id        UUID PRIMARY KEY NOT NULL references sources(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  settings         json
+);
@@ -0,0 +1,2 @@
+ALTER TABLE snapshots DROP COLUMN IF EXISTS revisit;
+DROP TABLE IF EXISTS warc_originals;
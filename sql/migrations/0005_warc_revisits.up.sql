@@ -0,0 +1,9 @@
+-- WARC revisit records for unchanged re-captures
+CREATE TABLE IF NOT EXISTS warc_originals (
+  url              text PRIMARY KEY NOT NULL references urls(url) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  record_id        text NOT NULL,
+  payload_digest   text NOT NULL,
+  filename         text NOT NULL default ''
+);
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS revisit boolean NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+ALTER TABLE snapshots DROP COLUMN IF EXISTS cid;
+ALTER TABLE urls DROP COLUMN IF EXISTS cid;
@@ -0,0 +1,3 @@
+-- IPFS CIDs for stored content
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS cid text NOT NULL default '';
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS cid text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- snapshots of bodies cut off at a size limit
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS truncated boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS url_failures;
@@ -0,0 +1,13 @@
+-- crawl failures, retries & dead urls
+CREATE TABLE IF NOT EXISTS url_failures (
+  url              text PRIMARY KEY NOT NULL,
+  source_id        text NOT NULL default '',
+  created          timestamp NOT NULL default (now() at time zone 'utc'),
+  updated          timestamp NOT NULL default (now() at time zone 'utc'),
+  attempts         integer NOT NULL default 0,
+  kind             text NOT NULL default '',
+  last_error       text NOT NULL default '',
+  next_attempt     timestamp,
+  dead             boolean NOT NULL default false
+);
+CREATE INDEX IF NOT EXISTS url_failures_source ON url_failures (source_id, updated);
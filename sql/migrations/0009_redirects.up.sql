@@ -0,0 +1,13 @@
+-- redirect hops between requested & final urls
+CREATE TABLE IF NOT EXISTS redirects (
+  url              text NOT NULL, -- url originally requested
+  created          timestamp NOT NULL,
+  hop              integer NOT NULL default 0,
+  src              text NOT NULL references urls(url) ON DELETE CASCADE,
+  dst              text NOT NULL references urls(url) ON DELETE CASCADE,
+  status           integer NOT NULL default 0,
+  location         text NOT NULL default '',
+  duration         bigint NOT NULL default 0, -- in milliseconds
+  PRIMARY KEY      (url, created, hop)
+);
+CREATE INDEX IF NOT EXISTS redirects_dst ON redirects (dst);
@@ -0,0 +1,2 @@
+-- typed links, so page requisites can be told apart from anchors
+ALTER TABLE links ADD COLUMN IF NOT EXISTS kind text NOT NULL default 'anchor';
@@ -20,3 +20,8 @@ delete from sources;
 -- name: delete-urls
 delete from urls;
 
+-- name: delete-frontier
+delete from frontier;
+
+-- name: delete-frontier_hosts
+delete from frontier_hosts;
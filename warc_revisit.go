@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/datatogether/core"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"net/http"
+	"time"
+)
+
+// WarcOriginal is the most recent full WARC response record written for a
+// url. Re-captures with the same payload digest are written as revisit
+// records that refer back to it, instead of storing the payload again
+type WarcOriginal struct {
+	// url the record was captured from
+	Url string `json:"url"`
+	// time of the capture, rounded to seconds in UTC
+	Created time.Time `json:"created"`
+	// WARC-Record-ID of the response record
+	RecordId string `json:"recordId"`
+	// WARC-Payload-Digest of the response record
+	PayloadDigest string `json:"payloadDigest"`
+	// name of the WARC file the record was written to
+	Filename string `json:"filename"`
+}
+
+// writeWarcGet archives a GET response to the current WARC file. If the
+// payload matches the last full capture of the url, a revisit record is
+// written in it's place & u's snapshot is marked as a revisit. It does
+// nothing if WARC output is disabled, errors are logged
+func writeWarcGet(db *sql.DB, u *core.Url, res *http.Response, p *WarcPayload) {
+	if warcs == nil || res == nil || res.Request == nil || u.LastGet == nil {
+		return
+	}
+
+	digest := p.Digest
+	prev := &WarcOriginal{Url: u.Url}
+	err := prev.Read(db)
+	if err != nil && err != core.ErrNotFound {
+		log.Infof("error reading warc original for %s: %s", u.Url, err)
+	}
+
+	if err == nil && p.Size > 0 && prev.PayloadDigest == digest {
+		if err := warcs.WriteRevisit(res, *u.LastGet, digest, prev.RecordId); err != nil {
+			log.Infof("error writing warc revisit for %s: %s", u.Url, err)
+			return
+		}
+		if err := markSnapshotRevisit(db, u); err != nil {
+			log.Infof("error marking snapshot revisit for %s: %s", u.Url, err)
+		}
+		return
+	}
+
+	id, filename, err := warcs.WriteCapture(res, p, *u.LastGet)
+	if err != nil {
+		log.Infof("error writing warc record for %s: %s", u.Url, err)
+		return
+	}
+
+	o := &WarcOriginal{
+		Url:           u.Url,
+		Created:       u.LastGet.In(time.UTC).Round(time.Second),
+		RecordId:      id,
+		PayloadDigest: digest,
+		Filename:      filename,
+	}
+	if err := o.Save(db); err != nil {
+		log.Infof("error saving warc original for %s: %s", u.Url, err)
+	}
+}
+
+// markSnapshotRevisit flags the snapshot for u's last GET as a revisit
+func markSnapshotRevisit(db sqlutil.Execable, u *core.Url) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		key := snapshotKey(&core.Snapshot{Url: u.Url, Created: u.LastGet.In(time.UTC).Round(time.Second)})
+		v, err := es.Get(key)
+		if err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		s := v.(*Snapshot)
+		s.Revisit = true
+		return es.Put(key, s)
+	}
+
+	_, err := db.Exec(qSnapshotMarkRevisit, u.Url, u.LastGet.In(time.UTC).Round(time.Second))
+	return err
+}
+
+// warcOriginalKey gives the embedded store key for rawurl's warc original
+func warcOriginalKey(rawurl string) datastore.Key {
+	return embeddedKey("WarcOriginal", rawurl)
+}
+
+// Read the warc original for a url from the db
+func (o *WarcOriginal) Read(db sqlutil.Queryable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		v, err := es.Get(warcOriginalKey(o.Url))
+		if err == datastore.ErrNotFound {
+			return core.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		*o = *v.(*WarcOriginal)
+		return nil
+	}
+	return o.UnmarshalSQL(db.QueryRow(qWarcOriginalByUrl, o.Url))
+}
+
+// Save a warc original to the db, replacing any existing record for the url
+func (o *WarcOriginal) Save(db sqlutil.Execable) error {
+	if es, ok := store.(*EmbeddedStore); ok {
+		return es.Put(warcOriginalKey(o.Url), o)
+	}
+	_, err := db.Exec(qWarcOriginalUpsert, o.Url, o.Created.In(time.UTC), o.RecordId, o.PayloadDigest, o.Filename)
+	return err
+}
+
+// UnmarshalSQL reads an sql response into the warc original receiver
+func (o *WarcOriginal) UnmarshalSQL(row sqlutil.Scannable) error {
+	var (
+		url, id, digest, filename string
+		created                   time.Time
+	)
+
+	if err := row.Scan(&url, &created, &id, &digest, &filename); err != nil {
+		if err == sql.ErrNoRows {
+			return core.ErrNotFound
+		}
+		return err
+	}
+
+	*o = WarcOriginal{
+		Url:           url,
+		Created:       created.In(time.UTC),
+		RecordId:      id,
+		PayloadDigest: digest,
+		Filename:      filename,
+	}
+	return nil
+}
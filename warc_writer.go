@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"github.com/datatogether/warc"
+	"github.com/pborman/uuid"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// warcs is the writer all captures are archived to, nil when WARC output
+// is disabled
+var warcs *WarcWriter
+
+// profile for revisit records that only share a payload with the
+// record they refer to
+const warcProfileIdenticalPayload = "http://netpreserve.org/warc/1.0/revisit/identical-payload-digest"
+
+// WarcWriter writes captures to a series of WARC files in Dir. Each record
+// is compressed as it's own gzip member, so files can be read from any record
+// offset. Once a file passes MaxSize a new one is started, each file opening
+// with a warcinfo record that describes it.
+//
+// Files are named PREFIX-TIMESTAMP-SERIAL.warc.gz, & carry a ".open"
+// suffix until they're finished, so only complete files are ever picked up
+// for transfer
+type WarcWriter struct {
+	// directory to write files to
+	Dir string
+	// filename prefix
+	Prefix string
+	// files are rolled over once they pass this many bytes
+	MaxSize int64
+
+	lock     sync.Mutex
+	file     *os.File
+	filename string
+	size     int64
+	serial   int
+	infoId   string
+}
+
+// NewWarcWriter creates a writer, creating dir if it doesn't exist
+func NewWarcWriter(dir, prefix string, maxSize int64) (*WarcWriter, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &WarcWriter{Dir: dir, Prefix: prefix, MaxSize: maxSize}, nil
+}
+
+// WriteCapture writes the request that produced res & the response itself as
+// a request / response record pair, returning the id of the response record
+// & the name of the file it was written to. the payload body is streamed
+// into the record, so it's read twice: once for the block digest & once to
+// write it
+func (w *WarcWriter) WriteCapture(res *http.Response, p *WarcPayload, at time.Time) (id, filename string, err error) {
+	id = newWarcRecordId()
+	header := httpResponseBlock(res, nil)
+
+	if _, err = p.Body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	sha := sha1.New()
+	sha.Write(header)
+	if _, err = io.Copy(sha, p.Body); err != nil {
+		return
+	}
+	if _, err = p.Body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	rec := &streamResponse{header: header, body: p.Body}
+	rec.WARCRecordId = id
+	rec.WARCDate = at.In(time.UTC)
+	rec.ContentLength = int64(len(header)) + p.Size
+	rec.ContentType = "application/http; msgtype=response"
+	rec.WARCBlockDigest = "sha1:" + base32.StdEncoding.EncodeToString(sha.Sum(nil))
+	rec.WARCPayloadDigest = p.Digest
+	rec.WARCTargetURI = res.Request.URL.String()
+	if p.Truncated {
+		rec.WARCTruncated = "length"
+	}
+
+	filename, err = w.writeExchange(res, at, func(infoId string) warc.Record {
+		rec.WARCWarcinfoID = infoId
+		return rec
+	})
+	return
+}
+
+// WriteRevisit writes the request that produced res & a revisit record in
+// place of the response, using the identical-payload-digest profile. Only
+// response headers are written, the payload is found by following refersTo
+// to the response record that holds it
+func (w *WarcWriter) WriteRevisit(res *http.Response, at time.Time, payloadDigest, refersTo string) error {
+	block := httpResponseBlock(res, nil)
+	_, err := w.writeExchange(res, at, func(infoId string) warc.Record {
+		return warc.Revisit{
+			WARCRecordId:      newWarcRecordId(),
+			WARCDate:          at.In(time.UTC),
+			ContentLength:     int64(len(block)),
+			ContentType:       "application/http; msgtype=response",
+			WARCBlockDigest:   warcDigest(block),
+			WARCPayloadDigest: payloadDigest,
+			WARCRefersTo:      refersTo,
+			WARCTargetURI:     res.Request.URL.String(),
+			WARCWarcinfoID:    infoId,
+			WARCProfile:       warcProfileIdenticalPayload,
+			Content:           block,
+		}
+	})
+	return err
+}
+
+// writeExchange writes a request record for res followed by the record
+// response builds, which is given the id of the current warcinfo record.
+// it returns the name of the file both records were written to
+func (w *WarcWriter) writeExchange(res *http.Response, at time.Time, response func(infoId string) warc.Record) (string, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.rollover(); err != nil {
+		return "", err
+	}
+
+	rec := response(w.infoId)
+	block := httpRequestBlock(res.Request)
+	request := warc.Request{
+		WARCRecordId:     newWarcRecordId(),
+		WARCDate:         at.In(time.UTC),
+		ContentLength:    int64(len(block)),
+		ContentType:      "application/http; msgtype=request",
+		WARCConcurrentTo: rec.GetRecordID(),
+		WARCBlockDigest:  warcDigest(block),
+		WARCTargetURI:    res.Request.URL.String(),
+		WARCWarcinfoID:   w.infoId,
+		Content:          block,
+	}
+
+	if err := w.writeRecord(request); err != nil {
+		return "", err
+	}
+	return w.filename, w.writeRecord(rec)
+}
+
+// Close finishes the current file, if any
+func (w *WarcWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closeFile()
+}
+
+// rollover starts a new file if there isn't one open or the current file
+// has passed MaxSize. rollover only happens between captures, so request
+// & response records always land in the same file
+func (w *WarcWriter) rollover() error {
+	if w.file != nil && (w.MaxSize <= 0 || w.size < w.MaxSize) {
+		return nil
+	}
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	now := time.Now().In(time.UTC)
+	w.serial++
+	w.filename = fmt.Sprintf("%s-%s-%05d.warc.gz", w.Prefix, now.Format("20060102150405"), w.serial)
+	file, err := os.Create(filepath.Join(w.Dir, w.filename+".open"))
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+
+	hostname, _ := os.Hostname()
+	fields := []byte(fmt.Sprintf("software: sentry\r\nformat: WARC File Format 1.0\r\nhostname: %s\r\nconformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.0/\r\n", hostname))
+	w.infoId = newWarcRecordId()
+	return w.writeRecord(warc.WARCInfo{
+		WARCRecordId:    w.infoId,
+		WARCDate:        now,
+		ContentLength:   int64(len(fields)),
+		ContentType:     "application/warc-fields",
+		WARCBlockDigest: warcDigest(fields),
+		WARCFilename:    w.filename,
+		Content:         fields,
+	})
+}
+
+// closeFile closes the current file, dropping the ".open" suffix
+func (w *WarcWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+
+	path := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	return os.Rename(path, filepath.Join(w.Dir, w.filename))
+}
+
+// writeRecord writes rec to the current file as a single gzip member
+func (w *WarcWriter) writeRecord(rec warc.Record) error {
+	cw := &countingWriter{w: w.file}
+	gz := gzip.NewWriter(cw)
+	err := rec.Write(gz)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	w.size += cw.n
+	return err
+}
+
+// countingWriter tallies the number of bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WarcPayload is a response body to be archived
+type WarcPayload struct {
+	// the body itself, read from the start
+	Body io.ReadSeeker
+	// length of Body in bytes
+	Size int64
+	// WARC-Payload-Digest of Body
+	Digest string
+	// true if Body was cut off at a size limit
+	Truncated bool
+}
+
+// NewWarcPayload creates a payload from a body held in memory
+func NewWarcPayload(body []byte, truncated bool) *WarcPayload {
+	return &WarcPayload{
+		Body:      bytes.NewReader(body),
+		Size:      int64(len(body)),
+		Digest:    warcDigest(body),
+		Truncated: truncated,
+	}
+}
+
+// streamResponse is a response record that copies it's payload from a
+// reader as it's written instead of holding it in Content
+type streamResponse struct {
+	warc.Response
+	// raw response headers, the start of the record block
+	header []byte
+	body   io.Reader
+}
+
+// Write writes the record header, followed by the block. headers are
+// formatted by writing the embedded response with an empty block &
+// dropping the block's trailing CRLFs
+func (r *streamResponse) Write(w io.Writer) error {
+	head := &bytes.Buffer{}
+	if err := r.Response.Write(head); err != nil {
+		return err
+	}
+	if _, err := w.Write(head.Bytes()[:head.Len()-4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(r.header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r.body); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// credentialHeaders are request headers that carry credentials
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// httpRequestBlock reconstructs the raw request for a request record.
+// values of credential headers & custom headers set for the source of the
+// url, or of any url redirected through on the way, are replaced with
+// redactedValue so secrets don't end up in WARC files
+func httpRequestBlock(req *http.Request) []byte {
+	header := req.Header.Clone()
+	redact := func(key string) {
+		if header.Get(key) != "" {
+			header.Set(key, redactedValue)
+		}
+	}
+	for _, key := range credentialHeaders {
+		redact(key)
+	}
+	for r := req; r != nil; {
+		for key := range settingsForUrl(r.URL.String()).Headers {
+			redact(key)
+		}
+		if r.Response == nil {
+			break
+		}
+		r = r.Response.Request
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(buf, "Host: %s\r\n", req.URL.Host)
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// httpResponseBlock reconstructs the raw response for a response record
+func httpResponseBlock(res *http.Response, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s\r\n", res.Proto, res.Status)
+	res.Header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// newWarcRecordId creates a globally unique record id
+func newWarcRecordId() string {
+	return fmt.Sprintf("<urn:uuid:%s>", uuid.New())
+}
+
+// warcDigest gives the base32 sha1 digest of data, the format
+// used by WARC-Block-Digest & WARC-Payload-Digest fields
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWarc archives a response to the current WARC file. It does nothing
+// if WARC output is disabled, errors are logged
+func writeWarc(res *http.Response, body []byte, at time.Time) {
+	if warcs == nil || res == nil || res.Request == nil {
+		return
+	}
+	if _, _, err := warcs.WriteCapture(res, NewWarcPayload(body, false), at); err != nil {
+		log.Infof("error writing warc record for %s: %s", res.Request.URL, err)
+	}
+}
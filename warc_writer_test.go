@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/datatogether/core"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readWarcMembers decompresses each gzip member of a WARC file separately
+func readWarcMembers(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	members := []string{}
+	for {
+		gz, err := gzip.NewReader(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: error reading gzip member: %s", path, err.Error())
+		}
+		gz.Multistream(false)
+		data, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("%s: error reading gzip member: %s", path, err.Error())
+		}
+		members = append(members, string(data))
+	}
+	return members
+}
+
+func TestWarcWriter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("page " + r.URL.Path))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "sentry_warcs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// tiny max size so every capture lands in it's own file
+	w, err := NewWarcWriter(dir, "test", 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	paths := []string{"/a", "/b", "/c"}
+	for _, p := range paths {
+		res, err := http.Get(s.URL + p)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, _, err := w.WriteCapture(res, NewWarcPayload(body, false), time.Now()); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(files) != len(paths) {
+		t.Fatalf("expected %d files, got %d", len(paths), len(files))
+	}
+
+	for i, path := range files {
+		if !strings.HasSuffix(path, fmt.Sprintf("-%05d.warc.gz", i+1)) {
+			t.Errorf("case %d: unexpected filename: %s", i, filepath.Base(path))
+		}
+
+		members := readWarcMembers(t, path)
+		if len(members) != 3 {
+			t.Errorf("case %d: expected 3 records, got %d", i, len(members))
+			continue
+		}
+
+		expect := []string{"warcinfo", "request", "response"}
+		for j, m := range members {
+			if !strings.HasPrefix(m, "WARC/1.0\r\n") {
+				t.Errorf("case %d record %d: missing WARC version line", i, j)
+			}
+			if !strings.Contains(m, "warc-type: "+expect[j]+"\r\n") {
+				t.Errorf("case %d record %d: expected %s record", i, j, expect[j])
+			}
+		}
+
+		if !strings.Contains(members[0], "warc-filename: "+filepath.Base(path)) {
+			t.Errorf("case %d: warcinfo filename mismatch", i)
+		}
+
+		body := []byte("page " + paths[i])
+		if !strings.Contains(members[2], "warc-payload-digest: "+warcDigest(body)+"\r\n") {
+			t.Errorf("case %d: response payload digest mismatch", i)
+		}
+		if !strings.HasSuffix(members[2], "\r\n\r\n"+string(body)+"\r\n\r\n") {
+			t.Errorf("case %d: response block doesn't end with body", i)
+		}
+		if !strings.Contains(members[1], "GET "+paths[i]+" HTTP/1.1\r\n") {
+			t.Errorf("case %d: request line missing", i)
+		}
+	}
+}
+
+func TestWarcDigest(t *testing.T) {
+	cases := []struct {
+		data   string
+		expect string
+	}{
+		{"", "sha1:3I42H3S6NNFQ2MSVX7XZKYAYSCX5QBYJ"},
+		{"hello", "sha1:VL2MMHO4YXUKFWV63YHTWSBM3GXKSQ2N"},
+	}
+
+	for i, c := range cases {
+		if got := warcDigest([]byte(c.data)); got != c.expect {
+			t.Errorf("case %d digest mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestHttpRequestBlockRedacts(t *testing.T) {
+	prevScopes, prevSettings := crawlingScopes, sourceSettings
+	defer func() { crawlingScopes, sourceSettings = prevScopes, prevSettings }()
+
+	crawlingScopes = testScopes(t,
+		&core.Source{Id: "private", Url: "private.gov"},
+		&core.Source{Id: "open", Url: "open.gov"},
+	)
+	sourceSettings = map[string]*SourceSettings{
+		"private": {SourceId: "private", Headers: map[string]string{"X-Api-Key": "key123"}},
+	}
+
+	first, _ := http.NewRequest("GET", "http://private.gov/start", nil)
+	hop, _ := http.NewRequest("GET", "http://open.gov/landing", nil)
+	hop.Response = &http.Response{Request: first}
+
+	cases := []struct {
+		req    *http.Request
+		header http.Header
+		keep   []string
+		secret []string
+	}{
+		{first, http.Header{"X-Api-Key": {"key123"}, "Authorization": {"Basic dXNlcjpwYXNz"}, "Accept": {"text/html"}},
+			[]string{"Accept: text/html"}, []string{"key123", "dXNlcjpwYXNz"}},
+		// values set for the source of an earlier hop are redacted as well
+		{hop, http.Header{"X-Api-Key": {"key123"}, "Cookie": {"session=abc"}},
+			[]string{"X-Api-Key: " + redactedValue, "Cookie: " + redactedValue}, []string{"key123", "abc"}},
+		{hop, http.Header{"Accept-Language": {"en"}}, []string{"Accept-Language: en"}, nil},
+	}
+
+	for i, c := range cases {
+		c.req.Header = c.header
+		block := string(httpRequestBlock(c.req))
+		for _, k := range c.keep {
+			if !strings.Contains(block, k+"\r\n") {
+				t.Errorf("case %d: expected block to contain '%s', got: %s", i, k, block)
+			}
+		}
+		for _, s := range c.secret {
+			if strings.Contains(block, s) {
+				t.Errorf("case %d: expected '%s' to be redacted, got: %s", i, s, block)
+			}
+		}
+		if c.req.Header.Get("Authorization") != c.header.Get("Authorization") {
+			t.Errorf("case %d: redacting changed the request's headers", i)
+		}
+	}
+}
+
+func TestWarcWriterRevisit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unchanging"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "sentry_warcs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWarcWriter(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	id, filename, err := w.WriteCapture(res, NewWarcPayload(body, false), time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := w.WriteRevisit(res, time.Now(), warcDigest(body), id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	members := readWarcMembers(t, filepath.Join(dir, filename))
+	if len(members) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(members))
+	}
+
+	revisit := members[4]
+	expect := []string{
+		"warc-type: revisit\r\n",
+		"warc-profile: " + warcProfileIdenticalPayload + "\r\n",
+		"warc-refers-to: " + id + "\r\n",
+		"warc-payload-digest: " + warcDigest(body) + "\r\n",
+	}
+	for i, e := range expect {
+		if !strings.Contains(revisit, e) {
+			t.Errorf("case %d: revisit record missing %q", i, e)
+		}
+	}
+	if strings.Contains(revisit, string(body)) {
+		t.Errorf("revisit record shouldn't contain the payload")
+	}
+}
+
+func TestWriteWarcGet(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unchanging"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "sentry_warcs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	prev := warcs
+	defer func() { warcs = prev }()
+	if warcs, err = NewWarcWriter(dir, "test", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	u := &core.Url{Url: s.URL + "/page"}
+	if err := u.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		at      time.Time
+		revisit bool
+	}{
+		{time.Now().Add(-time.Hour), false},
+		{time.Now(), true},
+	}
+
+	for i, c := range cases {
+		res, err := http.Get(u.Url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		at := c.at
+		u.LastGet = &at
+		if err := writeSnapshot(store, newSnapshot(u)); err != nil {
+			t.Fatal(err.Error())
+		}
+		writeWarcGet(appDB, u, res, NewWarcPayload(body, false))
+
+		var revisit bool
+		if err := appDB.QueryRow("select revisit from snapshots where url = $1 and created = $2", u.Url, at.In(time.UTC).Round(time.Second)).Scan(&revisit); err != nil {
+			t.Errorf("case %d error reading snapshot: %s", i, err.Error())
+			continue
+		}
+		if revisit != c.revisit {
+			t.Errorf("case %d revisit mismatch. expected: %t, got: %t", i, c.revisit, revisit)
+		}
+	}
+
+	o := &WarcOriginal{Url: u.Url}
+	if err := o.Read(appDB); err != nil {
+		t.Fatal(err.Error())
+	}
+	if first := cases[0].at.In(time.UTC).Round(time.Second); !o.Created.Equal(first) {
+		t.Errorf("expected original to stay at first capture, got: %s", o.Created)
+	}
+}